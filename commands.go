@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/spf13/pflag"
+)
+
+// The subcommands. A command line starting with a flag or an input runs
+// stamp, as snapstamp did before it had subcommands.
+const (
+	cmdStamp   = "stamp"
+	cmdRename  = "rename"
+	cmdInspect = "inspect"
+	cmdServe   = "serve"
+
+	cmdCompletion = "completion"
+)
+
+// commands lists the subcommands for the usage text.
+var commands = []struct{ name, summary string }{
+	{cmdStamp, "draw the capture date onto copies of the images (the default)"},
+	{cmdRename, "copy (or --move) the images to names from their capture date and set their file times, without drawing"},
+	{cmdInspect, "print each image's date source, date, dimensions and planned output; changes nothing"},
+	{cmdServe, "stamp images uploaded to POST /stamp over HTTP, e.g. on a NAS"},
+	{cmdCompletion, "print the shell completion script for bash|zsh|fish|powershell"},
+}
+
+// sourceCommand marks the flags a subcommand sets, for --print-config.
+const sourceCommand = "subcommand"
+
+// notTaken are the flags a subcommand doesn't take: for rename those about
+// the stamp and re-encoding, for inspect those only a real run uses, for
+// serve those about files, and the server's for the others.
+var notTaken = map[string][]string{
+	cmdStamp: {"listen", "max-upload"},
+	cmdRename: {
+		"margin", "font", "strict-font", "font-index", "widthpercent", "widthpercent-portrait", "font-size", "height-percent", "side", "position", "align",
+		"min-font-px", "template", "text", "text-append", "color", "outline-color", "style", "shadow-color", "frame", "frame-size",
+		"frame-color", "rotate", "opacity", "shadow-offset", "show-camera", "show-exposure", "show-place", "show-artist",
+		"artist", "gps", "gps-strip", "output-format", "strip-metadata", "scale", "max-dimension", "variant", "no-stamp",
+		"in-place", "backup-dir", "max-mem", "restamp", "zip-out", "listen", "max-upload",
+	},
+	cmdInspect: {"dry-run", "watch", "fsync", "zip-out", "listen", "max-upload"},
+	cmdServe: {
+		"in", "out", "files-from", "null", "base", "include", "exclude", "recursive", "copy-others", "link-others",
+		"follow-symlinks", "zip-out", "rename", "rename-format", "ascii-only", "include-videos", "variant", "no-stamp", "move", "in-place", "backup-dir", "fsync",
+		"touch", "no-touch", "overwrite", "skip-existing", "incremental", "manifest", "rehash", "after", "before", "require-exif",
+		"min-width", "min-height", "min-size", "force", "dry-run", "json", "warn-mtime", "watch", "decode-workers", "encode-workers",
+		"concurrency", "fail-fast", "retries", "sample", "sample-random", "seed", "ordered",
+	},
+}
+
+// splitCommand takes the subcommand off the front of args: the default
+// stamp when args don't start with one.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		for _, c := range commands {
+			if args[0] == c.name {
+				return c.name, args[1:]
+			}
+		}
+	}
+	return cmdStamp, args
+}
+
+// hideFlags leaves the flags cmd doesn't take out of the usage text.
+func hideFlags(flags *flag.FlagSet, cmd string) {
+	for _, name := range notTaken[cmd] {
+		flags.Lookup(name).Hidden = true
+	}
+}
+
+// usage prints the usage text of cmd.
+func usage(flags *flag.FlagSet, cmd string) {
+	fmt.Fprintf(os.Stderr, "Usage: snapstamp [command] [flags] [inputs...]\n       snapstamp completion bash|zsh|fish|powershell\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags of %s:\n%s", cmd, flags.FlagUsages())
+}
+
+// applyCommand checks the flags against cmd, once they have their values
+// from the command line, the environment and the config file, and sets the
+// ones cmd implies. A flag cmd doesn't take is an error on the command
+// line; from the environment or the config file, which serve every
+// subcommand, it goes back to its default.
+func applyCommand(flags *flag.FlagSet, cmd string, sources map[string]string) error {
+	for _, name := range notTaken[cmd] {
+		f := flags.Lookup(name)
+		switch sources[name] {
+		case "":
+			continue
+		case sourceCLI:
+			return fmt.Errorf("--%s doesn't apply to snapstamp %s", name, cmd)
+		}
+		if list, ok := f.Value.(flag.SliceValue); ok {
+			list.Replace(nil)
+		} else if err := f.Value.Set(f.DefValue); err != nil {
+			return err
+		}
+		f.Changed = false
+		delete(sources, name)
+	}
+	var implied []string
+	switch cmd {
+	case cmdRename:
+		implied = []string{"rename", "no-stamp"}
+	case cmdInspect:
+		implied = []string{"dry-run"}
+	}
+	for _, name := range implied {
+		if err := flags.Set(name, "true"); err != nil {
+			return err
+		}
+		sources[name] = sourceCommand
+	}
+	return nil
+}
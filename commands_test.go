@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// TestMain runs the test binary as snapstamp when runSnapstamp starts it.
+func TestMain(m *testing.M) {
+	if os.Getenv("SNAPSTAMPTEST_MAIN") != "" {
+		os.Args[0] = "snapstamp"
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runSnapstamp runs snapstamp with args in an empty working directory, away
+// from the user's config file and SNAPSTAMP_* variables, and returns its
+// output and exit code.
+func runSnapstamp(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	home := t.TempDir()
+	cmd.Dir = t.TempDir() // nothing a run writes by default lands in the tree
+	cmd.Env = []string{"SNAPSTAMPTEST_MAIN=1", "HOME=" + home, "XDG_CONFIG_HOME=" + home, "APPDATA=" + home, "TZ=UTC"}
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case errors.As(err, &exit):
+		code = exit.ExitCode()
+	case err != nil:
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// snapshot returns the name, size, time and content hash of every file
+// under dir.
+func snapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[p] = fmt.Sprintf("%v %v %x", fi.ModTime(), fi.Mode(), sha256.Sum256(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		cmd  string
+		rest []string
+	}{
+		{nil, cmdStamp, nil},
+		{[]string{"-i", "a.jpg"}, cmdStamp, []string{"-i", "a.jpg"}},
+		{[]string{"a.jpg"}, cmdStamp, []string{"a.jpg"}},
+		{[]string{"stamp", "a.jpg"}, cmdStamp, []string{"a.jpg"}},
+		{[]string{"rename", "--move", "dir"}, cmdRename, []string{"--move", "dir"}},
+		{[]string{"inspect", "dir"}, cmdInspect, []string{"dir"}},
+		{[]string{"serve", "--listen", ":8080"}, cmdServe, []string{"--listen", ":8080"}},
+		{[]string{"completion", "bash"}, cmdCompletion, []string{"bash"}},
+		{[]string{"inspecting"}, cmdStamp, []string{"inspecting"}},
+	}
+	for _, tt := range tests {
+		cmd, rest := splitCommand(tt.args)
+		if cmd != tt.cmd || strings.Join(rest, " ") != strings.Join(tt.rest, " ") {
+			t.Errorf("splitCommand(%q) = %s %q, want %s %q", tt.args, cmd, rest, tt.cmd, tt.rest)
+		}
+	}
+}
+
+// commandFlags returns a flag set with the flags notTaken names, and those
+// applyCommand implies.
+func commandFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("snapstamp", flag.ContinueOnError)
+	seen := map[string]bool{}
+	for _, names := range notTaken {
+		for _, name := range append(names, "rename", "no-stamp", "dry-run") {
+			if !seen[name] {
+				seen[name] = true
+				fs.String(name, "", "")
+			}
+		}
+	}
+	return fs
+}
+
+func TestApplyCommand(t *testing.T) {
+	implied := map[string][]string{
+		cmdStamp:   nil,
+		cmdRename:  {"rename", "no-stamp"},
+		cmdInspect: {"dry-run"},
+		cmdServe:   nil,
+	}
+	for cmd, want := range implied {
+		fs := commandFlags()
+		sources := map[string]string{}
+		if err := applyCommand(fs, cmd, sources); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		for _, name := range want {
+			if v := fs.Lookup(name).Value.String(); v != "true" || sources[name] != sourceCommand {
+				t.Errorf("%s: --%s = %q from %q, want true from the subcommand", cmd, name, v, sources[name])
+			}
+		}
+
+		// a flag the subcommand doesn't take: an error on the command
+		// line, dropped from the config file
+		name := notTaken[cmd][len(notTaken[cmd])-1]
+		fs = commandFlags()
+		fs.Set(name, "x")
+		if err := applyCommand(fs, cmd, map[string]string{name: sourceCLI}); err == nil || !strings.Contains(err.Error(), "--"+name) {
+			t.Errorf("%s --%s: error %v, want it refused", cmd, name, err)
+		}
+		fs = commandFlags()
+		fs.Set(name, "x")
+		sources = map[string]string{name: "config"}
+		if err := applyCommand(fs, cmd, sources); err != nil {
+			t.Errorf("%s: --%s from the config file: %v", cmd, name, err)
+		}
+		if v := fs.Lookup(name).Value.String(); v != "" || sources[name] != "" {
+			t.Errorf("%s: --%s from the config file kept %q", cmd, name, v)
+		}
+	}
+}
+
+func TestInspectChangesNothing(t *testing.T) {
+	// the input directory in a parent of its own, where a default output
+	// directory would go
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "photos")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writePNGs(t, dir, 3, 64, 48)
+	old := time.Date(2019, 6, 3, 8, 15, 0, 0, time.UTC)
+	for _, name := range []string{"img0.png", "img1.png", "img2.png"} {
+		os.Chtimes(filepath.Join(dir, name), old, old)
+	}
+	before := snapshot(t, parent)
+
+	stdout, stderr, code := runSnapstamp(t, "inspect", dir)
+	if code != 0 {
+		t.Fatalf("snapstamp inspect exited %d: %s", code, stderr)
+	}
+	for _, name := range []string{"img0.png", "img1.png", "img2.png"} {
+		if !strings.Contains(stdout+stderr, name) {
+			t.Errorf("inspect output doesn't list %s:\n%s%s", name, stdout, stderr)
+		}
+	}
+	after := snapshot(t, parent)
+	if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+		t.Errorf("inspect created %d entries next to the input directory", len(entries)-1)
+	}
+	if len(after) != len(before) {
+		t.Errorf("inspect left %d files, there were %d", len(after), len(before))
+	}
+	for p, s := range before {
+		if after[p] != s {
+			t.Errorf("inspect changed %s", p)
+		}
+	}
+}
+
+func TestSubcommandFlags(t *testing.T) {
+	dir := t.TempDir()
+	writePNGs(t, dir, 1, 64, 48)
+	tests := []struct {
+		args []string
+		fail bool
+	}{
+		{[]string{"rename", "--margin", "3", "--out", t.TempDir(), dir}, true},
+		{[]string{"inspect", "--watch", dir}, true},
+		{[]string{"serve", "--in", dir}, true},
+		{[]string{"stamp", "--listen", ":0", dir}, true},
+		{[]string{"rename", "--out", t.TempDir(), dir}, false},
+		{[]string{"stamp", "--out", t.TempDir(), dir}, false},
+	}
+	for _, tt := range tests {
+		_, stderr, code := runSnapstamp(t, tt.args...)
+		if tt.fail && (code == 0 || !strings.Contains(stderr, "doesn't apply to snapstamp "+tt.args[0])) {
+			t.Errorf("snapstamp %s: exit %d, want it refused:\n%s", strings.Join(tt.args, " "), code, stderr)
+		}
+		if !tt.fail && code != 0 {
+			t.Errorf("snapstamp %s: exit %d:\n%s", strings.Join(tt.args, " "), code, stderr)
+		}
+	}
+}
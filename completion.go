@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"snapstamp/stamp"
+)
+
+// cmdComplete is the hidden subcommand the completion scripts run to get
+// the candidates for the word under the cursor:
+//
+//	snapstamp __complete <words before the cursor...> <current word>
+//
+// It prints one candidate per line, or nothing to leave the word to the
+// shell's own file name completion.
+const cmdComplete = "__complete"
+
+// completionScripts are the scripts of snapstamp completion <shell>. They
+// hand the words to __complete and fall back to file names when it has no
+// candidates.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for snapstamp; load with
+#   source <(snapstamp completion bash)
+_snapstamp() {
+	local IFS=$'\n'
+	COMPREPLY=($("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _snapstamp snapstamp
+`,
+	"zsh": `#compdef snapstamp
+# zsh completion for snapstamp; load with
+#   source <(snapstamp completion zsh)
+# or save as _snapstamp in a directory of $fpath
+_snapstamp() {
+	local -a out
+	out=("${(@f)$("${words[1]}" __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ -n ${out[1]} ]]; then
+		compadd -Q -- "${out[@]}"
+	else
+		_files
+	fi
+}
+if [[ $funcstack[1] == _snapstamp ]]; then
+	_snapstamp "$@"
+else
+	compdef _snapstamp snapstamp
+fi
+`,
+	"fish": `# fish completion for snapstamp; load with
+#   snapstamp completion fish | source
+function __snapstamp_complete
+	set -l out (command snapstamp __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)
+	if test (count $out) -gt 0
+		printf '%s\n' $out
+	else
+		__fish_complete_path (commandline -ct)
+	end
+end
+complete -c snapstamp -f -a '(__snapstamp_complete)'
+`,
+	"powershell": `# PowerShell completion for snapstamp; load with
+#   snapstamp completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName snapstamp -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$words = @($commandAst.CommandElements | Select-Object -Skip 1 |
+		Where-Object { $_.Extent.EndOffset -le $cursorPosition } | ForEach-Object { $_.ToString() })
+	if ($wordToComplete -eq '') {
+		# older PowerShell drops empty arguments to native commands
+		$words += '""'
+	}
+	& snapstamp __complete @words 2>$null | ForEach-Object {
+		[System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+	}
+}
+`,
+}
+
+// printCompletion writes the completion script for shell to w.
+func printCompletion(w io.Writer, shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("unknown shell %q: want bash|zsh|fish|powershell", shell)
+	}
+	_, err := io.WriteString(w, script)
+	return err
+}
+
+// complete returns the candidates for the last of args, the words of a
+// command line after the program name.
+func complete(flags *flag.FlagSet, args []string) []string {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	cur, before := args[len(args)-1], args[:len(args)-1]
+	if cur == `""` {
+		cur = ""
+	}
+	cmd, before := splitCommand(before)
+	if cmd == cmdCompletion {
+		if len(before) > 0 {
+			return nil
+		}
+		var shells []string
+		for shell := range completionScripts {
+			if strings.HasPrefix(shell, cur) {
+				shells = append(shells, shell)
+			}
+		}
+		slices.Sort(shells)
+		return shells
+	}
+	hideFlags(flags, cmd)
+
+	// the value of a flag: --position=to, --position to, or as bash splits
+	// it, --position = to
+	prefix := ""
+	if n := len(before); n > 0 && before[n-1] == "=" {
+		before = before[:n-1]
+	} else if cur == "=" {
+		cur, prefix = "", "="
+	}
+	if n := len(before); n > 0 {
+		if f := lookupFlag(flags, before[n-1]); f != nil && f.NoOptDefVal == "" {
+			return withPrefix(prefix, flagValues(f, cur))
+		}
+	}
+	if name, value, ok := strings.Cut(cur, "="); ok && strings.HasPrefix(cur, "--") {
+		if f := lookupFlag(flags, name); f != nil {
+			return withPrefix(name+"=", flagValues(f, value))
+		}
+		return nil
+	}
+
+	var out []string
+	switch {
+	case strings.HasPrefix(cur, "-"):
+		flags.VisitAll(func(f *flag.Flag) {
+			if !f.Hidden && strings.HasPrefix("--"+f.Name, cur) {
+				out = append(out, "--"+f.Name)
+			}
+		})
+	case len(args) == 1:
+		// a subcommand, or the first input
+		for _, c := range commands {
+			if strings.HasPrefix(c.name, cur) {
+				out = append(out, c.name)
+			}
+		}
+	}
+	return out
+}
+
+// lookupFlag returns the flag of the word --name or -n, or nil.
+func lookupFlag(flags *flag.FlagSet, word string) *flag.Flag {
+	switch {
+	case strings.HasPrefix(word, "--"):
+		return flags.Lookup(word[2:])
+	case strings.HasPrefix(word, "-") && len(word) == 2:
+		return flags.ShorthandLookup(word[1:])
+	}
+	return nil
+}
+
+// flagValues returns the values of f starting with cur: the words of an
+// enum, and the fonts of the system font directories for --font, where
+// the last name of a comma-separated list is completed. Other flags get
+// none, leaving them to file name completion.
+func flagValues(f *flag.Flag, cur string) []string {
+	var values []string
+	switch v := f.Value.(type) {
+	case *enumValue:
+		values = v.allowed
+	default:
+		if f.Name != "font" {
+			return nil
+		}
+		i := strings.LastIndex(cur, ",")
+		list, last := cur[:i+1], cur[i+1:]
+		for _, name := range systemFonts() {
+			if strings.HasPrefix(strings.ToLower(name), strings.ToLower(last)) {
+				values = append(values, list+name)
+			}
+		}
+		return values
+	}
+	var out []string
+	for _, v := range values {
+		if strings.HasPrefix(v, strings.ToLower(cur)) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// systemFonts lists the font files stamp.FindSystemFont finds by name.
+func systemFonts() []string {
+	var names []string
+	for _, dir := range stamp.SystemFontDirs() {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".ttf", ".otf", ".ttc":
+				names = append(names, e.Name())
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// withPrefix puts prefix in front of each of values.
+func withPrefix(prefix string, values []string) []string {
+	if prefix == "" {
+		return values
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = prefix + v
+	}
+	return out
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// envPrefix starts the environment variables giving flag defaults: --max-mem
+// is SNAPSTAMP_MAX_MEM.
+const envPrefix = "SNAPSTAMP_"
+
+// Where a flag got its value, as printed by --print-config.
+const (
+	sourceCLI    = "command line"
+	sourceEnv    = "environment"
+	sourceConfig = "config"
+)
+
+// notConfigurable are the flags only the command line can set.
+var notConfigurable = map[string]bool{"help": true, "config": true, "print-config": true}
+
+// envName returns the environment variable of the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// defaultConfigPath returns the config file read without --config:
+// snapstamp/config.yaml in the user's config directory (~/.config on Linux).
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "snapstamp", "config.yaml")
+}
+
+// applyDefaults gives the flags not set on the command line their values
+// from SNAPSTAMP_* environment variables, then from the config file named
+// by the flag configFlag (or found at defaultConfigPath), so the command
+// line wins over the environment, which wins over the file. Flags set this
+// way count as changed, as if they had been given. It returns where each
+// non-default flag got its value and the config file read, if any.
+func applyDefaults(flags *flag.FlagSet, configFlag string) (map[string]string, string, error) {
+	sources := map[string]string{}
+	flags.Visit(func(f *flag.Flag) { sources[f.Name] = sourceCLI })
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if err != nil || !ok || sources[f.Name] != "" || f.Name == "help" || f.Name == "print-config" {
+			return
+		}
+		if serr := flags.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), serr)
+			return
+		}
+		sources[f.Name] = sourceEnv
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	path, explicit := flags.Lookup(configFlag).Value.String(), true
+	if path == "" {
+		path, explicit = defaultConfigPath(), false
+	}
+	if path == "" {
+		return sources, "", nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return sources, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	entries, err := parseConfig(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	for _, e := range entries {
+		fl := flags.Lookup(e.key)
+		switch {
+		case fl == nil:
+			return nil, "", fmt.Errorf("%s:%d: unknown key %q", path, e.line, e.key)
+		case notConfigurable[e.key]:
+			return nil, "", fmt.Errorf("%s:%d: %q can only be given on the command line", path, e.line, e.key)
+		case sources[e.key] != "":
+			continue // given on the command line or in the environment
+		}
+		if _, list := fl.Value.(flag.SliceValue); !list && len(e.values) != 1 {
+			return nil, "", fmt.Errorf("%s:%d: %s takes a single value", path, e.line, e.key)
+		}
+		for _, v := range e.values {
+			if err := flags.Set(e.key, v); err != nil {
+				return nil, "", fmt.Errorf("%s:%d: %s: %w", path, e.line, e.key, err)
+			}
+		}
+		sources[e.key] = sourceConfig
+	}
+	return sources, path, nil
+}
+
+// configEntry is one key of a config file with its values: one for a
+// scalar, any number for a list.
+type configEntry struct {
+	key    string
+	values []string
+	line   int
+}
+
+// parseConfig reads the YAML a config file needs: a flat mapping of flag
+// names to values, with lists written either as [a, b] or as "- item"
+// lines below the key. Values may be quoted, and # starts a comment.
+func parseConfig(r io.Reader) ([]configEntry, error) {
+	var entries []configEntry
+	seen := map[string]bool{}
+	open := false // the last entry has no value yet, so list items may follow
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		raw := stripComment(sc.Text())
+		line := strings.TrimSpace(raw)
+		if line == "" || line == "---" {
+			continue
+		}
+		if line == "-" || strings.HasPrefix(line, "- ") {
+			if !open {
+				return nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			v, err := unquote(strings.TrimSpace(line[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			last := &entries[len(entries)-1]
+			last.values = append(last.values, v)
+			continue
+		}
+		if raw[0] == ' ' || raw[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested values aren't supported", n)
+		}
+		if open && len(entries[len(entries)-1].values) == 0 {
+			e := entries[len(entries)-1]
+			return nil, fmt.Errorf("line %d: %s has no value", e.line, e.key)
+		}
+		key, value, ok := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: want \"key: value\"", n)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: %s is given twice", n, key)
+		}
+		seen[key] = true
+		e := configEntry{key: key, line: n}
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			open = true
+			entries = append(entries, e)
+			continue
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			for _, item := range splitList(value[1 : len(value)-1]) {
+				v, err := unquote(item)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				e.values = append(e.values, v)
+			}
+		default:
+			v, err := unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			e.values = []string{v}
+		}
+		open = false
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if open && len(entries[len(entries)-1].values) == 0 {
+		e := entries[len(entries)-1]
+		return nil, fmt.Errorf("line %d: %s has no value", e.line, e.key)
+	}
+	return entries, nil
+}
+
+// stripComment cuts a # comment (at the start or after a space, outside
+// quotes) off line.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitList splits the inside of a [a, b] list at the commas outside quotes.
+func splitList(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(items, strings.TrimSpace(s[start:]))
+}
+
+// unquote returns the YAML scalar s: "double" quoted with backslash
+// escapes, 'single' quoted with a doubled ' for a quote, or plain.
+func unquote(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad quoted value %s", s)
+		}
+		return v, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+// printConfig writes the flags in effect as a config file, noting where
+// the ones not at their defaults got their values.
+func printConfig(w io.Writer, flags *flag.FlagSet, sources map[string]string, path string) {
+	if path != "" {
+		fmt.Fprintf(w, "# config file: %s\n", path)
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		if notConfigurable[f.Name] {
+			return
+		}
+		var v string
+		if list, ok := f.Value.(flag.SliceValue); ok {
+			var items []string
+			for _, s := range list.GetSlice() {
+				items = append(items, strconv.Quote(s))
+			}
+			v = "[" + strings.Join(items, ", ") + "]"
+		} else if f.Value.Type() == "string" {
+			v = strconv.Quote(f.Value.String())
+		} else {
+			v = f.Value.String()
+		}
+		if src := sources[f.Name]; src != "" {
+			fmt.Fprintf(w, "%s: %s # %s\n", f.Name, v, src)
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", f.Name, v)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// enumValue is a flag taking one word of a fixed set, in any case, checked
+// as it is set: on the command line, from the environment or from the
+// config file, so a bad value fails before any file is touched. aliases
+// map other spellings onto a word of the set; the default, which may be
+// empty, is always accepted.
+type enumValue struct {
+	value   *string
+	def     string
+	allowed []string
+	aliases map[string]string
+}
+
+// enumFlag defines an enumValue flag on the command line.
+func enumFlag(name, shorthand, value string, allowed []string, aliases map[string]string, usage string) *string {
+	p := new(string)
+	*p = value
+	flag.VarP(&enumValue{value: p, def: value, allowed: allowed, aliases: aliases}, name, shorthand, usage)
+	return p
+}
+
+// parse returns the word of the set s stands for.
+func (e *enumValue) parse(s string) (string, error) {
+	s = strings.ToLower(s)
+	if a, ok := e.aliases[s]; ok {
+		s = a
+	}
+	if s != e.def && !slices.Contains(e.allowed, s) {
+		return "", fmt.Errorf("want %s", strings.Join(e.allowed, "|"))
+	}
+	return s, nil
+}
+
+func (e *enumValue) Set(s string) error {
+	v, err := e.parse(s)
+	if err != nil {
+		return err
+	}
+	*e.value = v
+	return nil
+}
+
+func (e *enumValue) String() string { return *e.value }
+
+// Type is string, as for the plain string flags the enums replaced.
+func (e *enumValue) Type() string { return "string" }
@@ -3,9 +3,12 @@ module snapstamp
 go 1.25.1
 
 require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/jdeng/goheif v0.0.0-20241115163857-e2bbb197c985
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	github.com/spf13/pflag v1.0.10
 	golang.org/x/image v0.32.0
+	golang.org/x/text v0.30.0
 )
 
-require golang.org/x/text v0.30.0 // indirect
+require golang.org/x/sys v0.13.0 // indirect
@@ -2,48 +2,311 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"image"
 	"image/color"
-	"image/draw"
-	"image/jpeg"
-	"image/png"
-	"io"
 	"log"
+	"math/rand/v2"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	flag "github.com/spf13/pflag"
-
-	"github.com/rwcarlsen/goexif/exif"
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/basicfont"
 	"golang.org/x/image/font/opentype"
-	"golang.org/x/image/math/fixed"
+
+	"snapstamp/stamp"
+)
+
+// Exit codes of a run. Single-file mode exits 1 on any error.
+const (
+	exitSomeFailed  = 1   // some files failed, others were written
+	exitAllFailed   = 2   // files failed and none could be written
+	exitInterrupted = 130 // cancelled by SIGINT/SIGTERM
 )
 
 func main() {
-	inPath := flag.StringP("in", "i", ".", "input image path or directory (jpg/png)")
+	inPaths := flag.StringArrayP("in", "i", []string{"."}, "input image path or directory (jpg/png/gif/webp/heic, or the JPEG preview in cr2/nef/arw/dng raw files); repeatable, more inputs and glob patterns may follow as arguments")
 	outPath := flag.StringP("out", "o", ".", "output image path (optional, only for single file)")
-	marginPercent := flag.IntP("margin", "m", 5, "margin from edges as percentage of the chosen image side (see --side)")
+	margin := flag.StringP("margin", "m", "5", "margin from edges as percentage of the chosen image side (see --side), or in pixels with a px suffix (e.g. 24px)")
+	filesFrom := flag.String("files-from", "", "read the images to process from this file (- for stdin), one path per line, instead of walking --in")
+	null := flag.BoolP("null", "0", false, "with --files-from, paths are separated by NUL characters (find -print0) instead of newlines")
+	base := flag.String("base", "", "with --files-from, place outputs relative to this directory (default: the deepest directory shared by all listed files)")
+	include := flag.StringArray("include", nil, "in directories, only process files matching this glob (relative to the input, ** for any depth, e.g. \"**/IMG_*.jpg\"); repeatable")
+	exclude := flag.StringArray("exclude", nil, "in directories, skip files and directories matching this glob (e.g. \"**/thumbnails/\"); repeatable, wins over --include")
 	recursive := flag.BoolP("recursive", "r", false, "when input is a directory, recurse into subdirectories")
-	fontPath := flag.StringP("font", "f", "arial.ttf", "path to .ttf font file to use for stamp (optional)")
+	copyOthers := flag.Bool("copy-others", false, "copy files that aren't images (videos, sidecars, ...) into the output tree as they are")
+	linkOthers := flag.Bool("link-others", false, "like --copy-others, but hard link the files where the output is on the same file system")
+	followLinks := flag.Bool("follow-symlinks", false, "descend into symlinked directories; files reachable by several paths are stamped once")
+	fontPath := flag.StringP("font", "f", "arial.ttf", "path to .ttf/.otf/.ttc font file to use for stamp; a comma-separated list forms a fallback chain for missing glyphs (optional)")
+	strictFont := flag.Bool("strict-font", false, "exit with an error instead of falling back to the built-in bitmap font when a --font can't be loaded")
+	fontIndex := flag.Int("font-index", 0, "face index to use when the (first) --font is a .ttc collection")
 	widthPercent := flag.IntP("widthpercent", "w", 40, "stamp max width as percentage of the chosen image side (1-100)")
-	side := flag.StringP("side", "s", "width", "which image side to use for margin/width calculations: width|long|short (default: width)")
+	widthPercentPortrait := flag.Int("widthpercent-portrait", 0, "--widthpercent for portrait images, taller than wide once rotated upright (1-100; default: the same as --widthpercent)")
+	fontSize := flag.Float64("font-size", 0, "fixed font size in points; overrides --height-percent and --widthpercent")
+	heightPercent := flag.Int("height-percent", 0, "stamp line height as percentage of the image height (1-100); overrides --widthpercent")
+	minFontPx := flag.String("min-font-px", "", "skip images whose stamp lines would come out lower than this many pixels; \"N,force\" (or \"force\" for 10) enlarges the stamp to N pixels instead")
+	side := enumFlag("side", "s", "width", []string{"width", "long", "short"}, map[string]string{"w": "width", "l": "long", "s": "short"}, "which image side to use for margin/width calculations: width|long|short (default: width)")
+	position := enumFlag("position", "p", "bottom-right", []string{"bottom-right", "bottom-left", "top-right", "top-left", "bottom-center", "auto"}, nil, "stamp position: bottom-right|bottom-left|top-right|top-left|bottom-center, or auto for the corner covering the least detail")
+	align := enumFlag("align", "", "", []string{"left", "center", "right"}, nil, "alignment of wrapped or multi-line stamp text within the stamp: left|center|right (default: the side of --position)")
+	dateFormat := flag.String("format", "datetime", "stamp date format: datetime|date-only|us|eu or a Go time layout (e.g. \"02 Jan 2006\")")
+	timezone := flag.String("timezone", "", "time zone of EXIF dates without an offset tag: Local, UTC, an offset like +09:00 or a name like Asia/Tokyo (default: this computer's)")
+	dateSource := flag.String("date-source", "exif,xmp,takeout,filename,gps,mtime", "where to look for the capture date, in order: exif, xmp (IMG_1234.xmp sidecar), takeout (IMG_1234.jpg.json sidecar), filename, gps (the UTC time of the GPS fix), mtime; the modification time is the last resort either way")
+	sidecar := enumFlag("sidecar", "", "auto", []string{"auto", "off"}, nil, "when a photo has no EXIF date, read its date and GPS from a Google Takeout JSON sidecar (IMG_1234.jpg.json): auto or off")
+	filenameDate := flag.String("filename-date", "auto", "when a photo has no EXIF date, read it from the file name: auto (IMG_20230714_103005, Screenshot_2023-07-14-10-30-05, IMG-20230714-WA0001, ...), off, or a regexp with named groups Y, m, d and optionally H, M, S, ms")
+	localDisplay := flag.Bool("local-display", false, "stamp and name by the capture time converted to this computer's time zone instead of the photo's own local time")
+	templateText := flag.String("template", "", "stamp text template, e.g. \"{{.Date}} · {{.Make}} {{.Model}}\" (fields: Date Make Model Lens ISO FNumber Exposure FocalLength GPS Lat Lon Place)")
+	text := flag.String("text", "", "stamp this text instead of the date; a literal \\n forces a line break")
+	textAppend := flag.Bool("text-append", false, "add --text as a line below the date instead of replacing it")
+	textColor := flag.String("color", "black", "stamp text color: white|black|yellow|orange|red, hex #RRGGBB[AA], or auto to pick black/white from the background")
+	outlineColor := flag.String("outline-color", "white", "stamp outline color: white|black|yellow|orange|red or hex #RRGGBB[AA]")
+	style := enumFlag("style", "", "outline", []string{"outline", "shadow", "plain", "lcd"}, nil, "stamp style: outline|shadow|plain|lcd (seven-segment 'YY MM DD, no font needed)")
+	shadowColor := flag.String("shadow-color", "#00000099", "shadow color for --style shadow: named color or hex #RRGGBB[AA]")
+	frame := enumFlag("frame", "", "", []string{"bar", "polaroid"}, nil, "stamp into a frame instead of over the photo: bar (strip below) | polaroid (borders, thicker bottom); not applied to GIF output")
+	frameSize := flag.Int("frame-size", 12, "--frame strip height as percentage of the image height (1-100)")
+	frameColor := flag.String("frame-color", "white", "--frame fill color: named color or hex #RRGGBB[AA]")
+	rotate := flag.Int("rotate", 0, "rotate the stamp counter-clockwise by 90|180|270 degrees (90 runs bottom-to-top)")
+	opacity := flag.Int("opacity", 100, "stamp opacity in percent (0-100), applied to fill, outline and shadow")
+	shadowOffset := flag.Int("shadow-offset", 0, "shadow offset in pixels for --style shadow (default: line height / 15)")
+	showCamera := flag.Bool("show-camera", false, "add the camera make and model as a line below the date")
+	showExposure := flag.Bool("show-exposure", false, "add focal length, aperture, shutter speed and ISO as a line below the date")
+	showPlace := flag.Bool("show-place", false, "add the nearest city from --geodb as a line below the date")
+	geoDBPath := flag.String("geodb", "", "GeoNames cities file (e.g. cities1000.txt) for --show-place and {{.Place}}; lookups are offline")
+	showArtist := flag.Bool("show-artist", false, "add a \"© YEAR Artist\" line from the EXIF Artist or Copyright tag")
+	artist := flag.String("artist", "", "artist for the © line when the photo has no Artist/Copyright tag (implies --show-artist)")
+	showGPS := flag.Bool("gps", false, "add the GPS coordinates as a line below the date (skipped when the photo has none)")
+	gpsFormatName := enumFlag("gps-format", "", "decimal", []string{"decimal", "dms"}, nil, "GPS coordinate format for --gps and the template: decimal|dms")
+	gpsPrecision := flag.Int("gps-precision", 5, "decimals of --gps-format decimal (0-8)")
+	stripGPSFlag := flag.Bool("gps-strip", false, "remove the GPS position from the EXIF copied into JPEG outputs")
 	rename := flag.BoolP("rename", "n", false, "rename output file to EXIF capture time (as filename)")
-	concurrency := flag.IntP("concurrency", "c", runtime.NumCPU(), "number of concurrent workers when processing a directory")
+	renameFormat := flag.String("rename-format", "", "file name template for --rename (implied), e.g. '{{.Date \"20060102_150405\"}}_{{.Model}}'; fields: those of --template plus Name (the original name), Date takes an optional Go time layout")
+	asciiOnly := flag.Bool("ascii-only", false, "with --rename, replace all but ASCII letters, digits, - _ and . in the names with _ (by default other letters, e.g. accented or CJK, are kept)")
+	zipOut := flag.String("zip-out", "", "with a .zip input, write the stamped images into this new ZIP file, keeping the archive's folders, instead of into --out")
+	outputFormat := enumFlag("output-format", "", "", []string{"jpg", "png"}, map[string]string{"jpeg": "jpg"}, "force output format: jpg|png (default: png for png inputs, jpg otherwise)")
+	stripMetadata := flag.Bool("strip-metadata", false, "do not copy EXIF, the ICC color profile or PNG text/DPI chunks from the input into the output")
+	scale := flag.Int("scale", 0, "downscale outputs to this percent of the original size (1-100), before the stamp is sized")
+	maxDimension := flag.Int("max-dimension", 0, "downscale outputs so the long edge is at most this many pixels, e.g. 2048 for the web; never upscales")
+	variantFlags := flag.StringArray("variant", nil, "also write a copy downscaled to this long edge into <out>/<name>/, mirroring the outputs, from the same decode: name=maxdim, e.g. thumb=800; repeatable")
+	noStamp := flag.Bool("no-stamp", false, "don't draw anything: copy the original bytes to the output name (e.g. with --rename) and set its times, without decoding")
+	move := flag.Bool("move", false, "with --no-stamp, move the inputs instead of copying them")
+	includeVideos := flag.Bool("include-videos", false, "with --rename, also pick up MP4/MOV videos and copy (or --move) them to names from their creation time, without drawing")
+	inPlace := flag.Bool("in-place", false, "overwrite the originals (atomically, via a temp file); excludes --out, --rename and --output-format")
+	backupDir := flag.String("backup-dir", "", "with --in-place, first copy each original into this directory, mirroring the input tree")
+	fsync := flag.Bool("fsync", false, "sync every output to disk before reporting it written (slower; for removable or network drives)")
+	touch := flag.Bool("touch", false, "leave outputs with the time they were written instead of the capture time (with --in-place: instead of the original's)")
+	noTouch := flag.Bool("no-touch", false, "the same as --touch: don't set the times of outputs")
+	overwrite := flag.Bool("overwrite", false, "replace existing output files instead of adding a _N suffix")
+	skipExisting := flag.Bool("skip-existing", false, "skip inputs whose output file already exists")
+	incremental := flag.Bool("incremental", false, "skip inputs whose output exists and is up to date (newer than the input, or carrying its capture time); replace stale outputs")
+	manifestPath := flag.String("manifest", "", "record stamped inputs (path, size, mtime, SHA-256, output) in this JSON file; later runs skip unchanged inputs and rewrite changed ones to the same output")
+	rehash := flag.Bool("rehash", false, "with --manifest, compare file contents instead of size and mtime")
+	after := flag.String("after", "", "skip images taken before this date, YYYY-MM-DD or \"YYYY-MM-DD HH:MM:SS\" local time (inclusive; EXIF date, else file time)")
+	before := flag.String("before", "", "skip images taken after this date, YYYY-MM-DD (the whole day) or \"YYYY-MM-DD HH:MM:SS\" local time (inclusive)")
+	requireEXIF := flag.Bool("require-exif", false, "skip images without a capture date of their own (EXIF, or the other --date-source sources) instead of stamping their file time")
+	fallbackDate := flag.String("fallback-date", "", "stamp images without a capture date with this date instead of their file time, e.g. 2001-01-01 (YYYY-MM-DD or \"YYYY-MM-DD HH:MM:SS\" local time)")
+	minWidth := flag.Int("min-width", 0, "skip images narrower than this many pixels (as displayed, after EXIF rotation), e.g. thumbnails")
+	minHeight := flag.Int("min-height", 0, "skip images shorter than this many pixels (as displayed, after EXIF rotation)")
+	minSize := flag.String("min-size", "", "skip files smaller than this size in bytes, or with a k/m suffix (e.g. 50k)")
+	maxMem := flag.String("max-mem", "auto", "memory for images decoded at once, with a k/m/g suffix (e.g. 4g); big images wait for each other while small ones run in parallel. auto: half the available RAM; 0 for no limit")
+	maxPixels := flag.Int64("max-pixels", stamp.DefaultMaxPixels, "refuse images with more pixels than this (width*height), checked before decoding; 0 for no limit")
+	restamp := flag.Bool("restamp", false, "also stamp images snapstamp wrote (they carry a marker), which are skipped so no photo gets two dates")
+	force := flag.Bool("force", false, "also stamp *_timestamped files when the output directory is inside the input directory")
+	verbose := flag.BoolP("verbose", "v", false, "verbose logging, with each file's date and its source and the time it spent decoding, drawing and encoding")
+	warnMtime := flag.Bool("warn-mtime", false, "log a warning for every file stamped with its modification time for want of a capture date")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile (go tool pprof) to this file")
+	memProfile := flag.String("memprofile", "", "write a heap profile (go tool pprof) to this file on exit")
+	quiet := flag.BoolP("quiet", "q", false, "print only errors and the final summary (no progress or per-file lines)")
+	dryRun := flag.Bool("dry-run", false, "print the planned input -> output mapping and date source without decoding or writing anything")
+	asJSON := flag.Bool("json", false, "print one JSON object per file and a final summary object on stdout instead of wrote/done lines")
+	watch := flag.Bool("watch", false, "after processing the input directories, keep running and stamp images added to them (once they stop growing) until interrupted")
+	decodeWorkers := flag.Int("decode-workers", 0, "workers reading and decoding images in a directory run (default: --concurrency)")
+	encodeWorkers := flag.Int("encode-workers", 0, "workers encoding and writing stamped images in a directory run (default: --concurrency)")
+	failFast := flag.Bool("fail-fast", false, "stop a directory run at the first file that fails, finishing only the files in progress")
+	retries := flag.Int("retries", 0, "try a file again up to N times, with a growing pause, when it fails with an I/O error that looks transient (e.g. a network share dropping out)")
+	concurrency := flag.IntP("concurrency", "c", runtime.NumCPU(), "number of workers per stage (decoding, stamping, encoding) when processing a directory")
+	sample := flag.Int("sample", 0, "only process the first N images found, to try settings on a large tree quickly")
+	sampleRandom := flag.Int("sample-random", 0, "only process N images picked at random across the tree")
+	seed := flag.Uint64("seed", 0, "with --sample-random, pick the same sample on every run (default: a new one each time)")
+	ordered := flag.Bool("ordered", false, "report directory results in input order instead of as they finish, so two runs over the same tree log the same")
+	flag.String("config", "", "read flag defaults from this YAML file of flag: value lines (default: snapstamp/config.yaml in the user config directory, if it exists); SNAPSTAMP_<FLAG> variables take precedence over it")
+	printConfigFlag := flag.Bool("print-config", false, "print the settings in effect, merged from the command line, SNAPSTAMP_* variables, the config file and the defaults, and exit")
+	listen := flag.String("listen", ":8080", "with serve, the address to listen on, e.g. :8080 or 127.0.0.1:8080")
+	maxUpload := flag.String("max-upload", "32m", "with serve, refuse uploads larger than this, with a k/m/g suffix")
 	help := flag.BoolP("help", "?", false, "display help")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == cmdComplete {
+		for _, c := range complete(flag.CommandLine, os.Args[2:]) {
+			fmt.Println(c)
+		}
+		return
+	}
+	cmd, args := splitCommand(os.Args[1:])
+	if cmd == cmdCompletion {
+		if len(args) != 1 {
+			log.Fatalf("usage: snapstamp completion bash|zsh|fish|powershell")
+		}
+		if err := printCompletion(os.Stdout, args[0]); err != nil {
+			log.Fatalf("completion: %v", err)
+		}
+		return
+	}
+	hideFlags(flag.CommandLine, cmd)
+	flag.Usage = func() { usage(flag.CommandLine, cmd) }
+	flag.CommandLine.Parse(args)
 	if *help {
 		flag.Usage()
 		return
 	}
+	sources, configUsed, err := applyDefaults(flag.CommandLine, "config")
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if err := applyCommand(flag.CommandLine, cmd, sources); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *printConfigFlag {
+		printConfig(os.Stdout, flag.CommandLine, sources, configUsed)
+		return
+	}
+	// inputs: --in (repeatable) plus positional arguments, which replace the default "."
+	inputs := *inPaths
+	if flag.NArg() > 0 {
+		if flag.CommandLine.Changed("in") {
+			inputs = append(inputs, flag.Args()...)
+		} else {
+			inputs = flag.Args()
+		}
+	}
+	inputs = expandInputs(inputs)
+	if problems := checkFlags(flag.CommandLine, inputs); len(problems) > 0 {
+		for _, p := range problems {
+			log.Print(p)
+		}
+		os.Exit(2)
+	}
+	marginPercent, marginPx, _ := parseMargin(*margin) // checked by checkFlags
+	minLineHeight, forceMinLineHeight, _ := parseMinFontPx(*minFontPx)
+	stampTemplate, err := stamp.ParseTemplate(*templateText)
+	if err != nil {
+		log.Fatalf("invalid --template: %v", err)
+	}
+	var zone *time.Location
+	if *timezone != "" {
+		if zone, err = stamp.ParseTimeZone(*timezone); err != nil {
+			log.Fatalf("invalid --timezone %q: want Local, UTC, an offset like +09:00 or a zone name like Asia/Tokyo", *timezone)
+		}
+	}
+	dateSources, err := stamp.ParseDateSources(*dateSource)
+	if err != nil {
+		log.Fatalf("invalid --date-source: %v", err)
+	}
+	if *sidecar == "off" {
+		dateSources = slices.DeleteFunc(dateSources, func(s string) bool { return s == stamp.DateSourceTakeout })
+	}
+	namePatterns := stamp.DefaultNamePatterns
+	switch *filenameDate {
+	case "auto":
+	case "off":
+		namePatterns = nil
+	default:
+		re, err := regexp.Compile(*filenameDate)
+		if err != nil {
+			log.Fatalf("invalid --filename-date: %v", err)
+		}
+		if !stamp.ValidNamePattern(re) {
+			log.Fatalf("invalid --filename-date %q: needs named groups (?P<Y>...), (?P<m>...) and (?P<d>...)", *filenameDate)
+		}
+		namePatterns = []*regexp.Regexp{re}
+	}
+	renameTemplate, err := stamp.ParseRenameTemplate(*renameFormat)
+	if err != nil {
+		log.Fatalf("invalid --rename-format: %v", err)
+	}
+	if renameTemplate != nil {
+		*rename = true
+	}
+	for _, p := range append(slices.Clone(*include), *exclude...) {
+		if !validPattern(p) {
+			log.Fatalf("invalid --include/--exclude pattern %q", p)
+		}
+	}
+	afterTime, _ := parseDateBound(*after, false) // checked by checkFlags
+	beforeTime, _ := parseDateBound(*before, true)
+	fallbackTime, err := parseDateBound(*fallbackDate, false)
+	if err != nil {
+		log.Fatalf("invalid --fallback-date: %v", err)
+	}
+	var memory *stamp.MemoryBudget
+	if *maxMem == "auto" {
+		if n := stamp.DefaultMemoryBudget(); n > 0 {
+			memory = stamp.NewMemoryBudget(n)
+		}
+	} else if n, err := parseByteSize(*maxMem); err != nil {
+		log.Fatalf("invalid --max-mem: %v", err)
+	} else if n > 0 {
+		memory = stamp.NewMemoryBudget(n)
+	}
+	minBytes, err := parseByteSize(*minSize)
+	if err != nil {
+		log.Fatalf("invalid --min-size: %v", err)
+	}
+	if *noTouch {
+		*touch = true
+	}
+	var variants []stamp.Variant
+	for _, s := range *variantFlags {
+		v, err := stamp.ParseVariant(s)
+		if err != nil {
+			log.Fatalf("invalid --variant %v", err)
+		}
+		if slices.ContainsFunc(variants, func(o stamp.Variant) bool { return o.Name == v.Name }) {
+			log.Fatalf("invalid --variant: %q is given twice", v.Name)
+		}
+		variants = append(variants, v)
+	}
+	retry := retryPolicy{max: *retries, verbose: *verbose}
+	autoColor := strings.EqualFold(*textColor, "auto")
+	var fillRGBA color.RGBA
+	if !autoColor {
+		fillRGBA, err = parseColor(*textColor)
+		if err != nil {
+			log.Fatalf("invalid --color: %v", err)
+		}
+	}
+	outlineRGBA, err := parseColor(*outlineColor)
+	if err != nil {
+		log.Fatalf("invalid --outline-color: %v", err)
+	}
+	frameRGBA, err := parseColor(*frameColor)
+	if err != nil {
+		log.Fatalf("invalid --frame-color: %v", err)
+	}
+	gps := stamp.GPSFormat{DMS: *gpsFormatName == "dms"}
+	gps.Precision = *gpsPrecision
+	var geo *stamp.GeoIndex
+	if *geoDBPath != "" {
+		if geo, err = stamp.LoadGeoDB(*geoDBPath); err != nil {
+			log.Fatalf("invalid --geodb: %v", err)
+		}
+	}
+	shadowRGBA, err := parseColor(*shadowColor)
+	if err != nil {
+		log.Fatalf("invalid --shadow-color: %v", err)
+	}
+	if *style == "lcd" && !flag.CommandLine.Changed("color") {
+		fillRGBA = stamp.LCDColor
+	}
+
+	stopProfiles, err := startProfiles(*cpuProfile, *memProfile)
+	if err != nil {
+		log.Fatalf("--cpuprofile: %v", err)
+	}
+	defer stopProfiles()
 
 	// context for graceful shutdown on Ctrl+C
 	ctx, cancel := context.WithCancel(context.Background())
@@ -52,568 +315,762 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
-		log.Printf("signal received, shutting down...")
+		log.Printf("signal received, finishing images in progress (press Ctrl+C again to quit now)...")
 		cancel()
+		<-sigs
+		log.Printf("second signal received, exiting")
+		stopProfiles()
+		os.Exit(exitInterrupted)
 	}()
 
-	// If user passed a bare font filename (e.g. "arial.ttf"), try to find it in system font dirs
-	if *fontPath != "" {
-		if filepath.Base(*fontPath) == *fontPath && !filepath.IsAbs(*fontPath) {
-			if p := findSystemFont(*fontPath); p != "" {
-				*fontPath = p
-			}
-		}
+	// parse and cache the fonts once (so we don't re-read/parse for every image);
+	// --font may list several fonts forming a per-glyph fallback chain;
+	// rename and inspect draw nothing and need none
+	var parsedFonts []*opentype.Font
+	drawing := cmd == cmdStamp || cmd == cmdServe
+	fontNames := strings.Split(*fontPath, ",")
+	if !drawing {
+		fontNames = nil
 	}
-
-	// parse and cache TTF font once (so we don't re-read/parse for every image)
-	var parsedFont *opentype.Font
-	if *fontPath != "" {
-		if b, err := os.ReadFile(*fontPath); err == nil {
-			if ft, err := opentype.Parse(b); err == nil {
-				parsedFont = ft
+	for i, name := range fontNames {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// If user passed a bare font filename (e.g. "arial.ttf"), try to find it in system font dirs
+		searched := ""
+		if filepath.Base(name) == name && !filepath.IsAbs(name) {
+			if p := stamp.FindSystemFont(name); p != "" {
+				name = p
 			} else {
-				log.Printf("warning: failed to parse font %s: %v", *fontPath, err)
+				searched = fmt.Sprintf(" (searched ./%s and %s)", name, strings.Join(stamp.SystemFontDirs(), ", "))
 			}
-		} else {
-			log.Printf("warning: failed to read font %s: %v", *fontPath, err)
+		}
+		// --font-index selects the face of the primary font only
+		index := 0
+		if i == 0 {
+			index = *fontIndex
+		}
+		ft, err := stamp.LoadFont(name, index)
+		switch {
+		case err == nil:
+			parsedFonts = append(parsedFonts, ft)
+		case *strictFont:
+			log.Fatalf("--strict-font: %v%s", err, searched)
+		default:
+			log.Printf("warning: %v%s", err, searched)
 		}
 	}
 
-	if *inPath == "" {
-		log.Fatalf("missing -in parameter\nUsage: %s -in photo.jpg|dir [-out out.jpg] [-recursive]", os.Args[0])
+	if len(parsedFonts) == 0 && *strictFont && drawing {
+		log.Fatalf("--strict-font: no font given")
+	}
+	if len(parsedFonts) == 0 && *style != "lcd" && drawing {
+		log.Printf("warning: no usable font loaded, falling back to the built-in bitmap font (scaled up, low quality)")
 	}
 
-	outIsDir := false
+	opts := stamp.Options{
+		MarginPercent:        marginPercent,
+		MarginPx:             marginPx,
+		Fonts:                parsedFonts,
+		WidthPercent:         *widthPercent,
+		WidthPercentPortrait: *widthPercentPortrait,
+		FontSize:             *fontSize,
+		HeightPercent:        *heightPercent,
+		Side:                 *side,
+		Position:             *position,
+		Align:                *align,
+		MinLineHeight:        minLineHeight,
+		ForceMinLineHeight:   forceMinLineHeight,
+		DateLayout:           resolveDateLayout(*dateFormat),
+		TimeZone:             zone,
+		LocalDisplay:         *localDisplay,
+		DateSources:          dateSources,
+		FallbackDate:         fallbackTime,
+		NamePatterns:         namePatterns,
+		Template:             stampTemplate,
+		RenameFormat:         renameTemplate,
+		Text:                 strings.ReplaceAll(*text, `\n`, "\n"),
+		TextAppend:           *textAppend,
+		Rename:               *rename,
+		ASCIINames:           *asciiOnly,
+		OutputFormat:         *outputFormat,
+		StripMetadata:        *stripMetadata,
+		Verbose:              *verbose,
+		InPlace:              *inPlace,
+		Overwrite:            *overwrite,
+		SkipExisting:         *skipExisting,
+		Incremental:          *incremental,
+		BackupDir:            *backupDir,
+		Touch:                *touch,
+		Fsync:                *fsync,
+		NoStamp:              *noStamp,
+		Move:                 *move,
+		After:                afterTime,
+		Before:               beforeTime,
+		MinSize:              minBytes,
+		MinWidth:             *minWidth,
+		MinHeight:            *minHeight,
+		RequireDate:          *requireEXIF,
+		MaxPixels:            *maxPixels,
+		Scale:                *scale,
+		MaxDimension:         *maxDimension,
+		Restamp:              *restamp,
+		Variants:             variants,
+		Memory:               memory,
+		StrictFont:           *strictFont,
+		TextColor:            fillRGBA,
+		AutoColor:            autoColor,
+		OutlineColor:         outlineRGBA,
+		Style:                *style,
+		ShadowColor:          shadowRGBA,
+		ShadowOffset:         *shadowOffset,
+		Opacity:              *opacity,
+		Rotate:               *rotate,
+		Frame:                *frame,
+		ShowCamera:           *showCamera,
+		ShowExposure:         *showExposure,
+		ShowPlace:            *showPlace,
+		Geo:                  geo,
+		ShowArtist:           *showArtist,
+		Artist:               *artist,
+		ShowGPS:              *showGPS,
+		GPS:                  gps,
+		StripGPS:             *stripGPSFlag,
+		FrameSize:            *frameSize,
+		FrameColor:           frameRGBA,
+	}
 
-	// Determine if input is dir or file
-	fi, err := os.Stat(*inPath)
-	if err != nil {
-		log.Fatalf("stat input: %v", err)
+	if cmd == cmdServe {
+		if flag.NArg() > 0 {
+			log.Fatalf("snapstamp serve takes no inputs")
+		}
+		maxUploadBytes, err := parseByteSize(*maxUpload)
+		if err != nil || maxUploadBytes == 0 {
+			log.Fatalf("invalid --max-upload %q: want a size in bytes, or with a k/m/g suffix like 32m", *maxUpload)
+		}
+		err = serve(ctx, *listen, &stampServer{base: opts, maxUpload: maxUploadBytes, quiet: *quiet})
+		stopProfiles()
+		if err != nil {
+			log.Fatalf("serve: %v", err)
+		}
+		return
 	}
 
-	if fi.IsDir() {
-		// if input is a directory, always treat outPath as a directory
-		// (no need for user to append a trailing separator)
-		if *outPath == "" {
-			*outPath = "."
+	if len(inputs) == 0 || inputs[0] == "" {
+		log.Fatalf("missing -in parameter\nUsage: %s -in photo.jpg|dir [-out out.jpg] [-recursive]", os.Args[0])
+	}
+	inPath := inputs[0]
+	if len(inputs) > 1 && slices.Contains(inputs, "-") {
+		log.Fatalf("- (stdin) can't be combined with other inputs")
+	}
+
+	// --files-from replaces walking the inputs
+	var listed []inputFile
+	if *filesFrom != "" {
+		if flag.CommandLine.Changed("in") || flag.NArg() > 0 {
+			log.Fatalf("--files-from can't be combined with --in or input arguments")
 		}
-		outIsDir = true
-		// create output dir if it doesn't exist
-		if err := os.MkdirAll(*outPath, 0755); err != nil {
-			log.Fatalf("create out dir: %v", err)
+		if *outPath == "-" {
+			log.Fatalf("--files-from can't be combined with -o -")
 		}
-		// walk directory and collect images to process
-		var files []string
-		walkFn := func(path string, d os.DirEntry, err error) error {
+		list := os.Stdin
+		if *filesFrom != "-" {
+			f, err := os.Open(*filesFrom)
 			if err != nil {
-				return nil
+				log.Fatalf("invalid --files-from: %v", err)
 			}
+			defer f.Close()
+			list = f
+		}
+		paths, err := readFileList(list, *null)
+		if err != nil {
+			log.Fatalf("read --files-from: %v", err)
+		}
+		listed = listedInputs(paths, *base, *includeVideos)
+	}
 
-			// stop walking if context cancelled
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
-			}
-			if d.IsDir() {
-				if path == *inPath {
-					return nil
-				}
-				if !*recursive {
-					return filepath.SkipDir
-				}
-				return nil
+	// "-" streams through stdin/stdout instead of naming a file
+	if *filesFrom == "" && (inPath == "-" || *outPath == "-") {
+		if cmd != cmdStamp {
+			log.Fatalf("snapstamp %s needs file paths, not - (stdin/stdout)", cmd)
+		}
+		for _, name := range []string{"rename", "rename-format", "in-place", "dry-run", "incremental", "manifest", "rehash", "watch", "no-stamp", "move", "after", "before", "min-width", "min-height", "min-size", "require-exif", "variant"} {
+			if flag.CommandLine.Changed(name) {
+				log.Fatalf("--%s needs file paths, not - (stdin/stdout)", name)
 			}
-			ext := filepath.Ext(d.Name())
-			low := ext
-			if len(low) > 0 {
-				low = low[1:]
+		}
+		if *outPath == "-" && *asJSON {
+			log.Fatalf("--json can't be combined with -o - (the image goes to stdout)")
+		}
+		out := *outPath
+		if inPath == "-" && !flag.CommandLine.Changed("out") {
+			out = "-"
+		}
+		if err := streamImage(ctx, inPath, out, opts, *quiet); err != nil {
+			stopProfiles()
+			log.Fatalf("process image: %v", flagError(err))
+		}
+		return
+	}
+
+	// a ZIP archive is stamped entry by entry without extracting it
+	if *filesFrom == "" && slices.ContainsFunc(inputs, isZip) {
+		if len(inputs) > 1 {
+			log.Fatalf("a .zip input can't be combined with other inputs")
+		}
+		for _, name := range []string{"rename", "rename-format", "in-place", "dry-run", "incremental", "manifest", "watch", "no-stamp", "move", "variant", "copy-others", "link-others", "sample", "sample-random"} {
+			if flag.CommandLine.Changed(name) {
+				log.Fatalf("--%s can't be used with a .zip input", name)
 			}
-			switch strings.ToLower(low) {
-			case "jpg", "jpeg", "png":
-				files = append(files, path)
+		}
+		if *zipOut != "" && flag.CommandLine.Changed("out") {
+			log.Fatalf("--zip-out and --out can't be used together")
+		}
+		opts.DateSources = zipDateSources(opts.DateSources)
+		z := &zipRun{opts: opts, wo: walkOptions{include: *include, exclude: *exclude}, workers: *concurrency, touch: *touch}
+		zr, entries, err := z.entries(inPath)
+		if err != nil {
+			log.Fatalf("open %s: %v", inPath, err)
+		}
+		defer zr.Close()
+		rep := newReporter(len(entries), *asJSON, *quiet, *verbose, false)
+		rep.warnMtime = *warnMtime
+		if err := stampZip(ctx, inPath, entries, *outPath, *zipOut, z, rep); err != nil {
+			stopProfiles()
+			log.Fatalf("%v", err)
+		}
+		if code := rep.finish(len(entries)); code != 0 {
+			stopProfiles()
+			os.Exit(code)
+		}
+		return
+	} else if *zipOut != "" {
+		log.Fatalf("--zip-out needs a .zip input")
+	}
+
+	process := stamp.ProcessFile
+	if *dryRun {
+		process = stamp.PlanFile
+	}
+	retried := 0
+	run := func(ctx context.Context, in, out string, opts stamp.Options) (stamp.Result, error) {
+		res, n, err := retry.do(ctx, in, func() (stamp.Result, error) { return process(ctx, in, out, opts) })
+		retried = n
+		return res, err
+	}
+	outputExt := func(p string) string {
+		if *noStamp {
+			return filepath.Ext(p) // the original bytes keep their format
+		}
+		return stamp.OutputExt(p, *outputFormat)
+	}
+	var m *manifest
+	if *manifestPath != "" {
+		if m, err = loadManifest(*manifestPath, *rehash); err != nil {
+			log.Fatalf("invalid --manifest: %v", err)
+		}
+	}
+
+	// several inputs or a directory make a batch run into an output directory
+	batch := len(inputs) > 1 || *filesFrom != ""
+	if !batch {
+		fi, err := os.Stat(inPath)
+		if err != nil {
+			log.Fatalf("stat input: %v", err)
+		}
+		batch = fi.IsDir()
+	}
+	if *watch && (!batch || *filesFrom != "") {
+		log.Fatalf("--watch needs an input directory")
+	}
+
+	if batch {
+		// the output is always a directory
+		// (no need for user to append a trailing separator)
+		if *outPath == "" {
+			*outPath = "."
+		}
+		// create output dir if it doesn't exist
+		if !opts.InPlace && !*dryRun {
+			if err := os.MkdirAll(*outPath, 0755); err != nil {
+				log.Fatalf("create out dir: %v", err)
 			}
-			return nil
 		}
-		// WalkDir: record errors encountered during traversal but continue where possible
-		if err := filepath.WalkDir(*inPath, func(path string, d os.DirEntry, err error) error {
-			if err != nil {
-				log.Printf("walk error %s: %v", path, err)
-				return nil
+		wo := walkOptions{recursive: *recursive, skipOutputs: !*force, include: *include, exclude: *exclude, followLinks: *followLinks, verbose: *verbose, others: *copyOthers || *linkOthers, videos: *includeVideos}
+		if !opts.InPlace {
+			wo.outDir = *outPath
+		}
+		// with --watch, watch before the initial walk so nothing slips through in between
+		var w *watcher
+		if *watch {
+			if w, err = newWatcher(inputs, wo); err != nil {
+				log.Fatalf("--watch: %v", err)
 			}
-			return walkFn(path, d, nil)
-		}); err != nil {
-			if err == context.Canceled {
-				log.Printf("walk cancelled")
-				// proceed with whatever files were collected
-			} else {
-				log.Fatalf("walkdir failed: %v", err)
+		}
+		files := listed
+		if *filesFrom == "" {
+			files = collectInputs(ctx, inputs, wo)
+		}
+		found := 0
+		if *sample > 0 {
+			files, found = sampleInputs(files, *sample, nil)
+		} else if *sampleRandom > 0 {
+			s := *seed
+			if !flag.CommandLine.Changed("seed") {
+				s = rand.Uint64()
 			}
+			files, found = sampleInputs(files, *sampleRandom, rand.New(rand.NewPCG(s, s)))
 		}
 
 		// If no files found, exit
-		if len(files) == 0 {
-			fmt.Println("no images found")
+		if len(files) == 0 && w == nil {
+			if *asJSON {
+				newReporter(0, true, false, false, *dryRun).finish(0)
+			} else {
+				fmt.Println("no images found")
+			}
 			return
 		}
 
-		// Worker pool to process files concurrently, respond to cancellation
-		jobs := make(chan string)
-		// determine number of workers
+		// stage the work so reading, decoding and encoding of different
+		// images overlap; each stage responds to cancellation
+		jobs := make(chan inputFile)
 		n := *concurrency
-		if n <= 0 {
-			n = 1
+		stages := &pipeline{
+			decoders: n,
+			drawers:  n,
+			writers:  n,
+			m:        m,
+			dryRun:   *dryRun,
+
+			linkOthers: *linkOthers,
+			retry:      retry,
 		}
-		// buffered results channel reduces the risk of worker goroutines blocking
-		results := make(chan struct {
-			out string
-			err error
-		}, n*2)
-		var wg sync.WaitGroup
-
-		worker := func() {
-			defer wg.Done()
-			for p := range jobs {
-				// respect cancellation
-				select {
-				case <-ctx.Done():
-					results <- struct {
-						out string
-						err error
-					}{"", ctx.Err()}
-					return
-				default:
-				}
-				// construct out path preserving relative structure
-				rel, err := filepath.Rel(*inPath, p)
-				if err != nil {
-					rel = filepath.Base(p)
-				}
-				relDir := filepath.Dir(rel)
-				destDir := filepath.Join(*outPath, relDir)
+		if *decodeWorkers > 0 {
+			stages.decoders = *decodeWorkers
+		}
+		if *encodeWorkers > 0 {
+			stages.writers = *encodeWorkers
+		}
+		stages.target = func(in inputFile) (string, stamp.Options, error) {
+			fileOpts := opts
+			fileOpts.InRoot, fileOpts.OutRoot = in.root, *outPath
+			if opts.InPlace {
+				return in.path, fileOpts, nil
+			}
+			// construct out path preserving relative structure
+			relDir := filepath.Dir(relPath(in.root, in.path))
+			destDir := filepath.Join(*outPath, relDir)
+			if !*dryRun {
 				if err := os.MkdirAll(destDir, 0755); err != nil {
-					results <- struct {
-						out string
-						err error
-					}{"", fmt.Errorf("mkdir dest: %w", err)}
-					continue
+					return "", fileOpts, fmt.Errorf("mkdir dest: %w", err)
 				}
-				ext := filepath.Ext(p)
-				base := fileBase(p)
-				out := filepath.Join(destDir, fmt.Sprintf("%s_timestamped%s", base, ext))
-				outFile, err := processImage(p, out, *marginPercent, parsedFont, *widthPercent, *side, *rename)
-				results <- struct {
-					out string
-					err error
-				}{outFile, err}
 			}
+			if in.other {
+				return filepath.Join(destDir, filepath.Base(in.path)), fileOpts, nil
+			}
+			ext := outputExt(in.path)
+			base := stamp.FileBase(in.path)
+			return filepath.Join(destDir, fmt.Sprintf("%s_timestamped%s", base, ext)), fileOpts, nil
 		}
-
-		// start workers
-		wg.Add(n)
-		for i := 0; i < n; i++ {
-			go worker()
-		}
+		// buffered results channel reduces the risk of worker goroutines blocking
+		results := make(chan fileResult, n*2)
 
 		// dispatch jobs; stop dispatching if cancelled
+		watched := 0
 		go func() {
 			defer close(jobs)
-			for _, p := range files {
+			for i, f := range files {
+				f.seq = i
 				select {
 				case <-ctx.Done():
 					return
-				default:
+				case jobs <- f:
+				}
+			}
+			if w != nil {
+				w.seen(files)
+				if !*quiet && !*asJSON {
+					log.Printf("watching for new images, press Ctrl+C to stop")
 				}
-				jobs <- p
+				watched = w.run(ctx, jobs, len(files))
 			}
 		}()
 
-		// close results when all workers finish
+		// close results when all stages finish
 		go func() {
-			wg.Wait()
+			stages.run(ctx, jobs, results)
 			close(results)
 		}()
 
 		// collect results until workers are done or cancelled
-		for res := range results {
-			if res.err != nil {
-				log.Printf("process: %v", res.err)
-			} else {
-				fmt.Printf("wrote %s\n", res.out)
+		total := len(files)
+		if w != nil {
+			total = 0 // unknown: no progress line
+		}
+		rep := newReporter(total, *asJSON, *quiet, *verbose, *dryRun)
+		rep.warnMtime = *warnMtime
+		if cmd == cmdInspect {
+			rep.tabulate()
+		}
+		if *sample > 0 || *sampleRandom > 0 {
+			rep.sampled(len(files), found)
+		}
+		var collected <-chan fileResult = results
+		if *ordered {
+			collected = orderResults(results)
+		}
+		for res := range collected {
+			rep.file(res)
+			if *failFast && res.failed() && rep.stopAt(res) {
+				// the stages wind down as on Ctrl+C, and collecting goes on until they have
+				cancel()
 			}
+			if w != nil {
+				m.flush() // the run has no natural end to wait for
+			}
+		}
+		m.flush()
+		if code := rep.finish(len(files) + watched); code != 0 {
+			stopProfiles()
+			os.Exit(code)
 		}
 		return
 	}
 
 	// single file
+	opts.InRoot = filepath.Dir(inPath)
 	out := *outPath
-	if out == "" {
-		ext := filepath.Ext(*inPath)
-		name := (*inPath)[:len(*inPath)-len(ext)]
-		out = fmt.Sprintf("%s_timestamped%s", name, ext)
-	} else if outIsDir {
+	if opts.InPlace {
+		out = inPath
+	} else if out == "" {
+		ext := filepath.Ext(inPath)
+		name := inPath[:len(inPath)-len(ext)]
+		out = fmt.Sprintf("%s_timestamped%s", name, outputExt(inPath))
+	} else if isDirPath(out) {
 		// place output inside specified directory
-		ext := filepath.Ext(*inPath)
-		base := fileBase(*inPath)
-		os.MkdirAll(out, 0755)
+		ext := outputExt(inPath)
+		base := stamp.FileBase(inPath)
+		if !*dryRun {
+			if err := os.MkdirAll(out, 0755); err != nil {
+				log.Fatalf("mkdir %s: %v", out, err)
+			}
+		}
 		out = filepath.Join(out, fmt.Sprintf("%s_timestamped%s", base, ext))
+	} else if *outputFormat != "" {
+		// a forced format also fixes the extension of an explicit output path
+		out = out[:len(out)-len(filepath.Ext(out))] + stamp.OutputExt(out, *outputFormat)
+	}
+	opts.OutRoot = filepath.Dir(out)
+	// the reporter also lists variants, sums up timings and fails the run
+	// when a variant failed
+	if *asJSON || *dryRun || *verbose || len(variants) > 0 {
+		start := time.Now()
+		res, err := m.run(ctx, run, inPath, out, opts, *dryRun)
+		m.flush()
+		rep := newReporter(1, *asJSON, *quiet, *verbose, *dryRun)
+		rep.warnMtime = *warnMtime
+		if cmd == cmdInspect {
+			rep.tabulate()
+		}
+		rep.file(fileResult{in: inPath, Result: res, err: err, elapsed: time.Since(start), retries: retried})
+		if rep.finish(1) != 0 {
+			stopProfiles()
+			os.Exit(1)
+		}
+		return
 	}
-	if outFile, err := processImage(*inPath, out, *marginPercent, parsedFont, *widthPercent, *side, *rename); err != nil {
+	res, err := m.run(ctx, run, inPath, out, opts, false)
+	err = flagError(err)
+	m.flush()
+	if errors.Is(err, stamp.ErrSkipped) {
+		if !*quiet {
+			log.Printf("%v", err)
+		}
+	} else if err != nil {
+		stopProfiles()
 		log.Fatalf("process image: %v", err)
+	} else if *quiet {
+		return
+	} else if res.Overwritten {
+		fmt.Printf("overwrote %s\n", res.Out)
 	} else {
-		fmt.Printf("wrote %s\n", outFile)
-	}
-}
-
-// helper: lowercase ascii
-// using strings.ToLower from stdlib
-
-func fileBase(path string) string {
-	name := filepath.Base(path)
-	ext := filepath.Ext(name)
-	if ext == "" {
-		return name
+		fmt.Printf("wrote %s\n", res.Out)
 	}
-	return name[:len(name)-len(ext)]
 }
 
-// processImage reads input, extracts date, wraps text if needed, draws multi-line stamp, and writes output
-// processImage reads input, extracts date, draws stamp, and writes output.
-// If rename is true, the output filename (inside outPath's directory) will be replaced
-// with a safe filename derived from the EXIF capture time.
-// Returns the actual written output path on success.
-func processImage(inPath, outPath string, marginPercent int, fontFT *opentype.Font, widthPercent int, side string, rename bool) (string, error) {
-	// Open file once and use stream for EXIF and image decoding to avoid reading whole file into memory
-	f, err := os.Open(inPath)
-	if err != nil {
-		return "", fmt.Errorf("open input: %w", err)
+// streamImage stamps inPath or stdin ("-") into outPath or stdout ("-").
+// Messages go to stderr so they never mix with an image on stdout.
+func streamImage(ctx context.Context, inPath, outPath string, opts stamp.Options, quiet bool) error {
+	in := os.Stdin
+	if inPath != "-" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return fmt.Errorf("open input: %w", err)
+		}
+		defer f.Close()
+		in = f
 	}
-	defer f.Close()
-
-	// Try to read EXIF
-	dateStr := ""
-	if ex, err := exif.Decode(f); err == nil {
-		if tag, err := ex.Get(exif.DateTimeOriginal); err == nil && tag != nil {
-			if s, err := tag.StringVal(); err == nil {
-				dateStr = s
-			}
+	if outPath == "-" {
+		res, err := stamp.Process(ctx, in, os.Stdout, opts)
+		if err != nil {
+			return err
 		}
-		if dateStr == "" {
-			if tag, err := ex.Get(exif.DateTime); err == nil && tag != nil {
-				if s, err := tag.StringVal(); err == nil {
-					dateStr = s
-				}
-			}
+		if !quiet {
+			log.Printf("wrote <stdout> (%s)", formatBytes(res.Size))
 		}
+		return nil
 	}
-
-	// Fallback to file mod time
-	if dateStr == "" {
-		if fi, err := os.Stat(inPath); err == nil {
-			dateStr = fi.ModTime().Format("2006-01-02 15:04:05")
-		} else {
-			dateStr = time.Now().Format("2006-01-02 15:04:05")
+	if opts.OutputFormat == "" {
+		// a stream has no name to follow, so the output path picks the format
+		switch strings.ToLower(filepath.Ext(outPath)) {
+		case ".png":
+			opts.OutputFormat = "png"
+		case ".jpg", ".jpeg":
+			opts.OutputFormat = "jpg"
 		}
 	}
-	dateStr = normalizeExifDate(dateStr)
-
-	// seek back to beginning for image decoding
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return "", fmt.Errorf("seek input: %w", err)
+	out, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	_, err = stamp.Process(ctx, in, out, opts)
+	if err == nil && opts.Fsync {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
 	}
-
-	img, format, err := image.Decode(f)
 	if err != nil {
-		return "", fmt.Errorf("decode image: %w", err)
-	}
-
-	bounds := img.Bounds()
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
-
-	// determine font face: if a parsed TTF font is provided, choose size so that text width <= widthPercent% of image width
-	var face font.Face
-	var drawer *font.Drawer
-	imgWidth := bounds.Dx()
-	imgHeight := bounds.Dy()
-
-	// determine which side length to use for margin/width calculations
-	sideLower := strings.ToLower(side)
-	var sideLen int
-	switch sideLower {
-	case "l", "long":
-		sideLen = max(imgWidth, imgHeight)
-	case "s", "short":
-		sideLen = min(imgWidth, imgHeight)
-	default:
-		// default and "width" -> use image width
-		sideLen = imgWidth
+		os.Remove(outPath)
+		return err
 	}
+	if !quiet {
+		fmt.Printf("wrote %s\n", outPath)
+	}
+	return nil
+}
 
-	availableWidth := max(sideLen*widthPercent/100, 10)
-
-	if fontFT != nil {
-		// binary search font size in points
-		lo := 4.0
-		hi := float64(imgWidth) // arbitrary upper bound
-		var chosen font.Face
-		for range 12 {
-			mid := (lo + hi) / 2
-			f, err := opentype.NewFace(fontFT, &opentype.FaceOptions{Size: mid, DPI: 72})
-			if err != nil {
-				hi = mid
-				continue
-			}
-			tmpDrawer := &font.Drawer{Dst: rgba, Src: image.NewUniform(color.RGBA{255, 255, 255, 220}), Face: f}
-			lines := wrapText(tmpDrawer, dateStr, availableWidth)
-			maxW := 0
-			for _, L := range lines {
-				w := tmpDrawer.MeasureString(L).Ceil()
-				if w > maxW {
-					maxW = w
-				}
-			}
-			if maxW <= availableWidth {
-				chosen = f
-				lo = mid
-			} else {
-				hi = mid
-			}
+// isStampedOutput reports whether name looks like an output of an earlier
+// run: name_timestamped.ext, or name_timestamped_N.ext as made by stamp.CreateUnique.
+func isStampedOutput(name string) bool {
+	base := stamp.FileBase(name)
+	if i := strings.LastIndexByte(base, '_'); i >= 0 {
+		if _, err := strconv.Atoi(base[i+1:]); err == nil {
+			base = base[:i]
 		}
-		if chosen != nil {
-			face = chosen
-			drawer = &font.Drawer{Dst: rgba, Src: image.NewUniform(color.RGBA{255, 255, 255, 220}), Face: face}
-		}
-	}
-	if drawer == nil {
-		face = basicfont.Face7x13
-		drawer = &font.Drawer{Dst: rgba, Src: image.NewUniform(color.RGBA{255, 255, 255, 220}), Face: face}
 	}
+	return strings.HasSuffix(base, "_timestamped")
+}
 
-	lines := wrapText(drawer, dateStr, availableWidth)
-
-	metrics := face.Metrics()
-	ascent := metrics.Ascent.Ceil()
-	descent := metrics.Descent.Ceil()
-	lineHeight := ascent + descent
-	// convert marginPercent to pixel margin using the chosen side length
-	pixelMargin := max(sideLen*marginPercent/100, 1)
-
-	// starting y for the first (top) line of the block so that block bottom is pixelMargin above bottom
-	startY := max(bounds.Max.Y-pixelMargin-descent-(len(lines)-1)*lineHeight, ascent+pixelMargin)
+// isDirPath reports whether p names a directory: an existing one, or one
+// to create as it ends in a path separator.
+func isDirPath(p string) bool {
+	if p != "" && os.IsPathSeparator(p[len(p)-1]) {
+		return true
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.IsDir()
+}
 
-	// draw each line right-aligned
-	for i, line := range lines {
-		textWidth := drawer.MeasureString(line).Ceil()
-		x := max(bounds.Max.X-textWidth-pixelMargin, pixelMargin)
-		y := startY + i*lineHeight
+// isWithin reports whether dir is root or a directory below it, comparing
+// absolute paths.
+func isWithin(root, dir string) bool {
+	absRoot, err1 := filepath.Abs(root)
+	absDir, err2 := filepath.Abs(dir)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
-		// draw white outline by drawing the text multiple times around the center
-		// outline thickness scales with font size
-		outlinePx := max(lineHeight/20, 1)
-		drawerOrig := *drawer
-		for ox := -outlinePx; ox <= outlinePx; ox++ {
-			for oy := -outlinePx; oy <= outlinePx; oy++ {
-				// skip center (will be drawn as main text)
-				if ox == 0 && oy == 0 {
-					continue
-				}
-				d := drawerOrig
-				d.Src = image.NewUniform(color.RGBA{255, 255, 255, 255})
-				d.Dot = fixed.P(x+ox, y+oy)
-				d.DrawString(line)
-			}
-		}
+// fileResult is one worker's outcome for a file in directory mode.
+type fileResult struct {
+	in string
+	stamp.Result
+	err     error
+	elapsed time.Duration
+	seq     int  // see inputFile.seq
+	other   bool // a --copy-others copy
+	retries int  // --retries used up
+}
 
-		// main fill (black)
-		drawer.Src = image.NewUniform(color.RGBA{0, 0, 0, 255})
-		drawer.Dot = fixed.P(x, y)
-		drawer.DrawString(line)
+// failed reports whether the input, one of its variants or its
+// --copy-others copy failed. Skipped inputs haven't failed.
+func (res fileResult) failed() bool {
+	if res.err != nil && !errors.Is(res.err, stamp.ErrSkipped) && !errors.Is(res.err, context.Canceled) {
+		return true
 	}
+	return slices.ContainsFunc(res.Variants, func(v stamp.VariantResult) bool {
+		return v.Err != nil && !errors.Is(v.Err, stamp.ErrSkipped)
+	})
+}
 
-	// determine final output path
-	ext := filepath.Ext(outPath)
-	outDir := filepath.Dir(outPath)
-	finalOut := outPath
-	if rename {
-		// build safe filename from dateStr: replace spaces with '_' and ':' with '-'
-		dateForFile := strings.ReplaceAll(dateStr, " ", "_")
-		dateForFile = strings.ReplaceAll(dateForFile, ":", "-")
-		dateForFile = safeFilename(dateForFile)
-		if dateForFile == "" {
-			dateForFile = "unknown_date"
+// optionFlags names the flags that set the fields of stamp.Options an
+// OptionError can be about.
+var optionFlags = map[string]string{
+	"StrictFont":   "--strict-font",
+	"MinSize":      "--min-size",
+	"MinWidth":     "--min-width/--min-height",
+	"MaxPixels":    "--max-pixels",
+	"After":        "--after/--before",
+	"Restamp":      "--restamp to stamp it anyway",
+	"RenameFormat": "--rename-format",
+}
+
+// flagError adds the flag behind a stamp.OptionError to err, which the
+// stamp package can't know.
+func flagError(err error) error {
+	var optErr *stamp.OptionError
+	if errors.As(err, &optErr) {
+		if f, ok := optionFlags[optErr.Option]; ok {
+			return fmt.Errorf("%w (%s)", err, f)
 		}
-		candidate := filepath.Join(outDir, dateForFile+ext)
-		// if exists, add numeric suffix
-		finalOut = uniquePath(candidate)
-	} else {
-		finalOut = uniquePath(outPath)
 	}
+	return err
+}
 
-	of, err := os.Create(finalOut)
-	if err != nil {
-		return "", fmt.Errorf("create output: %w", err)
-	}
-	defer of.Close()
+// namedColors are the color names accepted by --color and --outline-color.
+var namedColors = map[string]color.NRGBA{
+	"white":  {255, 255, 255, 255},
+	"black":  {0, 0, 0, 255},
+	"yellow": {255, 255, 0, 255},
+	"orange": {255, 136, 0, 255},
+	"red":    {255, 0, 0, 255},
+}
 
-	switch format {
-	case "png":
-		if err := png.Encode(of, rgba); err != nil {
-			return "", fmt.Errorf("encode png: %w", err)
-		}
-	default:
-		opts := &jpeg.Options{Quality: 95}
-		if err := jpeg.Encode(of, rgba, opts); err != nil {
-			return "", fmt.Errorf("encode jpeg: %w", err)
+// parseMargin parses a --margin value: a percentage ("5" or "5%") or a pixel
+// count ("24px"). The unused result is returned as -1 for marginPx and 0 for percent.
+func parseMargin(s string) (percent, px int, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if v, ok := strings.CutSuffix(s, "px"); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			return 0, -1, errors.New("want a non-negative number of pixels, e.g. 24px")
 		}
+		return 0, n, nil
 	}
-	// Try to set file times to EXIF capture time (attempt on all platforms).
-	if t, err := parseExifTime(dateStr); err == nil {
-		if err := os.Chtimes(finalOut, t, t); err != nil {
-			log.Printf("failed to set file times for %s: %v", finalOut, err)
-		}
-	} else {
-		log.Printf("failed to parse exif date '%s': %v", dateStr, err)
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+	if err != nil || n < 0 {
+		return 0, -1, errors.New("want a non-negative percentage or a pixel value like 24px")
 	}
-
-	return finalOut, nil
+	return n, -1, nil
 }
 
-// parseExifTime tries several common layouts to parse the normalized EXIF date string.
-func parseExifTime(s string) (time.Time, error) {
-	// try common layouts
-	layouts := []string{
-		"2006-01-02 15:04:05",
-		"2006-01-02_15-04-05",
-		"2006-01-02",
-		time.RFC3339,
-	}
-	var lastErr error
-	for _, l := range layouts {
-		if t, err := time.ParseInLocation(l, s, time.Local); err == nil {
-			return t, nil
-		} else {
-			lastErr = err
-		}
+// defaultMinFontPx is the --min-font-px minimum of a bare "force".
+const defaultMinFontPx = 10
+
+// parseMinFontPx parses a --min-font-px value: "" for no minimum, a line
+// height in pixels, optionally followed by ",force", or "force" alone.
+func parseMinFontPx(s string) (px int, force bool, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, false, nil
 	}
-	return time.Time{}, lastErr
+	if s == "force" {
+		return defaultMinFontPx, true, nil
+	}
+	v, force := strings.CutSuffix(s, ",force")
+	px, err = strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(v, "px")))
+	if err != nil || px < 1 {
+		return 0, false, errors.New("want a line height in pixels like 12, optionally followed by ,force")
+	}
+	return px, force, nil
 }
 
-// safeFilename replaces characters unsafe for filenames with underscores and keeps common safe chars.
-func safeFilename(s string) string {
-	var b strings.Builder
-	for _, r := range s {
-		// allow letters, numbers, dash, underscore, and dot
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
-			b.WriteRune(r)
-		} else {
-			b.WriteRune('_')
-		}
+// parseByteSize parses a --min-size value: a byte count with an optional
+// k or m suffix (binary units, like the summary). "" is 0.
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
 	}
-	return b.String()
+	// "50kib", "50kb" and "50k" all mean the same
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "b"), "i")
+	unit := int64(1)
+	if v, ok := strings.CutSuffix(s, "k"); ok {
+		s, unit = strings.TrimSpace(v), 1<<10
+	} else if v, ok := strings.CutSuffix(s, "m"); ok {
+		s, unit = strings.TrimSpace(v), 1<<20
+	} else if v, ok := strings.CutSuffix(s, "g"); ok {
+		s, unit = strings.TrimSpace(v), 1<<30
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("want a non-negative size in bytes, or with a k/m/g suffix like 50k")
+	}
+	return int64(n * float64(unit)), nil
 }
 
-// uniquePath returns a path that does not exist by appending _1, _2, ... when needed.
-func uniquePath(p string) string {
-	if _, err := os.Stat(p); os.IsNotExist(err) {
-		return p
+// parseColor parses a named color or a hex value like #FF8800 or #FF8800CC.
+// The result is premultiplied so it can be used directly as a draw source.
+func parseColor(s string) (color.RGBA, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := namedColors[s]; ok {
+		return color.RGBAModel.Convert(c).(color.RGBA), nil
 	}
-	dir := filepath.Dir(p)
-	base := fileBase(p)
-	ext := filepath.Ext(p)
-	for i := 1; i < 10000; i++ {
-		cand := filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, i, ext))
-		if _, err := os.Stat(cand); os.IsNotExist(err) {
-			return cand
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("unknown color %q (want white|black|yellow|orange|red or #RRGGBB[AA])", s)
+	}
+	var v [4]uint8
+	v[3] = 255
+	for i := 0; i < len(hex)/2; i++ {
+		n, err := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return color.RGBA{}, fmt.Errorf("invalid hex color %q", s)
 		}
+		v[i] = uint8(n)
 	}
-	// fallback: return original (will likely overwrite)
-	return p
+	c := color.NRGBA{v[0], v[1], v[2], v[3]}
+	return color.RGBAModel.Convert(c).(color.RGBA), nil
 }
 
-func normalizeExifDate(s string) string {
-	// common EXIF date format: "2006:01:02 15:04:05"
-	if len(s) >= 10 && s[4] == ':' && s[7] == ':' {
-		// replace first two ':' with '-'
-		runes := []rune(s)
-		runes[4] = '-'
-		runes[7] = '-'
-		return string(runes)
-	}
-	return s
+// dateLayouts maps the --format presets to Go time layouts.
+var dateLayouts = map[string]string{
+	"datetime":  "2006-01-02 15:04:05",
+	"date-only": "2006-01-02",
+	"us":        "01/02/2006 15:04:05",
+	"eu":        "02.01.2006 15:04:05",
 }
 
-// wrapText splits text into lines so each line fits within maxWidth (pixels) using the provided drawer.
-func wrapText(drawer *font.Drawer, text string, maxWidth int) []string {
-	// simple greedy wrap by spaces; if a word is too long, break by characters
-	words := strings.Fields(text)
-	var lines []string
-	if len(words) == 0 {
-		return []string{""}
-	}
-	cur := words[0]
-	for i := 1; i < len(words); i++ {
-		w := words[i]
-		try := cur + " " + w
-		if drawer.MeasureString(try).Ceil() <= maxWidth {
-			cur = try
-		} else {
-			// current line full, push it
-			lines = append(lines, cur)
-			// start new line with w, but if w alone too long, break it
-			if drawer.MeasureString(w).Ceil() <= maxWidth {
-				cur = w
-			} else {
-				// break word into chars
-				part := ""
-				for _, ch := range w {
-					try2 := part + string(ch)
-					if drawer.MeasureString(try2).Ceil() <= maxWidth {
-						part = try2
-					} else {
-						if part != "" {
-							lines = append(lines, part)
-						}
-						part = string(ch)
-					}
-				}
-				cur = part
-			}
-		}
+// resolveDateLayout returns the Go time layout for a --format value: either a named preset or the value itself.
+func resolveDateLayout(s string) string {
+	if l, ok := dateLayouts[strings.ToLower(s)]; ok {
+		return l
+	}
+	if s == "" {
+		return dateLayouts["datetime"]
 	}
-	lines = append(lines, cur)
-	return lines
+	return s
 }
 
-// findSystemFont searches common system font directories for the given filename (case-insensitive)
-func findSystemFont(filename string) string {
-	var dirs []string
-	switch runtime.GOOS {
-	case "windows":
-		dirs = []string{"C:\\Windows\\Fonts"}
-	case "darwin":
-		dirs = []string{"/System/Library/Fonts", "/Library/Fonts", filepath.Join(os.Getenv("HOME"), "Library/Fonts")}
-	default:
-		// linux/unix
-		dirs = []string{"/usr/share/fonts", "/usr/local/share/fonts", filepath.Join(os.Getenv("HOME"), ".fonts")}
-	}
+// dateBoundLayouts are the accepted --after/--before/--fallback-date formats.
+var dateBoundLayouts = []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
 
-	lower := strings.ToLower(filename)
-	for _, d := range dirs {
-		fpath := filepath.Join(d, filename)
-		if _, err := os.Stat(fpath); err == nil {
-			return fpath
-		}
-		// try case-insensitive scan
-		entries, err := os.ReadDir(d)
+// parseDateBound parses an --after/--before/--fallback-date value in local
+// time. A bare date given as an upper bound covers that whole day. An empty
+// s returns the zero time.
+func parseDateBound(s string, upper bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range dateBoundLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
 		if err != nil {
 			continue
 		}
-		for _, e := range entries {
-			if strings.ToLower(e.Name()) == lower {
-				return filepath.Join(d, e.Name())
-			}
+		if upper && layout == "2006-01-02" {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		} else if upper && layout == "2006-01-02 15:04" {
+			t = t.Add(time.Minute - time.Nanosecond)
 		}
+		return t, nil
 	}
-	return ""
+	return time.Time{}, fmt.Errorf("%q: want YYYY-MM-DD or \"YYYY-MM-DD HH:MM:SS\"", s)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsDirPath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "out.jpg")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sep := string(filepath.Separator)
+	for p, want := range map[string]bool{
+		dir:                                true,
+		dir + sep:                          true,
+		filepath.Join(dir, "new") + sep:    true, // to create
+		filepath.Join(dir, "new"):          false,
+		file:                               false,
+		filepath.Join(dir, "new", "a.jpg"): false,
+		"":                                 false,
+	} {
+		if got := isDirPath(p); got != want {
+			t.Errorf("isDirPath(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestSingleFileOutDir(t *testing.T) {
+	dir := t.TempDir()
+	in := writePNGs(t, dir, 1, 64, 48)[0]
+	existing := filepath.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sep := string(filepath.Separator)
+	tests := []struct {
+		out  string
+		want string // the output file
+	}{
+		{existing, filepath.Join(existing, "img0_timestamped.png")},
+		{filepath.Join(dir, "new") + sep, filepath.Join(dir, "new", "img0_timestamped.png")},
+		{filepath.Join(dir, "named.png"), filepath.Join(dir, "named.png")},
+	}
+	for _, tt := range tests {
+		if _, stderr, code := runSnapstamp(t, "--in", in, "--out", tt.out); code != 0 {
+			t.Fatalf("--out %s: exit %d:\n%s", tt.out, code, stderr)
+		}
+		if fi, err := os.Stat(tt.want); err != nil || !fi.Mode().IsRegular() {
+			t.Errorf("--out %s: no output file %s: %v", tt.out, tt.want, err)
+		}
+	}
+}
+
+func TestOptionErrorFlags(t *testing.T) {
+	dir := t.TempDir()
+	in := writePNGs(t, dir, 1, 64, 48)[0]
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--in", in, "--out", t.TempDir(), "--min-size", "1m"}, "below the minimum of 1048576 (--min-size)"},
+		{[]string{"--in", dir, "--out", t.TempDir(), "--max-pixels", "100"}, "more than the limit of 100 (--max-pixels)"},
+	}
+	for _, tt := range tests {
+		_, stderr, _ := runSnapstamp(t, tt.args...)
+		if !strings.Contains(stderr, tt.want) {
+			t.Errorf("snapstamp %s: %q not in\n%s", strings.Join(tt.args, " "), tt.want, stderr)
+		}
+	}
+}
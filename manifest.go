@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"snapstamp/stamp"
+)
+
+// manifestSaveEvery is how many recorded inputs may pile up before the
+// manifest is written out again, so a crash loses at most that many.
+const manifestSaveEvery = 100
+
+// manifestEntry is what --manifest remembers about a stamped input.
+type manifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+	Output  string    `json:"output"` // absolute
+}
+
+// manifestFile is the on-disk format of --manifest.
+type manifestFile struct {
+	Version int                      `json:"version"`
+	Files   map[string]manifestEntry `json:"files"` // by absolute input path
+}
+
+// manifest tracks the inputs stamped by this and earlier runs. Inputs it
+// lists with an unchanged size and mtime (or, with rehash, content) are
+// skipped, and changed ones are written again to the output they got
+// before. A nil *manifest (no --manifest) only runs the files.
+type manifest struct {
+	path    string
+	rehash  bool
+	mu      sync.Mutex
+	files   map[string]manifestEntry
+	pending int // entries recorded since the last save
+}
+
+// loadManifest reads the manifest at path; a missing file starts an empty one.
+func loadManifest(path string, rehash bool) (*manifest, error) {
+	m := &manifest{path: path, rehash: rehash, files: map[string]manifestEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var mf manifestFile
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if mf.Version != 1 {
+		return nil, fmt.Errorf("%s: unsupported manifest version %d", path, mf.Version)
+	}
+	if mf.Files != nil {
+		m.files = mf.Files
+	}
+	return m, nil
+}
+
+// run stamps inPath with fn (ProcessFile or PlanFile) unless the manifest
+// says its output is current, and records it once stamped. Dry runs
+// consult the manifest but don't change it.
+func (m *manifest) run(ctx context.Context, fn func(context.Context, string, string, stamp.Options) (stamp.Result, error), inPath, outPath string, opts stamp.Options, dryRun bool) (stamp.Result, error) {
+	key, outPath, opts, res, err := m.prepare(inPath, outPath, opts)
+	if err != nil {
+		return res, err
+	}
+	res, err = fn(ctx, inPath, outPath, opts)
+	m.done(key, inPath, res, err, dryRun)
+	return res, err
+}
+
+// prepare looks inPath up before it is stamped to outPath. It returns the
+// output path and options to stamp it with, or an ErrUpToDate error when
+// its output is current. key identifies the input to done; it is empty
+// when the manifest can't track the input.
+func (m *manifest) prepare(inPath, outPath string, opts stamp.Options) (key, out string, o stamp.Options, res stamp.Result, err error) {
+	if m == nil {
+		return "", outPath, opts, stamp.Result{}, nil
+	}
+	key, err = filepath.Abs(inPath)
+	if err != nil {
+		return "", outPath, opts, stamp.Result{}, nil
+	}
+	m.mu.Lock()
+	prev, known := m.files[key]
+	m.mu.Unlock()
+	if known && m.sameTarget(prev, outPath) {
+		if current, err := m.current(key, prev); err != nil {
+			return "", "", opts, stamp.Result{}, err
+		} else if current {
+			return "", "", opts, stamp.Result{Out: prev.Output}, fmt.Errorf("%w %s: %s (manifest)", stamp.ErrUpToDate, inPath, prev.Output)
+		}
+		// changed since: replace the earlier output rather than adding a _N copy
+		outPath = prev.Output
+		opts.Rename, opts.Overwrite, opts.SkipExisting, opts.Incremental = false, true, false, false
+	}
+	return key, outPath, opts, stamp.Result{}, nil
+}
+
+// done records the input prepare returned key for once it is stamped.
+func (m *manifest) done(key, inPath string, res stamp.Result, err error, dryRun bool) {
+	if m == nil || key == "" || err != nil || dryRun {
+		return
+	}
+	if err := m.record(key, res.Out); err != nil {
+		log.Printf("manifest: %s: %v", inPath, err)
+	}
+}
+
+// sameTarget reports whether the output recorded in e is where a run to
+// outPath writes: same directory and extension. With another --out or
+// --output-format the input is stamped anew.
+func (m *manifest) sameTarget(e manifestEntry, outPath string) bool {
+	abs, err := filepath.Abs(outPath)
+	if err != nil {
+		return false
+	}
+	return filepath.Dir(abs) == filepath.Dir(e.Output) && filepath.Ext(abs) == filepath.Ext(e.Output)
+}
+
+// current reports whether the input at key still matches e and its output
+// still exists. With rehash the content decides, and a matching input
+// whose mtime changed is recorded again.
+func (m *manifest) current(key string, e manifestEntry) (bool, error) {
+	if _, err := os.Stat(e.Output); err != nil {
+		return false, nil
+	}
+	fi, err := os.Stat(key)
+	if err != nil {
+		return false, fmt.Errorf("stat input: %w", err)
+	}
+	same := fi.Size() == e.Size && fi.ModTime().Equal(e.ModTime)
+	if !m.rehash {
+		return same, nil
+	}
+	sum, err := hashFile(key)
+	if err != nil {
+		return false, err
+	}
+	if sum != e.SHA256 {
+		return false, nil
+	}
+	if !same {
+		e.Size, e.ModTime = fi.Size(), fi.ModTime()
+		m.put(key, e)
+	}
+	return true, nil
+}
+
+// record remembers the input at key, as it is now, and its output.
+func (m *manifest) record(key, out string) error {
+	fi, err := os.Stat(key) // after --in-place this is the stamped file
+	if err != nil {
+		return err
+	}
+	sum, err := hashFile(key)
+	if err != nil {
+		return err
+	}
+	if out, err = filepath.Abs(out); err != nil {
+		return err
+	}
+	m.put(key, manifestEntry{Size: fi.Size(), ModTime: fi.ModTime(), SHA256: sum, Output: out})
+	return nil
+}
+
+func (m *manifest) put(key string, e manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[key] = e
+	m.pending++
+	if m.pending >= manifestSaveEvery {
+		if err := m.saveLocked(); err != nil {
+			log.Printf("save manifest: %v", err)
+		}
+	}
+}
+
+// flush writes out entries recorded since the last save.
+func (m *manifest) flush() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending == 0 {
+		return
+	}
+	if err := m.saveLocked(); err != nil {
+		log.Printf("save manifest: %v", err)
+	}
+}
+
+// saveLocked replaces the manifest file atomically: readers see either the
+// old or the new one, never a partial write.
+func (m *manifest) saveLocked() error {
+	data, err := json.MarshalIndent(manifestFile{Version: 1, Files: m.files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), "."+filepath.Base(m.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return err
+	}
+	m.pending = 0
+	return nil
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"snapstamp/stamp"
+)
+
+// copyOther mirrors the non-image file in to out for --copy-others: a hard
+// link with link when both are on one file system, a byte copy otherwise,
+// either way keeping in's modification time. An existing out is replaced
+// with --overwrite, or with --incremental when its size or time is off;
+// otherwise it is left alone. With dryRun nothing is written.
+func copyOther(in, out string, link, dryRun bool, opts stamp.Options) (stamp.Result, error) {
+	fi, err := os.Stat(in)
+	if err != nil {
+		return stamp.Result{}, fmt.Errorf("stat input: %w", err)
+	}
+	existed := false
+	if cur, err := os.Stat(out); err == nil {
+		switch {
+		case os.SameFile(fi, cur):
+			// already linked, or the output directory is the input's
+			return stamp.Result{}, fmt.Errorf("%w %s: %s is the same file", stamp.ErrUpToDate, in, out)
+		case opts.Incremental && cur.Size() == fi.Size() && !cur.ModTime().Before(fi.ModTime()):
+			return stamp.Result{}, fmt.Errorf("%w %s: %s", stamp.ErrUpToDate, in, out)
+		case opts.Overwrite, opts.Incremental:
+			existed = true
+		default:
+			return stamp.Result{}, fmt.Errorf("%w %s: %s already exists", stamp.ErrSkipped, in, out)
+		}
+	}
+	res := stamp.Result{Out: out, Overwritten: existed, Size: fi.Size()}
+	if dryRun {
+		return res, nil
+	}
+	if existed {
+		// a link can't replace a file, and a copy mustn't write through
+		// an earlier link into the input
+		if err := os.Remove(out); err != nil {
+			return stamp.Result{}, fmt.Errorf("replace output: %w", err)
+		}
+	}
+	if link && os.Link(in, out) == nil {
+		res.Size = 0 // nothing written
+		return res, nil
+	}
+	if err := copyFile(in, out, fi, opts.Fsync); err != nil {
+		os.Remove(out)
+		return stamp.Result{}, err
+	}
+	return res, nil
+}
+
+// copyFile copies in to the new file out and gives it in's modification
+// time.
+func copyFile(in, out string, fi os.FileInfo, sync bool) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil && sync {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := os.Chtimes(out, fi.ModTime(), fi.ModTime()); err != nil {
+		return fmt.Errorf("set file times: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"snapstamp/stamp"
+)
+
+// pipeline stamps the inputs of a batch in the three stages of
+// stamp.ProcessFile, each on its own workers: decoders read and decode
+// images, drawers stamp them and writers encode them to their outputs. The
+// stages are connected by unbuffered channels, so at most one image per
+// worker is in flight, and reading and decoding one image overlaps with
+// encoding and writing another.
+type pipeline struct {
+	decoders, drawers, writers int
+
+	// target returns where an input is written and the options to stamp
+	// it with
+	target func(in inputFile) (string, stamp.Options, error)
+	m      *manifest
+	dryRun bool // plan with stamp.PlanFile in the decode stage instead
+
+	linkOthers bool // hard link --copy-others files instead of copying them where possible
+	retry      retryPolicy
+}
+
+// stageJob is an input between the stages.
+type stageJob struct {
+	in    inputFile
+	key   string // see manifest.prepare
+	job   *stamp.FileJob
+	start time.Time
+
+	// where the job writes and how, to start it over on a retry
+	out  string
+	opts stamp.Options
+}
+
+// run stamps the inputs until the channel is closed and sends one result
+// per input it started. Once ctx is cancelled no more inputs are started,
+// but those already decoded are finished so no partial output is left
+// behind.
+func (p *pipeline) run(ctx context.Context, inputs <-chan inputFile, results chan<- fileResult) {
+	decoded := make(chan stageJob)
+	drawn := make(chan stageJob)
+
+	var decoders, drawers, writers sync.WaitGroup
+	decoders.Add(p.decoders)
+	for range p.decoders {
+		go func() {
+			defer decoders.Done()
+			for in := range inputs {
+				// respect cancellation; a file already started is finished
+				if ctx.Err() != nil {
+					return
+				}
+				if j, ok := p.decode(ctx, in, results); ok {
+					decoded <- j
+				}
+			}
+		}()
+	}
+	drawers.Add(p.drawers)
+	for range p.drawers {
+		go func() {
+			defer drawers.Done()
+			for j := range decoded {
+				j.job.Draw()
+				drawn <- j
+			}
+		}()
+	}
+	writers.Add(p.writers)
+	for range p.writers {
+		go func() {
+			defer writers.Done()
+			for j := range drawn {
+				first := true
+				res, retries, err := p.retry.do(ctx, j.in.path, func() (stamp.Result, error) {
+					if first {
+						first = false
+						return j.job.Write()
+					}
+					return stamp.ProcessFile(ctx, j.in.path, j.out, j.opts)
+				})
+				p.m.done(j.key, j.in.path, res, err, false)
+				results <- fileResult{in: j.in.path, seq: j.in.seq, Result: res, err: err, elapsed: time.Since(j.start), retries: retries}
+			}
+		}()
+	}
+
+	decoders.Wait()
+	close(decoded)
+	drawers.Wait()
+	close(drawn)
+	writers.Wait()
+}
+
+// decode runs the first stage for in. Inputs that end before decoding
+// (failed, up to date in the manifest, or planned in a dry run) are sent
+// to results right away and return false, as are --copy-others files,
+// which are copied here.
+func (p *pipeline) decode(ctx context.Context, in inputFile, results chan<- fileResult) (stageJob, bool) {
+	start := time.Now()
+	if in.err != nil {
+		results <- fileResult{in: in.path, seq: in.seq, err: in.err}
+		return stageJob{}, false
+	}
+	out, opts, err := p.target(in)
+	if err != nil {
+		results <- fileResult{in: in.path, seq: in.seq, err: err, elapsed: time.Since(start)}
+		return stageJob{}, false
+	}
+	if in.other {
+		res, err := copyOther(in.path, out, p.linkOthers, p.dryRun, opts)
+		results <- fileResult{in: in.path, seq: in.seq, Result: res, err: err, elapsed: time.Since(start), other: true}
+		return stageJob{}, false
+	}
+	key, out, opts, res, err := p.m.prepare(in.path, out, opts)
+	if err == nil && p.dryRun {
+		res, err = stamp.PlanFile(ctx, in.path, out, opts)
+	}
+	if err != nil || p.dryRun {
+		results <- fileResult{in: in.path, seq: in.seq, Result: res, err: err, elapsed: time.Since(start)}
+		return stageJob{}, false
+	}
+	return stageJob{in, key, stamp.DecodeFile(ctx, in.path, out, opts), start, out, opts}, true
+}
+
+// orderResults passes results on in input order (by inputFile.seq, counted
+// from 0): each is held back until those of all earlier inputs are through.
+// Inputs that never report (dropped when the run was cancelled) are passed
+// over once results is closed.
+func orderResults(results <-chan fileResult) <-chan fileResult {
+	ordered := make(chan fileResult)
+	go func() {
+		defer close(ordered)
+		held := map[int]fileResult{}
+		next := 0
+		for res := range results {
+			held[res.seq] = res
+			for r, ok := held[next]; ok; r, ok = held[next] {
+				ordered <- r
+				delete(held, next)
+				next++
+			}
+		}
+		for _, seq := range slices.Sorted(maps.Keys(held)) {
+			ordered <- held[seq]
+		}
+	}()
+	return ordered
+}
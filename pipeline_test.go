@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"snapstamp/stamp"
+)
+
+// writePNGs writes n w x h PNGs named img<i>.png into dir.
+func writePNGs(t testing.TB, dir string, n, w, h int) []string {
+	t.Helper()
+	var paths []string
+	for i := range n {
+		p := filepath.Join(dir, fmt.Sprintf("img%d.png", i))
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// testPipeline returns a pipeline writing <name>_timestamped<ext> files
+// into out, one worker per stage.
+func testPipeline(out string) *pipeline {
+	return &pipeline{
+		decoders: 1, drawers: 1, writers: 1,
+		target: func(in inputFile) (string, stamp.Options, error) {
+			return filepath.Join(out, stamp.FileBase(in.path)+"_timestamped"+stamp.OutputExt(in.path, "")), stamp.DefaultOptions(), nil
+		},
+	}
+}
+
+// runPipeline feeds paths to p as main does and returns the results by
+// input. onResult is called for each result as it arrives.
+func runPipeline(ctx context.Context, p *pipeline, paths []string, onResult func(fileResult)) map[string]fileResult {
+	jobs := make(chan inputFile)
+	results := make(chan fileResult)
+	go func() {
+		defer close(jobs)
+		for i, path := range paths {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- inputFile{path: path, root: filepath.Dir(path), seq: i}:
+			}
+		}
+	}()
+	go func() {
+		p.run(ctx, jobs, results)
+		close(results)
+	}()
+	got := map[string]fileResult{}
+	for res := range results {
+		if onResult != nil {
+			onResult(res)
+		}
+		got[res.in] = res
+	}
+	return got
+}
+
+func TestPipelineCancel(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	paths := writePNGs(t, in, 20, 400, 300)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := runPipeline(ctx, testPipeline(out), paths, func(fileResult) { cancel() })
+
+	if len(results) == 0 || len(results) >= len(paths) {
+		t.Fatalf("%d of %d inputs reported after cancelling at the first, want some but not all", len(results), len(paths))
+	}
+	written := map[string]bool{}
+	for _, res := range results {
+		if res.err != nil {
+			t.Errorf("%s: %v", res.in, res.err)
+			continue
+		}
+		written[filepath.Base(res.Out)] = true
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every file left is a finished output that was reported: no temp or
+	// partial files
+	for _, e := range entries {
+		if !written[e.Name()] {
+			t.Errorf("%s left in the output directory, but not reported written", e.Name())
+			continue
+		}
+		f, err := os.Open(filepath.Join(out, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := png.Decode(f); err != nil {
+			t.Errorf("%s: incomplete output: %v", e.Name(), err)
+		}
+		f.Close()
+	}
+	if len(entries) != len(written) {
+		t.Errorf("%d outputs for %d written results", len(entries), len(written))
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("temp file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestPipelineUndecodable(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	paths := writePNGs(t, in, 4, 64, 48)
+	bad := filepath.Join(in, "broken.png")
+	if err := os.WriteFile(bad, []byte("\x89PNG\r\n\x1a\n truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths[:2], append([]string{bad}, paths[2:]...)...)
+	results := runPipeline(context.Background(), testPipeline(out), paths, nil)
+
+	if len(results) != len(paths) {
+		t.Fatalf("%d of %d inputs reported", len(results), len(paths))
+	}
+	for _, p := range paths {
+		res := results[p]
+		switch {
+		case p == bad && !res.failed():
+			t.Errorf("%s: reported %v, want a failure", p, res.err)
+		case p != bad && res.err != nil:
+			t.Errorf("%s: %v", p, res.err)
+		}
+	}
+	entries, _ := os.ReadDir(out)
+	if len(entries) != len(paths)-1 {
+		t.Errorf("%d outputs, want one per valid input", len(entries))
+	}
+}
+
+// BenchmarkPipeline stamps a directory of PNGs with the staged pipeline and
+// with a pool of workers that each run stamp.ProcessFile start to end, as
+// before the stages.
+func BenchmarkPipeline(b *testing.B) {
+	in, out := b.TempDir(), b.TempDir()
+	paths := writePNGs(b, in, 40, 1600, 1200)
+	const n = 4
+	b.Run("pool", func(b *testing.B) {
+		for b.Loop() {
+			jobs := make(chan string)
+			var wg sync.WaitGroup
+			for range n {
+				wg.Go(func() {
+					for path := range jobs {
+						target := filepath.Join(out, stamp.FileBase(path)+"_timestamped.png")
+						if _, err := stamp.ProcessFile(context.Background(), path, target, stamp.DefaultOptions()); err != nil {
+							b.Error(err)
+						}
+					}
+				})
+			}
+			for _, path := range paths {
+				jobs <- path
+			}
+			close(jobs)
+			wg.Wait()
+		}
+	})
+	for _, workers := range [][3]int{{n, n, n}, {2 * n, n, 2 * n}} {
+		p := testPipeline(out)
+		p.decoders, p.drawers, p.writers = workers[0], workers[1], workers[2]
+		b.Run(fmt.Sprintf("stages/%d-%d-%d", workers[0], workers[1], workers[2]), func(b *testing.B) {
+			for b.Loop() {
+				for _, res := range runPipeline(context.Background(), p, paths, nil) {
+					if res.err != nil {
+						b.Error(res.err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+)
+
+// startProfiles starts the --cpuprofile and --memprofile output (either
+// path may be empty). The returned stop writes the profiles; it must run on
+// every way out of the process, since os.Exit skips deferred calls, and
+// may be called more than once.
+func startProfiles(cpuPath, memPath string) (stop func(), err error) {
+	var cpu *os.File
+	if cpuPath != "" {
+		if cpu, err = os.Create(cpuPath); err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, err
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if cpu != nil {
+				pprof.StopCPUProfile()
+				if err := cpu.Close(); err != nil {
+					log.Printf("write --cpuprofile: %v", err)
+				}
+			}
+			if memPath != "" {
+				if err := writeHeapProfile(memPath); err != nil {
+					log.Printf("write --memprofile: %v", err)
+				}
+			}
+		})
+	}, nil
+}
+
+// writeHeapProfile writes the heap profile to path: the memory allocated
+// over the whole run, and what is still in use at its end.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC() // bring the in-use statistics up to date
+	err = pprof.WriteHeapProfile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// progressLogInterval is how often progress is logged when stderr is not a terminal.
+const progressLogInterval = 5 * time.Second
+
+// progress reports how far a directory run has got: a live line redrawn in
+// place on a terminal, or a periodic log line otherwise. A nil *progress
+// (--quiet, --json) reports nothing.
+type progress struct {
+	total   int
+	done    int
+	start   time.Time
+	tty     bool
+	lastLog time.Time
+	shown   bool // the live line is currently on screen
+}
+
+func newProgress(total int) *progress {
+	tty := false
+	if fi, err := os.Stderr.Stat(); err == nil {
+		tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	now := time.Now()
+	return &progress{total: total, start: now, tty: tty, lastLog: now}
+}
+
+// clear removes the live line so other output can be printed.
+func (p *progress) clear() {
+	if p != nil && p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// step counts one finished file and updates the display.
+func (p *progress) step() {
+	if p == nil {
+		return
+	}
+	p.done++
+	if p.tty {
+		fmt.Fprint(os.Stderr, "\r\033[K"+p.String())
+		p.shown = true
+	} else if now := time.Now(); now.Sub(p.lastLog) >= progressLogInterval || p.done == p.total {
+		log.Print(p.String())
+		p.lastLog = now
+	}
+}
+
+// finish ends the live line.
+func (p *progress) finish() {
+	if p != nil && p.shown {
+		fmt.Fprintln(os.Stderr)
+		p.shown = false
+	}
+}
+
+// String formats e.g. "123/5000 (2.5%)  12.3 img/s  ETA 6m40s".
+func (p *progress) String() string {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+	s := fmt.Sprintf("%d/%d (%.1f%%)  %.1f img/s", p.done, p.total, 100*float64(p.done)/float64(max(p.total, 1)), rate)
+	if rate > 0 && p.done < p.total {
+		eta := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		s += "  ETA " + eta.Round(time.Second).String()
+	}
+	return s
+}
+
+// formatBytes prints n with a binary unit, e.g. "12.3 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
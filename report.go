@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"snapstamp/stamp"
+)
+
+// Statuses of a file in --json output.
+const (
+	statusWritten     = "written"
+	statusOverwritten = "overwritten"
+	statusSkipped     = "skipped"
+	statusUpToDate    = "up-to-date"      // --incremental
+	statusStamped     = "already-stamped" // written by snapstamp, see --restamp
+	statusFailed      = "failed"
+
+	// --dry-run
+	statusWouldWrite     = "would-write"
+	statusWouldOverwrite = "would-overwrite"
+
+	// --copy-others
+	statusCopied    = "copied"
+	statusWouldCopy = "would-copy"
+)
+
+// jsonFile is the --json record emitted for every processed file.
+type jsonFile struct {
+	Type       string `json:"type"` // always "file"
+	Input      string `json:"input"`
+	Output     string `json:"output,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Date       string `json:"date,omitempty"` // capture date from EXIF, a sidecar or the file name, "2006-01-02 15:04:05"
+	DateSource string `json:"date_source,omitempty"`
+	Time       string `json:"time,omitempty"`     // the date parsed, RFC 3339 with the photo's offset, whatever date_source
+	Position   string `json:"position,omitempty"` // the corner stamped, which --position auto chose
+	DurationMs int64  `json:"duration_ms"`
+	Retries    int    `json:"retries,omitempty"` // --retries used up
+
+	// planned files only (dry runs and snapstamp inspect), see stamp.Result
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	ResolvedDate string `json:"resolved_date,omitempty"`
+
+	// sizes and stage timings of a written file, see stamp.Timing
+	InBytes  int64 `json:"in_bytes,omitempty"`
+	OutBytes int64 `json:"out_bytes,omitempty"`
+	DecodeMs int64 `json:"decode_ms,omitempty"`
+	DrawMs   int64 `json:"draw_ms,omitempty"`
+	EncodeMs int64 `json:"encode_ms,omitempty"`
+
+	Variants []jsonVariant `json:"variants,omitempty"` // --variant outputs
+}
+
+// jsonVariant is the record of one --variant output within a jsonFile.
+type jsonVariant struct {
+	Name   string `json:"name"`
+	Output string `json:"output,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// jsonSummary is the last --json record of a run.
+type jsonSummary struct {
+	Type        string `json:"type"` // always "summary"
+	DryRun      bool   `json:"dry_run"`
+	Written     int    `json:"written"`
+	Overwritten int    `json:"overwritten"`
+	UpToDate    int    `json:"up_to_date"`
+	Stamped     int    `json:"already_stamped"`
+	Skipped     int    `json:"skipped"`
+	Failed      int    `json:"failed"`
+	Cancelled   int    `json:"cancelled"`
+	Bytes       int64  `json:"bytes"`
+	ElapsedMs   int64  `json:"elapsed_ms"`
+
+	DateSources map[string]int `json:"date_sources,omitempty"` // written and overwritten files by date_source
+
+	// --variant outputs, which the counts above don't include
+	Variants       int `json:"variants,omitempty"`
+	VariantsFailed int `json:"variants_failed,omitempty"`
+
+	// --copy-others files, which the counts above don't include either
+	Copied        int `json:"copied,omitempty"`
+	CopiesSkipped int `json:"copies_skipped,omitempty"` // existing or up to date
+	CopiesFailed  int `json:"copies_failed,omitempty"`
+
+	// --sample and --sample-random: the run took Sampled of SampledFrom inputs
+	Sampled     int `json:"sampled,omitempty"`
+	SampledFrom int `json:"sampled_from,omitempty"`
+
+	Timing *jsonStages `json:"timing,omitempty"` // over the files stamped
+
+	StoppedAt string `json:"stopped_at,omitempty"` // --fail-fast: the input whose failure stopped the run
+}
+
+// jsonStages sums up the stage timings of the files a run stamped.
+type jsonStages struct {
+	Decode jsonTiming `json:"decode"`
+	Draw   jsonTiming `json:"draw"`
+	Encode jsonTiming `json:"encode"`
+}
+
+// jsonTiming is the total and the percentiles of one stage's times.
+type jsonTiming struct {
+	TotalMs int64 `json:"total_ms"`
+	P50Ms   int64 `json:"p50_ms"`
+	P90Ms   int64 `json:"p90_ms"`
+	P99Ms   int64 `json:"p99_ms"`
+}
+
+// newTiming sums up times, which it sorts.
+func newTiming(times []time.Duration) jsonTiming {
+	slices.Sort(times)
+	var total time.Duration
+	for _, t := range times {
+		total += t
+	}
+	// nearest rank
+	pct := func(p int) int64 { return times[(len(times)*p+99)/100-1].Milliseconds() }
+	return jsonTiming{TotalMs: total.Milliseconds(), P50Ms: pct(50), P90Ms: pct(90), P99Ms: pct(99)}
+}
+
+// reporter prints per-file results and the final summary, either for
+// people (wrote lines, progress, a done line) or as JSON lines on stdout.
+type reporter struct {
+	json   bool
+	quiet  bool
+	dryRun bool
+	enc    *json.Encoder
+	prog   *progress
+	sum    jsonSummary
+	start  time.Time
+
+	verbose   bool           // log the date and timings of each file and sum the timings up
+	warnMtime bool           // warn about files dated by their modification time
+	timings   []stamp.Timing // of the files stamped
+	stopped   *fileResult    // see stopAt
+
+	// snapstamp inspect, see tabulate
+	inspect bool
+	table   *tabwriter.Writer
+}
+
+func newReporter(total int, asJSON, quiet, verbose, dryRun bool) *reporter {
+	r := &reporter{json: asJSON, quiet: quiet, verbose: verbose, dryRun: dryRun, start: time.Now(), sum: jsonSummary{Type: "summary", DryRun: dryRun}}
+	if asJSON {
+		r.enc = json.NewEncoder(os.Stdout)
+	} else if !quiet && total > 1 {
+		r.prog = newProgress(total)
+	}
+	return r
+}
+
+// tabulate lists planned files as the table of snapstamp inspect instead
+// of "would write" lines. The table is aligned and printed by finish.
+func (r *reporter) tabulate() {
+	r.inspect = true
+	if r.json || r.quiet {
+		return
+	}
+	r.table = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(r.table, "INPUT\tSOURCE\tDATE\tSIZE\tOUTPUT")
+}
+
+// row adds a line to the inspect table, with - for empty cells.
+func (r *reporter) row(cells ...string) {
+	for i, c := range cells {
+		if c == "" {
+			cells[i] = "-"
+		}
+	}
+	fmt.Fprintln(r.table, strings.Join(cells, "\t"))
+}
+
+// file records the outcome of one input.
+func (r *reporter) file(res fileResult) {
+	res.err = flagError(res.err)
+	if errors.Is(res.err, context.Canceled) {
+		return // not started, counted as cancelled
+	}
+	if res.other {
+		r.other(res)
+		return
+	}
+	status := statusWritten
+	switch {
+	case errors.Is(res.err, stamp.ErrUpToDate):
+		status = statusUpToDate
+		r.sum.UpToDate++
+	case errors.Is(res.err, stamp.ErrStamped):
+		status = statusStamped
+		r.sum.Stamped++
+	case errors.Is(res.err, stamp.ErrSkipped):
+		status = statusSkipped
+		r.sum.Skipped++
+	case res.err != nil:
+		status = statusFailed
+		r.sum.Failed++
+	case res.Overwritten:
+		status = statusOverwritten
+		r.sum.Overwritten++
+		r.sum.Bytes += res.Size
+	default:
+		r.sum.Written++
+		r.sum.Bytes += res.Size
+	}
+	if (status == statusWritten || status == statusOverwritten) && res.DateSource != "" {
+		if r.sum.DateSources == nil {
+			r.sum.DateSources = map[string]int{}
+		}
+		r.sum.DateSources[res.DateSource]++
+		if r.warnMtime && res.DateSource == stamp.DateSourceMtime {
+			r.prog.clear()
+			log.Printf("warning: %s has no capture date, using its modification time %s", res.in, formatTime(res.Time))
+		}
+	}
+	if res.Timing != (stamp.Timing{}) {
+		r.timings = append(r.timings, res.Timing)
+	}
+	if r.dryRun && status == statusWritten {
+		status = statusWouldWrite
+	} else if r.dryRun && status == statusOverwritten {
+		status = statusWouldOverwrite
+	}
+	variants := r.variants(res)
+	if r.json {
+		rec := jsonFile{Type: "file", Input: res.in, Output: res.Out, Status: status, Date: res.Date, DateSource: res.DateSource, Time: formatTime(res.Time), Position: res.Position, DurationMs: res.elapsed.Milliseconds(), Retries: res.retries, Width: res.Width, Height: res.Height, ResolvedDate: res.Resolved, Variants: variants}
+		if res.Timing != (stamp.Timing{}) {
+			rec.InBytes, rec.OutBytes = res.InSize, res.Size
+			rec.DecodeMs, rec.DrawMs, rec.EncodeMs = res.Timing.Decode.Milliseconds(), res.Timing.Draw.Milliseconds(), res.Timing.Encode.Milliseconds()
+		}
+		if res.err != nil {
+			rec.Error = res.err.Error()
+		}
+		r.enc.Encode(rec)
+		return
+	}
+	r.prog.clear()
+	switch status {
+	case statusSkipped, statusUpToDate, statusStamped:
+		if !r.quiet {
+			log.Printf("%v", res.err)
+		}
+	case statusFailed:
+		if res.retries > 0 {
+			log.Printf("process %s: %v (after %d retries)", res.in, res.err, res.retries)
+		} else {
+			log.Printf("process %s: %v", res.in, res.err)
+		}
+	case statusWouldWrite, statusWouldOverwrite:
+		if r.table != nil {
+			size, out := "", res.Out
+			if res.Width > 0 {
+				size = fmt.Sprintf("%dx%d", res.Width, res.Height)
+			}
+			if status == statusWouldOverwrite {
+				out += " (overwrite)"
+			}
+			r.row(res.in, res.DateSource, res.Resolved, size, out)
+		} else if !r.quiet {
+			verb := "write"
+			if status == statusWouldOverwrite {
+				verb = "overwrite"
+			}
+			fmt.Printf("would %s %s -> %s (date: %s)\n", verb, res.in, res.Out, res.DateSource)
+		}
+	case statusOverwritten:
+		if !r.quiet {
+			fmt.Printf("overwrote %s\n", res.Out)
+		}
+	default:
+		if !r.quiet {
+			fmt.Printf("wrote %s\n", res.Out)
+		}
+	}
+	for _, v := range variants {
+		switch {
+		case v.Status == statusFailed:
+			log.Printf("process %s (variant %s): %s", res.in, v.Name, v.Error)
+		case r.quiet:
+		case v.Status == statusSkipped:
+			log.Printf("%s", v.Error)
+		case r.table != nil:
+			r.row(res.in, "variant "+v.Name, "", "", v.Output)
+		case r.dryRun:
+			verb := "write"
+			if v.Status == statusWouldOverwrite {
+				verb = "overwrite"
+			}
+			fmt.Printf("would %s %s -> %s (variant %s)\n", verb, res.in, v.Output, v.Name)
+		case v.Status == statusOverwritten:
+			fmt.Printf("overwrote %s\n", v.Output)
+		default:
+			fmt.Printf("wrote %s\n", v.Output)
+		}
+	}
+	if r.verbose && res.DateSource != "" {
+		log.Printf("%s: date %s from %s", res.in, formatTime(res.Time), res.DateSource)
+	}
+	if r.verbose && res.Timing != (stamp.Timing{}) {
+		t := res.Timing
+		log.Printf("%s: decode %v, draw %v, encode %v; %s -> %s", res.in,
+			t.Decode.Round(time.Millisecond), t.Draw.Round(time.Millisecond), t.Encode.Round(time.Millisecond),
+			formatBytes(res.InSize), formatBytes(res.Size))
+	}
+	r.prog.step()
+}
+
+// formatTime formats a stamp.Result time for the report, "" for none.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// stopAt records res as the failure --fail-fast stops the run at, unless
+// an earlier one did already, and reports whether it is the first.
+func (r *reporter) stopAt(res fileResult) bool {
+	if r.stopped != nil {
+		return false
+	}
+	r.stopped = &res
+	r.sum.StoppedAt = res.in
+	return true
+}
+
+// sampled notes that the run only takes n of the total inputs found.
+func (r *reporter) sampled(n, total int) {
+	r.sum.Sampled, r.sum.SampledFrom = n, total
+}
+
+// other records the outcome of a --copy-others copy.
+func (r *reporter) other(res fileResult) {
+	status := statusCopied
+	switch {
+	case errors.Is(res.err, stamp.ErrSkipped):
+		status = statusSkipped
+		if errors.Is(res.err, stamp.ErrUpToDate) {
+			status = statusUpToDate
+		}
+		r.sum.CopiesSkipped++
+	case res.err != nil:
+		status = statusFailed
+		r.sum.CopiesFailed++
+	default:
+		r.sum.Copied++
+		r.sum.Bytes += res.Size
+		if r.dryRun {
+			status = statusWouldCopy
+		}
+	}
+	if r.json {
+		rec := jsonFile{Type: "file", Input: res.in, Output: res.Out, Status: status, DurationMs: res.elapsed.Milliseconds()}
+		if res.err != nil {
+			rec.Error = res.err.Error()
+		}
+		r.enc.Encode(rec)
+		return
+	}
+	r.prog.clear()
+	switch status {
+	case statusFailed:
+		log.Printf("copy %s: %v", res.in, res.err)
+	case statusSkipped, statusUpToDate:
+		if !r.quiet {
+			log.Printf("%v", res.err)
+		}
+	case statusWouldCopy:
+		if r.table != nil {
+			r.row(res.in, "copy", "", "", res.Out)
+		} else if !r.quiet {
+			fmt.Printf("would copy %s -> %s\n", res.in, res.Out)
+		}
+	default:
+		if !r.quiet {
+			fmt.Printf("copied %s\n", res.Out)
+		}
+	}
+	r.prog.step()
+}
+
+// variants counts the --variant outputs of res and returns their records.
+func (r *reporter) variants(res fileResult) []jsonVariant {
+	var recs []jsonVariant
+	for _, v := range res.Variants {
+		rec := jsonVariant{Name: v.Name, Output: v.Out}
+		switch {
+		case errors.Is(v.Err, stamp.ErrSkipped):
+			rec.Status, rec.Error = statusSkipped, v.Err.Error()
+		case v.Err != nil:
+			rec.Status, rec.Error = statusFailed, v.Err.Error()
+			r.sum.VariantsFailed++
+		case r.dryRun && v.Overwritten:
+			rec.Status = statusWouldOverwrite
+		case r.dryRun:
+			rec.Status = statusWouldWrite
+		case v.Overwritten:
+			rec.Status = statusOverwritten
+		default:
+			rec.Status = statusWritten
+		}
+		if v.Err == nil {
+			r.sum.Variants++
+			r.sum.Bytes += v.Size
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// finish prints the summary for a run over total inputs and returns the
+// process exit code.
+func (r *reporter) finish(total int) int {
+	r.prog.finish()
+	r.sum.Cancelled = total - (r.sum.Written + r.sum.Overwritten + r.sum.UpToDate + r.sum.Stamped + r.sum.Skipped + r.sum.Failed +
+		r.sum.Copied + r.sum.CopiesSkipped + r.sum.CopiesFailed)
+	elapsed := time.Since(r.start)
+	r.sum.ElapsedMs = elapsed.Milliseconds()
+	if len(r.timings) > 0 {
+		var decode, draw, encode []time.Duration
+		for _, t := range r.timings {
+			decode, draw, encode = append(decode, t.Decode), append(draw, t.Draw), append(encode, t.Encode)
+		}
+		r.sum.Timing = &jsonStages{Decode: newTiming(decode), Draw: newTiming(draw), Encode: newTiming(encode)}
+	}
+	if r.table != nil {
+		r.table.Flush()
+	}
+	if r.json {
+		r.enc.Encode(r.sum)
+	} else if r.dryRun {
+		label := "dry run"
+		if r.inspect {
+			label = "inspect"
+		}
+		fmt.Printf("%s: %d to write, %d to overwrite, ", label, r.sum.Written, r.sum.Overwritten)
+		r.printCounts()
+		fmt.Println()
+	} else {
+		fmt.Printf("done: %d written, %d overwritten, ", r.sum.Written, r.sum.Overwritten)
+		r.printCounts()
+		fmt.Printf("; %s in %s\n", formatBytes(r.sum.Bytes), elapsed.Round(10*time.Millisecond))
+	}
+	if r.stopped != nil && !r.json {
+		err := r.stopped.err
+		if err == nil {
+			err = errors.New("a variant failed")
+		}
+		log.Printf("stopped at the first failure (--fail-fast): %s: %v", r.stopped.in, err)
+	}
+	if !r.json {
+		r.printDateSources()
+		if r.verbose && r.sum.Timing != nil {
+			r.printTiming()
+		}
+		if r.sum.SampledFrom > 0 {
+			fmt.Printf("sample: %d of %d inputs\n", r.sum.Sampled, r.sum.SampledFrom)
+		}
+	}
+	switch {
+	case r.sum.Cancelled > 0 && r.stopped == nil:
+		return exitInterrupted
+	case r.sum.Failed > 0 && r.sum.Written+r.sum.Overwritten == 0:
+		return exitAllFailed
+	case r.sum.Failed > 0, r.sum.VariantsFailed > 0, r.sum.CopiesFailed > 0:
+		return exitSomeFailed
+	}
+	return 0
+}
+
+// printCounts prints the part of the summary line shared by real and dry
+// runs: skipped, failed and, when there are any, up-to-date, already
+// stamped and cancelled inputs.
+func (r *reporter) printCounts() {
+	if r.sum.UpToDate > 0 {
+		fmt.Printf("%d up to date, ", r.sum.UpToDate)
+	}
+	if r.sum.Stamped > 0 {
+		fmt.Printf("%d already stamped, ", r.sum.Stamped)
+	}
+	fmt.Printf("%d skipped, %d failed", r.sum.Skipped, r.sum.Failed)
+	if r.sum.Cancelled > 0 {
+		fmt.Printf(", %d cancelled", r.sum.Cancelled)
+	}
+	if r.sum.Variants+r.sum.VariantsFailed > 0 {
+		fmt.Printf(", %d variants", r.sum.Variants)
+		if r.sum.VariantsFailed > 0 {
+			fmt.Printf(" (%d failed)", r.sum.VariantsFailed)
+		}
+	}
+	if r.sum.Copied+r.sum.CopiesSkipped+r.sum.CopiesFailed > 0 {
+		verb := "copied"
+		if r.dryRun {
+			verb = "to copy"
+		}
+		fmt.Printf(", %d %s", r.sum.Copied, verb)
+		if r.sum.CopiesSkipped+r.sum.CopiesFailed > 0 {
+			fmt.Printf(" (%d skipped, %d failed)", r.sum.CopiesSkipped, r.sum.CopiesFailed)
+		}
+	}
+}
+
+// printTiming sums up where the stamped files spent their time.
+func (r *reporter) printTiming() {
+	ms := func(n int64) time.Duration { return time.Duration(n) * time.Millisecond }
+	names := []string{"decode", "draw", "encode"}
+	for i, t := range []jsonTiming{r.sum.Timing.Decode, r.sum.Timing.Draw, r.sum.Timing.Encode} {
+		fmt.Printf("%s: %v total, p50 %v, p90 %v, p99 %v\n", names[i], ms(t.TotalMs), ms(t.P50Ms), ms(t.P90Ms), ms(t.P99Ms))
+	}
+}
+
+// printDateSources lists how many outputs got their date from where, so a
+// run can be audited, when any of them wasn't dated by EXIF.
+func (r *reporter) printDateSources() {
+	allEXIF := true
+	for src := range r.sum.DateSources {
+		allEXIF = allEXIF && strings.HasPrefix(src, "exif-")
+	}
+	if allEXIF {
+		return
+	}
+	var parts []string
+	for _, src := range slices.Sorted(maps.Keys(r.sum.DateSources)) {
+		parts = append(parts, fmt.Sprintf("%d %s", r.sum.DateSources[src], src))
+	}
+	fmt.Printf("dates: %s\n", strings.Join(parts, ", "))
+}
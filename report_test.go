@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// jsonKind returns the JSON type of a value decoded into any.
+func jsonKind(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	return "null"
+}
+
+// The --json schema: the type of every field of each record type, and
+// whether it is always present.
+var jsonSchema = map[string]map[string]struct {
+	kind     string
+	required bool
+}{
+	"file": {
+		"type": {"string", true}, "input": {"string", true}, "output": {"string", false},
+		"status": {"string", true}, "error": {"string", false}, "date": {"string", false},
+		"date_source": {"string", false}, "time": {"string", false}, "position": {"string", false},
+		"duration_ms": {"number", true}, "retries": {"number", false},
+		"width": {"number", false}, "height": {"number", false}, "resolved_date": {"string", false},
+		"in_bytes": {"number", false}, "out_bytes": {"number", false},
+		"decode_ms": {"number", false}, "draw_ms": {"number", false}, "encode_ms": {"number", false},
+		"variants": {"array", false},
+	},
+	"variant": {
+		"name": {"string", true}, "output": {"string", false}, "status": {"string", true}, "error": {"string", false},
+	},
+	"summary": {
+		"type": {"string", true}, "dry_run": {"bool", true}, "written": {"number", true},
+		"overwritten": {"number", true}, "up_to_date": {"number", true}, "already_stamped": {"number", true},
+		"skipped": {"number", true}, "failed": {"number", true}, "cancelled": {"number", true},
+		"bytes": {"number", true}, "elapsed_ms": {"number", true}, "date_sources": {"object", false},
+		"variants": {"number", false}, "variants_failed": {"number", false},
+		"copied": {"number", false}, "copies_skipped": {"number", false}, "copies_failed": {"number", false},
+		"sampled": {"number", false}, "sampled_from": {"number", false},
+		"timing": {"object", false}, "stopped_at": {"string", false},
+	},
+}
+
+// checkSchema checks the fields of the record rec of type typ.
+func checkSchema(t *testing.T, typ string, rec map[string]any) {
+	t.Helper()
+	schema := jsonSchema[typ]
+	for name, f := range schema {
+		v, ok := rec[name]
+		switch {
+		case !ok && f.required:
+			t.Errorf("%s record without %q: %v", typ, name, rec)
+		case ok && jsonKind(v) != f.kind:
+			t.Errorf("%s record: %q is a %s, want a %s", typ, name, jsonKind(v), f.kind)
+		}
+	}
+	for name := range rec {
+		if _, ok := schema[name]; !ok {
+			t.Errorf("%s record: unknown field %q", typ, name)
+		}
+	}
+}
+
+func TestJSONReport(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	os.Mkdir(in, 0755)
+	writePNGs(t, in, 2, 64, 48)
+	if err := os.WriteFile(filepath.Join(in, "broken.png"), []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runSnapstamp(t, "--json", "--variant", "web=32", "--out", filepath.Join(dir, "out"), in)
+	if code != 1 {
+		t.Errorf("exit %d with a failed file, want 1:\n%s", code, stderr)
+	}
+
+	statuses := map[string]string{}
+	var summary map[string]any
+	sc := bufio.NewScanner(strings.NewReader(stdout))
+	for sc.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("not a JSON record: %s", sc.Text())
+		}
+		switch rec["type"] {
+		case "file":
+			checkSchema(t, "file", rec)
+			statuses[filepath.Base(rec["input"].(string))] = rec["status"].(string)
+			variants, _ := rec["variants"].([]any)
+			for _, v := range variants {
+				checkSchema(t, "variant", v.(map[string]any))
+			}
+		case "summary":
+			if summary != nil {
+				t.Errorf("more than one summary")
+			}
+			summary = rec
+			checkSchema(t, "summary", rec)
+		default:
+			t.Errorf("record of type %v", rec["type"])
+		}
+	}
+	want := map[string]string{"img0.png": "written", "img1.png": "written", "broken.png": "failed"}
+	for name, status := range want {
+		if statuses[name] != status {
+			t.Errorf("%s: status %q, want %q", name, statuses[name], status)
+		}
+	}
+	if summary == nil {
+		t.Fatal("no summary record")
+	}
+	if summary["written"] != 2.0 || summary["failed"] != 1.0 || summary["variants"] != 2.0 {
+		t.Errorf("summary written %v, failed %v, variants %v; want 2, 1, 2", summary["written"], summary["failed"], summary["variants"])
+	}
+}
+
+func TestJSONReportDryRun(t *testing.T) {
+	in := t.TempDir()
+	writePNGs(t, in, 1, 64, 48)
+	stdout, stderr, code := runSnapstamp(t, "inspect", "--json", in)
+	if code != 0 {
+		t.Fatalf("exit %d:\n%s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d records, want a file and the summary:\n%s", len(lines), stdout)
+	}
+	var file, summary map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &file); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	checkSchema(t, "file", file)
+	checkSchema(t, "summary", summary)
+	if file["width"] != 64.0 || file["height"] != 48.0 || jsonKind(file["resolved_date"]) != "string" {
+		t.Errorf("planned file: width %v, height %v, resolved_date %v; want 64, 48 and a date", file["width"], file["height"], file["resolved_date"])
+	}
+	if summary["dry_run"] != true {
+		t.Errorf("summary of inspect has dry_run %v", summary["dry_run"])
+	}
+}
+
+func TestJSONReportAlreadyStamped(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	os.Mkdir(in, 0755)
+	writePNGs(t, in, 2, 64, 48)
+	if _, stderr, code := runSnapstamp(t, "--out", out, in); code != 0 {
+		t.Fatalf("exit %d:\n%s", code, stderr)
+	}
+	// the outputs fed back in
+	stdout, stderr, code := runSnapstamp(t, "--json", "--out", filepath.Join(dir, "again"), out)
+	if code != 0 {
+		t.Fatalf("exit %d restamping:\n%s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	var summary map[string]any
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary["already_stamped"] != 2.0 || summary["written"] != 0.0 || summary["skipped"] != 0.0 {
+		t.Errorf("summary already_stamped %v, written %v, skipped %v; want 2, 0, 0", summary["already_stamped"], summary["written"], summary["skipped"])
+	}
+	for _, line := range lines[:len(lines)-1] {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec["status"] != "already-stamped" {
+			t.Errorf("%v: status %v, want already-stamped", rec["input"], rec["status"])
+		}
+	}
+}
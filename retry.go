@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+
+	"snapstamp/stamp"
+)
+
+// retryBackoff is the wait before the first retry; it doubles for each
+// further one.
+const retryBackoff = 500 * time.Millisecond
+
+// retryPolicy is --retries: how many more times an input is tried after
+// failing with what looks like a transient I/O error, such as a network
+// share dropping out.
+type retryPolicy struct {
+	max     int
+	verbose bool // log each retry
+}
+
+// do runs fn, and again after a backoff while it fails transiently and
+// retries are left. It returns the outcome of the last run and how many
+// times fn was retried. Cancelling ctx ends the wait with the last
+// outcome.
+func (p retryPolicy) do(ctx context.Context, in string, fn func() (stamp.Result, error)) (stamp.Result, int, error) {
+	res, err := fn()
+	retries := 0
+	for delay := retryBackoff; retries < p.max && transient(err); delay *= 2 {
+		if p.verbose {
+			log.Printf("retrying %s in %v: %v", in, delay, err)
+		}
+		select {
+		case <-ctx.Done():
+			return res, retries, err
+		case <-time.After(delay):
+		}
+		retries++
+		res, err = fn()
+	}
+	return res, retries, err
+}
+
+// transient reports whether err looks like a passing I/O failure worth
+// another try, rather than a problem with the file itself such as a
+// corrupt image, which fails the same way every time.
+func transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno.Timeout() || slices.Contains(transientErrnos, errno))
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// transientErrnos are the errors of reads and writes that may succeed when
+// tried again, typically on network file systems.
+var transientErrnos = []syscall.Errno{
+	syscall.EIO,
+	syscall.ESTALE, // NFS handle invalidated by the server
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// transientErrnos are the errors of reads and writes that may succeed when
+// tried again, typically on SMB shares.
+var transientErrnos = []syscall.Errno{
+	syscall.ERROR_NETNAME_DELETED,
+	54,   // ERROR_NETWORK_BUSY
+	59,   // ERROR_UNEXP_NET_ERR
+	121,  // ERROR_SEM_TIMEOUT
+	1117, // ERROR_IO_DEVICE
+}
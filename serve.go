@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"snapstamp/stamp"
+)
+
+// stampServer answers POST /stamp for snapstamp serve: the uploaded image,
+// as the raw body or the "image" field of a multipart form, comes back
+// stamped with the settings of the command line, which the query or form
+// parameters named like the flags can change per request.
+type stampServer struct {
+	base      stamp.Options
+	maxUpload int64 // bytes
+	quiet     bool
+}
+
+// serve runs the server on addr until ctx is cancelled, then waits for
+// the requests in progress.
+func serve(ctx context.Context, addr string, s *stampServer) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /stamp", s.stamp)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !s.quiet {
+		log.Printf("listening on %s, POST images to /stamp", ln.Addr())
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	return srv.Shutdown(context.Background())
+}
+
+// stamp handles one upload. The stamped image is buffered so a failure can
+// still be answered with an error status, and so its Content-Type is known.
+func (s *stampServer) stamp(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	// a raw body is read as the image whatever its Content-Type (curl
+	// --data-binary says application/x-www-form-urlencoded), so only a
+	// multipart form has parameters besides the query's
+	var in io.Reader = r.Body
+	params := r.URL.Query()
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		if err := r.ParseMultipartForm(s.maxUpload); err != nil {
+			s.fail(w, r, uploadStatus(err), fmt.Errorf("read form: %w", err))
+			return
+		}
+		f, _, err := r.FormFile("image")
+		if err != nil {
+			s.fail(w, r, http.StatusBadRequest, fmt.Errorf("form field image: %w", err))
+			return
+		}
+		defer f.Close()
+		in, params = f, r.Form
+	}
+	opts, err := requestOptions(params, s.base)
+	if err != nil {
+		s.fail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var out bytes.Buffer
+	res, err := stamp.Process(r.Context(), in, &out, opts)
+	switch {
+	case r.Context().Err() != nil:
+		return // the client is gone
+	case err != nil:
+		s.fail(w, r, uploadStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(out.Bytes()))
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	if res.DateSource != "" {
+		w.Header().Set("X-Snapstamp-Date-Source", res.DateSource)
+	}
+	if res.Position != "" {
+		w.Header().Set("X-Snapstamp-Position", res.Position)
+	}
+	if _, err := out.WriteTo(w); err != nil {
+		log.Printf("%s %s from %s: write response: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		return
+	}
+	if !s.quiet {
+		log.Printf("%s %s from %s: %s -> %s in %s", r.Method, r.URL.Path, r.RemoteAddr,
+			formatBytes(res.InSize), formatBytes(res.Size), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// fail answers the request with status and err, and logs it.
+func (s *stampServer) fail(w http.ResponseWriter, r *http.Request, status int, err error) {
+	log.Printf("%s %s from %s: %d %v", r.Method, r.URL.Path, r.RemoteAddr, status, err)
+	http.Error(w, err.Error(), status)
+}
+
+// uploadStatus returns the status answering a failure to read or stamp an
+// upload: too large, or not an image that can be stamped.
+func uploadStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// requestOptions returns base with the settings of a request's parameters:
+// margin, widthpercent, format, position, align, color and output-format,
+// taking the values of the flags of the same names.
+func requestOptions(params url.Values, base stamp.Options) (stamp.Options, error) {
+	opts := base
+	if v := params.Get("margin"); v != "" {
+		percent, px, err := parseMargin(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid margin %q: %v", v, err)
+		}
+		if percent > maxMarginPercent {
+			return opts, fmt.Errorf("invalid margin %q: want 0-%d percent, or pixels like 24px", v, maxMarginPercent)
+		}
+		opts.MarginPercent, opts.MarginPx = percent, px
+	}
+	if v := params.Get("widthpercent"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return opts, fmt.Errorf("invalid widthpercent %q: want 1-100", v)
+		}
+		opts.WidthPercent = n
+	}
+	if v := params.Get("format"); v != "" {
+		opts.DateLayout = resolveDateLayout(v)
+	}
+	if v := params.Get("position"); v != "" {
+		p, err := flag.Lookup("position").Value.(*enumValue).parse(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid position %q: %v", v, err)
+		}
+		opts.Position = p
+	}
+	if v := params.Get("align"); v != "" {
+		a, err := flag.Lookup("align").Value.(*enumValue).parse(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid align %q: %v", v, err)
+		}
+		opts.Align = a
+	}
+	if v := params.Get("output-format"); v != "" {
+		f, err := flag.Lookup("output-format").Value.(*enumValue).parse(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid output-format %q: %v", v, err)
+		}
+		opts.OutputFormat = f
+	}
+	if v := params.Get("color"); v != "" {
+		opts.AutoColor = strings.EqualFold(v, "auto")
+		if !opts.AutoColor {
+			c, err := parseColor(v)
+			if err != nil {
+				return opts, fmt.Errorf("invalid color: %v", err)
+			}
+			opts.TextColor = c
+		}
+	}
+	return opts, nil
+}
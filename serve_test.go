@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"snapstamp/stamp"
+)
+
+// uploadPNG returns a w x h PNG to upload.
+func uploadPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// multipartBody returns a form with data as its field named field.
+func multipartBody(t *testing.T, field string, data []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile(field, "upload.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	if err := mw.WriteField("margin", "2"); err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+	return &b, mw.FormDataContentType()
+}
+
+func TestServeStamp(t *testing.T) {
+	s := &stampServer{base: stamp.DefaultOptions(), maxUpload: 1 << 20, quiet: true}
+	img := uploadPNG(t, 120, 80)
+	form, formType := multipartBody(t, "image", img)
+	noField, noFieldType := multipartBody(t, "file", img)
+	tests := []struct {
+		name        string
+		query       string
+		body        []byte
+		contentType string
+		status      int
+	}{
+		{"raw body", "", img, "application/x-www-form-urlencoded", http.StatusOK},
+		{"raw body, parameters", "?margin=24px&widthpercent=50&color=auto", img, "image/png", http.StatusOK},
+		{"multipart", "", form.Bytes(), formType, http.StatusOK},
+		{"multipart without image", "", noField.Bytes(), noFieldType, http.StatusBadRequest},
+		{"bad margin", "?margin=lots", img, "image/png", http.StatusBadRequest},
+		{"margin too large", "?margin=90", img, "image/png", http.StatusBadRequest},
+		{"bad widthpercent", "?widthpercent=0", img, "image/png", http.StatusBadRequest},
+		{"not an image", "", []byte("hello"), "text/plain", http.StatusUnprocessableEntity},
+		{"too large", "", append(img, make([]byte, 1<<20)...), "image/png", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/stamp"+tt.query, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			s.stamp(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, bytes.TrimSpace(w.Body.Bytes()), tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+				t.Errorf("Content-Type %q, want image/png", ct)
+			}
+			cfg, err := png.DecodeConfig(w.Body)
+			if err != nil || cfg.Width != 120 || cfg.Height != 80 {
+				t.Errorf("response is a %dx%d image (%v), want the 120x80 upload", cfg.Width, cfg.Height, err)
+			}
+		})
+	}
+}
+
+func TestServeTooLargeMultipart(t *testing.T) {
+	s := &stampServer{base: stamp.DefaultOptions(), maxUpload: 1 << 10, quiet: true}
+	form, formType := multipartBody(t, "image", make([]byte, 1<<16))
+	r := httptest.NewRequest(http.MethodPost, "/stamp", form)
+	r.Header.Set("Content-Type", formType)
+	w := httptest.NewRecorder()
+	s.stamp(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	base := stamp.DefaultOptions()
+	opts, err := requestOptions(url.Values{"margin": {"24px"}, "widthpercent": {"60"}, "color": {"#ff0000"}, "format": {"2006"}}, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MarginPx != 24 || opts.WidthPercent != 60 || opts.DateLayout != "2006" {
+		t.Errorf("margin %dpx, widthpercent %d, format %q; want 24px, 60, 2006", opts.MarginPx, opts.WidthPercent, opts.DateLayout)
+	}
+	if c := color.RGBAModel.Convert(opts.TextColor).(color.RGBA); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("color %v, want red", c)
+	}
+	if opts, _ := requestOptions(url.Values{}, base); opts.MarginPercent != base.MarginPercent || opts.WidthPercent != base.WidthPercent {
+		t.Errorf("no parameters changed the options")
+	}
+	for _, params := range []url.Values{
+		{"margin": {"-3"}},
+		{"margin": {"12pt"}},
+		{"widthpercent": {"101"}},
+		{"widthpercent": {"half"}},
+		{"color": {"not-a-color"}},
+	} {
+		if _, err := requestOptions(params, base); err == nil {
+			t.Errorf("requestOptions(%v) succeeded, want an error", params)
+		}
+	}
+}
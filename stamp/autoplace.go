@@ -0,0 +1,95 @@
+package stamp
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math"
+)
+
+// autoPositions are the corners Options.Position "auto" chooses from, in
+// the order ties are broken.
+var autoPositions = []string{"bottom-right", "bottom-left", "top-right", "top-left"}
+
+// busynessSamples is the number of samples busyness takes along the longer
+// side of a region, which is as good as measuring a downscaled copy.
+const busynessSamples = 64
+
+// placeStamp lays out text on img within bounds, in the corner
+// pickPosition returns. A stamp whose lines would come out less than
+// Options.MinLineHeight pixels high is skipped with an error wrapping
+// ErrSkipped, or with Options.ForceMinLineHeight enlarged to that height.
+func placeStamp(name string, img image.Image, bounds image.Rectangle, text string, opts Options) (*stampLayout, string, error) {
+	l, position := pickPosition(name, img, bounds, text, opts)
+	if opts.MinLineHeight <= 0 || l.lineHeight >= opts.MinLineHeight {
+		return l, position, nil
+	}
+	if !opts.ForceMinLineHeight {
+		l.release()
+		return nil, "", fmt.Errorf("%w %s: the stamp would be %dpx high, below the minimum of %dpx", ErrSkipped, name, l.lineHeight, opts.MinLineHeight)
+	}
+	// the line height grows with the size; the bitmap font takes a size in pixels
+	size := float64(opts.MinLineHeight)
+	if l.size > 0 {
+		size = l.size * float64(opts.MinLineHeight) / float64(l.lineHeight)
+	}
+	if opts.Verbose {
+		log.Printf("%s: stamp enlarged from %dpx to the minimum of %dpx", name, l.lineHeight, opts.MinLineHeight)
+	}
+	l.release()
+	opts.FontSize, opts.HeightPercent, opts.Position = math.Ceil(size), 0, position
+	return layoutStamp(bounds, text, opts), position, nil
+}
+
+// pickPosition lays out text on img within bounds. With Options.Position
+// "auto" every corner is laid out and the one whose area, stamp and margin,
+// has the least detail wins; the corner used is returned either way.
+func pickPosition(name string, img image.Image, bounds image.Rectangle, text string, opts Options) (*stampLayout, string) {
+	if opts.Position != "auto" {
+		return layoutStamp(bounds, text, opts), opts.Position
+	}
+	var best *stampLayout
+	position, least := "", math.Inf(1)
+	for _, p := range autoPositions {
+		opts.Position = p
+		l := layoutStamp(bounds, text, opts)
+		area := l.rect().Inset(-l.lineHeight / 2).Intersect(bounds)
+		if score := busyness(img, area); score < least {
+			if best != nil {
+				best.release()
+			}
+			best, position, least = l, p, score
+		} else {
+			l.release()
+		}
+	}
+	if opts.Verbose {
+		log.Printf("%s: auto position: %s (busyness %.1f)", name, position, least)
+	}
+	return best, position
+}
+
+// busyness measures the detail of img within r as its mean luminance
+// gradient (0-510), sampled on a grid of at most busynessSamples along the
+// longer side: flat sky scores near 0, foliage, text and faces high.
+func busyness(img image.Image, r image.Rectangle) float64 {
+	r = r.Intersect(img.Bounds())
+	step := max(max(r.Dx(), r.Dy())/busynessSamples, 1)
+	if r.Dx() <= step || r.Dy() <= step {
+		return 0
+	}
+	luma := func(x, y int) float64 {
+		cr, cg, cb, _ := img.At(x, y).RGBA()
+		return (0.299*float64(cr) + 0.587*float64(cg) + 0.114*float64(cb)) / 257
+	}
+	var sum float64
+	n := 0
+	for y := r.Min.Y; y+step < r.Max.Y; y += step {
+		for x := r.Min.X; x+step < r.Max.X; x += step {
+			l := luma(x, y)
+			sum += math.Abs(luma(x+step, y)-l) + math.Abs(luma(x, y+step)-l)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,146 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBusyness(t *testing.T) {
+	r := image.Rect(0, 0, 400, 300)
+	checker := image.NewGray(r)
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			if (x/6+y/6)%2 == 0 {
+				checker.Pix[y*checker.Stride+x] = 255
+			}
+		}
+	}
+	flat, busy := busyness(solid(400, 300, color.RGBA{90, 140, 200, 255}), r), busyness(noise(400, 300), r)
+	if flat != 0 {
+		t.Errorf("flat image: busyness %.1f, want 0", flat)
+	}
+	if busy < 100 {
+		t.Errorf("noise: busyness %.1f, want it high", busy)
+	}
+	if c := busyness(checker, r); c < 50 {
+		t.Errorf("checkerboard: busyness %.1f, want it high", c)
+	}
+	if b := busyness(noise(400, 300), image.Rect(10, 10, 10, 300)); b != 0 {
+		t.Errorf("empty region: busyness %.1f", b)
+	}
+}
+
+func TestPickPosition(t *testing.T) {
+	const w, h = 400, 300
+	// halves returns a flat image with noise over the rectangles busy
+	halves := func(busy ...image.Rectangle) image.Image {
+		img := solid(w, h, color.RGBA{90, 140, 200, 255})
+		n := noise(w, h)
+		for _, r := range busy {
+			draw.Draw(img, r, n, r.Min, draw.Src)
+		}
+		return img
+	}
+	left, right := image.Rect(0, 0, w/2, h), image.Rect(w/2, 0, w, h)
+	top, bottom := image.Rect(0, 0, w, h/2), image.Rect(0, h/2, w, h)
+	tests := []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		{"busy left half", halves(left), "bottom-right"},
+		{"busy right half", halves(right), "bottom-left"},
+		{"busy bottom half", halves(bottom), "top-right"},
+		{"flat only top left", halves(right, bottom), "top-left"},
+		{"all flat, a tie", halves(), "bottom-right"},
+		{"busy top half", halves(top), "bottom-right"},
+	}
+	opts := DefaultOptions()
+	opts.Position = "auto"
+	for _, tt := range tests {
+		l, got := pickPosition("test", tt.img, tt.img.Bounds(), "2023-07-14 10:30", opts)
+		l.release()
+		if got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// the corner chosen is reported in the result
+	res, err := Process(context.Background(), bytes.NewReader(encodePNG(t, halves(right))), io.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Position != "bottom-left" {
+		t.Errorf("result position %q, want bottom-left", res.Position)
+	}
+}
+
+func TestMinLineHeight(t *testing.T) {
+	img := solid(160, 120, color.RGBA{90, 140, 200, 255})
+	opts := DefaultOptions()
+	opts.MinLineHeight = 24
+	if l, _, err := placeStamp("small.png", img, img.Bounds(), "2023-07-14 10:30", opts); err == nil {
+		t.Errorf("160x120: stamped with %dpx lines, want it skipped", l.lineHeight)
+		l.release()
+	} else if !errors.Is(err, ErrSkipped) {
+		t.Errorf("160x120: error %v, want it skipped", err)
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "small.png")
+	if err := os.WriteFile(in, encodePNG(t, img), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.png")
+	if _, err := ProcessFile(context.Background(), in, out, opts); !errors.Is(err, ErrSkipped) {
+		t.Errorf("ProcessFile of 160x120: %v, want it skipped", err)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("skipped file left an output: %v", err)
+	}
+
+	opts.ForceMinLineHeight = true
+	l, _, err := placeStamp("small.png", img, img.Bounds(), "2023-07-14 10:30", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.lineHeight < 24 {
+		t.Errorf("forced line height %d, want at least 24", l.lineHeight)
+	}
+	l.release()
+	if _, err := ProcessFile(context.Background(), in, out, opts); err != nil {
+		t.Errorf("ProcessFile with ForceMinLineHeight: %v", err)
+	}
+
+	// a 160x120 variant of a large image is stamped however small its text
+	in = filepath.Join(dir, "large.png")
+	if err := os.WriteFile(in, encodePNG(t, solid(1600, 1200, color.RGBA{90, 140, 200, 255})), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts = DefaultOptions()
+	opts.MinLineHeight = 24
+	opts.OutRoot = dir
+	opts.Variants = []Variant{{Name: "thumb", MaxDimension: 160}}
+	res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "large_out.png"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Variants) != 1 || res.Variants[0].Err != nil {
+		t.Fatalf("variants %+v", res.Variants)
+	}
+	f, err := os.Open(res.Variants[0].Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if cfg, _, err := image.DecodeConfig(f); err != nil || cfg.Width != 160 || cfg.Height != 120 {
+		t.Errorf("variant %dx%d, %v; want 160x120", cfg.Width, cfg.Height, err)
+	}
+}
@@ -0,0 +1,108 @@
+package stamp
+
+import (
+	"container/list"
+	"context"
+	"image"
+	"io"
+	"sync"
+)
+
+// bytesPerPixel estimates the memory stamping takes per pixel: the decoded
+// source (up to 4 bytes for 8-bit images), the RGBA canvas and the copy
+// orientImage makes of rotated photos.
+const bytesPerPixel = 12
+
+// MemoryBudget bounds the memory taken by images being stamped at once.
+// Concurrent ProcessFile and Process calls sharing one budget wait before
+// decoding until their image fits, so large images are stamped one after
+// another while small ones still run in parallel. Waiters are served in
+// order; an image larger than the whole budget runs alone.
+type MemoryBudget struct {
+	mu      sync.Mutex
+	size    int64
+	used    int64
+	waiters list.List // of *budgetWaiter
+}
+
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// NewMemoryBudget returns a budget of bytes shared by whoever uses it.
+func NewMemoryBudget(bytes int64) *MemoryBudget {
+	return &MemoryBudget{size: max(bytes, 1)}
+}
+
+// DefaultMemoryBudget returns half the memory available on this machine,
+// leaving room for the garbage collector, or 0 when that is unknown.
+func DefaultMemoryBudget() int64 {
+	return availableMemory() / 2
+}
+
+// acquire reads the image size from the header of r and waits until the
+// budget has room for it. The returned release must be called once the
+// image is written. An unreadable header takes nothing: decoding reports
+// it. A nil budget never waits.
+func (b *MemoryBudget) acquire(ctx context.Context, r io.ReadSeeker) (release func(), err error) {
+	if b == nil {
+		return func() {}, nil
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return func() {}, nil
+	}
+	n := min(int64(cfg.Width)*int64(cfg.Height)*bytesPerPixel, b.size)
+	release = func() { b.release(n) }
+
+	b.mu.Lock()
+	if b.waiters.Len() == 0 && b.used+n <= b.size {
+		b.used += n
+		b.mu.Unlock()
+		return release, nil
+	}
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	e := b.waiters.PushBack(w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// granted meanwhile: give it back
+			b.used -= n
+		default:
+			b.waiters.Remove(e)
+		}
+		b.grantLocked()
+		b.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (b *MemoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.grantLocked()
+	b.mu.Unlock()
+}
+
+// grantLocked lets waiters in, in order, while the first one fits.
+func (b *MemoryBudget) grantLocked() {
+	for e := b.waiters.Front(); e != nil; e = b.waiters.Front() {
+		w := e.Value.(*budgetWaiter)
+		if b.used+w.n > b.size {
+			return
+		}
+		b.used += w.n
+		b.waiters.Remove(e)
+		close(w.ready)
+	}
+}
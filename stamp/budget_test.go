@@ -0,0 +1,134 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queued waits until n callers are waiting for b.
+func queued(t *testing.T, b *MemoryBudget, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		got := b.waiters.Len()
+		b.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiting for the budget, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryBudgetSerializes(t *testing.T) {
+	// a budget smaller than a single image: each runs alone, in the order
+	// they asked
+	b := NewMemoryBudget(100)
+	img := encodePNG(t, solid(64, 48, color.White))
+	acquire := func() func() {
+		release, err := b.acquire(context.Background(), bytes.NewReader(img))
+		if err != nil {
+			t.Error(err)
+			return func() {}
+		}
+		return release
+	}
+
+	first := acquire()
+	granted := make(chan int)
+	releases := make([]func(), 3)
+	for i := range releases {
+		go func() {
+			releases[i] = acquire()
+			granted <- i
+		}()
+		queued(t, b, i+1)
+	}
+	select {
+	case i := <-granted:
+		t.Fatalf("image %d started while the first holds the budget", i)
+	case <-time.After(20 * time.Millisecond):
+	}
+	first()
+	for want := range releases {
+		select {
+		case i := <-granted:
+			if i != want {
+				t.Fatalf("image %d started, want %d", i, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("image %d never started", want)
+		}
+		select {
+		case i := <-granted:
+			t.Fatalf("image %d started alongside %d", i, want)
+		case <-time.After(20 * time.Millisecond):
+		}
+		releases[want]()
+	}
+}
+
+func TestMemoryBudgetCancel(t *testing.T) {
+	b := NewMemoryBudget(100)
+	img := encodePNG(t, solid(64, 48, color.White))
+	first, err := b.acquire(context.Background(), bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := b.acquire(ctx, bytes.NewReader(img))
+		errc <- err
+	}()
+	queued(t, b, 1)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("cancelled wait: %v, want context.Canceled", err)
+	}
+	first()
+	// the cancelled waiter holds nothing back
+	release, err := b.acquire(context.Background(), bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if b.used != 0 || b.waiters.Len() != 0 {
+		t.Errorf("%d bytes used, %d waiting after all released", b.used, b.waiters.Len())
+	}
+}
+
+func TestMemoryBudgetProcess(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Memory = NewMemoryBudget(1)
+	in := dated(t, 64, 48, "2023:07:14 10:30:05")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			var out bytes.Buffer
+			if _, err := Process(context.Background(), bytes.NewReader(in), &out, opts); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("stamping with a 1-byte budget deadlocked")
+	}
+	if opts.Memory.used != 0 {
+		t.Errorf("%d bytes of the budget still used", opts.Memory.used)
+	}
+}
@@ -0,0 +1,72 @@
+package stamp
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Stamping draws on an RGBA canvas, or an RGBA64 one for 16-bit sources,
+// whatever the color model of the source, which only matters at both ends:
+//
+//   - 16-bit PNGs are stamped on an RGBA64 canvas and written back with 16
+//     bits per channel, unless the output is JPEG, which has 8.
+//   - Grayscale sources (*image.Gray, *image.Gray16) are written back as a
+//     one-channel JPEG or gray PNG, a third the size of the YCbCr JPEG the
+//     RGBA canvas would encode to. The stamp colors become their luminance.
+//   - CMYK JPEGs (*image.CMYK, from print workflows) are converted to RGB
+//     with R = (1-C)(1-K) and likewise for G and B; image/jpeg has already
+//     undone the inverted values Adobe writes. Without a color management
+//     module the source's CMYK profile can't be applied, so it is dropped:
+//     labelled with it, the RGB output would show the colors far off.
+
+// isGray reports whether img is one of the grayscale types the decoders
+// return.
+func isGray(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// is16Bit reports whether img has 16 bits per channel, as PNGs of bit
+// depth 16 decode.
+func is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// newCanvas returns a canvas of bounds r as deep as img: RGBA64 for 16-bit
+// images, RGBA otherwise. RGBA pixels may be left over from an earlier
+// image (see newRGBA).
+func newCanvas(img image.Image, r image.Rectangle) draw.Image {
+	if is16Bit(img) {
+		return image.NewRGBA64(r)
+	}
+	return newRGBA(r)
+}
+
+// grayImage converts the stamped canvas of a grayscale source back to one
+// channel of the same depth, using the luminance weights of
+// color.GrayModel. The canvas is recycled.
+func grayImage(canvas image.Image) image.Image {
+	var gray draw.Image = image.NewGray(canvas.Bounds())
+	if is16Bit(canvas) {
+		gray = image.NewGray16(canvas.Bounds())
+	}
+	draw.Draw(gray, gray.Bounds(), canvas, canvas.Bounds().Min, draw.Src)
+	recycle(canvas)
+	return gray
+}
+
+// iccColorSpace returns the data color space in the header of an ICC
+// profile ("RGB ", "GRAY", "CMYK", ...), or "" if it is too short.
+func iccColorSpace(profile []byte) string {
+	if len(profile) < 20 {
+		return ""
+	}
+	return string(profile[16:20])
+}
@@ -0,0 +1,191 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stampedPixels counts the pixels of img more than 40 levels from bg in
+// any channel.
+func stampedPixels(img image.Image, bg color.Color) int {
+	br, bgr, bb, _ := bg.RGBA()
+	far := func(a, b uint32) bool { return a>>8 > b>>8+40 || b>>8 > a>>8+40 }
+	n := 0
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			if far(r, br) || far(g, bgr) || far(b, bb) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestGrayJPEG(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.jpg")
+	gray := image.NewGray(image.Rect(0, 0, 320, 240))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i % 320 / 2)
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, gray, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(in, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "out.jpg"), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(res.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := out.(*image.Gray)
+	if !ok {
+		t.Fatalf("gray input written as %T", out)
+	}
+	changed := 0
+	for i := range g.Pix {
+		if d := int(g.Pix[i]) - int(gray.Pix[i]); d > 40 || d < -40 {
+			changed++
+		}
+	}
+	if changed == 0 {
+		t.Errorf("no stamp on the gray output")
+	}
+
+	// the same pixels in color take more room
+	rgba := image.NewRGBA(g.Bounds())
+	for i, v := range g.Pix {
+		copy(rgba.Pix[4*i:], []byte{v, v, v, 255})
+	}
+	b.Reset()
+	if err := jpeg.Encode(&b, rgba, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= b.Len() {
+		t.Errorf("gray output of %d bytes, the color encoding is %d", len(data), b.Len())
+	}
+}
+
+func TestCMYKJPEG(t *testing.T) {
+	// testdata/cmyk.jpg is an Adobe CMYK JPEG of C=200 M=20 Y=0 K=0; a CMYK
+	// profile doesn't describe the RGB output and is dropped
+	data, err := os.ReadFile(filepath.Join("testdata", "cmyk.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := testProfile(500)
+	copy(profile[16:], "CMYK")
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.jpg")
+	if err := os.WriteFile(in, withICC(t, data, profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "out.jpg"), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(res.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out.(*image.CMYK); ok {
+		t.Fatalf("CMYK input written as CMYK")
+	}
+	// (1-C)(1-K) and so on, in 8 bits
+	want := color.RGBA{55, 235, 255, 255}
+	if got := color.RGBAModel.Convert(out.At(1, 1)).(color.RGBA); abs(int(got.R)-int(want.R)) > 4 || abs(int(got.G)-int(want.G)) > 4 || abs(int(got.B)-int(want.B)) > 4 {
+		t.Errorf("background %v, want about %v", got, want)
+	}
+	if stampedPixels(out, want) == 0 {
+		t.Errorf("no stamp on the CMYK output")
+	}
+	m, err := readJPEGMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.icc != nil {
+		t.Errorf("CMYK profile kept on the RGB output")
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func TestPNGBitDepth(t *testing.T) {
+	rect := image.Rect(0, 0, 320, 240)
+	rgba64 := image.NewNRGBA64(rect)
+	gray16 := image.NewGray16(rect)
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			v := uint16(x*200 + y) // the low byte matters
+			rgba64.SetNRGBA64(x, y, color.NRGBA64{v, v / 2, 0x1234, 0xFFFF})
+			gray16.SetGray16(x, y, color.Gray16{v})
+		}
+	}
+	tests := []struct {
+		name      string
+		img       image.Image
+		depth     byte
+		colorType byte // of the PNG IHDR: 0 gray, 2 RGB, 6 RGBA
+	}{
+		{"nrgba64", rgba64, 16, 2},
+		{"gray16", gray16, 16, 0},
+		{"rgba", solid(320, 240, color.RGBA{200, 60, 30, 255}), 8, 2},
+		{"gray", image.NewGray(rect), 8, 0},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		in := filepath.Join(dir, tt.name+".png")
+		if err := os.WriteFile(in, encodePNG(t, tt.img), 0644); err != nil {
+			t.Fatal(err)
+		}
+		res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "out.png"), DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, err := os.ReadFile(res.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) < 26 || data[24] != tt.depth || data[25] != tt.colorType {
+			t.Errorf("%s: output IHDR %v, want bit depth %d, color type %d", tt.name, data[24:26], tt.depth, tt.colorType)
+		}
+		if tt.depth != 16 {
+			continue
+		}
+		out, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the top left corner is clear of the stamp
+		r1, g1, b1, _ := tt.img.At(3, 5).RGBA()
+		if r2, g2, b2, _ := out.At(3, 5).RGBA(); r1 != r2 || g1 != g2 || b1 != b2 {
+			t.Errorf("%s: pixel %04x,%04x,%04x became %04x,%04x,%04x", tt.name, r1, g1, b1, r2, g2, b2)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+// Package stamp draws the capture date of a photo, read from its EXIF, onto
+// the image, the way a film camera's date back did.
+//
+// ProcessFile stamps a file into another file; Process works on streams.
+// Both take Options, best started from DefaultOptions:
+//
+//	opts := stamp.DefaultOptions()
+//	opts.Fonts = []*opentype.Font{f} // from LoadFont
+//	res, err := stamp.ProcessFile(ctx, "IMG_0001.jpg", "IMG_0001_timestamped.jpg", opts)
+package stamp
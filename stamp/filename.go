@@ -0,0 +1,126 @@
+package stamp
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultNamePatterns are the file name shapes Options.NamePatterns
+// recognizes by default, most specific first: camera and phone names with a
+// time (IMG_20230714_103005, PXL_20230714_013005123, 20230714_103005),
+// screenshots and exports with a separated time (Screenshot_2023-07-14-10-30-05,
+// "2023-07-14 at 10.30.05"), then date-only names (IMG-20230714-WA0001,
+// 2023-07-14).
+var DefaultNamePatterns = []*regexp.Regexp{
+	// Pixel names are in UTC
+	regexp.MustCompile(`^(?P<utc>PXL)_(?P<Y>(?:19|20)\d\d)(?P<m>\d\d)(?P<d>\d\d)_(?P<H>\d\d)(?P<M>\d\d)(?P<S>\d\d)(?P<ms>\d{3})?`),
+	regexp.MustCompile(`(?:^|\D)(?P<Y>(?:19|20)\d\d)(?P<m>\d\d)(?P<d>\d\d)[_-]?(?P<H>\d\d)(?P<M>\d\d)(?P<S>\d\d)(?P<ms>\d{3})?(?:\D|$)`),
+	regexp.MustCompile(`(?:^|\D)(?P<Y>(?:19|20)\d\d)-(?P<m>\d\d)-(?P<d>\d\d)(?:[ _-]|[ _]at[ _])(?P<H>\d\d)[.:-](?P<M>\d\d)[.:-](?P<S>\d\d)(?:\D|$)`),
+	regexp.MustCompile(`(?:^|\D)(?P<Y>(?:19|20)\d\d)(?P<m>\d\d)(?P<d>\d\d)-WA\d+`),
+	regexp.MustCompile(`(?:^|\D)(?P<Y>(?:19|20)\d\d)-(?P<m>\d\d)-(?P<d>\d\d)(?:\D|$)`),
+	regexp.MustCompile(`(?:^|\D)(?P<Y>(?:19|20)\d\d)(?P<m>\d\d)(?P<d>\d\d)(?:\D|$)`),
+}
+
+// filenameDate returns the date encoded in the file name base (without
+// extension) by the first matching pattern, in loc unless the pattern has a
+// matching "utc" group. Patterns name their groups Y, m and d, and
+// optionally H, M, S and ms. A match that isn't a real date is passed over.
+func filenameDate(base string, patterns []*regexp.Regexp, loc *time.Location) (t time.Time, subsec string, ok bool) {
+	for _, re := range patterns {
+		m := re.FindStringSubmatch(base)
+		if m == nil {
+			continue
+		}
+		group := func(name string) string {
+			if i := re.SubexpIndex(name); i >= 0 {
+				return m[i]
+			}
+			return ""
+		}
+		num := func(name string) int {
+			n, _ := strconv.Atoi(group(name))
+			return n
+		}
+		zone := loc
+		if group("utc") != "" {
+			zone = time.UTC
+		}
+		y, mo, d, h, mi, s := num("Y"), num("m"), num("d"), num("H"), num("M"), num("S")
+		t := time.Date(y, time.Month(mo), d, h, mi, s, 0, zone)
+		// time.Date normalizes overflow: 2023-02-30 would become March 2
+		if t.Year() != y || int(t.Month()) != mo || t.Day() != d || t.Hour() != h || t.Minute() != mi || t.Second() != s {
+			continue
+		}
+		return t.In(loc), group("ms"), true
+	}
+	return time.Time{}, "", false
+}
+
+// ValidNamePattern reports whether re has the groups a custom
+// Options.NamePatterns entry needs: Y, m and d.
+func ValidNamePattern(re *regexp.Regexp) bool {
+	return re.SubexpIndex("Y") >= 0 && re.SubexpIndex("m") >= 0 && re.SubexpIndex("d") >= 0
+}
+
+// maxNameBytes caps the names safeFilename makes, below the 255 bytes most
+// file systems allow, leaving room for the extension and a _N suffix.
+const maxNameBytes = 200
+
+// windowsReserved are the device names Windows refuses as file names,
+// with or without an extension.
+var windowsReserved = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// safeFilename makes s usable as a file name (without extension) on the
+// platform, keeping any other letters: it is normalized to NFC, so names
+// from macOS and Linux agree, path separators and control characters
+// become '_', and for windows so do the characters it forbids, trailing
+// dots and spaces are dropped and reserved device names get a '_' suffix.
+// The result is cut to maxNameBytes on a rune boundary.
+func safeFilename(s string, windows bool) string {
+	s = norm.NFC.String(s)
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '/', unicode.IsControl(r), windows && strings.ContainsRune(`\:*?"<>|`, r):
+			r = '_'
+		}
+		if b.Len()+utf8.RuneLen(r) > maxNameBytes {
+			break
+		}
+		b.WriteRune(r)
+	}
+	name := b.String()
+	if windows {
+		name = strings.TrimRight(name, ". ")
+		stem, _, _ := strings.Cut(name, ".")
+		if slices.ContainsFunc(windowsReserved, func(d string) bool { return strings.EqualFold(stem, d) }) {
+			name = stem + "_" + name[len(stem):]
+		}
+	}
+	return name
+}
+
+// asciiFilename replaces all but ASCII letters, digits, '-', '_' and '.'
+// in s with '_'.
+func asciiFilename(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
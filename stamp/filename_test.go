@@ -0,0 +1,104 @@
+package stamp
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFilenameDate(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*3600)
+	tests := []struct {
+		base   string
+		want   string // RFC 3339 in tokyo; "" for no date
+		subsec string
+	}{
+		// one per default pattern, in order
+		{"PXL_20230714_013005123", "2023-07-14T10:30:05+09:00", "123"},
+		{"IMG_20230714_103005", "2023-07-14T10:30:05+09:00", ""},
+		{"20230714_103005", "2023-07-14T10:30:05+09:00", ""},
+		{"VID_20230714-103005123", "2023-07-14T10:30:05+09:00", "123"},
+		{"Screenshot_2023-07-14-10-30-05", "2023-07-14T10:30:05+09:00", ""},
+		{"Screen Shot 2023-07-14 at 10.30.05", "2023-07-14T10:30:05+09:00", ""},
+		{"IMG-20230714-WA0001", "2023-07-14T00:00:00+09:00", ""},
+		{"holiday 2023-07-14", "2023-07-14T00:00:00+09:00", ""},
+		{"scan_20230714", "2023-07-14T00:00:00+09:00", ""},
+
+		// not dates
+		{"IMG_0042", "", ""},
+		{"DSC_20231345_103005", "", ""},
+		{"2023-02-30", "", ""},
+		{"IMG_20230714_256161", "2023-07-14T00:00:00+09:00", ""}, // the time is invalid, the date alone still matches
+		{"18990101_120000", "", ""},
+		{"120230714", "", ""},
+	}
+	for _, tt := range tests {
+		got, subsec, ok := filenameDate(tt.base, DefaultNamePatterns, tokyo)
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("filenameDate(%q) = %v, want no date", tt.base, got)
+		case tt.want != "" && !ok:
+			t.Errorf("filenameDate(%q) found no date, want %s", tt.base, tt.want)
+		case ok && (got.Format(time.RFC3339) != tt.want || subsec != tt.subsec):
+			t.Errorf("filenameDate(%q) = %s, %q; want %s, %q", tt.base, got.Format(time.RFC3339), subsec, tt.want, tt.subsec)
+		}
+	}
+}
+
+func TestCustomNamePattern(t *testing.T) {
+	re := regexp.MustCompile(`^scan(?P<d>\d\d)(?P<m>\d\d)(?P<Y>\d{4})$`)
+	if !ValidNamePattern(re) {
+		t.Fatal("pattern with Y, m and d rejected")
+	}
+	got, _, ok := filenameDate("scan14072023", []*regexp.Regexp{re}, time.UTC)
+	if !ok || got.Format(time.DateOnly) != "2023-07-14" {
+		t.Errorf("custom pattern: %v, %v; want 2023-07-14", got, ok)
+	}
+	if ValidNamePattern(regexp.MustCompile(`(?P<Y>\d{4})(?P<m>\d\d)`)) {
+		t.Errorf("pattern without d accepted")
+	}
+}
+
+func TestSafeFilename(t *testing.T) {
+	tests := []struct {
+		s       string
+		windows bool
+		want    string
+	}{
+		{"2023-07-14 京都", false, "2023-07-14 京都"},
+		{"Café", false, "Café"},
+		{"Cafe\u0301", false, "Caf\u00e9"}, // macOS decomposes, NFC composes
+		{"a/b\x00c\td", false, "a_b_c_d"},
+		{`a\b:c*d?e"f<g>h|i`, false, `a\b:c*d?e"f<g>h|i`},
+		{`a\b:c*d?e"f<g>h|i`, true, "a_b_c_d_e_f_g_h_i"},
+		{"trailing. .", false, "trailing. ."},
+		{"trailing. .", true, "trailing"},
+		{"CON", false, "CON"},
+		{"CON", true, "CON_"},
+		{"con", true, "con_"},
+		{"Con.tar", true, "Con_.tar"},
+		{"LPT9.", true, "LPT9_"},
+		{"CONSOLE", true, "CONSOLE"},
+		{"COM10", true, "COM10"},
+	}
+	for _, tt := range tests {
+		if got := safeFilename(tt.s, tt.windows); got != tt.want {
+			t.Errorf("safeFilename(%q, %v) = %q, want %q", tt.s, tt.windows, got, tt.want)
+		}
+	}
+
+	// cut to maxNameBytes on a rune boundary
+	long := strings.Repeat("京", 100) // 300 bytes
+	got := safeFilename(long, false)
+	if len(got) > maxNameBytes || !utf8.ValidString(got) || len(got) < maxNameBytes-2 {
+		t.Errorf("safeFilename of %d bytes: %d bytes, valid UTF-8 %v", len(long), len(got), utf8.ValidString(got))
+	}
+}
+
+func TestASCIIFilename(t *testing.T) {
+	if got := asciiFilename("2023-07-14 京都.v1"); got != "2023-07-14___.v1" {
+		t.Errorf("asciiFilename = %q", got)
+	}
+}
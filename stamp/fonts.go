@@ -0,0 +1,277 @@
+package stamp
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// LoadFont reads a .ttf, .otf or .ttc font file. For collections, index picks
+// the face; single-face files only accept index 0.
+func LoadFont(path string, index int) (*opentype.Font, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("font file not found: %s", path)
+		}
+		return nil, fmt.Errorf("failed to read font %s: %w", path, err)
+	}
+	// ParseCollection also accepts single-face fonts as a collection of one
+	coll, err := opentype.ParseCollection(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font %s: %w", path, err)
+	}
+	if n := coll.NumFonts(); index < 0 || index >= n {
+		return nil, fmt.Errorf("font index %d out of range for %s (it has %d face(s))", index, path, n)
+	}
+	ft, err := coll.Font(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font %s face %d: %w", path, index, err)
+	}
+	return ft, nil
+}
+
+// faceKey identifies a cached face: the whole font chain, since callers
+// of the library and requests to serve may each pass their own, and the
+// size.
+type faceKey struct {
+	chain string // see chainKey
+	size  float64
+}
+
+// chainKey identifies a font chain by the fonts in it, in order.
+func chainKey(fonts []*opentype.Font) string {
+	var b strings.Builder
+	for _, ft := range fonts {
+		fmt.Fprintf(&b, "%p;", ft)
+	}
+	return b.String()
+}
+
+// maxFacePools bounds the face cache. Sizing an image tries a dozen sizes,
+// so a long-running serve or watch sees new ones with every image size;
+// the least recently used are dropped.
+const maxFacePools = 256
+
+// faceCache keeps idle faces per chain and size so that batches of
+// same-sized images reuse the faces built for the first one. Faces are not
+// safe for concurrent use, hence a pool per key instead of a single face.
+var faceCache = struct {
+	sync.Mutex
+	pools map[faceKey]*list.Element // of *facePoolEntry
+	lru   list.List                 // most recently used first
+}{pools: map[faceKey]*list.Element{}}
+
+type facePoolEntry struct {
+	key  faceKey
+	pool sync.Pool
+}
+
+func facePool(fonts []*opentype.Font, size float64) *sync.Pool {
+	key := faceKey{chainKey(fonts), size}
+	faceCache.Lock()
+	defer faceCache.Unlock()
+	if e := faceCache.pools[key]; e != nil {
+		faceCache.lru.MoveToFront(e)
+		return &e.Value.(*facePoolEntry).pool
+	}
+	if faceCache.lru.Len() >= maxFacePools {
+		oldest := faceCache.lru.Back()
+		faceCache.lru.Remove(oldest)
+		delete(faceCache.pools, oldest.Value.(*facePoolEntry).key)
+	}
+	entry := &facePoolEntry{key: key}
+	faceCache.pools[key] = faceCache.lru.PushFront(entry)
+	return &entry.pool
+}
+
+// acquireFace returns a face from the cache, or a new one. Hand it back with
+// releaseFace once done drawing.
+func acquireFace(fonts []*opentype.Font, size float64) (font.Face, error) {
+	if f, ok := facePool(fonts, size).Get().(font.Face); ok {
+		return f, nil
+	}
+	return newFace(fonts, size)
+}
+
+// releaseFace returns a face obtained from acquireFace to the cache.
+func releaseFace(fonts []*opentype.Font, size float64, f font.Face) {
+	facePool(fonts, size).Put(f)
+}
+
+// newFace creates a face of the given size in points for a font chain. A
+// chain of more than one font yields a fallbackFace.
+func newFace(fonts []*opentype.Font, size float64) (font.Face, error) {
+	faces := make([]font.Face, 0, len(fonts))
+	for _, ft := range fonts {
+		f, err := opentype.NewFace(ft, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+		faces = append(faces, f)
+	}
+	if len(faces) == 1 {
+		return faces[0], nil
+	}
+	return &fallbackFace{fonts: fonts, faces: faces}, nil
+}
+
+// fallbackFace is a font.Face that renders each rune with the first face in
+// the chain whose font has a glyph for it, falling back to the first face.
+// Like the faces it wraps, it is not safe for concurrent use.
+type fallbackFace struct {
+	fonts []*opentype.Font
+	faces []font.Face
+	buf   sfnt.Buffer
+}
+
+// pick returns the face to use for r.
+func (f *fallbackFace) pick(r rune) font.Face {
+	for i, ft := range f.fonts {
+		if gi, err := ft.GlyphIndex(&f.buf, r); err == nil && gi != 0 {
+			return f.faces[i]
+		}
+	}
+	return f.faces[0]
+}
+
+func (f *fallbackFace) Close() error {
+	for _, face := range f.faces {
+		face.Close()
+	}
+	return nil
+}
+
+func (f *fallbackFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	return f.pick(r).Glyph(dot, r)
+}
+
+func (f *fallbackFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	return f.pick(r).GlyphBounds(r)
+}
+
+func (f *fallbackFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	return f.pick(r).GlyphAdvance(r)
+}
+
+// Kern only applies between runes rendered by the same face.
+func (f *fallbackFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	a, b := f.pick(r0), f.pick(r1)
+	if a != b {
+		return 0
+	}
+	return a.Kern(r0, r1)
+}
+
+// Metrics uses the largest ascent and descent in the chain so lines mixing
+// faces don't overlap.
+func (f *fallbackFace) Metrics() font.Metrics {
+	m := f.faces[0].Metrics()
+	for _, face := range f.faces[1:] {
+		fm := face.Metrics()
+		m.Ascent = max(m.Ascent, fm.Ascent)
+		m.Descent = max(m.Descent, fm.Descent)
+		m.Height = max(m.Height, fm.Height)
+	}
+	return m
+}
+
+// scaledFace enlarges a bitmap face by an integer factor using
+// nearest-neighbor sampling, so the built-in font stays crisp at any size.
+type scaledFace struct {
+	font.Face
+	scale int
+}
+
+func (f *scaledFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	dr, mask, mp, advance, ok := f.Face.Glyph(fixed.Point26_6{}, r)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+	s := f.scale
+	m := image.NewAlpha(image.Rect(0, 0, dr.Dx()*s, dr.Dy()*s))
+	for y := 0; y < m.Rect.Dy(); y++ {
+		for x := 0; x < m.Rect.Dx(); x++ {
+			_, _, _, a := mask.At(mp.X+x/s, mp.Y+y/s).RGBA()
+			m.Pix[y*m.Stride+x] = uint8(a >> 8)
+		}
+	}
+	origin := image.Pt(dot.X.Round(), dot.Y.Round())
+	dr = image.Rectangle{Min: dr.Min.Mul(s), Max: dr.Max.Mul(s)}.Add(origin)
+	return dr, m, image.Point{}, advance * fixed.Int26_6(s), true
+}
+
+func (f *scaledFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	b, advance, ok := f.Face.GlyphBounds(r)
+	s := fixed.Int26_6(f.scale)
+	b.Min.X, b.Min.Y, b.Max.X, b.Max.Y = b.Min.X*s, b.Min.Y*s, b.Max.X*s, b.Max.Y*s
+	return b, advance * s, ok
+}
+
+func (f *scaledFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	advance, ok := f.Face.GlyphAdvance(r)
+	return advance * fixed.Int26_6(f.scale), ok
+}
+
+func (f *scaledFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	return f.Face.Kern(r0, r1) * fixed.Int26_6(f.scale)
+}
+
+func (f *scaledFace) Metrics() font.Metrics {
+	m := f.Face.Metrics()
+	s := fixed.Int26_6(f.scale)
+	m.Height *= s
+	m.Ascent *= s
+	m.Descent *= s
+	m.XHeight *= s
+	m.CapHeight *= s
+	return m
+}
+
+// FindSystemFont searches common system font directories for the given
+// filename (case-insensitive) and returns its path, or "" when not found.
+func FindSystemFont(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, d := range SystemFontDirs() {
+		fpath := filepath.Join(d, filename)
+		if _, err := os.Stat(fpath); err == nil {
+			return fpath
+		}
+		// try case-insensitive scan
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if strings.ToLower(e.Name()) == lower {
+				return filepath.Join(d, e.Name())
+			}
+		}
+	}
+	return ""
+}
+
+// SystemFontDirs lists the directories FindSystemFont searches on this OS.
+func SystemFontDirs() []string {
+	switch runtime.GOOS {
+	case "windows":
+		return []string{"C:\\Windows\\Fonts"}
+	case "darwin":
+		return []string{"/System/Library/Fonts", "/Library/Fonts", filepath.Join(os.Getenv("HOME"), "Library/Fonts")}
+	default:
+		// linux/unix
+		return []string{"/usr/share/fonts", "/usr/local/share/fonts", filepath.Join(os.Getenv("HOME"), ".fonts")}
+	}
+}
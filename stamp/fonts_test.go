@@ -0,0 +1,148 @@
+package stamp
+
+import (
+	"encoding/binary"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+)
+
+// buildTTC returns a font collection of the single-face fonts, moving the
+// table offsets of each, which count from the start of the file.
+func buildTTC(fonts ...[]byte) []byte {
+	b := []byte("ttcf\x00\x01\x00\x00")
+	b = binary.BigEndian.AppendUint32(b, uint32(len(fonts)))
+	dirs := len(b)
+	b = append(b, make([]byte, 4*len(fonts))...)
+	for i, f := range fonts {
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		base := len(b)
+		binary.BigEndian.PutUint32(b[dirs+4*i:], uint32(base))
+		b = append(b, f...)
+		for t := 0; t < int(binary.BigEndian.Uint16(f[4:])); t++ {
+			off := base + 12 + 16*t + 8
+			binary.BigEndian.PutUint32(b[off:], binary.BigEndian.Uint32(b[off:])+uint32(base))
+		}
+	}
+	return b
+}
+
+func TestLoadFont(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	ttc := write("go.ttc", buildTTC(goregular.TTF, gobold.TTF))
+	ttf := write("go.ttf", goregular.TTF)
+	broken := write("broken.ttf", []byte("not a font at all"))
+
+	tests := []struct {
+		path  string
+		index int
+		name  string // full name of the face; "" for an error
+		err   string // part of the error
+	}{
+		{ttc, 0, "Go Regular", ""},
+		{ttc, 1, "Go Bold", ""},
+		{ttc, 2, "", "out of range"},
+		{ttc, -1, "", "out of range"},
+		{ttf, 0, "Go Regular", ""},
+		{ttf, 1, "", "out of range"},
+		{broken, 0, "", "failed to parse"},
+		{filepath.Join(dir, "missing.ttf"), 0, "", "not found"},
+	}
+	for _, tt := range tests {
+		f, err := LoadFont(tt.path, tt.index)
+		if tt.name == "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s face %d: error %v, want %q", filepath.Base(tt.path), tt.index, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s face %d: %v", filepath.Base(tt.path), tt.index, err)
+			continue
+		}
+		if name, err := f.Name(nil, sfnt.NameIDFull); err != nil || name != tt.name {
+			t.Errorf("%s face %d: %q, %v; want %s", filepath.Base(tt.path), tt.index, name, err, tt.name)
+		}
+	}
+}
+
+// BenchmarkFaceCache lays out the stamps of 100 same-sized images with the
+// face cache, and with it emptied before every image as if there were none.
+func BenchmarkFaceCache(b *testing.B) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Fonts = []*opentype.Font{f}
+	bounds := image.Rect(0, 0, 4000, 3000)
+	for _, cached := range []bool{true, false} {
+		b.Run(map[bool]string{true: "cached", false: "uncached"}[cached], func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				for range 100 {
+					if !cached {
+						faceCache.Lock()
+						clear(faceCache.pools)
+						faceCache.lru.Init()
+						faceCache.Unlock()
+					}
+					layoutStamp(bounds, "2023-07-14 10:30", opts).release()
+				}
+			}
+		})
+	}
+}
+
+func TestFaceCacheChains(t *testing.T) {
+	var fonts []*opentype.Font
+	for _, ttf := range [][]byte{goregular.TTF, gobold.TTF, gomono.TTF} {
+		f, err := opentype.Parse(ttf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fonts = append(fonts, f)
+	}
+	// the same first font and length, different fallbacks
+	a, b := []*opentype.Font{fonts[0], fonts[1]}, []*opentype.Font{fonts[0], fonts[2]}
+	fa, err := acquireFace(a, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseFace(a, 20, fa)
+	fb, err := acquireFace(b, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseFace(b, 20, fb)
+	if ff, ok := fb.(*fallbackFace); !ok || ff.fonts[1] != fonts[2] {
+		t.Errorf("face for the chain with Go Mono falls back to another chain's font")
+	}
+
+	for i := range 2 * maxFacePools {
+		facePool(a, 10+float64(i)/8)
+	}
+	faceCache.Lock()
+	n := len(faceCache.pools)
+	faceCache.Unlock()
+	if n > maxFacePools {
+		t.Errorf("%d face pools cached, want at most %d", n, maxFacePools)
+	}
+}
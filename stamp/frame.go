@@ -0,0 +1,38 @@
+package stamp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+// frameImage returns img on a larger canvas filled with c: "bar" adds a strip
+// below the photo, "polaroid" adds equal borders on the other three sides as
+// well. The strip is sizePercent of the image height. The original pixels
+// are copied unchanged onto a canvas of the same depth; the returned
+// rectangle is the strip for the stamp.
+func frameImage(img draw.Image, style string, sizePercent int, c color.RGBA) (draw.Image, image.Rectangle) {
+	b := img.Bounds()
+	bar := max(b.Dy()*sizePercent/100, 1)
+	border := 0
+	if style == "polaroid" {
+		border = max(bar/3, 1)
+	}
+	canvas := newCanvas(img, image.Rect(0, 0, b.Dx()+2*border, b.Dy()+border+bar))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	draw.Draw(canvas, b.Sub(b.Min).Add(image.Pt(border, border)), img, b.Min, draw.Src)
+	strip := image.Rect(0, border+b.Dy(), canvas.Bounds().Dx(), canvas.Bounds().Dy())
+	return canvas, strip
+}
+
+// frameOptions adapts opts to stamp the frame strip: the text is centered
+// and, unless a size was given, its lines share a bit less than half of the
+// strip height.
+func frameOptions(opts Options, text string) Options {
+	opts.Position = "center"
+	if opts.FontSize <= 0 && opts.HeightPercent <= 0 {
+		opts.HeightPercent = max(45/(strings.Count(text, "\n")+1), 1)
+	}
+	return opts
+}
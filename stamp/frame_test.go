@@ -0,0 +1,65 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	src := noise(400, 300)
+	tests := []struct {
+		style  string
+		w, h   int
+		border int
+	}{
+		// the strip is 12% of 300, polaroid borders a third of that
+		{"bar", 400, 336, 0},
+		{"polaroid", 424, 348, 12},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Frame = tt.style
+		var out bytes.Buffer
+		if _, err := Process(context.Background(), bytes.NewReader(encodePNG(t, src)), &out, opts); err != nil {
+			t.Fatalf("%s: %v", tt.style, err)
+		}
+		img, err := png.Decode(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("%s: %dx%d output, want %dx%d", tt.style, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		// the photo is untouched, the text centered in the strip below it
+		changed := 0
+		for y := 0; y < 300; y++ {
+			for x := 0; x < 400; x++ {
+				r1, g1, b1, _ := src.At(x, y).RGBA()
+				r2, g2, b2, _ := img.At(x+tt.border, y+tt.border).RGBA()
+				if r1 != r2 || g1 != g2 || b1 != b2 {
+					changed++
+				}
+			}
+		}
+		if changed > 0 {
+			t.Errorf("%s: %d pixels of the photo changed", tt.style, changed)
+		}
+		strip := image.Rect(0, 300+tt.border, tt.w, tt.h)
+		rgba, ok := img.(*image.RGBA)
+		if !ok {
+			t.Fatalf("%s: output decoded as %T", tt.style, img)
+		}
+		ink := inkBounds(rgba.SubImage(strip))
+		if ink.Empty() {
+			t.Errorf("%s: no text in the strip", tt.style)
+			continue
+		}
+		if left, right := ink.Min.X, tt.w-ink.Max.X; left-right > 2 || right-left > 2 {
+			t.Errorf("%s: text at %v, want it centered in %v", tt.style, ink, strip)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package stamp
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxPlaceKm is how far the nearest city may be for a photo to be labelled
+// with it; further out (at sea, in the wilderness) the place stays empty.
+const maxPlaceKm = 150
+
+// geoCity is one entry of the cities database.
+type geoCity struct {
+	name    string
+	country string // ISO 3166 country code
+	lat     float64
+	lon     float64
+}
+
+// GeoIndex answers nearest-city queries over a 1°×1° grid. It is read-only
+// once loaded and safe for concurrent use.
+type GeoIndex struct {
+	cities []geoCity
+	cells  map[[2]int][]int32
+}
+
+// LoadGeoDB reads a GeoNames cities file (cities500.txt, cities1000.txt,
+// cities15000.txt, ... from https://download.geonames.org/export/dump/).
+func LoadGeoDB(path string) (*GeoIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g := &GeoIndex{cells: map[[2]int][]int32{}}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) < 9 {
+			return nil, fmt.Errorf("%s:%d: not a GeoNames cities file", path, line)
+		}
+		lat, err1 := strconv.ParseFloat(cols[4], 64)
+		lon, err2 := strconv.ParseFloat(cols[5], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%s:%d: invalid coordinates", path, line)
+		}
+		g.cities = append(g.cities, geoCity{name: cols[1], country: cols[8], lat: lat, lon: lon})
+		k := geoCell(lat, lon)
+		g.cells[k] = append(g.cells[k], int32(len(g.cities)-1))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(g.cities) == 0 {
+		return nil, fmt.Errorf("%s: no cities", path)
+	}
+	return g, nil
+}
+
+func geoCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+// place returns "City, CC" for the city nearest to lat/lon, or "" when
+// there is none within maxPlaceKm.
+func (g *GeoIndex) place(lat, lon float64) string {
+	if g == nil {
+		return ""
+	}
+	c := geoCell(lat, lon)
+	best, bestKm := -1, math.Inf(1)
+	// a degree of latitude is ~111 km; longitude cells narrow towards the
+	// poles, so widen the ring there to cover the same distance
+	rings := int(math.Ceil(maxPlaceKm / 111.0))
+	lonRings := min(int(math.Ceil(float64(rings)/max(math.Cos(lat*math.Pi/180), 0.01))), 180)
+	for dy := -rings; dy <= rings; dy++ {
+		for dx := -lonRings; dx <= lonRings; dx++ {
+			x := ((c[1]+dx+180)%360+360)%360 - 180
+			for _, i := range g.cells[[2]int{c[0] + dy, x}] {
+				if km := haversineKm(lat, lon, g.cities[i].lat, g.cities[i].lon); km < bestKm {
+					best, bestKm = int(i), km
+				}
+			}
+		}
+	}
+	if best < 0 || bestKm > maxPlaceKm {
+		return ""
+	}
+	city := g.cities[best]
+	if city.country == "" {
+		return city.name
+	}
+	return city.name + ", " + city.country
+}
+
+// haversineKm returns the great-circle distance between two points.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthKm = 6371
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthKm * math.Asin(math.Sqrt(a))
+}
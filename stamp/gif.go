@@ -0,0 +1,55 @@
+package stamp
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"path/filepath"
+	"strings"
+)
+
+// isGIF reports whether path has a .gif extension.
+func isGIF(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gif")
+}
+
+// stampGIF draws the stamp onto every frame of an animated GIF in place
+// and returns the corner it went to. The layout is computed once for the
+// logical screen, from the first frame for Options.Position "auto"; each
+// frame is drawn in RGBA and quantized back to its own palette, so delays,
+// loop count and disposal methods are left untouched.
+func stampGIF(inPath string, g *gif.GIF, text string, opts Options) (string, error) {
+	if len(g.Image) == 0 {
+		return "", nil
+	}
+	canvas := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if canvas.Empty() {
+		canvas = g.Image[0].Bounds()
+	}
+	var layout *stampLayout
+	var position string
+	for i, frame := range g.Image {
+		b := frame.Bounds()
+		rgba := newRGBA(b)
+		draw.Draw(rgba, b, frame, b.Min, draw.Src)
+		if i == 0 {
+			// decide once from the first frame so the stamp doesn't jump or flicker
+			var err error
+			if layout, position, err = placeStamp(inPath, rgba, canvas, text, opts); err != nil {
+				recycle(rgba)
+				return "", err
+			}
+			defer layout.release()
+			if opts.AutoColor {
+				opts.TextColor, opts.OutlineColor = pickAutoColors(inPath, rgba, layout, opts.Verbose)
+			}
+		}
+		// the drawer clips to the frame, so partial frames only get their share of the stamp
+		layout.draw(rgba, opts)
+		out := image.NewPaletted(b, frame.Palette)
+		draw.Draw(out, b, rgba, b.Min, draw.Src)
+		recycle(rgba)
+		g.Image[i] = out
+	}
+	return position, nil
+}
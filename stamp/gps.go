@@ -0,0 +1,105 @@
+package stamp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// GPSFormat controls how coordinates are printed by Options.ShowGPS and the template.
+type GPSFormat struct {
+	DMS       bool // degrees, minutes, seconds with N/S/E/W instead of signed decimal degrees
+	Precision int  // decimals of the decimal-degree format
+}
+
+// exifLatLong returns the GPS position of ex. A missing or invalid position
+// and the (0, 0) "null island" written by receivers without a fix report !ok.
+func exifLatLong(ex *exif.Exif) (lat, lon float64, ok bool) {
+	if ex == nil {
+		return 0, 0, false
+	}
+	lat, lon, err := ex.LatLong()
+	if err != nil || math.IsNaN(lat) || math.IsNaN(lon) || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return 0, 0, false
+	}
+	if lat == 0 && lon == 0 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// gpsTime returns the time of the GPS fix of ex, GPSDateStamp and
+// GPSTimeStamp, which are in UTC.
+func gpsTime(ex *exif.Exif) (time.Time, bool) {
+	if ex == nil {
+		return time.Time{}, false
+	}
+	date := exifString(ex, exif.GPSDateStamp)
+	tag, err := ex.Get(exif.GPSTimeStamp)
+	if date == "" || err != nil || tag == nil || tag.Count != 3 {
+		return time.Time{}, false
+	}
+	var hms [3][2]int64
+	for i := range hms {
+		if hms[i][0], hms[i][1], err = tag.Rat2(i); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return parseGPSTime(date, hms)
+}
+
+// parseGPSTime combines a GPSDateStamp, "2006:01:02", with the hours,
+// minutes and seconds of a GPSTimeStamp as numerator and denominator
+// rationals, e.g. {{10, 1}, {30, 1}, {5250, 100}} for 10:30:52.5 UTC. A
+// time of 24:00:00 rolls over into the next day.
+func parseGPSTime(date string, hms [3][2]int64) (time.Time, bool) {
+	// some writers use dashes
+	day, err := time.Parse("2006:01:02", strings.ReplaceAll(strings.TrimSpace(date), "-", ":"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		num, den := hms[i][0], hms[i][1]
+		if den <= 0 || num < 0 || num/den > 60 {
+			return time.Time{}, false
+		}
+		// whole units, then the fraction in nanoseconds
+		d += time.Duration(num/den)*unit + time.Duration(num%den)*unit/time.Duration(den)
+	}
+	if d > 24*time.Hour {
+		return time.Time{}, false
+	}
+	return day.Add(d), true
+}
+
+// format returns lat and lon formatted separately and as one "lat, lon" string.
+func (f GPSFormat) format(lat, lon float64) (latText, lonText, both string) {
+	if f.DMS {
+		latText = formatDMS(lat, "N", "S")
+		lonText = formatDMS(lon, "E", "W")
+		return latText, lonText, latText + " " + lonText
+	}
+	latText = strconv.FormatFloat(lat, 'f', f.Precision, 64)
+	lonText = strconv.FormatFloat(lon, 'f', f.Precision, 64)
+	return latText, lonText, latText + ", " + lonText
+}
+
+// formatDMS prints v as 35°39'29.2"N, using pos or neg as the hemisphere letter.
+func formatDMS(v float64, pos, neg string) string {
+	hemi := pos
+	if v < 0 {
+		hemi = neg
+		v = -v
+	}
+	// work in tenths of a second so rounding carries into minutes and degrees
+	tenths := int64(math.Round(v * 36000))
+	deg := tenths / 36000
+	mins := tenths % 36000 / 600
+	secs := float64(tenths%600) / 10
+	return fmt.Sprintf("%d°%d'%.1f\"%s", deg, mins, secs, hemi)
+}
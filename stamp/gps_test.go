@@ -0,0 +1,59 @@
+package stamp
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestParseGPSTime(t *testing.T) {
+	tests := []struct {
+		date string
+		hms  [3][2]int64
+		want string // RFC 3339 in UTC; "" when rejected
+	}{
+		{"2023:07:14", [3][2]int64{{10, 1}, {30, 1}, {5250, 100}}, "2023-07-14T10:30:52.5Z"},
+		{"2023:07:14", [3][2]int64{{10, 1}, {30, 1}, {5, 1}}, "2023-07-14T10:30:05Z"},
+		{"2023:12:31", [3][2]int64{{24, 1}, {0, 1}, {0, 1}}, "2024-01-01T00:00:00Z"},
+		{"2023:12:31", [3][2]int64{{23, 1}, {59, 1}, {59999, 1000}}, "2023-12-31T23:59:59.999Z"},
+		{"2023-07-14", [3][2]int64{{10, 1}, {30, 1}, {5, 1}}, "2023-07-14T10:30:05Z"},
+		{" 2023:07:14 ", [3][2]int64{{10, 1}, {30, 1}, {5, 1}}, "2023-07-14T10:30:05Z"},
+		{"2023:07:14", [3][2]int64{{10, 1}, {30, 0}, {5, 1}}, ""},
+		{"2023:07:14", [3][2]int64{{10, 1}, {30, 1}, {5, -1}}, ""},
+		{"2023:07:14", [3][2]int64{{-1, 1}, {30, 1}, {5, 1}}, ""},
+		{"2023:07:14", [3][2]int64{{10, 1}, {61, 1}, {5, 1}}, ""},
+		{"2023:07:14", [3][2]int64{{10, 1}, {30, 1}, {6100, 100}}, ""},
+		{"2023:07:14", [3][2]int64{{25, 1}, {0, 1}, {0, 1}}, ""},
+		{"2023:07:14", [3][2]int64{{24, 1}, {0, 1}, {1, 1}}, ""},
+		{"", [3][2]int64{{10, 1}, {30, 1}, {5, 1}}, ""},
+		{"2023:13:01", [3][2]int64{{10, 1}, {30, 1}, {5, 1}}, ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseGPSTime(tt.date, tt.hms)
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("parseGPSTime(%q, %v) = %v, want it rejected", tt.date, tt.hms, got)
+		case tt.want != "" && !ok:
+			t.Errorf("parseGPSTime(%q, %v) rejected, want %s", tt.date, tt.hms, tt.want)
+		case ok && got.Format(time.RFC3339Nano) != tt.want:
+			t.Errorf("parseGPSTime(%q, %v) = %s, want %s", tt.date, tt.hms, got.Format(time.RFC3339Nano), tt.want)
+		}
+	}
+}
+
+func TestGPSDateSource(t *testing.T) {
+	// no EXIF date, only the GPS fix: it wins over the file time
+	gps := []tiffEntry{
+		ratTag(0x0007, 23, 1, 59, 1, 59500, 1000),
+		asciiTag(0x001D, "2023:12:31"),
+	}
+	in := withExif(encodeJPEG(t, solid(16, 16, color.White)), buildTIFF(nil, nil, gps))
+	opts := DefaultOptions()
+	opts.TimeZone = time.UTC
+	capture := readCaptureDate(bytes.NewReader(in), false, "", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), opts)
+	res := capture.result()
+	if res.DateSource != "gps" || res.Time.Format(time.RFC3339Nano) != "2023-12-31T23:59:59.5Z" {
+		t.Errorf("date %s from %q, want 2023-12-31T23:59:59.5Z from gps", res.Time.Format(time.RFC3339Nano), res.DateSource)
+	}
+}
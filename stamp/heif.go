@@ -0,0 +1,22 @@
+//go:build heif
+
+package stamp
+
+import (
+	"io"
+
+	"github.com/jdeng/goheif" // registers the "heic" image format
+)
+
+func init() {
+	// copy decoded planes out of libde265 so images outlive the decoder
+	goheif.SafeEncoding = true
+}
+
+// heifSupported reports whether HEIC/HEIF decoding is compiled in (build tag "heif").
+const heifSupported = true
+
+// heifExif returns the EXIF block ("Exif\x00\x00" followed by TIFF data) of a HEIF file.
+func heifExif(r io.ReaderAt) ([]byte, error) {
+	return goheif.ExtractExif(r)
+}
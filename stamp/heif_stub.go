@@ -0,0 +1,16 @@
+//go:build !heif
+
+package stamp
+
+import (
+	"errors"
+	"io"
+)
+
+// heifSupported reports whether HEIC/HEIF decoding is compiled in (build tag "heif").
+const heifSupported = false
+
+// heifExif is unavailable without the "heif" build tag.
+func heifExif(io.ReaderAt) ([]byte, error) {
+	return nil, errors.New("HEIC/HEIF support not compiled in")
+}
@@ -0,0 +1,58 @@
+package stamp
+
+import (
+	"context"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/camel.heic is a 1596x1064 HEIC without EXIF; testdata/park.heic
+// is the first 50000 bytes of an iPhone photo, enough for its EXIF but not
+// its pixels. Both come from the test data of github.com/jdeng/goheif.
+
+func TestHEIF(t *testing.T) {
+	in := filepath.Join("testdata", "camel.heic")
+	out := filepath.Join(t.TempDir(), "camel.jpg")
+	res, err := ProcessFile(context.Background(), in, out, DefaultOptions())
+	if !heifSupported {
+		if !errors.Is(err, ErrSkipped) || !strings.Contains(err.Error(), "-tags heif") {
+			t.Errorf("without the heif build tag: %v, want it skipped with a hint", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := OutputExt(in, ""); got != ".jpg" {
+		t.Errorf("HEIC output extension %s, want .jpg", got)
+	}
+	f, err := os.Open(res.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil || format != "jpeg" || cfg.Width != 1596 || cfg.Height != 1064 {
+		t.Errorf("output %s %dx%d, %v; want a 1596x1064 jpeg", format, cfg.Width, cfg.Height, err)
+	}
+}
+
+func TestHEIFExif(t *testing.T) {
+	if !heifSupported {
+		t.Skip("built without the heif tag")
+	}
+	f, err := os.Open(filepath.Join("testdata", "park.heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c := readCaptureDate(f, true, f.Name(), time.Time{}, DefaultOptions())
+	if c.date != "2018-04-07 11:24:11" || c.source != dateSourceOriginal {
+		t.Errorf("date %s from %s, want 2018-04-07 11:24:11 from DateTimeOriginal", c.date, c.source)
+	}
+}
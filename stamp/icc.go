@@ -0,0 +1,44 @@
+package stamp
+
+import (
+	"bytes"
+	"slices"
+)
+
+// iccChunkSize is the profile data carried by one APP2 segment: the 64 KiB
+// segment minus its length field, the "ICC_PROFILE\0" header and the
+// sequence number and count bytes.
+const iccChunkSize = 0xFFFF - 2 - 12 - 2
+
+// assembleICC puts an ICC profile split across APP2 segments back
+// together. Each segment carries its 1-based sequence number and the
+// segment count; a profile with missing, repeated or inconsistently
+// counted parts returns nil.
+func assembleICC(segs [][]byte) []byte {
+	if len(segs) == 0 || len(segs) > 255 {
+		return nil
+	}
+	parts := make([][]byte, len(segs))
+	for _, p := range segs {
+		if len(p) < len(iccHeader)+2 {
+			return nil
+		}
+		seq, count := int(p[len(iccHeader)]), int(p[len(iccHeader)+1])
+		if count != len(segs) || seq < 1 || seq > count || parts[seq-1] != nil {
+			return nil
+		}
+		parts[seq-1] = p[len(iccHeader)+2:]
+	}
+	return bytes.Join(parts, nil)
+}
+
+// iccSegments splits an ICC profile into APP2 segments.
+func iccSegments(profile []byte) []jpegSegment {
+	chunks := slices.Collect(slices.Chunk(profile, iccChunkSize))
+	segs := make([]jpegSegment, len(chunks))
+	for i, c := range chunks {
+		payload := append(slices.Clip(iccHeader), byte(i+1), byte(len(chunks)))
+		segs[i] = jpegSegment{markerAPP2, append(payload, c...)}
+	}
+	return segs
+}
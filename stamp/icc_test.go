@@ -0,0 +1,159 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testProfile returns a fake ICC profile of n bytes in the RGB color space.
+func testProfile(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i * 7)
+	}
+	copy(p[16:], "RGB ")
+	return p
+}
+
+func TestICCSegments(t *testing.T) {
+	for _, n := range []int{100, iccChunkSize, iccChunkSize + 1, 3*iccChunkSize + 17} {
+		profile := testProfile(n)
+		segs := iccSegments(profile)
+		if want := (n + iccChunkSize - 1) / iccChunkSize; len(segs) != want {
+			t.Errorf("%d bytes: %d segments, want %d", n, len(segs), want)
+		}
+		var payloads [][]byte
+		for _, s := range segs {
+			if s.marker != markerAPP2 || len(s.payload)+2 > 0xFFFF {
+				t.Errorf("%d bytes: segment %#x of %d bytes", n, s.marker, len(s.payload))
+			}
+			payloads = append(payloads, s.payload)
+		}
+		if got := assembleICC(payloads); !bytes.Equal(got, profile) {
+			t.Errorf("%d bytes: reassembled %d bytes, not the profile", n, len(got))
+		}
+		// segments may come in any order
+		if len(payloads) > 1 {
+			payloads[0], payloads[1] = payloads[1], payloads[0]
+			if got := assembleICC(payloads); !bytes.Equal(got, profile) {
+				t.Errorf("%d bytes: swapped segments not reassembled", n)
+			}
+		}
+	}
+
+	var payloads [][]byte
+	for _, s := range iccSegments(testProfile(2*iccChunkSize + 1)) {
+		payloads = append(payloads, s.payload)
+	}
+	if assembleICC(payloads[:2]) != nil {
+		t.Errorf("profile with a missing segment assembled")
+	}
+	if assembleICC([][]byte{payloads[0], payloads[0], payloads[2]}) != nil {
+		t.Errorf("profile with a repeated segment assembled")
+	}
+	if assembleICC([][]byte{iccHeader}) != nil {
+		t.Errorf("segment without sequence bytes assembled")
+	}
+}
+
+// withICC returns the JPEG data with profile inserted after SOI as APP2
+// segments.
+func withICC(t *testing.T, data, profile []byte) []byte {
+	var b bytes.Buffer
+	b.Write(data[:2])
+	for _, s := range iccSegments(profile) {
+		if err := writeSegment(&b, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Write(data[2:])
+	return b.Bytes()
+}
+
+// withICCP returns the PNG data with profile in an iCCP chunk after IHDR.
+func withICCP(data, profile []byte) []byte {
+	chunk := (&imageMetadata{icc: profile}).pngChunks()
+	chunk = chunk[len(appendPNGChunk(nil, "tEXt", pngMarker)):] // without the marker
+	ihdr := len(pngSignature) + 8 + 13 + 4
+	return append(append(bytes.Clone(data[:ihdr]), chunk...), data[ihdr:]...)
+}
+
+func TestICCRoundTrip(t *testing.T) {
+	img := solid(64, 48, color.RGBA{200, 60, 30, 255})
+	profile := testProfile(2*iccChunkSize + 1000) // three APP2 segments
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"in.jpg", withICC(t, encodeJPEG(t, img), profile)},
+		{"in.png", withICCP(encodePNG(t, img), profile)},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		in := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(in, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m *imageMetadata
+		if filepath.Ext(in) == ".png" {
+			m, _ = readPNGMetadata(f)
+		} else {
+			m, _ = readJPEGMetadata(f)
+		}
+		f.Close()
+		if m == nil || !bytes.Equal(m.icc, profile) {
+			t.Fatalf("%s: fixture profile not read back", tt.name)
+		}
+
+		res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "out"+filepath.Ext(in)), DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		out, err := os.ReadFile(res.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(res.Out) == ".png" {
+			m, err = readPNGMetadata(bytes.NewReader(out))
+		} else {
+			m, err = readJPEGMetadata(bytes.NewReader(out))
+		}
+		if err != nil {
+			t.Fatalf("%s: output metadata: %v", tt.name, err)
+		}
+		if !bytes.Equal(m.icc, profile) {
+			t.Errorf("%s: output profile of %d bytes, want the input's %d", tt.name, len(m.icc), len(profile))
+		}
+	}
+}
+
+func TestICCColorSpaceMismatch(t *testing.T) {
+	// a gray profile doesn't describe the RGB pixels of the output
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.jpg")
+	profile := testProfile(500)
+	copy(profile[16:], "GRAY")
+	if err := os.WriteFile(in, withICC(t, encodeJPEG(t, solid(64, 48, color.RGBA{200, 60, 30, 255})), profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "out.jpg"), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(res.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if m, err := readJPEGMetadata(f); err != nil || m.icc != nil {
+		t.Errorf("gray profile kept on an RGB output: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package stamp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// backupOriginal copies inPath into backupDir, mirroring its path relative
+// to root. The copy keeps the original's permissions and times.
+func backupOriginal(inPath, root, backupDir string) error {
+	rel, err := filepath.Rel(root, inPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(inPath)
+	}
+	dst := filepath.Join(backupDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	src, err := os.Open(inPath)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return fmt.Errorf("backup: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// replaceFile atomically replaces path with the fully written temp file tmp:
+// it is synced, given path's permissions and renamed over it, so a crash
+// leaves either the old or the new file, never a truncated one.
+func replaceFile(tmp *os.File, path string, orig os.FileInfo) error {
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), orig.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
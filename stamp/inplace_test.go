@@ -0,0 +1,122 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photo.jpg")
+	if err := os.WriteFile(path, []byte("original"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := os.CreateTemp(dir, ".photo.jpg.*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmp.WriteString("stamped"); err != nil {
+		t.Fatal(err)
+	}
+	// until the rename, the original is whole
+	if data, _ := os.ReadFile(path); string(data) != "original" {
+		t.Fatalf("original %q before the rename", data)
+	}
+	if err := replaceFile(tmp, path, orig); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "stamped" {
+		t.Errorf("replaced file %q", data)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("replaced file mode %v, %v; want 0640", fi.Mode().Perm(), err)
+	}
+	if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
+
+func TestInPlace(t *testing.T) {
+	root := t.TempDir()
+	backup := filepath.Join(t.TempDir(), "backup")
+	in := filepath.Join(root, "2023", "kyoto", "photo.jpg")
+	if err := os.MkdirAll(filepath.Dir(in), 0755); err != nil {
+		t.Fatal(err)
+	}
+	original := dated(t, 64, 48, "2023:07:14 10:30:05")
+	if err := os.WriteFile(in, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Date(2023, 7, 20, 8, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(in, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.InPlace, opts.InRoot, opts.BackupDir = true, root, backup
+	if _, err := ProcessFile(context.Background(), in, in, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, original) {
+		t.Errorf("original not replaced")
+	}
+	fi, err := os.Stat(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(old) {
+		t.Errorf("stamped original: mode %v, time %v; want 0600 and %v", fi.Mode().Perm(), fi.ModTime(), old)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(in)); len(entries) != 1 {
+		t.Errorf("%d files next to the original, want no temp file left", len(entries))
+	}
+
+	// the backup mirrors the tree below root, untouched
+	saved := filepath.Join(backup, "2023", "kyoto", "photo.jpg")
+	if data, err := os.ReadFile(saved); err != nil || !bytes.Equal(data, original) {
+		t.Errorf("backup %s: %v, the same bytes %v", saved, err, bytes.Equal(data, original))
+	}
+	if fi, err := os.Stat(saved); err != nil || fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(old) {
+		t.Errorf("backup mode or time changed: %v", err)
+	}
+
+	// a backup that fails leaves the original alone
+	other := filepath.Join(root, "other.jpg")
+	if err := os.WriteFile(other, encodeJPEG(t, solid(64, 48, color.White)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(other)
+	blocked := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.BackupDir = blocked // a file, not a directory
+	if _, err := ProcessFile(context.Background(), other, other, opts); err == nil {
+		t.Errorf("backup into a file succeeded")
+	}
+	if after, _ := os.ReadFile(other); !bytes.Equal(before, after) {
+		t.Errorf("original changed although its backup failed")
+	}
+
+	// --touch gives the stamped original the current time
+	opts.BackupDir, opts.Touch, opts.Restamp = "", true, true
+	if _, err := ProcessFile(context.Background(), in, in, opts); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(in); err != nil || fi.ModTime().Equal(old) {
+		t.Errorf("with Touch the original kept its time: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package stamp
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// lcdDateLayout is the date format of the classic film camera imprint: 'YY MM DD.
+const lcdDateLayout = "'06 01 02"
+
+// LCDColor is the orange of the film camera date back, the usual TextColor
+// for Style "lcd".
+var LCDColor = color.RGBA{0xFF, 0x8A, 0x1E, 0xFF}
+
+// Segment bits of a seven-segment digit: top, top-right, bottom-right,
+// bottom, bottom-left, top-left and middle.
+const (
+	segA = 1 << iota
+	segB
+	segC
+	segD
+	segE
+	segF
+	segG
+)
+
+var lcdSegments = map[rune]int{
+	'0': segA | segB | segC | segD | segE | segF,
+	'1': segB | segC,
+	'2': segA | segB | segG | segE | segD,
+	'3': segA | segB | segG | segC | segD,
+	'4': segF | segG | segB | segC,
+	'5': segA | segF | segG | segC | segD,
+	'6': segA | segF | segG | segE | segD | segC,
+	'7': segA | segB | segC,
+	'8': segA | segB | segC | segD | segE | segF | segG,
+	'9': segA | segB | segC | segD | segF | segG,
+	'-': segG,
+}
+
+// lcdFace is a font.Face that draws digits from seven-segment primitives, so
+// --style lcd needs no font file. Runes it has no shape for are left blank.
+type lcdFace struct {
+	h int // digit height in pixels
+}
+
+// newLCDFace returns an lcdFace sized like the vector fonts would be: by
+// --font-size, --height-percent or the available width.
+func newLCDFace(text string, opts Options, availableWidth, imgHeight int) *lcdFace {
+	switch {
+	case opts.FontSize > 0:
+		return &lcdFace{h: max(int(math.Round(opts.FontSize)), 7)}
+	case opts.HeightPercent > 0:
+		return &lcdFace{h: max(imgHeight*opts.HeightPercent/100, 7)}
+	}
+	// width is linear in the height, so measure once at a reference height;
+	// the date is short, so fit it on one line rather than by its widest token
+	const ref = 100
+	w := font.MeasureString(&lcdFace{h: ref}, text).Ceil()
+	return &lcdFace{h: max(ref*availableWidth/max(w, 1), 7)}
+}
+
+func (f *lcdFace) width(r rune) int {
+	switch r {
+	case '\'', ':', '.':
+		return f.h / 4
+	}
+	return f.h * 11 / 20
+}
+
+func (f *lcdFace) advance(r rune) int {
+	return f.width(r) + f.h/5
+}
+
+// thickness is the stroke width of a segment.
+func (f *lcdFace) thickness() int {
+	return max(f.h/9, 1)
+}
+
+func (f *lcdFace) Close() error { return nil }
+
+func (f *lcdFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	w, h, t := f.width(r), f.h, f.thickness()
+	m := image.NewAlpha(image.Rect(0, 0, w, h))
+	fill := func(x0, y0, x1, y1 int) {
+		for y := max(y0, 0); y < min(y1, h); y++ {
+			for x := max(x0, 0); x < min(x1, w); x++ {
+				m.Pix[y*m.Stride+x] = 0xFF
+			}
+		}
+	}
+	switch r {
+	case '\'':
+		fill(w/2-t/2, 0, w/2-t/2+t, h/4)
+	case ':':
+		fill(w/2-t/2, h/3-t/2, w/2-t/2+t, h/3-t/2+t)
+		fill(w/2-t/2, h*2/3-t/2, w/2-t/2+t, h*2/3-t/2+t)
+	case '.':
+		fill(w/2-t/2, h-t, w/2-t/2+t, h)
+	default:
+		// leave a small gap where segments meet, as on a real display
+		gap := max(t/4, 1)
+		mid := h / 2
+		segs := lcdSegments[r]
+		if segs&segA != 0 {
+			fill(t+gap, 0, w-t-gap, t)
+		}
+		if segs&segG != 0 {
+			fill(t+gap, mid-t/2, w-t-gap, mid-t/2+t)
+		}
+		if segs&segD != 0 {
+			fill(t+gap, h-t, w-t-gap, h)
+		}
+		if segs&segF != 0 {
+			fill(0, gap, t, mid-gap)
+		}
+		if segs&segB != 0 {
+			fill(w-t, gap, w, mid-gap)
+		}
+		if segs&segE != 0 {
+			fill(0, mid+gap, t, h-gap)
+		}
+		if segs&segC != 0 {
+			fill(w-t, mid+gap, w, h-gap)
+		}
+	}
+	origin := image.Pt(dot.X.Round(), dot.Y.Round()-h)
+	return m.Rect.Add(origin), m, image.Point{}, fixed.I(f.advance(r)), true
+}
+
+func (f *lcdFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	b := fixed.R(0, -f.h, f.width(r), 0)
+	return b, fixed.I(f.advance(r)), true
+}
+
+func (f *lcdFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	return fixed.I(f.advance(r)), true
+}
+
+func (f *lcdFace) Kern(r0, r1 rune) fixed.Int26_6 { return 0 }
+
+func (f *lcdFace) Metrics() font.Metrics {
+	return font.Metrics{
+		Height:    fixed.I(f.h * 5 / 4),
+		Ascent:    fixed.I(f.h),
+		Descent:   fixed.I(f.h / 4),
+		XHeight:   fixed.I(f.h / 2),
+		CapHeight: fixed.I(f.h),
+	}
+}
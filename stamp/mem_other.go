@@ -0,0 +1,8 @@
+//go:build !linux
+
+package stamp
+
+// availableMemory returns 0: the available memory is only read on Linux.
+func availableMemory() int64 {
+	return 0
+}
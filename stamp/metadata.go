@@ -0,0 +1,391 @@
+package stamp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// JPEG markers used when copying metadata segments.
+const (
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerAPP1 = 0xE1
+	markerAPP2 = 0xE2
+	markerCOM  = 0xFE
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// stampMarker marks the images snapstamp writes, so they aren't stamped a
+// second time when they end up among the inputs again: the text of a JPEG
+// COM segment, and of a PNG tEXt chunk with the keyword Software.
+const stampMarker = "snapstamp"
+
+// pngMarker is the data of the tEXt chunk carrying stampMarker.
+var pngMarker = []byte("Software\x00" + stampMarker)
+
+// jpegSegment is a raw marker segment: the marker byte and its payload (without the length field).
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// imageMetadata holds the metadata copied from a source image.
+type imageMetadata struct {
+	exif *jpegSegment // APP1 "Exif" segment, or the PNG eXIf chunk in that form
+	icc  []byte       // ICC profile, reassembled from APP2 "ICC_PROFILE" segments or a PNG iCCP chunk
+	png  []pngChunk   // other ancillary chunks of a PNG input, copied into PNG outputs
+
+	marked bool // the input carries stampMarker, not copied
+}
+
+// readJPEGMetadata scans the marker segments before the first SOS and keeps the
+// EXIF segment and the ICC profile. Non-JPEG input returns an error.
+func readJPEGMetadata(r io.Reader) (*imageMetadata, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xFF || soi[1] != markerSOI {
+		return nil, errors.New("not a jpeg")
+	}
+	m := &imageMetadata{}
+	var icc [][]byte
+	for {
+		// skip fill bytes before the marker
+		b, err := br.ReadByte()
+		if err != nil {
+			return m, err
+		}
+		if b != 0xFF {
+			return m, errors.New("invalid jpeg marker")
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return m, err
+		}
+		if marker == markerSOS || marker == markerEOI {
+			m.icc = assembleICC(icc)
+			return m, nil
+		}
+		// standalone markers carry no length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+		var lb [2]byte
+		if _, err := io.ReadFull(br, lb[:]); err != nil {
+			return m, err
+		}
+		n := int(binary.BigEndian.Uint16(lb[:]))
+		if n < 2 {
+			return m, errors.New("invalid jpeg segment length")
+		}
+		payload := make([]byte, n-2)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return m, err
+		}
+		switch {
+		case marker == markerAPP1 && m.exif == nil && bytes.HasPrefix(payload, exifHeader):
+			m.exif = &jpegSegment{marker, payload}
+		case marker == markerAPP2 && bytes.HasPrefix(payload, iccHeader):
+			icc = append(icc, payload)
+		case marker == markerCOM && bytes.HasPrefix(payload, []byte(stampMarker)):
+			m.marked = true
+		}
+	}
+}
+
+// exifTIFF returns the TIFF structure inside an APP1 Exif payload, its byte
+// order and the offset of IFD0. ok is false for anything malformed.
+func exifTIFF(payload []byte) (t []byte, bo binary.ByteOrder, ifd0 int, ok bool) {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return nil, nil, 0, false
+	}
+	t = payload[len(exifHeader):]
+	if len(t) < 8 {
+		return nil, nil, 0, false
+	}
+	switch string(t[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, nil, 0, false
+	}
+	ifd0 = int(bo.Uint32(t[4:8]))
+	if ifd0 < 8 || ifd0+2 > len(t) {
+		return nil, nil, 0, false
+	}
+	return t, bo, ifd0, true
+}
+
+// maxIFDs bounds the IFDs exifSane follows; real files have a handful.
+const maxIFDs = 16
+
+// exifSane reports whether goexif can safely parse an APP1 Exif payload.
+// goexif trusts the value counts of the entries, allocating by them even
+// when count times size overflows, and only notices an IFD chain that
+// points at itself, so a corrupt block could exhaust memory or never end.
+// This checks that no value is larger than the block and that the IFD chain
+// doesn't loop. IFDs that are merely out of range are left to goexif, which
+// rejects them on its own.
+func exifSane(payload []byte) bool {
+	t, bo, off, ok := exifTIFF(payload)
+	if !ok {
+		return false
+	}
+	// entries checks the values of the IFD at off and returns the offsets of
+	// the next IFD and of the sub-IFDs it points to.
+	entries := func(off int) (next int, subs []int, ok bool) {
+		n := int(bo.Uint16(t[off : off+2]))
+		for i := 0; i < n; i++ {
+			e := off + 2 + i*12
+			if e+12 > len(t) {
+				return 0, subs, true
+			}
+			size := uint64(tiffTypeSize(bo.Uint16(t[e+2:e+4]))) * uint64(bo.Uint32(t[e+4:e+8]))
+			if size > uint64(len(t)) {
+				return 0, nil, false
+			}
+			switch bo.Uint16(t[e : e+2]) {
+			case 0x8769, 0x8825, 0xA005: // Exif, GPS and Interoperability IFD pointers
+				subs = append(subs, int(bo.Uint32(t[e+8:e+12])))
+			}
+		}
+		if e := off + 2 + n*12; e+4 <= len(t) {
+			next = int(bo.Uint32(t[e : e+4]))
+		}
+		return next, subs, true
+	}
+	inRange := func(off int) bool { return off >= 8 && off+2 <= len(t) }
+	seen := map[int]bool{}
+	var queue []int
+	for off != 0 && inRange(off) {
+		if seen[off] || len(seen) == maxIFDs {
+			return false // goexif would follow the chain forever
+		}
+		seen[off] = true
+		next, subs, ok := entries(off)
+		if !ok {
+			return false
+		}
+		queue = append(queue, subs...)
+		off = next
+	}
+	for len(queue) > 0 && len(seen) < maxIFDs {
+		off, queue = queue[0], queue[1:]
+		if seen[off] || !inRange(off) {
+			continue
+		}
+		seen[off] = true
+		_, subs, ok := entries(off)
+		if !ok {
+			return false
+		}
+		queue = append(queue, subs...)
+	}
+	return true
+}
+
+// resetOrientation sets the IFD0 Orientation tag inside an APP1 Exif payload to 1
+// (normal), since the pixels written to the output are already upright.
+func resetOrientation(payload []byte) {
+	t, bo, off, ok := exifTIFF(payload)
+	if !ok {
+		return
+	}
+	n := int(bo.Uint16(t[off : off+2]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(t) {
+			return
+		}
+		// tag 0x0112 Orientation, type 3 SHORT, value stored inline
+		if bo.Uint16(t[e:e+2]) == 0x0112 && bo.Uint16(t[e+2:e+4]) == 3 {
+			bo.PutUint16(t[e+8:e+10], 1)
+			return
+		}
+	}
+}
+
+// setPixelDimensions sets the PixelXDimension and PixelYDimension tags in
+// the Exif IFD of an APP1 Exif payload to w and h, in place.
+func setPixelDimensions(payload []byte, w, h int) {
+	t, bo, off, ok := exifTIFF(payload)
+	if !ok {
+		return
+	}
+	exifIFD := 0
+	n := int(bo.Uint16(t[off : off+2]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(t) {
+			return
+		}
+		if bo.Uint16(t[e:e+2]) == 0x8769 {
+			exifIFD = int(bo.Uint32(t[e+8 : e+12]))
+		}
+	}
+	if exifIFD < 8 || exifIFD+2 > len(t) {
+		return
+	}
+	n = int(bo.Uint16(t[exifIFD : exifIFD+2]))
+	for i := 0; i < n; i++ {
+		e := exifIFD + 2 + i*12
+		if e+12 > len(t) {
+			return
+		}
+		v := w
+		switch bo.Uint16(t[e : e+2]) {
+		case 0xA002: // PixelXDimension
+		case 0xA003: // PixelYDimension
+			v = h
+		default:
+			continue
+		}
+		// SHORT or LONG, one value stored inline
+		switch bo.Uint16(t[e+2 : e+4]) {
+		case 3:
+			if v <= 0xFFFF {
+				bo.PutUint16(t[e+8:e+10], uint16(v))
+			}
+		case 4:
+			bo.PutUint32(t[e+8:e+12], uint32(v))
+		}
+	}
+}
+
+// stripGPS removes the GPS IFD pointer (tag 0x8825) from IFD0 of an APP1
+// Exif payload and zeroes the GPS IFD and its values, in place.
+func stripGPS(payload []byte) {
+	t, bo, off, ok := exifTIFF(payload)
+	if !ok {
+		return
+	}
+	n := int(bo.Uint16(t[off : off+2]))
+	end := off + 2 + n*12 + 4 // entries plus the next-IFD offset
+	if end > len(t) {
+		return
+	}
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if bo.Uint16(t[e:e+2]) != 0x8825 {
+			continue
+		}
+		zeroIFD(t, bo, int(bo.Uint32(t[e+8:e+12])))
+		// drop the entry: move the later entries and the next-IFD offset up
+		copy(t[e:], t[e+12:end])
+		clear(t[end-12 : end])
+		bo.PutUint16(t[off:off+2], uint16(n-1))
+		return
+	}
+}
+
+// zeroIFD clears the IFD at off in t along with the values it points to.
+func zeroIFD(t []byte, bo binary.ByteOrder, off int) {
+	if off < 8 || off+2 > len(t) {
+		return
+	}
+	n := int(bo.Uint16(t[off : off+2]))
+	end := min(off+2+n*12+4, len(t))
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(t) {
+			break
+		}
+		size := tiffTypeSize(bo.Uint16(t[e+2:e+4])) * int(bo.Uint32(t[e+4:e+8]))
+		if size > 4 {
+			v := int(bo.Uint32(t[e+8 : e+12]))
+			if v >= 8 && v+size <= len(t) {
+				clear(t[v : v+size])
+			}
+		}
+	}
+	clear(t[off:end])
+}
+
+// tiffTypeSize returns the size in bytes of one value of a TIFF field type.
+func tiffTypeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		return 1
+	case 3, 8: // SHORT, SSHORT
+		return 2
+	case 4, 9, 11: // LONG, SLONG, FLOAT
+		return 4
+	case 5, 10, 12: // RATIONAL, SRATIONAL, DOUBLE
+		return 8
+	}
+	return 0
+}
+
+// writeSegment writes one marker segment with its length field.
+func writeSegment(w io.Writer, s jpegSegment) error {
+	if len(s.payload)+2 > 0xFFFF {
+		return errors.New("jpeg segment too large")
+	}
+	hdr := []byte{0xFF, s.marker, 0, 0}
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(s.payload)+2))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(s.payload)
+	return err
+}
+
+// metadataWriter wraps the writer handed to jpeg.Encode and inserts the
+// preserved segments and the stampMarker comment right after the SOI marker
+// the encoder writes first. meta may be nil.
+type metadataWriter struct {
+	w    io.Writer
+	meta *imageMetadata
+	head []byte // bytes seen before SOI was complete
+	done bool
+}
+
+func (mw *metadataWriter) Write(p []byte) (int, error) {
+	if mw.done {
+		return mw.w.Write(p)
+	}
+	n := len(p)
+	need := 2 - len(mw.head)
+	if len(p) < need {
+		mw.head = append(mw.head, p...)
+		return n, nil
+	}
+	mw.head = append(mw.head, p[:need]...)
+	p = p[need:]
+	mw.done = true
+	if _, err := mw.w.Write(mw.head); err != nil {
+		return 0, err
+	}
+	var segs []jpegSegment
+	if mw.meta != nil && mw.meta.exif != nil {
+		segs = append(segs, *mw.meta.exif) // EXIF comes first, right after SOI
+	}
+	segs = append(segs, jpegSegment{markerCOM, []byte(stampMarker)})
+	if mw.meta != nil {
+		segs = append(segs, iccSegments(mw.meta.icc)...)
+	}
+	for _, s := range segs {
+		if err := writeSegment(mw.w, s); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := mw.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,64 @@
+package stamp
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// placeOriginal puts the unmodified input f at finalOut for Options.NoStamp:
+// a byte copy, or with Options.Move a rename (a copy and delete across file
+// systems). Name collisions are handled as for stamped outputs, and the
+// output's times are set the same way.
+func placeOriginal(f *os.File, fi os.FileInfo, inPath, finalOut string, existed bool, capture captureDate, opts Options) (Result, error) {
+	of, finalOut, err := createOutput(inPath, finalOut, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	moved := false
+	if opts.Move {
+		// the empty file only reserves the name; the rename replaces it
+		of.Close()
+		f.Close() // Windows can't rename an open file
+		moved = os.Rename(inPath, finalOut) == nil
+		if !moved {
+			if f, err = os.Open(inPath); err != nil {
+				os.Remove(finalOut)
+				return Result{}, fmt.Errorf("open input: %w", err)
+			}
+			defer f.Close()
+			if of, err = os.OpenFile(finalOut, os.O_WRONLY|os.O_TRUNC, 0666); err != nil {
+				os.Remove(finalOut)
+				return Result{}, fmt.Errorf("create output: %w", err)
+			}
+		}
+	}
+	if !moved {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			of.Close()
+			os.Remove(finalOut)
+			return Result{}, fmt.Errorf("seek input: %w", err)
+		}
+		_, err := io.Copy(of, f)
+		if err == nil {
+			err = syncOutput(of, opts)
+		}
+		if cerr := of.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(finalOut)
+			return Result{}, fmt.Errorf("copy input: %w", err)
+		}
+		if opts.Move {
+			f.Close()
+			if err := os.Remove(inPath); err != nil {
+				return Result{}, fmt.Errorf("remove moved input: %w", err)
+			}
+		}
+	}
+	setOutputTimes(finalOut, capture, fi, opts)
+	res := capture.result()
+	res.Out, res.Overwritten, res.Size = finalOut, existed, fi.Size()
+	return res, nil
+}
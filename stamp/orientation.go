@@ -0,0 +1,106 @@
+package stamp
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifOrientation returns the EXIF Orientation value (1-8), or 1 when absent or invalid.
+func exifOrientation(ex *exif.Exif) int {
+	if ex == nil {
+		return 1
+	}
+	tag, err := ex.Get(exif.Orientation)
+	if err != nil || tag == nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// orientImage copies img into a new RGBA canvas rotated/flipped into upright
+// orientation according to the EXIF Orientation value. An upright RGBA img
+// is returned as is, to be drawn on in place.
+//
+//	1: normal               2: mirror horizontal
+//	3: rotate 180           4: mirror vertical
+//	5: transpose            6: rotate 90 CW
+//	7: transverse           8: rotate 90 CCW
+func orientImage(img image.Image, orientation int) *image.RGBA {
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = newRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	dst := newRGBA(orientedRect(b, orientation))
+	orientPix(dst.Pix, dst.Stride, src.Pix, src.Stride, 4, b.Dx(), b.Dy(), orientation)
+	if src != img {
+		recycle(src)
+	}
+	return dst
+}
+
+// orientImage64 is orientImage for 16-bit sources, onto an RGBA64 canvas.
+func orientImage64(img image.Image, orientation int) *image.RGBA64 {
+	b := img.Bounds()
+	src := image.NewRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	dst := image.NewRGBA64(orientedRect(b, orientation))
+	orientPix(dst.Pix, dst.Stride, src.Pix, src.Stride, 8, b.Dx(), b.Dy(), orientation)
+	return dst
+}
+
+// orientedRect is the upright canvas for an image of bounds b.
+func orientedRect(b image.Rectangle, orientation int) image.Rectangle {
+	if orientation >= 5 {
+		// orientations 5-8 swap width and height
+		return image.Rect(0, 0, b.Dy(), b.Dx())
+	}
+	return image.Rect(0, 0, b.Dx(), b.Dy())
+}
+
+// orientPix copies the w x h pixels of src, bpp bytes each, into dst turned
+// upright.
+func orientPix(dst []byte, dstStride int, src []byte, srcStride, bpp, w, h, orientation int) {
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// (sx, sy) is the source pixel that lands at (x, y) in the upright image
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			si := sy*srcStride + sx*bpp
+			di := y*dstStride + x*bpp
+			copy(dst[di:di+bpp], src[si:si+bpp])
+		}
+	}
+}
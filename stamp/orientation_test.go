@@ -0,0 +1,82 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrientImage(t *testing.T) {
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+	tests := []struct {
+		orientation int
+		size        image.Point
+		red         image.Point // where the left pixel ends up
+	}{
+		{1, image.Pt(2, 1), image.Pt(0, 0)},
+		{3, image.Pt(2, 1), image.Pt(1, 0)},
+		{6, image.Pt(1, 2), image.Pt(0, 0)},
+		{8, image.Pt(1, 2), image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		img := orientImage(src, tt.orientation)
+		if got := img.Bounds().Size(); got != tt.size {
+			t.Errorf("orientation %d: %v image, want %v", tt.orientation, got, tt.size)
+			continue
+		}
+		if got := img.RGBAAt(tt.red.X, tt.red.Y); got != red {
+			t.Errorf("orientation %d: %v at %v, want red", tt.orientation, got, tt.red)
+		}
+	}
+}
+
+// inkBounds returns the bounds of the dark pixels of img.
+func inkBounds(img image.Image) image.Rectangle {
+	var ink image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if r, g, bl, _ := img.At(x, y).RGBA(); r+g+bl < 3*0x4000 {
+				ink = ink.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return ink
+}
+
+func TestProcessOrientation(t *testing.T) {
+	tests := []struct {
+		orientation uint16
+		w, h        int
+	}{
+		{1, 200, 100},
+		{3, 200, 100},
+		{6, 100, 200},
+		{8, 100, 200},
+	}
+	for _, tt := range tests {
+		in := withExif(encodeJPEG(t, solid(200, 100, color.White)), buildTIFF([]tiffEntry{shortTag(0x0112, tt.orientation)}, nil, nil))
+		var out bytes.Buffer
+		if _, err := Process(context.Background(), bytes.NewReader(in), &out, DefaultOptions()); err != nil {
+			t.Fatalf("orientation %d: %v", tt.orientation, err)
+		}
+		img, _, err := image.Decode(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: %dx%d output, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		// the stamp goes to the bottom right of the upright image
+		ink := inkBounds(img)
+		if ink.Empty() || ink.Min.X < tt.w/2 || ink.Min.Y < tt.h/2 {
+			t.Errorf("orientation %d: stamp at %v, want it in the bottom right of the %dx%d image", tt.orientation, ink, tt.w, tt.h)
+		}
+	}
+}
@@ -0,0 +1,598 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Where the capture date of an image came from.
+const (
+	dateSourceOriginal  = "exif-original"  // EXIF DateTimeOriginal
+	dateSourceDigitized = "exif-digitized" // EXIF DateTimeDigitized (when a scanner or app digitized it)
+	dateSourceDateTime  = "exif-datetime"  // EXIF DateTime (last modified by the camera or an editor)
+	dateSourceXMP       = "xmp"            // an XMP sidecar
+	dateSourceTakeout   = "takeout"        // photoTakenTime of a Google Takeout JSON sidecar
+	dateSourceFilename  = "filename"       // a date in the file name, see DefaultNamePatterns
+	dateSourceGPS       = "gps"            // EXIF GPSDateStamp and GPSTimeStamp
+	dateSourceFallback  = "fallback"       // Options.FallbackDate
+	dateSourceMtime     = "mtime"          // file modification time
+	dateSourceNow       = "now"            // no file to take a modification time from
+)
+
+// Sources of the capture date for Options.DateSources.
+const (
+	DateSourceEXIF     = "exif"     // DateTimeOriginal, else DateTimeDigitized, else DateTime
+	DateSourceXMP      = "xmp"      // an XMP sidecar: IMG_1234.xmp or IMG_1234.CR2.xmp
+	DateSourceTakeout  = "takeout"  // a Google Takeout JSON sidecar: IMG_1234.jpg.json
+	DateSourceFilename = "filename" // a date in the file name, see Options.NamePatterns
+	DateSourceGPS      = "gps"      // the time of the GPS fix in EXIF, which is in UTC
+	DateSourceMtime    = "mtime"    // the file modification time, also the last resort
+)
+
+// DefaultDateSources is the order the capture date is looked for in by default.
+var DefaultDateSources = []string{DateSourceEXIF, DateSourceXMP, DateSourceTakeout, DateSourceFilename, DateSourceGPS, DateSourceMtime}
+
+// ParseDateSources parses a comma-separated list of date sources for
+// Options.DateSources, e.g. "xmp,exif,mtime".
+func ParseDateSources(s string) ([]string, error) {
+	var sources []string
+	for _, src := range strings.Split(s, ",") {
+		src = strings.ToLower(strings.TrimSpace(src))
+		if !slices.Contains(DefaultDateSources, src) {
+			return nil, fmt.Errorf("unknown date source %q (want exif, xmp, takeout, filename, gps or mtime)", src)
+		}
+		if slices.Contains(sources, src) {
+			return nil, fmt.Errorf("date source %q listed twice", src)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// captureDate is the EXIF and capture time read from an input.
+type captureDate struct {
+	ex       *exif.Exif
+	heifExif []byte    // raw EXIF block of a HEIF input
+	date     string    // normalized date string, e.g. "2006-01-02 15:04:05"
+	source   string    // one of the dateSource constants
+	subsec   string    // EXIF sub-second digits of date, e.g. "123"; "" when absent
+	time     time.Time // date parsed, valid when timeErr is nil
+	timeErr  error
+	takeout  *takeoutSidecar // sidecar the date came from, else nil
+	marked   bool            // the input carries stampMarker
+}
+
+// readCaptureDate reads EXIF from r and picks the capture date from the
+// first of opts.DateSources that has one, looking for sidecars and dates in
+// the file name at path ("" for none). The last resort is opts.FallbackDate,
+// else modTime, or the current time when modTime is zero. Dates without a
+// zone of their own are in opts.TimeZone.
+func readCaptureDate(r readSeekerAt, heif bool, path string, modTime time.Time, opts Options) captureDate {
+	var c captureDate
+	zone := opts.TimeZone
+	if zone == nil {
+		zone = time.Local
+	}
+	video := IsVideo(path)
+	if video {
+		// no EXIF, the container has the date
+	} else if err := c.decodeExif(r, heif); err != nil {
+		name := path
+		if name == "" {
+			name = "<stream>"
+		}
+		log.Printf("warning: %s: unreadable EXIF, using the next date source: %v", name, err)
+	}
+	sources := opts.DateSources
+	if sources == nil {
+		sources = DefaultDateSources
+	}
+	loc := zone
+	for _, src := range sources {
+		switch {
+		case src == DateSourceEXIF && video:
+			if size, err := r.Seek(0, io.SeekEnd); err == nil {
+				if t, source, ok := videoDate(r, size, zone); ok {
+					c.setTime(t, source)
+					loc = t.Location()
+				}
+			}
+		case src == DateSourceEXIF:
+			loc = c.exifDate(zone)
+		case src == DateSourceGPS:
+			if t, ok := gpsTime(c.ex); ok {
+				c.setTime(t.In(zone), dateSourceGPS)
+			}
+		case src == DateSourceMtime:
+			// below
+		case path == "":
+		case src == DateSourceXMP:
+			if t, ok := readXMP(path, zone); ok {
+				c.setTime(t, dateSourceXMP)
+				loc = t.Location()
+			}
+		case src == DateSourceTakeout:
+			if s, t, ok := readTakeout(path); ok {
+				c.setTime(t.In(zone), dateSourceTakeout)
+				c.takeout = s
+			}
+		case src == DateSourceFilename:
+			if t, subsec, ok := filenameDate(FileBase(path), opts.NamePatterns, zone); ok {
+				c.setTime(t, dateSourceFilename)
+				c.subsec = subsec
+			}
+		}
+		if c.date != "" || src == DateSourceMtime {
+			break
+		}
+	}
+	if c.date == "" {
+		loc = time.Local
+		switch {
+		case !opts.FallbackDate.IsZero():
+			c.date, c.source = opts.FallbackDate.Format("2006-01-02 15:04:05"), dateSourceFallback
+			loc = opts.FallbackDate.Location()
+		case !modTime.IsZero():
+			c.date, c.source = modTime.Format("2006-01-02 15:04:05"), dateSourceMtime
+		default:
+			c.date, c.source = time.Now().Format("2006-01-02 15:04:05"), dateSourceNow
+		}
+	}
+	c.date = normalizeExifDate(c.date)
+	c.time, c.timeErr = parseExifTime(c.date, loc)
+	if c.timeErr == nil && c.subsec != "" {
+		// a fraction of a second keeps burst frames apart and in order
+		ns, _ := strconv.Atoi((c.subsec + "000000000")[:9])
+		c.time = c.time.Add(time.Duration(ns))
+	}
+	return c
+}
+
+// maxExifScan bounds how far into a file the EXIF block is looked for. It
+// comes before the image data, within the first few segments or chunks.
+const maxExifScan = 4 << 20
+
+// decodeExif reads the EXIF of r into c. A missing or malformed EXIF block
+// leaves c.ex nil; the error reports one the parser gave up on or that
+// would have sent it astray (see exifSane), so one bad file can't take
+// down a batch.
+func (c *captureDate) decodeExif(r readSeekerAt, heif bool) (err error) {
+	defer func() {
+		// goexif panics on some vendor maker notes
+		if p := recover(); p != nil {
+			c.ex, c.heifExif, err = nil, nil, fmt.Errorf("exif parser panic: %v", p)
+		}
+	}()
+	var payload []byte
+	var hdr [8]byte
+	r.ReadAt(hdr[:], 0)
+	if heif {
+		// HEIF keeps EXIF in a separate item rather than a JPEG-style APP1 segment
+		b, err := heifExif(r)
+		if err != nil {
+			return nil
+		}
+		c.heifExif, payload = b, b
+		if bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*")) {
+			payload = append(slices.Clip(exifHeader), b...) // some writers leave out the header
+		}
+	} else if sniffTIFF(hdr[:]) {
+		// a raw file is a TIFF file whose IFDs are the EXIF, ahead of the sensor data
+		b, err := io.ReadAll(io.NewSectionReader(r, 0, maxExifScan))
+		if err != nil {
+			return nil
+		}
+		payload = append(slices.Clip(exifHeader), b...)
+	} else {
+		m, err := readJPEGMetadata(io.LimitReader(r, maxExifScan))
+		if m == nil && err != nil {
+			// not a JPEG: screenshots and phone PNGs carry EXIF in an eXIf chunk
+			if _, err := r.Seek(0, io.SeekStart); err != nil {
+				return nil
+			}
+			m, _ = readPNGMetadata(io.LimitReader(r, maxExifScan))
+		}
+		if m == nil {
+			return nil
+		}
+		c.marked = m.marked
+		if m.exif == nil {
+			return nil
+		}
+		payload = m.exif.payload
+	}
+	if !exifSane(payload) {
+		c.heifExif = nil
+		return errors.New("malformed EXIF block")
+	}
+	if c.ex, err = exif.Decode(bytes.NewReader(payload)); err != nil {
+		c.ex = nil
+	}
+	return nil
+}
+
+// exifDate takes the date from DateTimeOriginal, else DateTimeDigitized,
+// else DateTime, and returns the zone it is in: that of its offset tag,
+// else zone.
+func (c *captureDate) exifDate(zone *time.Location) *time.Location {
+	if c.ex == nil {
+		return zone
+	}
+	for _, t := range []struct {
+		name, subsec, offset exif.FieldName
+		source               string
+	}{
+		{exif.DateTimeOriginal, exif.SubSecTimeOriginal, offsetTimeOriginal, dateSourceOriginal},
+		{exif.DateTimeDigitized, exif.SubSecTimeDigitized, offsetTimeDigitized, dateSourceDigitized},
+		{exif.DateTime, exif.SubSecTime, offsetTime, dateSourceDateTime},
+	} {
+		if tag, err := c.ex.Get(t.name); err == nil && tag != nil {
+			if s, err := tag.StringVal(); err == nil && s != "" {
+				c.date, c.source = s, t.source
+				c.subsec = subsecDigits(exifString(c.ex, t.subsec))
+				if off, ok := parseOffset(exifString(c.ex, t.offset)); ok {
+					return off
+				}
+				return zone
+			}
+		}
+	}
+	return zone
+}
+
+// setTime takes the date from t, to the second, and its fraction as subsec.
+func (c *captureDate) setTime(t time.Time, source string) {
+	c.date, c.source = t.Format("2006-01-02 15:04:05"), source
+	if ns := t.Nanosecond(); ns != 0 {
+		c.subsec = strings.TrimRight(fmt.Sprintf("%09d", ns), "0")
+	}
+}
+
+// subsecDigits returns the leading digits of an EXIF SubSecTime value, at
+// most nine (nanoseconds).
+func subsecDigits(s string) string {
+	n := 0
+	for n < len(s) && n < 9 && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return s[:n]
+}
+
+// millis returns the sub-second part of the capture time as three digits,
+// e.g. "120" for SubSecTime "12", or "" when there is none.
+func (c captureDate) millis() string {
+	if c.subsec == "" || c.timeErr != nil {
+		return ""
+	}
+	return (c.subsec + "00")[:3]
+}
+
+// fromPhoto reports whether the date was read from EXIF, a sidecar or the
+// file name rather than taken from the file's times or a fallback.
+func (c captureDate) fromPhoto() bool {
+	return c.source != dateSourceMtime && c.source != dateSourceNow && c.source != dateSourceFallback
+}
+
+// latLong returns the GPS position from EXIF, else from a Takeout sidecar.
+func (c captureDate) latLong() (lat, lon float64, ok bool) {
+	if lat, lon, ok = exifLatLong(c.ex); ok || c.takeout == nil {
+		return lat, lon, ok
+	}
+	return c.takeout.latLong()
+}
+
+// result returns an Result carrying the date, as read and parsed, and its
+// source.
+func (c captureDate) result() Result {
+	res := Result{DateSource: c.source}
+	if c.fromPhoto() {
+		res.Date = c.date
+	}
+	if c.timeErr == nil {
+		res.Time = c.time
+	}
+	return res
+}
+
+// text formats the capture time with opts.DateLayout, or returns the raw
+// date string when it could not be parsed.
+func (c captureDate) text(opts Options) string {
+	if c.timeErr != nil {
+		return c.date
+	}
+	return c.displayTime(opts).Format(opts.DateLayout)
+}
+
+// displayTime returns the capture time as shown and used in names: the
+// photo's own local time, or with opts.LocalDisplay the same instant in the
+// local zone.
+func (c captureDate) displayTime(opts Options) time.Time {
+	if opts.LocalDisplay {
+		return c.time.In(time.Local)
+	}
+	return c.time
+}
+
+// checkMarked returns an ErrStamped error when the input carries the
+// marker of an image snapstamp wrote and would be stamped again, unless
+// opts.Restamp is set. Outputs stamped twice show two dates.
+func (c captureDate) checkMarked(inPath string, opts Options) error {
+	if c.marked && !opts.Restamp && !opts.NoStamp {
+		return &OptionError{"Restamp", fmt.Errorf("%w %s: written by snapstamp, stamping it again would add a second date", ErrStamped, inPath)}
+	}
+	return nil
+}
+
+// checkDated returns an ErrSkipped error when opts.RequireDate is set and
+// the image has no usable capture date of its own.
+func (c captureDate) checkDated(inPath string, opts Options) error {
+	switch {
+	case !opts.RequireDate:
+	case !c.fromPhoto():
+		return fmt.Errorf("%w %s: no capture date in its metadata (would use %s)", ErrSkipped, inPath, c.source)
+	case c.timeErr != nil:
+		return fmt.Errorf("%w %s: unusable capture date %q", ErrSkipped, inPath, c.date)
+	}
+	return nil
+}
+
+// checkRange returns an ErrSkipped error when opts.After or opts.Before is
+// set and the capture time is outside them or could not be parsed. Both
+// bounds are inclusive.
+func (c captureDate) checkRange(inPath string, opts Options) error {
+	if opts.After.IsZero() && opts.Before.IsZero() {
+		return nil
+	}
+	switch {
+	case c.timeErr != nil:
+		return &OptionError{"After", fmt.Errorf("%w %s: can't compare date %q with the date range", ErrSkipped, inPath, c.date)}
+	case !opts.After.IsZero() && c.time.Before(opts.After),
+		!opts.Before.IsZero() && c.time.After(opts.Before):
+		return &OptionError{"After", fmt.Errorf("%w %s: taken %s, outside the date range", ErrSkipped, inPath, c.date)}
+	}
+	return nil
+}
+
+// checkDimensions returns an ErrSkipped error when opts.MinWidth or
+// opts.MinHeight is set and the image is smaller. Only the header is read,
+// so tiny files are skipped without being decoded.
+func checkDimensions(r readSeekerAt, c captureDate, inPath string, opts Options) error {
+	if opts.MinWidth <= 0 && opts.MinHeight <= 0 {
+		return nil
+	}
+	w, h, err := displaySize(r, c)
+	if err != nil {
+		return err
+	}
+	if w < opts.MinWidth || h < opts.MinHeight {
+		return &OptionError{"MinWidth", fmt.Errorf("%w %s: %dx%d, below the minimum of %dx%d", ErrSkipped, inPath, w, h, opts.MinWidth, opts.MinHeight)}
+	}
+	return nil
+}
+
+// displaySize reads the image header from r and returns the size of the
+// image as displayed, after EXIF rotation.
+func displaySize(r readSeekerAt, c captureDate) (w, h int, err error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("seek input: %w", err)
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("decode image: %w", err)
+	}
+	if exifOrientation(c.ex) >= 5 {
+		// orientations 5-8 turn the image on its side
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// checkPixels reads the image header from r and returns an error when the
+// image has more than maxPixels pixels. maxPixels <= 0 disables the check.
+func checkPixels(r readSeekerAt, maxPixels int64) error {
+	if maxPixels <= 0 {
+		return nil
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek input: %w", err)
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("decode image: %w", err)
+	}
+	if n := int64(cfg.Width) * int64(cfg.Height); n > maxPixels {
+		return &OptionError{"MaxPixels", fmt.Errorf("image is %dx%d (%d pixels), more than the limit of %d", cfg.Width, cfg.Height, n, maxPixels)}
+	}
+	return nil
+}
+
+// resolveOutput returns the path an image is written to before any numeric
+// suffix is added: outPath, or with --rename a name built from the capture
+// date in the same directory. ProcessFile and PlanFile share it so a dry run
+// and --incremental see the same path the real run writes. existed reports
+// an existing file that --overwrite (or --incremental, when stale) will
+// replace; with --skip-existing an existing file is an ErrSkipped error, and
+// with --incremental a current one is an ErrUpToDate error.
+func resolveOutput(inPath, outPath string, capture captureDate, in os.FileInfo, opts Options) (finalOut string, existed bool, err error) {
+	finalOut = outPath
+	if opts.Rename {
+		name := capture.text(opts)
+		if ms := capture.millis(); ms != "" && opts.RenameFormat == nil {
+			// burst frames share the second; templates can use a ".000" layout instead
+			name += "." + ms
+		}
+		if opts.RenameFormat != nil {
+			d := renameData{templateData: newTemplateData(capture, name, opts), Name: FileBase(inPath), time: capture.displayTime(opts), timeOK: capture.timeErr == nil}
+			var b strings.Builder
+			if err := opts.RenameFormat.Execute(&b, d); err != nil {
+				return "", false, &OptionError{"RenameFormat", fmt.Errorf("rename format: %w", err)}
+			}
+			name = strings.TrimSpace(b.String())
+		}
+		// build safe filename from the date text: replace spaces with '_' and ':' or '/' with '-'
+		dateForFile := strings.ReplaceAll(name, " ", "_")
+		dateForFile = strings.ReplaceAll(dateForFile, ":", "-")
+		dateForFile = strings.ReplaceAll(dateForFile, "/", "-")
+		if opts.ASCIINames {
+			dateForFile = asciiFilename(dateForFile)
+		} else {
+			dateForFile = safeFilename(dateForFile, runtime.GOOS == "windows")
+		}
+		if dateForFile == "" {
+			dateForFile = "unknown_date"
+		}
+		finalOut = filepath.Join(filepath.Dir(outPath), dateForFile+filepath.Ext(outPath))
+	}
+	if opts.InPlace {
+		return finalOut, false, nil
+	}
+	if out, err := os.Stat(finalOut); err == nil {
+		switch {
+		case opts.SkipExisting:
+			return "", false, fmt.Errorf("%w %s: %s already exists", ErrSkipped, inPath, finalOut)
+		case opts.Incremental && upToDate(out, in, capture):
+			return "", false, fmt.Errorf("%w %s: %s", ErrUpToDate, inPath, finalOut)
+		case opts.Overwrite, opts.Incremental:
+			existed = true
+		}
+	}
+	return finalOut, existed, nil
+}
+
+// upToDate reports whether the output out is current for the input in: it
+// is newer than the input, or carries the capture time ProcessFile gives
+// its outputs (which usually predates the input's own modification time).
+func upToDate(out, in os.FileInfo, capture captureDate) bool {
+	if !out.ModTime().Before(in.ModTime()) {
+		return true
+	}
+	if capture.timeErr != nil {
+		return false
+	}
+	// allow for file systems that round times, e.g. FAT's 2 seconds
+	d := out.ModTime().Sub(capture.time)
+	return d > -2*time.Second && d < 2*time.Second
+}
+
+// suffixedPath returns p with "_i" inserted before the extension.
+func suffixedPath(p string, i int) string {
+	return filepath.Join(filepath.Dir(p), fmt.Sprintf("%s_%d%s", FileBase(p), i, filepath.Ext(p)))
+}
+
+// CreateUnique creates p, or the first of p_1, p_2, ... (before the
+// extension) that does not exist yet. The exclusive create makes the choice
+// safe between concurrent callers.
+func CreateUnique(p string) (*os.File, string, error) {
+	cand := p
+	for i := 1; i < 10000; i++ {
+		f, err := os.OpenFile(cand, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, cand, err
+		}
+		cand = suffixedPath(p, i)
+	}
+	return nil, "", fmt.Errorf("%s: no free name after 9999 numeric suffixes", p)
+}
+
+// freePath returns the name CreateUnique would pick for p right now,
+// without creating anything.
+func freePath(p string) (string, error) {
+	cand := p
+	for i := 1; i < 10000; i++ {
+		if _, err := os.Lstat(cand); errors.Is(err, fs.ErrNotExist) {
+			return cand, nil
+		}
+		cand = suffixedPath(p, i)
+	}
+	return "", fmt.Errorf("%s: no free name after 9999 numeric suffixes", p)
+}
+
+// PlanFile is the dry-run counterpart of ProcessFile: it reads the capture
+// date and resolves the output path the same way, but decodes no pixels and
+// writes nothing. With concurrent callers the numeric suffix ProcessFile
+// picks may differ.
+func PlanFile(ctx context.Context, inPath, outPath string, opts Options) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if opts.InPlace && OutputExt(inPath, "") != filepath.Ext(inPath) {
+		return Result{}, fmt.Errorf("%w %s: can't be written back in its own format", ErrSkipped, inPath)
+	}
+	video := IsVideo(inPath)
+	if video && !opts.Rename {
+		return Result{}, fmt.Errorf("%w %s: videos are only renamed, not stamped", ErrSkipped, inPath)
+	}
+	heif := isHEIF(inPath)
+	if heif && !heifSupported {
+		return Result{}, fmt.Errorf("%w %s: HEIC/HEIF support not compiled in (rebuild with -tags heif)", ErrSkipped, inPath)
+	}
+	f, err := os.Open(inPath)
+	if err != nil {
+		return Result{}, fmt.Errorf("open input: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return Result{}, fmt.Errorf("stat input: %w", err)
+	}
+	if fi.Size() < opts.MinSize {
+		return Result{}, &OptionError{"MinSize", fmt.Errorf("%w %s: %d bytes, below the minimum of %d", ErrSkipped, inPath, fi.Size(), opts.MinSize)}
+	}
+	capture := readCaptureDate(f, heif, inPath, fi.ModTime(), opts)
+	if err := capture.checkMarked(inPath, opts); err != nil {
+		return Result{}, err
+	}
+	if err := capture.checkDated(inPath, opts); err != nil {
+		return capture.result(), err
+	}
+	if err := capture.checkRange(inPath, opts); err != nil {
+		return Result{}, err
+	}
+	res := capture.result()
+	if !video {
+		pixels, err := previewOf(f, fi.Size(), isRaw(inPath), inPath)
+		if err != nil {
+			return capture.result(), err
+		}
+		if err := checkDimensions(pixels, capture, inPath, opts); err != nil {
+			return Result{}, err
+		}
+		if err := checkPixels(pixels, opts.MaxPixels); err != nil {
+			return Result{}, err
+		}
+		res.Width, res.Height, _ = displaySize(pixels, capture)
+	}
+	res.Resolved = capture.date
+	if capture.timeErr == nil {
+		res.Resolved = capture.displayTime(opts).Format("2006-01-02 15:04:05")
+	}
+	finalOut, existed, err := resolveOutput(inPath, outPath, capture, fi, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if !opts.InPlace && !opts.Overwrite && !opts.SkipExisting && !opts.Incremental {
+		if finalOut, err = freePath(finalOut); err != nil {
+			return Result{}, err
+		}
+	}
+	res.Out, res.Overwritten = finalOut, existed
+	if !opts.InPlace {
+		res.Variants = planVariants(inPath, finalOut, opts)
+	}
+	return res, nil
+}
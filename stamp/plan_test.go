@@ -0,0 +1,219 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image/color"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessFileConcurrent(t *testing.T) {
+	// distinct inputs all aimed at the same output: every worker must get
+	// a name of its own
+	const n = 8
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.jpg")
+	var inputs []string
+	for i := range n {
+		p := filepath.Join(dir, fmt.Sprintf("in%d.jpg", i))
+		if err := os.WriteFile(p, dated(t, 80, 60, fmt.Sprintf("2023:07:14 10:30:%02d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, p)
+	}
+	results := make([]Result, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i, in := range inputs {
+		wg.Go(func() {
+			results[i], errs[i] = ProcessFile(context.Background(), in, out, DefaultOptions())
+		})
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for i, res := range results {
+		if errs[i] != nil {
+			t.Fatalf("%s: %v", inputs[i], errs[i])
+		}
+		if seen[res.Out] {
+			t.Errorf("%s written twice", res.Out)
+		}
+		seen[res.Out] = true
+		fi, err := os.Stat(res.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != res.Size {
+			t.Errorf("%s: %d bytes on disk, %d reported", res.Out, fi.Size(), res.Size)
+		}
+	}
+}
+
+func TestCreateUniqueConcurrent(t *testing.T) {
+	const n = 32
+	p := filepath.Join(t.TempDir(), "a.png")
+	names := make(chan string, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			f, name, err := CreateUnique(p)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			f.Close()
+			names <- name
+		})
+	}
+	wg.Wait()
+	close(names)
+	seen := map[string]bool{}
+	for name := range names {
+		if seen[name] {
+			t.Errorf("%s handed out twice", name)
+		}
+		seen[name] = true
+	}
+	if len(seen) != n {
+		t.Errorf("%d names for %d callers", len(seen), n)
+	}
+}
+
+// pngHeader returns the signature and IHDR of a w x h RGB PNG, followed by
+// a few bytes of IDAT: enough for image.DecodeConfig, not for a decode.
+func pngHeader(w, h uint32) []byte {
+	chunk := func(typ string, data []byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		b = append(append(b, typ...), data...)
+		return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+	}
+	ihdr := binary.BigEndian.AppendUint32(nil, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0) // 8-bit RGB
+	b := append([]byte("\x89PNG\r\n\x1a\n"), chunk("IHDR", ihdr)...)
+	return append(b, chunk("IDAT", []byte{0x78, 0x9c, 0, 0})...)
+}
+
+func TestMaxPixels(t *testing.T) {
+	// a 100000x100000 image would take 40 GB to decode: it must be refused
+	// from its header alone
+	in := pngHeader(100000, 100000)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := Process(context.Background(), bytes.NewReader(in), &bytes.Buffer{}, DefaultOptions())
+	runtime.ReadMemStats(&after)
+	var optErr *OptionError
+	if !errors.As(err, &optErr) || optErr.Option != "MaxPixels" || strings.Contains(err.Error(), "--") {
+		t.Fatalf("error %v, want the MaxPixels limit without naming a flag", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+		t.Errorf("%d MB allocated to refuse the image", n>>20)
+	}
+
+	// the limit is on width times height, and 0 disables it
+	opts := DefaultOptions()
+	opts.MaxPixels = 100*100 - 1
+	if err := checkPixels(bytes.NewReader(pngHeader(100, 100)), opts.MaxPixels); err == nil {
+		t.Errorf("100x100 with a limit of %d: no error", opts.MaxPixels)
+	}
+	if err := checkPixels(bytes.NewReader(pngHeader(100, 100)), 100*100); err != nil {
+		t.Errorf("100x100 with a limit of 10000: %v", err)
+	}
+	if err := checkPixels(bytes.NewReader(pngHeader(100000, 100000)), 0); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+}
+
+func TestRenameSubSecond(t *testing.T) {
+	// a burst: three frames in the same second, apart by their sub-second
+	// time, each in the SubSecTime tag of the date it was taken from
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	date := "2023:07:14 10:30:05"
+	frames := []struct {
+		name         string
+		ifd0, exif   []tiffEntry
+		want, source string
+		ns           int
+	}{
+		{"a.jpg", nil, []tiffEntry{asciiTag(0x9003, date), asciiTag(0x9291, "12")}, "2023-07-14_10-30-05.120.jpg", "exif-original", 120_000_000},
+		{"b.jpg", nil, []tiffEntry{asciiTag(0x9004, date), asciiTag(0x9292, "345 ")}, "2023-07-14_10-30-05.345.jpg", "exif-digitized", 345_000_000},
+		{"c.jpg", []tiffEntry{asciiTag(0x0132, date)}, []tiffEntry{asciiTag(0x9290, "9")}, "2023-07-14_10-30-05.900.jpg", "exif-datetime", 900_000_000},
+	}
+	opts := DefaultOptions()
+	opts.Rename = true
+	opts.TimeZone = time.UTC
+	for _, f := range frames {
+		in := filepath.Join(dir, f.name)
+		if err := os.WriteFile(in, withExif(encodeJPEG(t, solid(40, 30, color.White)), buildTIFF(f.ifd0, f.exif, nil)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		res, err := ProcessFile(context.Background(), in, filepath.Join(out, f.name), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(res.Out) != f.want || res.DateSource != f.source {
+			t.Errorf("%s: wrote %s from %s, want %s from %s", f.name, filepath.Base(res.Out), res.DateSource, f.want, f.source)
+		}
+		if res.Time.Nanosecond() != f.ns {
+			t.Errorf("%s: time %v, want %dns past the second", f.name, res.Time, f.ns)
+		}
+		fi, err := os.Stat(res.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.ModTime().Nanosecond() != f.ns {
+			t.Errorf("%s: output time %v, want the sub-second capture time", f.name, fi.ModTime())
+		}
+	}
+}
+
+func TestBadExif(t *testing.T) {
+	// corrupt EXIF blocks that would have goexif allocate 4 GiB, loop
+	// forever or give up; each file is stamped with the date in its name
+	for _, name := range []string{"count", "loop", "offset"} {
+		in := filepath.Join("testdata", "badexif_20230714_103005_"+name+".jpg")
+		res, err := ProcessFile(context.Background(), in, filepath.Join(t.TempDir(), "out.jpg"), DefaultOptions())
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if res.DateSource != dateSourceFilename || res.Date != "2023-07-14 10:30:05" {
+			t.Errorf("%s: %s from %s, want 2023-07-14 10:30:05 from the file name", name, res.Date, res.DateSource)
+		}
+	}
+}
+
+func TestDigitizedDate(t *testing.T) {
+	// testdata/digitized.jpg is a scan: DateTimeDigitized 2023:07:14
+	// 10:30:05, no DateTimeOriginal, and a later DateTime from an editor
+	in := filepath.Join("testdata", "digitized.jpg")
+	for _, rename := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Rename, opts.TimeZone = rename, time.UTC
+		out := t.TempDir()
+		res, err := ProcessFile(context.Background(), in, filepath.Join(out, "digitized.jpg"), opts)
+		if err != nil {
+			t.Fatalf("rename %v: %v", rename, err)
+		}
+		if res.DateSource != dateSourceDigitized || res.Date != "2023-07-14 10:30:05" {
+			t.Errorf("rename %v: %s from %s, want 2023-07-14 10:30:05 from DateTimeDigitized", rename, res.Date, res.DateSource)
+		}
+		if want := map[bool]string{false: "digitized.jpg", true: "2023-07-14_10-30-05.jpg"}[rename]; filepath.Base(res.Out) != want {
+			t.Errorf("rename %v: wrote %s, want %s", rename, filepath.Base(res.Out), want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package stamp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// maxPNGChunk bounds the ancillary chunks read from PNG inputs, and the
+// ICC profile decompressed from iCCP; real ones are a few kilobytes.
+const maxPNGChunk = 4 << 20
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunk is an ancillary PNG chunk copied from the input.
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// pngColorChunks are the unsafe-to-copy chunks that stay valid for a
+// stamped image: they describe the color space, which stamping keeps.
+// Others (sBIT, bKGD, tRNS, hIST, tIME, ...) depend on the pixels or their
+// encoding and are dropped.
+var pngColorChunks = map[string]bool{"gAMA": true, "cHRM": true, "sRGB": true}
+
+// readPNGMetadata reads the chunks of a PNG before its image data and keeps
+// the ICC profile (iCCP), the EXIF (eXIf, as an APP1 payload) and the
+// ancillary chunks worth copying into a PNG output: the safe-to-copy ones
+// (tEXt, zTXt, iTXt, pHYs, ...) and pngColorChunks. Chunks with a bad CRC
+// are left out. Non-PNG input returns an error.
+func readPNGMetadata(r io.Reader) (*imageMetadata, error) {
+	br := bufio.NewReader(r)
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return nil, errors.New("not a png")
+	}
+	m := &imageMetadata{}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return m, err
+		}
+		n, typ := binary.BigEndian.Uint32(hdr[:4]), string(hdr[4:])
+		if typ == "IDAT" || typ == "IEND" {
+			return m, nil
+		}
+		// bit 5 of the first byte marks ancillary chunks, of the last byte safe-to-copy ones
+		ancillary, safe := hdr[4]&0x20 != 0, hdr[7]&0x20 != 0
+		if !ancillary || n > maxPNGChunk || !(safe || typ == "iCCP" || pngColorChunks[typ]) {
+			if _, err := br.Discard(int(n) + 4); err != nil { // data and CRC
+				return m, err
+			}
+			continue
+		}
+		data := make([]byte, n+4)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return m, err
+		}
+		data, sum := data[:n], binary.BigEndian.Uint32(data[n:])
+		if crc32.Update(crc32.ChecksumIEEE(hdr[4:]), crc32.IEEETable, data) != sum {
+			continue
+		}
+		switch typ {
+		case "iCCP":
+			m.icc = pngICC(data)
+		case "eXIf":
+			m.exif = &jpegSegment{markerAPP1, append(bytes.Clone(exifHeader), data...)}
+		case "tEXt":
+			if bytes.Equal(data, pngMarker) {
+				m.marked = true // the output gets a marker of its own
+				continue
+			}
+			m.png = append(m.png, pngChunk{typ, data})
+		default:
+			m.png = append(m.png, pngChunk{typ, data})
+		}
+	}
+}
+
+// pngICC returns the profile in the data of an iCCP chunk: a name, NUL,
+// compression method 0 (zlib) and the compressed profile. It returns nil
+// for anything malformed.
+func pngICC(data []byte) []byte {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+2 > len(data) || data[i+1] != 0 {
+		return nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+	profile, err := io.ReadAll(io.LimitReader(zr, maxPNGChunk+1))
+	if err != nil || len(profile) > maxPNGChunk {
+		return nil
+	}
+	return profile
+}
+
+// pngChunks returns the chunks to insert into a PNG output, in an order
+// the PNG rules allow right after IHDR: the stampMarker tEXt chunk, the
+// color chunks (which must come before PLTE), the copied chunks in their
+// original order, then eXIf. m may be nil.
+func (m *imageMetadata) pngChunks() []byte {
+	b := appendPNGChunk(nil, "tEXt", pngMarker)
+	if m == nil {
+		return b
+	}
+	if m.icc != nil {
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(m.icc)
+		zw.Close()
+		b = appendPNGChunk(b, "iCCP", append([]byte("ICC profile\x00\x00"), z.Bytes()...))
+	}
+	for _, c := range m.png {
+		// iCCP and sRGB exclude each other; the profile is the more precise
+		if pngColorChunks[c.typ] && (m.icc == nil || c.typ != "sRGB") {
+			b = appendPNGChunk(b, c.typ, c.data)
+		}
+	}
+	for _, c := range m.png {
+		if !pngColorChunks[c.typ] {
+			b = appendPNGChunk(b, c.typ, c.data)
+		}
+	}
+	if m.exif != nil {
+		b = appendPNGChunk(b, "eXIf", m.exif.payload[len(exifHeader):])
+	}
+	return b
+}
+
+// appendPNGChunk appends a chunk of type typ with its length and CRC.
+func appendPNGChunk(b []byte, typ string, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	start := len(b)
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+// pngChunkWriter wraps the writer handed to png.Encode and inserts chunks
+// right after the signature and IHDR chunk the encoder writes first.
+type pngChunkWriter struct {
+	w      io.Writer
+	chunks []byte
+	head   []byte // bytes seen before IHDR was complete
+	done   bool
+}
+
+// pngHeadSize is the signature plus the IHDR chunk: length, type, 13 bytes
+// of data and the CRC.
+const pngHeadSize = 8 + 4 + 4 + 13 + 4
+
+func (pw *pngChunkWriter) Write(p []byte) (int, error) {
+	if pw.done {
+		return pw.w.Write(p)
+	}
+	n := len(p)
+	need := pngHeadSize - len(pw.head)
+	if len(p) < need {
+		pw.head = append(pw.head, p...)
+		return n, nil
+	}
+	pw.head = append(pw.head, p[:need]...)
+	p = p[need:]
+	pw.done = true
+	for _, b := range [][]byte{pw.head, pw.chunks, p} {
+		if _, err := pw.w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
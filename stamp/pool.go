@@ -0,0 +1,75 @@
+package stamp
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"os"
+	"sync"
+)
+
+// pixPool recycles the pixel buffers of RGBA canvases between images. A
+// batch from one camera needs the same size over and over, and each 24 MP
+// canvas would otherwise be 96 MB of garbage.
+var pixPool sync.Pool // of *[]byte
+
+// newRGBA is image.NewRGBA on a pooled buffer when one is large enough.
+// The pixels are not cleared: callers overwrite all of them.
+func newRGBA(r image.Rectangle) *image.RGBA {
+	n := 4 * r.Dx() * r.Dy()
+	if p, ok := pixPool.Get().(*[]byte); ok && cap(*p) >= n {
+		return &image.RGBA{Pix: (*p)[:n], Stride: 4 * r.Dx(), Rect: r}
+	}
+	return image.NewRGBA(r)
+}
+
+// recycle hands the buffer of an RGBA img back to newRGBA; img must not be
+// used afterwards. Other images are left to the garbage collector.
+func recycle(img image.Image) {
+	if rgba, ok := img.(*image.RGBA); ok && rgba != nil {
+		p := rgba.Pix[:0]
+		pixPool.Put(&p)
+	}
+}
+
+// inputPool recycles the buffers Process reads whole inputs into, so a
+// server stamping upload after upload doesn't grow a new one every time.
+var inputPool sync.Pool // of *bytes.Buffer
+
+// readInput reads all of r into a pooled buffer, allocated once at the
+// right size when r knows its length: a regular file, or anything with a
+// Len method such as a bytes.Reader. done hands the buffer back; data must
+// not be used afterwards.
+func readInput(r io.Reader) (data []byte, done func(), err error) {
+	buf, ok := inputPool.Get().(*bytes.Buffer)
+	if !ok {
+		buf = new(bytes.Buffer)
+	}
+	buf.Reset()
+	if n := sizeHint(r); n > 0 {
+		// ReadFrom wants MinRead spare bytes before it sees the end
+		buf.Grow(int(n) + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		inputPool.Put(buf)
+		return nil, nil, err
+	}
+	return buf.Bytes(), func() { inputPool.Put(buf) }, nil
+}
+
+// sizeHint returns the number of bytes left in r, or 0 when it can't tell.
+func sizeHint(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0
+		}
+		if pos, err := r.Seek(0, io.SeekCurrent); err == nil && pos <= fi.Size() {
+			return fi.Size() - pos
+		}
+	}
+	return 0
+}
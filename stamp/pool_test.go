@@ -0,0 +1,42 @@
+package stamp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// BenchmarkCanvasPool stamps a batch of same-sized JPEGs with the canvas
+// buffers recycled between images, and with the pool emptied before every
+// image so each canvas is allocated afresh.
+func BenchmarkCanvasPool(b *testing.B) {
+	dir := b.TempDir()
+	var inputs []string
+	for i := range 20 {
+		in := filepath.Join(dir, fmt.Sprintf("in%d.jpg", i))
+		if err := os.WriteFile(in, encodeJPEG(b, noise(1200, 900)), 0644); err != nil {
+			b.Fatal(err)
+		}
+		inputs = append(inputs, in)
+	}
+	out := filepath.Join(dir, "out.jpg")
+	opts := DefaultOptions()
+	for _, pooled := range []bool{true, false} {
+		b.Run(map[bool]string{true: "pooled", false: "unpooled"}[pooled], func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				for _, in := range inputs {
+					if !pooled {
+						pixPool = sync.Pool{}
+					}
+					if _, err := ProcessFile(context.Background(), in, out, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
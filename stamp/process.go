@@ -0,0 +1,1120 @@
+package stamp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	_ "golang.org/x/image/webp"
+)
+
+// ErrSkipped is wrapped by the errors of inputs that were intentionally not
+// processed, e.g. an existing output with Options.SkipExisting.
+var ErrSkipped = errors.New("skipped")
+
+// ErrUpToDate wraps ErrSkipped for inputs left alone by Options.Incremental
+// because their output is current.
+var ErrUpToDate = fmt.Errorf("%w (up to date)", ErrSkipped)
+
+// ErrStamped wraps ErrSkipped for inputs that carry the marker of an image
+// snapstamp wrote, unless Options.Restamp is set.
+var ErrStamped = fmt.Errorf("%w (already stamped)", ErrSkipped)
+
+// OptionError is an error caused by a setting of Options, such as an input
+// below MinSize or a font refused by StrictFont. Option names the field, so
+// a front end can point at whatever sets it; the error may wrap ErrSkipped.
+type OptionError struct {
+	Option string // the field of Options, e.g. "MinSize"
+	Err    error
+}
+
+func (e *OptionError) Error() string { return e.Err.Error() }
+
+func (e *OptionError) Unwrap() error { return e.Err }
+
+// isHEIF reports whether path has a HEIC/HEIF extension.
+func isHEIF(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// sniffHEIF reports whether data starts like a HEIF file: an ISO BMFF
+// "ftyp" box with a HEIC/HEIF brand.
+func sniffHEIF(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(data[8:12]) {
+	case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// OutputExt returns the extension for the output of inPath: the input's own
+// extension unless an output format is forced or the input format can't be
+// encoded (e.g. WebP), in which case the output is JPEG. Videos keep theirs.
+func OutputExt(inPath, outputFormat string) string {
+	switch outputFormat {
+	case "jpg":
+		return ".jpg"
+	case "png":
+		return ".png"
+	}
+	ext := filepath.Ext(inPath)
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return ext
+	}
+	if IsVideo(inPath) {
+		return ext // copied as it is
+	}
+	return ".jpg"
+}
+
+// flattenOnto composites img over an opaque background color in place.
+func flattenOnto(img *image.RGBA, bg color.Color) {
+	br, bgc, bb, _ := bg.RGBA()
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		a := uint32(img.Pix[i+3])
+		if a == 255 {
+			continue
+		}
+		// Pix is premultiplied: out = src + bg*(1-alpha)
+		img.Pix[i+0] = uint8(uint32(img.Pix[i+0]) + (br>>8)*(255-a)/255)
+		img.Pix[i+1] = uint8(uint32(img.Pix[i+1]) + (bgc>>8)*(255-a)/255)
+		img.Pix[i+2] = uint8(uint32(img.Pix[i+2]) + (bb>>8)*(255-a)/255)
+		img.Pix[i+3] = 255
+	}
+}
+
+// FileBase returns the last element of path without its extension.
+func FileBase(path string) string {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return name
+	}
+	return name[:len(name)-len(ext)]
+}
+
+// Options controls what is stamped on an image and how the output is
+// written. The zero value is not useful; start from DefaultOptions.
+type Options struct {
+	// Layout
+	MarginPercent        int              // margin as percent of the side chosen by Side
+	MarginPx             int              // absolute margin in pixels, used instead of MarginPercent when >= 0
+	Fonts                []*opentype.Font // fallback chain, first match per glyph wins; empty uses a built-in bitmap font
+	WidthPercent         int              // widest line as percent of the side chosen by Side
+	WidthPercentPortrait int              // WidthPercent for images taller than wide, once oriented; 0 for the same
+	FontSize             float64          // points; takes precedence over HeightPercent and WidthPercent
+	HeightPercent        int              // line height as percent of the image height; takes precedence over WidthPercent
+	Side                 string           // side the percentages refer to: "width", "long" or "short"
+	Position             string           // "bottom-right", "bottom-left", "top-right", "top-left", "bottom-center" or "auto" for the corner with the least detail
+	Align                string           // lines within the stamp: "left", "center", "right" or "" to follow Position
+	MinLineHeight        int              // pixels; a stamp whose lines come out lower skips the image, 0 for no minimum
+	ForceMinLineHeight   bool             // enlarge a stamp below MinLineHeight to it instead of skipping
+	Rotate               int              // stamp rotation in degrees counter-clockwise: 0, 90, 180 or 270
+
+	// Text
+	DateLayout   string             // Go time layout of the date
+	TimeZone     *time.Location     // zone of EXIF dates without an offset tag; nil for the local zone
+	LocalDisplay bool               // show the date converted to the local zone instead of the photo's own time
+	DateSources  []string           // where to look for the capture date, in order; nil for DefaultDateSources
+	FallbackDate time.Time          // date of images without one instead of their modification time; zero for none
+	NamePatterns []*regexp.Regexp   // date shapes tried on the file name when EXIF has no date, see DefaultNamePatterns
+	Template     *template.Template // replaces the date, see ParseTemplate
+	RenameFormat *template.Template // with Rename: names the output instead of the date, see ParseRenameTemplate
+	Text         string             // replaces the date in the stamp (Rename still uses the date)
+	TextAppend   bool               // add Text below the date instead
+	ShowCamera   bool
+	ShowExposure bool
+	ShowPlace    bool      // needs Geo
+	Geo          *GeoIndex // see LoadGeoDB
+	ShowArtist   bool
+	Artist       string // fallback for ShowArtist when the tags are empty
+	ShowGPS      bool
+	GPS          GPSFormat
+
+	// Look
+	TextColor    color.RGBA
+	AutoColor    bool // pick TextColor/OutlineColor per image from the background
+	OutlineColor color.RGBA
+	Style        string // "outline", "shadow", "plain" or "lcd"
+	ShadowColor  color.RGBA
+	ShadowOffset int    // pixels; 0 derives it from the line height
+	Opacity      int    // percent applied to every stamp color; 0 draws nothing
+	Frame        string // "", "bar" or "polaroid"
+	FrameSize    int    // frame strip height in percent of the image height
+	FrameColor   color.RGBA
+	StrictFont   bool // refuse to stamp with the built-in bitmap font
+
+	// Output
+	OutputFormat  string // "jpg", "png" or "" to follow the input format
+	StripMetadata bool   // don't copy EXIF, the ICC profile or PNG ancillary chunks into the output
+	StripGPS      bool   // drop the GPS IFD from copied EXIF
+	Verbose       bool   // log per-image decisions such as automatic colors
+	MaxPixels     int64  // refuse to decode images with more pixels than this; 0 for no limit
+	Scale         int    // downscale to this percent of the size; 0 or 100 keeps it
+	MaxDimension  int    // downscale so the long edge is at most this many pixels; 0 for no limit
+	Restamp       bool   // stamp inputs that carry the marker of a snapstamp output (see ErrStamped) again
+
+	// ProcessFile only
+	Rename       bool   // name the output after the capture date, in the directory of outPath; videos (IsVideo) are placed only with it
+	ASCIINames   bool   // Rename: replace all but ASCII letters, digits, '-', '_' and '.' in the name
+	InPlace      bool   // overwrite inPath; outPath is ignored
+	Overwrite    bool   // replace an existing output instead of picking a unique name
+	SkipExisting bool   // skip the input when its output already exists
+	Incremental  bool   // skip the input when its output is up to date, replace a stale one
+	InRoot       string // input directory, mirrored under BackupDir
+	BackupDir    string // InPlace: copy originals here first
+	Touch        bool   // leave the output's times at writing time instead of the capture time (InPlace: the original's)
+	NoStamp      bool   // copy the original bytes to the output instead of stamping; no decoding
+	Move         bool   // NoStamp: move the input instead of copying it
+	RequireDate  bool   // skip the input when its date would come from its file times or FallbackDate
+	Fsync        bool   // sync each output to disk before reporting it written
+
+	// ProcessFile only: inputs to skip; zero values set no limit
+	After     time.Time // skip images taken earlier (inclusive bound)
+	Before    time.Time // skip images taken later (inclusive bound)
+	MinSize   int64     // skip files smaller than this many bytes
+	MinWidth  int       // skip images narrower than this, in pixels after EXIF orientation
+	MinHeight int       // skip images shorter than this, in pixels after EXIF orientation
+
+	// ProcessFile only, not with InPlace: downscaled copies written from the
+	// same decode, each below OutRoot/<name> mirroring the output's path
+	// below OutRoot
+	Variants []Variant
+	OutRoot  string
+
+	// shared by concurrent calls, which wait before decoding until their
+	// image fits; nil for no limit
+	Memory *MemoryBudget
+}
+
+// DefaultMaxPixels is the default Options.MaxPixels: 200 megapixels, an
+// RGBA buffer of 800 MB.
+const DefaultMaxPixels = 200_000_000
+
+// DefaultOptions returns the settings of the snapstamp command without flags.
+func DefaultOptions() Options {
+	return Options{
+		MarginPercent: 5,
+		MarginPx:      -1,
+		WidthPercent:  40,
+		Side:          "width",
+		Position:      "bottom-right",
+		DateLayout:    "2006-01-02 15:04:05",
+		GPS:           GPSFormat{Precision: 5},
+		TextColor:     color.RGBA{0, 0, 0, 255},
+		OutlineColor:  color.RGBA{255, 255, 255, 255},
+		Style:         "outline",
+		ShadowColor:   color.RGBA{0, 0, 0, 0x99},
+		Opacity:       100,
+		FrameSize:     12,
+		FrameColor:    color.RGBA{255, 255, 255, 255},
+		MaxPixels:     DefaultMaxPixels,
+		NamePatterns:  DefaultNamePatterns,
+	}
+}
+
+// Result reports what Process or ProcessFile wrote.
+type Result struct {
+	Out         string    // final output path; empty for Process
+	Overwritten bool      // Out existed and was replaced (Options.Overwrite)
+	Size        int64     // bytes written
+	InSize      int64     // bytes of the input
+	Date        string    // capture date from EXIF, a sidecar or the file name as "2006-01-02 15:04:05", empty when the image had none
+	DateSource  string    // where the capture date came from: "exif-original", "exif-digitized", "exif-datetime", "xmp", "takeout", "filename", "gps", "fallback", "mtime" or "now", and for videos "quicktime" or "mvhd"
+	Time        time.Time // the date parsed, in the photo's own zone, whatever its source; zero when it couldn't be
+	Position    string    // the corner the stamp went to, which Options.Position "auto" chose; empty when nothing was drawn
+
+	// set by PlanFile: the input's size as displayed, after EXIF rotation
+	// (zero when the image header can't be read), and the date the stamp
+	// and Options.Rename use, whatever its source
+	Width, Height int
+	Resolved      string
+
+	// how long the stages of stamping took; zero for inputs that didn't
+	// get that far
+	Timing Timing
+
+	// one per Options.Variants, in order
+	Variants []VariantResult
+}
+
+// Timing is the time stamping one image spent in each stage. Decode
+// includes reading the input and its metadata, Draw includes resizing and
+// the variants, and Encode includes writing all outputs. Time spent waiting
+// for Options.Memory isn't counted.
+type Timing struct {
+	Decode time.Duration
+	Draw   time.Duration
+	Encode time.Duration
+}
+
+// readSeekerAt is an input both the EXIF and the image decoders can read.
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// stampText builds the text drawn on an image: the date (or Text/Template)
+// followed by the optional lines of Options.
+func stampText(capture captureDate, opts Options) (string, error) {
+	ex := capture.ex
+	captureTime, timeErr := capture.displayTime(opts), capture.timeErr
+	dateText := capture.text(opts)
+	text := dateText
+	if opts.Style == "lcd" {
+		// the segment display only has digits: always the film camera 'YY MM DD
+		if timeErr == nil {
+			text = captureTime.Format(lcdDateLayout)
+		}
+		return text, nil
+	} else if opts.Text != "" {
+		text = opts.Text
+		if opts.TextAppend {
+			text = dateText + "\n" + opts.Text
+		}
+	} else if opts.Template != nil {
+		s, err := renderTemplate(opts.Template, newTemplateData(capture, dateText, opts))
+		if err != nil {
+			return "", fmt.Errorf("render template: %w", err)
+		}
+		text = s
+	}
+	// optional lines below the date; each one is left out when its tags are missing
+	lines := []string{text}
+	if opts.ShowCamera {
+		if camera := cameraName(ex); camera != "" {
+			lines = append(lines, camera)
+		}
+	}
+	if opts.ShowExposure {
+		if exposure := exposureLine(newTemplateData(capture, dateText, opts)); exposure != "" {
+			lines = append(lines, exposure)
+		}
+	}
+	if opts.ShowPlace {
+		if lat, lon, ok := capture.latLong(); ok {
+			if place := opts.Geo.place(lat, lon); place != "" {
+				lines = append(lines, place)
+			}
+		}
+	}
+	if opts.ShowArtist || opts.Artist != "" {
+		name := artistName(ex)
+		if name == "" {
+			name = opts.Artist
+		}
+		if name != "" {
+			line := "© " + name
+			if timeErr == nil {
+				line = fmt.Sprintf("© %d %s", captureTime.Year(), name)
+			}
+			lines = append(lines, line)
+		}
+	}
+	if opts.ShowGPS {
+		if lat, lon, ok := capture.latLong(); ok {
+			_, _, gps := opts.GPS.format(lat, lon)
+			lines = append(lines, gps)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// stamped is a decoded image with the stamp drawn, ready to be encoded. img
+// is an RGBA, RGBA64, Gray or Gray16 image (see colorspace.go).
+type stamped struct {
+	img    image.Image
+	anim   *gif.GIF // set instead of img for animated GIF output
+	format string   // "gif", "png" or "jpg"
+	meta   *imageMetadata
+
+	position string // where the stamp went, see Options.Position "auto"
+}
+
+// decoded is an input decoded and turned upright, before the stamp is
+// drawn: either a still canvas (see colorspace.go) or an animated GIF.
+type decoded struct {
+	canvas draw.Image
+	anim   *gif.GIF
+	gray   bool   // grayscale source, written back as one channel
+	format string // output format: "gif", "png" or "jpg"
+	meta   *imageMetadata
+}
+
+// decodeImage decodes r, with the metadata to copy into the output, and
+// turns it upright.
+func decodeImage(r readSeekerAt, capture captureDate, animated bool, opts Options) (*decoded, error) {
+	out := &decoded{format: opts.OutputFormat}
+
+	// keep the source EXIF, ICC profile and PNG chunks so they can be copied into the output
+	if !opts.StripMetadata {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seek input: %w", err)
+		}
+		if capture.heifExif != nil {
+			out.meta = &imageMetadata{exif: &jpegSegment{markerAPP1, capture.heifExif}}
+		} else if m, err := readJPEGMetadata(r); err == nil {
+			out.meta = m
+		} else if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seek input: %w", err)
+		} else if m, err := readPNGMetadata(r); err == nil {
+			out.meta = m
+		}
+	}
+
+	// read the header first so a decompression bomb fails before any pixels are allocated
+	if err := checkPixels(r, opts.MaxPixels); err != nil {
+		return nil, err
+	}
+	// seek back to beginning for image decoding
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek input: %w", err)
+	}
+
+	if animated && out.format == "" {
+		// keep GIFs animated: stamp every frame instead of flattening the first one
+		anim, err := gif.DecodeAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("decode gif: %w", err)
+		}
+		out.anim, out.format = anim, "gif"
+		return out, nil
+	}
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	// see colorspace.go for how the decoded color model carries into the output
+	out.gray = isGray(img)
+	if out.meta != nil && out.meta.icc != nil {
+		// keep the profile only where it describes the output's pixels
+		want := "RGB "
+		if out.gray {
+			want = "GRAY"
+		}
+		if iccColorSpace(out.meta.icc) != want {
+			out.meta.icc = nil
+		}
+	}
+
+	if out.format == "" {
+		out.format = "jpg"
+		if format == "png" {
+			out.format = "png"
+		}
+	}
+
+	// rotate/flip into upright orientation so the stamp lands in the visual corner
+	if out.format == "png" && is16Bit(img) {
+		out.canvas = orientImage64(img, exifOrientation(capture.ex))
+	} else {
+		rgba := orientImage(img, exifOrientation(capture.ex))
+		if out.format == "jpg" && !rgba.Opaque() {
+			// JPEG has no alpha: composite onto white instead of letting transparency turn black
+			flattenOnto(rgba, color.White)
+		}
+		out.canvas = rgba
+	}
+	return out, nil
+}
+
+// stamp resizes the decoded image for opts and draws text on it. With keep
+// the decoded pixels are left untouched so they can be stamped again, e.g.
+// for Options.Variants; otherwise they may be drawn on in place or
+// recycled, and d can't be stamped again.
+func (d *decoded) stamp(text, name string, opts Options, keep bool) (*stamped, error) {
+	out := &stamped{format: d.format, meta: d.meta}
+	if d.anim != nil {
+		anim := d.anim
+		if keep {
+			// resizing and stamping replace frames rather than drawing on them
+			c := *anim
+			c.Image = slices.Clone(anim.Image)
+			anim = &c
+		}
+		resizeGIF(anim, opts)
+		position, err := stampGIF(name, anim, text, opts)
+		if err != nil {
+			return nil, err
+		}
+		out.position, out.anim = position, anim
+		return out, nil
+	}
+
+	// shrink before laying out so the stamp is sized for the output
+	canvas := resizeImage(d.canvas, opts)
+	if keep && canvas == d.canvas {
+		canvas = newCanvas(d.canvas, d.canvas.Bounds())
+		draw.Draw(canvas, canvas.Bounds(), d.canvas, d.canvas.Bounds().Min, draw.Src)
+	} else if !keep && canvas != d.canvas {
+		recycle(d.canvas)
+	}
+	bounds := canvas.Bounds()
+
+	if opts.Frame != "" {
+		// stamp into a strip added below the photo instead of over it
+		framed, strip := frameImage(canvas, opts.Frame, opts.FrameSize, opts.FrameColor)
+		recycle(canvas)
+		canvas, bounds = framed, strip
+		opts = frameOptions(opts, text)
+	}
+	layout, position, err := placeStamp(name, canvas, bounds, text, opts)
+	if err != nil {
+		recycle(canvas)
+		return nil, err
+	}
+	out.position = position
+	if opts.AutoColor {
+		opts.TextColor, opts.OutlineColor = pickAutoColors(name, canvas, layout, opts.Verbose)
+	}
+	layout.draw(canvas, opts)
+	layout.release()
+	out.img = canvas
+	if d.gray {
+		out.img = grayImage(canvas)
+	}
+	return out, nil
+}
+
+// encode writes the stamped image to w in its output format.
+func (s *stamped) encode(w io.Writer, opts Options) error {
+	if s.meta != nil && s.meta.exif != nil {
+		// pixels are already upright, so the copied tag must say so
+		resetOrientation(s.meta.exif.payload)
+		if s.img != nil {
+			// rotation, --frame and resizing change the size the camera recorded
+			setPixelDimensions(s.meta.exif.payload, s.img.Bounds().Dx(), s.img.Bounds().Dy())
+		}
+		if opts.StripGPS {
+			stripGPS(s.meta.exif.payload)
+		}
+	}
+	switch s.format {
+	case "gif":
+		if err := gif.EncodeAll(w, s.anim); err != nil {
+			return fmt.Errorf("encode gif: %w", err)
+		}
+	case "png":
+		// keeps DPI, text, EXIF and the color profile; without the profile
+		// wide-gamut colors (Display P3, Adobe RGB) shift
+		w = &pngChunkWriter{w: w, chunks: s.meta.pngChunks()}
+		if err := png.Encode(w, s.img); err != nil {
+			return fmt.Errorf("encode png: %w", err)
+		}
+	default:
+		w = &metadataWriter{w: w, meta: s.meta}
+		jpegOpts := &jpeg.Options{Quality: 95}
+		if err := jpeg.Encode(w, s.img, jpegOpts); err != nil {
+			return fmt.Errorf("encode jpeg: %w", err)
+		}
+	}
+	return nil
+}
+
+// Process reads an image from r, stamps it and writes it to w. The whole
+// input is read once into a pooled buffer, which the EXIF, size and image
+// decoders all read from, so r need not be seekable. Without EXIF the
+// modification time is stamped when r is a regular *os.File, otherwise the
+// current time. The output is JPEG unless opts.OutputFormat says
+// otherwise or the input is a PNG (PNG output) or a GIF (animated GIF).
+func Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) (Result, error) {
+	var name string
+	var modTime time.Time
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			name, modTime = f.Name(), fi.ModTime()
+		}
+	}
+	return ProcessReader(ctx, r, name, modTime, w, opts)
+}
+
+// ProcessReader is Process for an input that isn't an open file, such as a
+// member of an archive: name is its path, where opts.DateSources look for
+// sidecars and dates in the file name ("" for none), and modTime is
+// stamped when they find no date (zero for the current time). Inputs the
+// filters of Options leave out (MinSize, RequireDate, After, Before,
+// MinWidth, MinHeight) return an error wrapping ErrSkipped, as with
+// ProcessFile. Data with a TIFF header is taken for a camera raw file.
+func ProcessReader(ctx context.Context, r io.Reader, name string, modTime time.Time, w io.Writer, opts Options) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if opts.StrictFont && len(opts.Fonts) == 0 && opts.Style != "lcd" {
+		return Result{}, &OptionError{"StrictFont", errors.New("no font loaded, refusing to use the built-in bitmap font")}
+	}
+	data, done, err := readInput(r)
+	if err != nil {
+		return Result{}, fmt.Errorf("read input: %w", err)
+	}
+	defer done()
+	in := bytes.NewReader(data)
+	heif := sniffHEIF(data)
+	if heif && !heifSupported {
+		return Result{}, fmt.Errorf("%w: HEIC/HEIF support not compiled in (rebuild with -tags heif)", ErrSkipped)
+	}
+	capture := readCaptureDate(in, heif, name, modTime, opts)
+	label := name
+	if label == "" {
+		label = "<stream>"
+	}
+	if err := capture.checkMarked(label, opts); err != nil {
+		return Result{}, err
+	}
+	if int64(len(data)) < opts.MinSize {
+		return Result{}, &OptionError{"MinSize", fmt.Errorf("%w %s: %d bytes, below the minimum of %d", ErrSkipped, label, len(data), opts.MinSize)}
+	}
+	if err := capture.checkDated(label, opts); err != nil {
+		return capture.result(), err
+	}
+	if err := capture.checkRange(label, opts); err != nil {
+		return Result{}, err
+	}
+	pixels, err := previewOf(in, int64(len(data)), sniffTIFF(data), label)
+	if err != nil {
+		return capture.result(), err
+	}
+	if err := checkDimensions(pixels, capture, label, opts); err != nil {
+		return Result{}, err
+	}
+	text, err := stampText(capture, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	release, err := opts.Memory.acquire(ctx, pixels)
+	if err != nil {
+		return Result{}, err
+	}
+	defer release()
+	var timing Timing
+	start := time.Now()
+	src, err := decodeImage(pixels, capture, bytes.HasPrefix(data, []byte("GIF8")), opts)
+	if err != nil {
+		return Result{}, err
+	}
+	timing.Decode, start = time.Since(start), time.Now()
+	img, err := src.stamp(text, label, opts, false)
+	if err != nil {
+		return capture.result(), err
+	}
+	timing.Draw, start = time.Since(start), time.Now()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriterSize(cw, outputBufferSize)
+	err = img.encode(bw, opts)
+	recycle(img.img)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := bw.Flush(); err != nil {
+		return Result{}, fmt.Errorf("write output: %w", err)
+	}
+	timing.Encode = time.Since(start)
+	res := capture.result()
+	res.Size, res.InSize, res.Timing, res.Position = cw.n, int64(len(data)), timing, img.position
+	return res, nil
+}
+
+// ProcessFile stamps the image at inPath and writes it to outPath, or next
+// to it when opts.Rename names the output after the capture date. An
+// existing output gets a numeric suffix unless opts.Overwrite,
+// opts.SkipExisting or opts.Incremental say otherwise; inputs that are deliberately left alone
+// return an error wrapping ErrSkipped. Unless opts.Touch, the output's
+// modification time (and on Windows its creation time) is set to the capture
+// time.
+//
+// ctx is only checked before the input is opened and while waiting for
+// opts.Memory: once decoding starts, an image is finished so no partial
+// output is left behind.
+func ProcessFile(ctx context.Context, inPath, outPath string, opts Options) (Result, error) {
+	job := DecodeFile(ctx, inPath, outPath, opts)
+	job.Draw()
+	return job.Write()
+}
+
+// FileJob is an input of ProcessFile between its stages: DecodeFile reads
+// and decodes it, Draw stamps it and Write writes it to its output. The
+// stages may run on different goroutines, so that reading and decoding one
+// image overlaps with encoding another. Every job must reach Write, which
+// releases what it holds, including its share of Options.Memory.
+type FileJob struct {
+	inPath   string
+	opts     Options
+	finalOut string
+	existed  bool
+	fi       os.FileInfo
+	capture  captureDate
+	text     string
+	src      *decoded   // from DecodeFile to Draw
+	img      *stamped   // from Draw to Write
+	variants []*stamped // from Draw to Write
+	release  func()
+	timing   Timing
+
+	// the outcome of a job that ended in DecodeFile: skipped, failed, or
+	// copied by NoStamp
+	res Result
+	err error
+}
+
+// DecodeFile runs the first stage of ProcessFile: it checks the input,
+// reads its capture date, resolves the output path and decodes the image.
+// A job that ends here still goes through Draw, and Write returns its
+// outcome.
+func DecodeFile(ctx context.Context, inPath, outPath string, opts Options) *FileJob {
+	j := &FileJob{inPath: inPath, opts: opts, release: func() {}}
+	j.res, j.err = j.decode(ctx, outPath)
+	return j
+}
+
+func (j *FileJob) decode(ctx context.Context, outPath string) (Result, error) {
+	inPath, opts := j.inPath, j.opts
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	start := time.Now()
+	if opts.InPlace && OutputExt(inPath, "") != filepath.Ext(inPath) {
+		return Result{}, fmt.Errorf("%w %s: can't be written back in its own format", ErrSkipped, inPath)
+	}
+	video := IsVideo(inPath)
+	if video && !opts.Rename {
+		return Result{}, fmt.Errorf("%w %s: videos are only renamed, not stamped", ErrSkipped, inPath)
+	}
+	if opts.StrictFont && len(opts.Fonts) == 0 && opts.Style != "lcd" && !opts.NoStamp && !video {
+		return Result{}, &OptionError{"StrictFont", errors.New("no font loaded, refusing to use the built-in bitmap font")}
+	}
+	heif := isHEIF(inPath)
+	if heif && !heifSupported {
+		return Result{}, fmt.Errorf("%w %s: HEIC/HEIF support not compiled in (rebuild with -tags heif)", ErrSkipped, inPath)
+	}
+
+	// Open file once and use stream for EXIF and image decoding to avoid reading whole file into memory
+	f, err := os.Open(inPath)
+	if err != nil {
+		return Result{}, fmt.Errorf("open input: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return Result{}, fmt.Errorf("stat input: %w", err)
+	}
+
+	if fi.Size() < opts.MinSize {
+		return Result{}, &OptionError{"MinSize", fmt.Errorf("%w %s: %d bytes, below the minimum of %d", ErrSkipped, inPath, fi.Size(), opts.MinSize)}
+	}
+	capture := readCaptureDate(f, heif, inPath, fi.ModTime(), opts)
+	if err := capture.checkMarked(inPath, opts); err != nil {
+		return Result{}, err
+	}
+	if err := capture.checkDated(inPath, opts); err != nil {
+		return capture.result(), err
+	}
+	if err := capture.checkRange(inPath, opts); err != nil {
+		return Result{}, err
+	}
+	var pixels readSeekerAt = f
+	if !video {
+		if pixels, err = previewOf(f, fi.Size(), isRaw(inPath), inPath); err != nil {
+			return capture.result(), err
+		}
+		if err := checkDimensions(pixels, capture, inPath, opts); err != nil {
+			return Result{}, err
+		}
+	}
+	finalOut, existed, err := resolveOutput(inPath, outPath, capture, fi, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if opts.NoStamp || video {
+		return placeOriginal(f, fi, inPath, finalOut, existed, capture, opts)
+	}
+	text, err := stampText(capture, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	j.timing.Decode = time.Since(start)
+	release, err := opts.Memory.acquire(ctx, pixels)
+	if err != nil {
+		return Result{}, err
+	}
+	start = time.Now()
+	src, err := decodeImage(pixels, capture, isGIF(inPath), opts)
+	if err != nil {
+		release()
+		return Result{}, err
+	}
+	j.timing.Decode += time.Since(start)
+	j.finalOut, j.existed, j.fi, j.capture, j.text = finalOut, existed, fi, capture, text
+	j.src, j.release = src, release
+	return Result{}, nil
+}
+
+// Draw runs the second stage of ProcessFile: it stamps the image and its
+// Options.Variants.
+func (j *FileJob) Draw() {
+	if j.src == nil {
+		return
+	}
+	start := time.Now()
+	defer func() { j.timing.Draw = time.Since(start) }()
+	if !j.opts.InPlace {
+		// before the full-size image, which is stamped in place
+		j.variants = drawVariants(j.src, j.text, j.inPath, j.opts)
+	}
+	img, err := j.src.stamp(j.text, j.inPath, j.opts, false)
+	j.src = nil
+	if err != nil {
+		for _, v := range j.variants {
+			if v != nil {
+				recycle(v.img)
+			}
+		}
+		j.release()
+		j.variants, j.res, j.err = nil, j.capture.result(), err
+		return
+	}
+	j.img = img
+}
+
+// Write runs the last stage of ProcessFile: it writes the stamped image
+// and its variants to their outputs and returns the outcome of the job.
+func (j *FileJob) Write() (Result, error) {
+	j.Draw() // in case the caller skipped it
+	if j.img == nil {
+		return j.res, j.err
+	}
+	defer j.release()
+	inPath, finalOut, existed, fi, capture, opts := j.inPath, j.finalOut, j.existed, j.fi, j.capture, j.opts
+	start := time.Now()
+	var err error
+
+	var of *os.File
+	if opts.InPlace {
+		// write next to the original and rename over it once complete
+		if opts.BackupDir != "" {
+			if err := backupOriginal(inPath, opts.InRoot, opts.BackupDir); err != nil {
+				recycle(j.img.img)
+				return Result{}, err
+			}
+		}
+		of, err = os.CreateTemp(filepath.Dir(inPath), "."+filepath.Base(inPath)+".*.tmp")
+		if err != nil {
+			recycle(j.img.img)
+			return Result{}, fmt.Errorf("create temp output: %w", err)
+		}
+		defer os.Remove(of.Name()) // no-op once renamed
+	} else if of, finalOut, err = createOutput(inPath, finalOut, opts); err != nil {
+		// the variants have outputs of their own, which may well be free,
+		// e.g. when another worker took the main output since Decode
+		variants := writeVariants(j.variants, capture, inPath, j.finalOut, fi, opts)
+		recycle(j.img.img)
+		return Result{Variants: variants}, err
+	}
+	defer of.Close()
+	// never leave a half-written output behind
+	complete := false
+	defer func() {
+		if !complete && !opts.InPlace {
+			of.Close()
+			os.Remove(finalOut)
+		}
+	}()
+
+	variants := writeVariants(j.variants, capture, inPath, finalOut, fi, opts)
+	size, err := writeImage(of, j.img, opts)
+	recycle(j.img.img)
+	if err != nil {
+		return Result{Variants: variants}, err
+	}
+	complete = true
+	res := capture.result()
+	res.Out, res.Overwritten, res.Size, res.InSize, res.Variants = finalOut, existed, size, fi.Size(), variants
+	res.Position = j.img.position
+	res.Timing = j.timing
+	res.Timing.Encode = time.Since(start)
+	if opts.InPlace {
+		if err := replaceFile(of, finalOut, fi); err != nil {
+			return Result{}, fmt.Errorf("replace original: %w", err)
+		}
+		// keep the original's modification time unless --touch
+		if !opts.Touch {
+			if err := os.Chtimes(finalOut, fi.ModTime(), fi.ModTime()); err != nil {
+				log.Printf("failed to set file times for %s: %v", finalOut, err)
+			}
+		}
+		return res, nil
+	}
+	// close first: on Windows a close after writing may bump the modification time again
+	if err := of.Close(); err != nil {
+		os.Remove(finalOut)
+		return Result{}, fmt.Errorf("write output: %w", err)
+	}
+	setOutputTimes(finalOut, capture, fi, opts)
+	return res, nil
+}
+
+// outputBufferSize is the buffer encoders write through: the JPEG and PNG
+// encoders emit many small writes, each a system call on a bare *os.File.
+const outputBufferSize = 256 << 10
+
+// writeImage encodes s to of through a buffer and returns the size written.
+// Every write error surfaces, including those of the final flush, and with
+// opts.Fsync the data is on disk before it returns.
+func writeImage(of *os.File, s *stamped, opts Options) (int64, error) {
+	bw := bufio.NewWriterSize(of, outputBufferSize)
+	if err := s.encode(bw, opts); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("write output: %w", err)
+	}
+	if err := syncOutput(of, opts); err != nil {
+		return 0, err
+	}
+	return of.Seek(0, io.SeekCurrent)
+}
+
+// syncOutput flushes of to disk when opts.Fsync asks for it, so a drive
+// unplugged right after a run doesn't lose outputs reported as written.
+func syncOutput(of *os.File, opts Options) error {
+	if !opts.Fsync {
+		return nil
+	}
+	if err := of.Sync(); err != nil {
+		return fmt.Errorf("sync output: %w", err)
+	}
+	return nil
+}
+
+// createOutput creates the output file for inPath at finalOut: replacing an
+// existing file with Overwrite or Incremental, skipping with SkipExisting,
+// or else under the first free numeric suffix. It returns the path used.
+func createOutput(inPath, finalOut string, opts Options) (*os.File, string, error) {
+	if opts.Overwrite || opts.Incremental {
+		of, err := os.Create(finalOut)
+		if err != nil {
+			return nil, "", fmt.Errorf("create output: %w", err)
+		}
+		return of, finalOut, nil
+	}
+	if opts.SkipExisting {
+		// another worker may have created it since resolveOutput looked
+		of, err := os.OpenFile(finalOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, fs.ErrExist) {
+			return nil, "", fmt.Errorf("%w %s: %s already exists", ErrSkipped, inPath, finalOut)
+		} else if err != nil {
+			return nil, "", fmt.Errorf("create output: %w", err)
+		}
+		return of, finalOut, nil
+	}
+	// taken names get a numeric suffix; O_EXCL keeps concurrent workers
+	// (e.g. burst shots renamed to the same second) from sharing one
+	of, finalOut, err := CreateUnique(finalOut)
+	if err != nil {
+		return nil, "", fmt.Errorf("create output: %w", err)
+	}
+	return of, finalOut, nil
+}
+
+// setOutputTimes gives the output the capture time so it sorts with the
+// photo, or the input's own time when the date can't be parsed. Nothing is
+// changed with opts.Touch.
+func setOutputTimes(finalOut string, capture captureDate, in os.FileInfo, opts Options) {
+	if opts.Touch {
+		return
+	}
+	t := capture.time
+	if capture.timeErr != nil {
+		log.Printf("failed to parse exif date '%s': %v", capture.date, capture.timeErr)
+		t = in.ModTime()
+	}
+	if err := setFileTimes(finalOut, t); err != nil {
+		log.Printf("failed to set file times for %s: %v", finalOut, err)
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseExifTime tries several common layouts to parse the normalized EXIF
+// date string as a time in loc.
+func parseExifTime(s string, loc *time.Location) (time.Time, error) {
+	// try common layouts
+	layouts := []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02_15-04-05",
+		"2006-01-02",
+		time.RFC3339,
+	}
+	var lastErr error
+	for _, l := range layouts {
+		if t, err := time.ParseInLocation(l, s, loc); err == nil {
+			return t, nil
+		} else {
+			lastErr = err
+		}
+	}
+	return time.Time{}, lastErr
+}
+
+func normalizeExifDate(s string) string {
+	// common EXIF date format: "2006:01:02 15:04:05"
+	if len(s) >= 10 && s[4] == ':' && s[7] == ':' {
+		// replace first two ':' with '-'
+		runes := []rune(s)
+		runes[4] = '-'
+		runes[7] = '-'
+		return string(runes)
+	}
+	return s
+}
+
+// wrapText splits text into lines so each line fits within maxWidth (pixels) using the provided drawer.
+// Latin words are kept whole where possible, while CJK text may break between any two characters.
+// A single glyph wider than maxWidth is placed on a line of its own.
+// Each '\n'-separated paragraph is wrapped on its own; blank paragraphs
+// between others stay as empty lines, those before and after are dropped.
+func wrapText(drawer *font.Drawer, text string, maxWidth int) []string {
+	var lines []string
+	blank := 0 // blank paragraphs since the last line
+	for _, para := range strings.Split(text, "\n") {
+		if strings.TrimSpace(para) == "" {
+			blank++
+			continue
+		}
+		if len(lines) > 0 {
+			lines = append(lines, make([]string, blank)...)
+		}
+		blank = 0
+		lines = append(lines, wrapParagraph(drawer, para, maxWidth)...)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+// wrapParagraph wraps one line of text without explicit breaks.
+func wrapParagraph(drawer *font.Drawer, text string, maxWidth int) []string {
+	fits := func(s string) bool { return drawer.MeasureString(s).Ceil() <= maxWidth }
+	var lines []string
+	cur := ""
+	for _, tok := range wrapTokens(text) {
+		try := tok.text
+		if cur != "" {
+			if tok.space {
+				try = cur + " " + tok.text
+			} else {
+				try = cur + tok.text
+			}
+		}
+		if fits(try) {
+			cur = try
+			continue
+		}
+		// current line full, push it and start a new one with this token
+		if cur != "" {
+			lines = append(lines, cur)
+			cur = ""
+		}
+		if fits(tok.text) {
+			cur = tok.text
+			continue
+		}
+		// token alone too long: break it by characters
+		for _, ch := range tok.text {
+			try2 := cur + string(ch)
+			if cur == "" || fits(try2) {
+				cur = try2
+			} else {
+				lines = append(lines, cur)
+				cur = string(ch)
+			}
+		}
+	}
+	if cur != "" || len(lines) == 0 {
+		lines = append(lines, cur)
+	}
+	return lines
+}
+
+// wrapToken is an unbreakable piece of text for wrapText.
+type wrapToken struct {
+	text  string
+	space bool // separated from the previous token by a space
+}
+
+// wrapTokens splits text into wrap tokens: whitespace-separated words, with
+// every CJK character in a word becoming a token of its own.
+func wrapTokens(text string) []wrapToken {
+	var toks []wrapToken
+	for _, word := range strings.Fields(text) {
+		space := len(toks) > 0
+		run := ""
+		for _, r := range word {
+			if !isCJK(r) {
+				run += string(r)
+				continue
+			}
+			if run != "" {
+				toks = append(toks, wrapToken{run, space})
+				run, space = "", false
+			}
+			toks = append(toks, wrapToken{string(r), space})
+			space = false
+		}
+		if run != "" {
+			toks = append(toks, wrapToken{run, space})
+		}
+	}
+	return toks
+}
+
+// isCJK reports whether r belongs to a script conventionally broken between any two characters.
+func isCJK(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+		return true
+	case r >= 0x3000 && r <= 0x303F: // CJK symbols and punctuation
+		return true
+	case r >= 0xFF00 && r <= 0xFFEF: // halfwidth and fullwidth forms
+		return true
+	}
+	return false
+}
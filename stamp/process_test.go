@@ -0,0 +1,572 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// solid returns a w x h image filled with c.
+func solid(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b, a := c.RGBA()
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8)
+	}
+	return img
+}
+
+func encodeJPEG(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func encodePNG(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// tiffEntry is a tag of a test EXIF block, with its value already encoded
+// little-endian.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+func asciiTag(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortTag(tag, v uint16) tiffEntry {
+	return tiffEntry{tag, 3, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func longTag(tag uint16, v uint32) tiffEntry {
+	return tiffEntry{tag, 4, 1, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+// ratTag is a RATIONAL tag of num/den pairs.
+func ratTag(tag uint16, v ...uint32) tiffEntry {
+	var data []byte
+	for _, x := range v {
+		data = binary.LittleEndian.AppendUint32(data, x)
+	}
+	return tiffEntry{tag, 5, uint32(len(v) / 2), data}
+}
+
+// ifdSize is the bytes an IFD of es takes, with its out-of-line values.
+func ifdSize(es []tiffEntry) uint32 {
+	n := 2 + 12*len(es) + 4
+	for _, e := range es {
+		if len(e.data) > 4 {
+			n += len(e.data) + len(e.data)%2
+		}
+	}
+	return uint32(n)
+}
+
+// appendIFD appends the IFD of es, placed at off in the TIFF block b.
+func appendIFD(b []byte, off uint32, es []tiffEntry) []byte {
+	le := binary.LittleEndian
+	data := off + 2 + 12*uint32(len(es)) + 4
+	var values []byte
+	b = le.AppendUint16(b, uint16(len(es)))
+	for _, e := range es {
+		b = le.AppendUint16(b, e.tag)
+		b = le.AppendUint16(b, e.typ)
+		b = le.AppendUint32(b, e.count)
+		if len(e.data) <= 4 {
+			var v [4]byte
+			copy(v[:], e.data)
+			b = append(b, v[:]...)
+			continue
+		}
+		b = le.AppendUint32(b, data+uint32(len(values)))
+		values = append(values, e.data...)
+		if len(e.data)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	b = le.AppendUint32(b, 0)
+	return append(b, values...)
+}
+
+// buildTIFF returns a little-endian TIFF block with ifd0 and, when not
+// empty, an Exif and a GPS IFD it points to.
+func buildTIFF(ifd0, exifIFD, gpsIFD []tiffEntry) []byte {
+	ifd0 = append([]tiffEntry(nil), ifd0...)
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, longTag(0x8769, 0))
+	}
+	if len(gpsIFD) > 0 {
+		ifd0 = append(ifd0, longTag(0x8825, 0))
+	}
+	off := 8 + ifdSize(ifd0)
+	for i, e := range ifd0 {
+		switch e.tag {
+		case 0x8769:
+			ifd0[i] = longTag(0x8769, off)
+			off += ifdSize(exifIFD)
+		case 0x8825:
+			ifd0[i] = longTag(0x8825, off)
+		}
+	}
+	b := []byte("II*\x00\x08\x00\x00\x00")
+	b = appendIFD(b, 8, ifd0)
+	if len(exifIFD) > 0 {
+		b = appendIFD(b, uint32(len(b)), exifIFD)
+	}
+	if len(gpsIFD) > 0 {
+		b = appendIFD(b, uint32(len(b)), gpsIFD)
+	}
+	return b
+}
+
+// withExif inserts the TIFF block tiff as an EXIF APP1 segment right after
+// the SOI marker of the JPEG data.
+func withExif(data, tiff []byte) []byte {
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	out := append([]byte{}, data[:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(seg)+2))
+	out = append(out, seg...)
+	return append(out, data[2:]...)
+}
+
+// dated returns a w x h gray JPEG whose EXIF DateTimeOriginal is date.
+func dated(t testing.TB, w, h int, date string) []byte {
+	return withExif(encodeJPEG(t, solid(w, h, color.Gray{128})), buildTIFF(nil, []tiffEntry{asciiTag(0x9003, date)}, nil))
+}
+
+func TestProcess(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	strict := DefaultOptions()
+	strict.StrictFont = true
+	large := DefaultOptions()
+	large.MinSize = 1 << 20
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		in     []byte
+		opts   Options
+		format string // of the output; "" when Process fails
+		err    error  // wrapped by the error, when not nil
+	}{
+		{"jpeg", context.Background(), dated(t, 64, 48, "2023:07:14 10:30:05"), DefaultOptions(), "jpeg", nil},
+		{"png", context.Background(), encodePNG(t, solid(64, 48, color.White)), DefaultOptions(), "png", nil},
+		{"garbage", context.Background(), []byte("not an image at all"), DefaultOptions(), "", nil},
+		{"empty", context.Background(), nil, DefaultOptions(), "", nil},
+		{"truncated jpeg", context.Background(), dated(t, 64, 48, "2023:07:14 10:30:05")[:300], DefaultOptions(), "", nil},
+		{"cancelled", cancelled, encodePNG(t, solid(8, 8, color.White)), DefaultOptions(), "", context.Canceled},
+		{"strict font", context.Background(), encodePNG(t, solid(8, 8, color.White)), strict, "", nil},
+		{"min size", context.Background(), encodePNG(t, solid(8, 8, color.White)), large, "", ErrSkipped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			res, err := Process(tt.ctx, bytes.NewReader(tt.in), &out, tt.opts)
+			if tt.format == "" {
+				if err == nil {
+					t.Fatalf("Process succeeded, want an error")
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("Process error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Process: %v", err)
+			}
+			if res.Size != int64(out.Len()) {
+				t.Errorf("Result.Size = %d, want %d", res.Size, out.Len())
+			}
+			cfg, format, err := image.DecodeConfig(&out)
+			if err != nil {
+				t.Fatalf("decode output: %v", err)
+			}
+			if format != tt.format || cfg.Width != 64 || cfg.Height != 48 {
+				t.Errorf("output is a %dx%d %s, want a 64x48 %s", cfg.Width, cfg.Height, format, tt.format)
+			}
+			if res.InSize != int64(len(tt.in)) {
+				t.Errorf("Result.InSize = %d, want %d", res.InSize, len(tt.in))
+			}
+		})
+	}
+}
+
+func TestProcessReader(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	tests := []struct {
+		name    string
+		in      []byte
+		file    string
+		modTime time.Time
+		time    string // Result.Time
+		source  string
+	}{
+		{"exif", dated(t, 32, 32, "2023:07:14 10:30:05"), "", mtime, "2023-07-14 10:30:05", "exif-original"},
+		{"file name", encodePNG(t, solid(32, 32, color.White)), "IMG_20190603_081500.png", mtime, "2019-06-03 08:15:00", "filename"},
+		{"mtime", encodePNG(t, solid(32, 32, color.White)), "", mtime, "2020-01-02 03:04:05", "mtime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			res, err := ProcessReader(context.Background(), bytes.NewReader(tt.in), tt.file, tt.modTime, &out, DefaultOptions())
+			if err != nil {
+				t.Fatalf("ProcessReader: %v", err)
+			}
+			if got := res.Time.Format(time.DateTime); got != tt.time || res.DateSource != tt.source {
+				t.Errorf("time %s from %q, want %s from %q", got, res.DateSource, tt.time, tt.source)
+			}
+		})
+	}
+
+	opts := DefaultOptions()
+	opts.RequireDate = true
+	_, err := ProcessReader(context.Background(), bytes.NewReader(encodePNG(t, solid(8, 8, color.White))), "", time.Time{}, &bytes.Buffer{}, opts)
+	if !errors.Is(err, ErrSkipped) {
+		t.Errorf("undated input with RequireDate: error %v, want ErrSkipped", err)
+	}
+}
+
+func TestProcessReaderNoSeek(t *testing.T) {
+	in := dated(t, 64, 48, "2023:07:14 10:30:05")
+	var want bytes.Buffer
+	if _, err := ProcessReader(context.Background(), bytes.NewReader(in), "", time.Time{}, &want, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		// in small writes, as a network body arrives
+		for b := in; len(b) > 0; b = b[min(len(b), 100):] {
+			pw.Write(b[:min(len(b), 100)])
+		}
+		pw.Close()
+	}()
+	readers := map[string]io.Reader{
+		"one byte at a time": iotest.OneByteReader(bytes.NewReader(in)),
+		"pipe":               pr,
+	}
+	for name, r := range readers {
+		if _, ok := r.(io.Seeker); ok {
+			t.Fatalf("%s: reader can seek", name)
+		}
+		var out bytes.Buffer
+		res, err := ProcessReader(context.Background(), r, "", time.Time{}, &out, DefaultOptions())
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if res.DateSource != "exif-original" || res.InSize != int64(len(in)) {
+			t.Errorf("%s: date from %q of %d bytes, want exif-original of %d", name, res.DateSource, res.InSize, len(in))
+		}
+		if !bytes.Equal(out.Bytes(), want.Bytes()) {
+			t.Errorf("%s: output differs from that of a seekable reader", name)
+		}
+	}
+}
+
+func TestWriteTakenOutputVariants(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.jpg")
+	if err := os.WriteFile(in, dated(t, 640, 480, "2023:07:14 10:30:05"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "out")
+	out := filepath.Join(root, "in.jpg")
+	opts := DefaultOptions()
+	opts.SkipExisting, opts.OutRoot = true, root
+	opts.Variants = []Variant{{Name: "thumb", MaxDimension: 100}}
+	job := DecodeFile(context.Background(), in, out, opts)
+	job.Draw()
+	// another worker takes the main output between the stages
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(out, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := job.Write()
+	if !errors.Is(err, ErrSkipped) {
+		t.Fatalf("taken output: error %v, want ErrSkipped", err)
+	}
+	if len(res.Variants) != 1 || res.Variants[0].Err != nil {
+		t.Fatalf("variants %+v, want the thumbnail written", res.Variants)
+	}
+	f, err := os.Open(filepath.Join(root, "thumb", "in.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if cfg, _, err := image.DecodeConfig(f); err != nil || cfg.Width != 100 {
+		t.Errorf("thumbnail %dx%d, %v; want 100 wide", cfg.Width, cfg.Height, err)
+	}
+}
+
+func TestProcessFile(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.jpg")
+	if err := os.WriteFile(in, dated(t, 40, 30, "2023:07:14 10:30:05"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.jpg")
+	if err := os.WriteFile(bad, []byte("\xff\xd8 not really"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.jpg")
+	overwrite := DefaultOptions()
+	overwrite.Overwrite = true
+	skip := DefaultOptions()
+	skip.SkipExisting = true
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		want string // output path; "" for an error
+		err  error
+	}{
+		{"new", in, DefaultOptions(), out, nil},
+		{"suffix", in, DefaultOptions(), filepath.Join(dir, "out_1.jpg"), nil},
+		{"overwrite", in, overwrite, out, nil},
+		{"skip existing", in, skip, "", ErrSkipped},
+		{"missing", filepath.Join(dir, "missing.jpg"), DefaultOptions(), "", os.ErrNotExist},
+		{"undecodable", bad, DefaultOptions(), "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ProcessFile(context.Background(), tt.in, out, tt.opts)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("ProcessFile wrote %s, want an error", res.Out)
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("ProcessFile error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessFile: %v", err)
+			}
+			if res.Out != tt.want {
+				t.Errorf("wrote %s, want %s", res.Out, tt.want)
+			}
+			fi, err := os.Stat(res.Out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := time.Date(2023, 7, 14, 10, 30, 5, 0, time.Local); !fi.ModTime().Equal(want) {
+				t.Errorf("output mtime %v, want the capture time %v", fi.ModTime(), want)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad_timestamped.jpg")); err == nil {
+		t.Errorf("a failed input left an output behind")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 4 { // in, bad, out, out_1
+		t.Errorf("%d files in the output directory, want 4", len(entries))
+	}
+}
+
+// failingWriter accepts n bytes, then fails every write.
+type failingWriter struct{ n int }
+
+var errDiskFull = errors.New("no space left on device")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errDiskFull
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// noise returns a w x h opaque image of pseudo-random pixels, which
+// compress badly.
+func noise(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	x := uint32(1)
+	for i := range img.Pix {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		img.Pix[i] = uint8(x)
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+func TestFailingWriter(t *testing.T) {
+	small, large := solid(64, 48, color.White), noise(800, 600)
+	tests := []struct {
+		name string
+		data []byte
+		n    int // bytes the writer takes before failing
+	}{
+		// the whole output sits in the buffer until the final flush
+		{"small jpeg", encodeJPEG(t, small), 0},
+		{"small png", encodePNG(t, small), 100},
+		// the encoders write through the buffer before they finish
+		{"large jpeg", encodeJPEG(t, large), outputBufferSize + 10},
+		{"large png", encodePNG(t, large), outputBufferSize / 2},
+	}
+	for _, tt := range tests {
+		_, err := Process(context.Background(), bytes.NewReader(tt.data), &failingWriter{tt.n}, DefaultOptions())
+		if !errors.Is(err, errDiskFull) {
+			t.Errorf("%s: error %v, want the writer's", tt.name, err)
+		}
+	}
+
+	// writeImage, in both formats, on a file that takes no writes
+	path := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	of, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+	for _, format := range []string{"jpg", "png"} {
+		if _, err := writeImage(of, &stamped{img: small, format: format}, DefaultOptions()); err == nil {
+			t.Errorf("%s written to a read-only file", format)
+		}
+	}
+}
+
+func TestRestamp(t *testing.T) {
+	img := solid(64, 48, color.RGBA{200, 60, 30, 255})
+	for _, tt := range []struct {
+		ext  string
+		data []byte
+	}{{".jpg", encodeJPEG(t, img)}, {".png", encodePNG(t, img)}} {
+		dir := t.TempDir()
+		in := filepath.Join(dir, "in"+tt.ext)
+		if err := os.WriteFile(in, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "out"+tt.ext), DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the output back as an input
+		again := filepath.Join(dir, "again"+tt.ext)
+		if _, err := ProcessFile(context.Background(), res.Out, again, DefaultOptions()); !errors.Is(err, ErrStamped) {
+			t.Errorf("%s: output stamped again: %v", tt.ext, err)
+		}
+		if _, err := os.Stat(again); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: skipped input left an output: %v", tt.ext, err)
+		}
+		if res, err := PlanFile(context.Background(), res.Out, again, DefaultOptions()); !errors.Is(err, ErrStamped) {
+			t.Errorf("%s: plan of the output: %v, %v", tt.ext, res, err)
+		}
+		opts := DefaultOptions()
+		opts.Restamp = true
+		if _, err := ProcessFile(context.Background(), res.Out, again, opts); err != nil {
+			t.Errorf("%s: with Restamp: %v", tt.ext, err)
+		}
+	}
+}
+
+func TestOutputTimes(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		date  string // DateTimeOriginal
+		touch bool
+		want  time.Time // zero for about now
+	}{
+		{"2023:07:14 10:30:05", false, time.Date(2023, 7, 14, 10, 30, 5, 0, time.UTC)},
+		// a date that doesn't parse: the input's time
+		{"2023:13:45 99:99:99", false, old},
+		{"2023:07:14 10:30:05", true, time.Time{}},
+	}
+	for i, tt := range tests {
+		in := filepath.Join(dir, fmt.Sprintf("in%d.jpg", i))
+		if err := os.WriteFile(in, dated(t, 64, 48, tt.date), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(in, old, old); err != nil {
+			t.Fatal(err)
+		}
+		opts := DefaultOptions()
+		opts.TimeZone, opts.Touch = time.UTC, tt.touch
+		res, err := ProcessFile(context.Background(), in, filepath.Join(dir, fmt.Sprintf("out%d.jpg", i)), opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.date, err)
+		}
+		fi, err := os.Stat(res.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch got := fi.ModTime(); {
+		case tt.want.IsZero() && time.Since(got) > time.Minute:
+			t.Errorf("%s with Touch: output time %v, want about now", tt.date, got)
+		case !tt.want.IsZero() && !got.Equal(tt.want):
+			t.Errorf("%s: output time %v, want %v", tt.date, got.UTC(), tt.want)
+		}
+	}
+}
+
+// BenchmarkProcessReader stamps the same photo from an open file, which
+// reads it in one call at its known size, and from a reader that can't
+// seek or tell its size.
+func BenchmarkProcessReader(b *testing.B) {
+	in := filepath.Join(b.TempDir(), "in.jpg")
+	if err := os.WriteFile(in, dated(b, 1200, 900, "2023:07:14 10:30:05"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	data, err := os.ReadFile(in)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("file", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			f, err := os.Open(in)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = Process(context.Background(), f, io.Discard, DefaultOptions())
+			f.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			r := iotest.HalfReader(bytes.NewReader(data))
+			if _, err := ProcessReader(context.Background(), r, "", time.Time{}, io.Discard, DefaultOptions()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
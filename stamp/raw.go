@@ -0,0 +1,164 @@
+package stamp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// rawExts are the extensions of the camera raw formats taken as inputs.
+// They are all TIFF files; the JPEG preview the camera embeds is stamped,
+// the raw sensor data isn't decoded.
+var rawExts = map[string]bool{".cr2": true, ".nef": true, ".arw": true, ".dng": true}
+
+// isRaw reports whether path has the extension of a camera raw format.
+func isRaw(path string) bool {
+	return rawExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// sniffTIFF reports whether data starts with a TIFF header, as raw files do.
+func sniffTIFF(data []byte) bool {
+	return len(data) >= 8 && (string(data[:4]) == "II*\x00" || string(data[:4]) == "MM\x00*")
+}
+
+// TIFF tags that locate the JPEGs embedded in a raw file.
+const (
+	tagCompression     = 0x0103
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagSubIFDs         = 0x014A
+	tagJPEGOffset      = 0x0201 // JPEGInterchangeFormat
+	tagJPEGLength      = 0x0202 // JPEGInterchangeFormatLength
+)
+
+// maxRawIFDs bounds the IFDs rawPreview visits; raw files have a handful,
+// and a corrupt one could point them at each other.
+const maxRawIFDs = 32
+
+// errNoPreview is the error of a raw file without a JPEG preview to stamp.
+var errNoPreview = errors.New("no embedded JPEG preview")
+
+// rawPreview returns the largest JPEG preview embedded in the raw file r of
+// size bytes. Previews are found in every IFD and SubIFD, as a JPEG
+// interchange format block or as a single JPEG-compressed strip: CR2 keeps
+// the full-size one in IFD0, NEF in a SubIFD, ARW and DNG in either. JPEGs
+// image/jpeg can't decode, like the lossless ones of raw sensor data, are
+// passed over.
+func rawPreview(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil || !sniffTIFF(hdr[:]) {
+		return nil, errors.New("not a TIFF-based raw file")
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	if hdr[0] == 'M' {
+		bo = binary.BigEndian
+	}
+	var best *io.SectionReader
+	bestPixels := 0
+	seen := map[uint32]bool{}
+	queue := []uint32{bo.Uint32(hdr[4:])}
+	for len(queue) > 0 && len(seen) < maxRawIFDs {
+		off := queue[0]
+		queue = queue[1:]
+		if off == 0 || seen[off] {
+			continue
+		}
+		seen[off] = true
+		tags, next, err := readIFD(r, bo, off)
+		if err != nil {
+			continue
+		}
+		queue = append(append(queue, next), tags[tagSubIFDs]...)
+
+		var found [][2]uint32 // offset and length
+		if o, n := tags[tagJPEGOffset], tags[tagJPEGLength]; len(o) == 1 && len(n) == 1 {
+			found = append(found, [2]uint32{o[0], n[0]})
+		}
+		// 6 is old-style JPEG, 7 JPEG; a JPEG in several strips isn't one file
+		if c := tags[tagCompression]; len(c) == 1 && (c[0] == 6 || c[0] == 7) {
+			if o, n := tags[tagStripOffsets], tags[tagStripByteCounts]; len(o) == 1 && len(n) == 1 {
+				found = append(found, [2]uint32{o[0], n[0]})
+			}
+		}
+		for _, f := range found {
+			if f[1] == 0 || int64(f[0])+int64(f[1]) > size {
+				continue
+			}
+			cfg, err := jpeg.DecodeConfig(io.NewSectionReader(r, int64(f[0]), int64(f[1])))
+			if err == nil && cfg.Width*cfg.Height > bestPixels {
+				best, bestPixels = io.NewSectionReader(r, int64(f[0]), int64(f[1])), cfg.Width*cfg.Height
+			}
+		}
+	}
+	if best == nil {
+		return nil, errNoPreview
+	}
+	return best, nil
+}
+
+// readIFD reads the IFD at off in a TIFF file of byte order bo and returns
+// the values of the tags rawPreview uses, and the offset of the next IFD.
+func readIFD(r io.ReaderAt, bo binary.ByteOrder, off uint32) (map[uint16][]uint32, uint32, error) {
+	var b [2]byte
+	if _, err := r.ReadAt(b[:], int64(off)); err != nil {
+		return nil, 0, err
+	}
+	n := int(bo.Uint16(b[:]))
+	dir := make([]byte, n*12+4)
+	if _, err := r.ReadAt(dir, int64(off)+2); err != nil {
+		return nil, 0, err
+	}
+	tags := map[uint16][]uint32{}
+	for i := range n {
+		e := dir[i*12 : i*12+12]
+		tag, typ, count := bo.Uint16(e), bo.Uint16(e[2:]), bo.Uint32(e[4:])
+		switch tag {
+		case tagCompression, tagStripOffsets, tagStripByteCounts, tagSubIFDs, tagJPEGOffset, tagJPEGLength:
+		default:
+			continue
+		}
+		// SHORT, LONG or IFD, and a few values at most
+		if typ != 3 && typ != 4 && typ != 13 || count == 0 || count > 64 {
+			continue
+		}
+		size := 4
+		if typ == 3 {
+			size = 2
+		}
+		data := e[8:12]
+		if int(count)*size > 4 {
+			data = make([]byte, int(count)*size)
+			if _, err := r.ReadAt(data, int64(bo.Uint32(e[8:]))); err != nil {
+				continue
+			}
+		}
+		vals := make([]uint32, count)
+		for j := range vals {
+			if size == 2 {
+				vals[j] = uint32(bo.Uint16(data[j*2:]))
+			} else {
+				vals[j] = bo.Uint32(data[j*4:])
+			}
+		}
+		tags[tag] = vals
+	}
+	return tags, bo.Uint32(dir[n*12:]), nil
+}
+
+// previewOf returns what to decode of the input r of size bytes, named
+// label: r itself, or for a raw file its JPEG preview. A raw file without
+// one is skipped.
+func previewOf(r readSeekerAt, size int64, raw bool, label string) (readSeekerAt, error) {
+	if !raw {
+		return r, nil
+	}
+	p, err := rawPreview(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrSkipped, label, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,93 @@
+package stamp
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures in testdata are minimal TIFF-based raw files with a 160x120
+// gray JPEG preview, a 32x24 thumbnail, uncompressed sensor data, EXIF
+// Orientation 6 and a DateTimeOriginal of 2019:08:07 06:05:04:
+//
+//	preview.dng    the preview as a JPEG strip in a SubIFD, the thumbnail in IFD0
+//	preview.cr2    the preview as an old-style JPEG strip in IFD0, the thumbnail in IFD1
+//	nopreview.dng  only the sensor data
+
+func TestRawPreview(t *testing.T) {
+	for _, name := range []string{"preview.dng", "preview.cr2", "nopreview.dng"} {
+		f, err := os.Open(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := f.Stat()
+		p, err := rawPreview(f, fi.Size())
+		if name == "nopreview.dng" {
+			if !errors.Is(err, errNoPreview) {
+				t.Errorf("%s: error %v, want errNoPreview", name, err)
+			}
+			f.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// the largest JPEG, not the thumbnail
+		if cfg, err := jpeg.DecodeConfig(p); err != nil || cfg.Width != 160 || cfg.Height != 120 {
+			t.Errorf("%s: preview %dx%d (%v), want 160x120", name, cfg.Width, cfg.Height, err)
+		}
+		f.Close()
+	}
+}
+
+func TestProcessFileRaw(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"preview.dng", "preview.cr2"} {
+		res, err := ProcessFile(context.Background(), filepath.Join("testdata", name), filepath.Join(dir, name+".jpg"), DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if res.DateSource != "exif-original" || res.Date != "2019-08-07 06:05:04" {
+			t.Errorf("%s: date %q from %q, want 2019-08-07 06:05:04 from exif-original", name, res.Date, res.DateSource)
+		}
+		f, err := os.Open(res.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// upright, and stamped: the white outline of the text on the dark gray preview
+		if b := img.Bounds(); b.Dx() != 120 || b.Dy() != 160 {
+			t.Fatalf("%s: %dx%d output, want the 160x120 preview turned to 120x160", name, b.Dx(), b.Dy())
+		}
+		if bright := brightBounds(img); bright.Empty() || bright.Min.X < 60 || bright.Min.Y < 80 {
+			t.Errorf("%s: stamp at %v, want it in the bottom right", name, bright)
+		}
+	}
+
+	_, err := ProcessFile(context.Background(), filepath.Join("testdata", "nopreview.dng"), filepath.Join(dir, "nopreview.jpg"), DefaultOptions())
+	if !errors.Is(err, ErrSkipped) {
+		t.Errorf("raw file without a preview: error %v, want ErrSkipped", err)
+	}
+}
+
+// brightBounds returns the bounds of the near-white pixels of img.
+func brightBounds(img image.Image) image.Rectangle {
+	var r image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if cr, cg, cb, _ := img.At(x, y).RGBA(); cr+cg+cb > 3*0xc000 {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,74 @@
+package stamp
+
+import (
+	"image"
+	"image/gif"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// scaledSize returns the output size of a w x h image: scaled to percent
+// (0 or 100 keeps it), then fitted so the long edge is at most maxDim (0 for
+// no limit). The aspect ratio is kept and the size never grows.
+func scaledSize(w, h, percent, maxDim int) (int, int) {
+	f := 1.0
+	if percent > 0 && percent < 100 {
+		f = float64(percent) / 100
+	}
+	if long := float64(max(w, h)) * f; maxDim > 0 && long > float64(maxDim) {
+		f *= float64(maxDim) / long
+	}
+	if f >= 1 {
+		return w, h
+	}
+	return max(int(math.Round(float64(w)*f)), 1), max(int(math.Round(float64(h)*f)), 1)
+}
+
+// resizeImage downscales canvas for opts.Scale and opts.MaxDimension, or
+// returns it unchanged. Catmull-Rom is the sharpest of the x/image/draw
+// kernels and has fast paths for RGBA images, which photos are drawn on.
+func resizeImage(canvas xdraw.Image, opts Options) xdraw.Image {
+	b := canvas.Bounds()
+	w, h := scaledSize(b.Dx(), b.Dy(), opts.Scale, opts.MaxDimension)
+	if w == b.Dx() && h == b.Dy() {
+		return canvas
+	}
+	dst := newCanvas(canvas, image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), canvas, b, xdraw.Src, nil)
+	return dst
+}
+
+// resizeGIF downscales every frame of an animated GIF in place, scaling the
+// frame rectangles with the logical screen. Frames are sampled with nearest
+// neighbor so they keep their palette and transparency exactly; smoothing
+// would blend in colors the palette lacks.
+func resizeGIF(g *gif.GIF, opts Options) {
+	sw, sh := g.Config.Width, g.Config.Height
+	if sw <= 0 || sh <= 0 {
+		if len(g.Image) == 0 {
+			return
+		}
+		sw, sh = g.Image[0].Bounds().Dx(), g.Image[0].Bounds().Dy()
+	}
+	w, h := scaledSize(sw, sh, opts.Scale, opts.MaxDimension)
+	if w == sw && h == sh {
+		return
+	}
+	fx, fy := float64(w)/float64(sw), float64(h)/float64(sh)
+	scale := func(p image.Point) image.Point {
+		return image.Pt(int(math.Round(float64(p.X)*fx)), int(math.Round(float64(p.Y)*fy)))
+	}
+	for i, frame := range g.Image {
+		b := frame.Bounds()
+		r := image.Rectangle{scale(b.Min), scale(b.Max)}
+		if r.Empty() {
+			// keep tiny frames visible rather than dropping them
+			r.Max = r.Min.Add(image.Pt(max(r.Dx(), 1), max(r.Dy(), 1)))
+		}
+		out := image.NewPaletted(r, frame.Palette)
+		xdraw.NearestNeighbor.Scale(out, r, frame, b, xdraw.Src, nil)
+		g.Image[i] = out
+	}
+	g.Config.Width, g.Config.Height = w, h
+}
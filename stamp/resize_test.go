@@ -0,0 +1,23 @@
+package stamp
+
+import (
+	"fmt"
+	"image"
+	"testing"
+)
+
+// BenchmarkResize downscales photos of common sensor sizes to 2048px on
+// the long edge, which each worker does per image with --max-dimension.
+func BenchmarkResize(b *testing.B) {
+	opts := DefaultOptions()
+	opts.MaxDimension = 2048
+	for _, size := range []image.Point{{4000, 3000}, {6000, 4000}} {
+		src := noise(size.X, size.Y)
+		b.Run(fmt.Sprintf("%dMP", size.X*size.Y/1e6), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				recycle(resizeImage(src, opts))
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package stamp
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takeoutNameMax is the longest sidecar name, without ".json", Google
+// Takeout writes; longer names are cut off at this many characters.
+const takeoutNameMax = 46
+
+// takeoutDup matches the "(1)" Takeout appends to duplicate file names.
+var takeoutDup = regexp.MustCompile(`^(.*)(\(\d+\))$`)
+
+// takeoutSidecar is the part of a Google Takeout JSON sidecar snapstamp uses.
+type takeoutSidecar struct {
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"` // Unix seconds
+	} `json:"photoTakenTime"`
+	GeoData     takeoutGeo `json:"geoData"`
+	GeoDataExif takeoutGeo `json:"geoDataExif"`
+}
+
+type takeoutGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// takeoutPaths returns where Takeout may have put the sidecar of the image
+// at path. For "IMG_1234(1).jpg" it writes "IMG_1234.jpg(1).json", for
+// "IMG_1234-edited.jpg" it reuses the original's sidecar, newer exports
+// name it "IMG_1234.jpg.supplemental-metadata.json", and long names are
+// truncated.
+func takeoutPaths(path string) []string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(strings.TrimSuffix(base, ext), "-edited")
+	var dup string
+	if m := takeoutDup.FindStringSubmatch(stem); m != nil {
+		stem, dup = m[1], m[2]
+	}
+	var paths []string
+	for _, c := range []struct{ name, dup string }{
+		{base, ""},
+		{stem + ext, dup},
+		{stem + ext + ".supplemental-metadata", dup},
+		{stem, dup},
+	} {
+		// the number goes after the truncated name
+		p := filepath.Join(dir, truncateRunes(c.name, takeoutNameMax)+c.dup+".json")
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// readTakeout returns the first sidecar of the image at path that has a
+// capture time, with that time. A missing or unreadable sidecar is not an
+// error: the date falls back to the next source.
+func readTakeout(path string) (*takeoutSidecar, time.Time, bool) {
+	for _, p := range takeoutPaths(path) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var s takeoutSidecar
+		if json.Unmarshal(data, &s) != nil {
+			continue
+		}
+		sec, err := strconv.ParseInt(s.PhotoTakenTime.Timestamp, 10, 64)
+		if err != nil || sec <= 0 {
+			continue
+		}
+		return &s, time.Unix(sec, 0), true
+	}
+	return nil, time.Time{}, false
+}
+
+// latLong returns the position of the sidecar: where Google placed the
+// photo, else the one from its original EXIF. (0, 0) means none.
+func (s *takeoutSidecar) latLong() (lat, lon float64, ok bool) {
+	for _, g := range []takeoutGeo{s.GeoData, s.GeoDataExif} {
+		if g.Latitude == 0 && g.Longitude == 0 || math.Abs(g.Latitude) > 90 || math.Abs(g.Longitude) > 180 {
+			continue
+		}
+		return g.Latitude, g.Longitude, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,75 @@
+package stamp
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestTakeoutPaths(t *testing.T) {
+	long := "PXL_20230714_103005123.PORTRAIT.ORIGINAL_SHOT_1"
+	tests := []struct {
+		image   string
+		sidecar string // one of the paths tried
+	}{
+		{"IMG_1234.jpg", "IMG_1234.jpg.json"},
+		{"IMG_1234(1).jpg", "IMG_1234.jpg(1).json"},
+		{"IMG_1234(12).jpg", "IMG_1234.jpg(12).json"},
+		{"IMG_1234(1).jpg", "IMG_1234.jpg.supplemental-metadata(1).json"},
+		{"IMG_1234-edited.jpg", "IMG_1234.jpg.json"},
+		{"IMG_1234.jpg", "IMG_1234.json"},
+		{long + ".jpg", long[:46] + ".json"},
+	}
+	for _, tt := range tests {
+		paths := takeoutPaths(filepath.Join("dir", tt.image))
+		if !slices.Contains(paths, filepath.Join("dir", tt.sidecar)) {
+			t.Errorf("takeoutPaths(%s) = %q, want it to try %s", tt.image, paths, tt.sidecar)
+		}
+	}
+	// "(1)" in the middle of a name isn't a duplicate number
+	if paths := takeoutPaths("a(1)b.jpg"); !slices.Contains(paths, "a(1)b.jpg.json") || slices.Contains(paths, "a.jpg(1).json") {
+		t.Errorf("takeoutPaths(a(1)b.jpg) = %q", paths)
+	}
+}
+
+func TestReadTakeout(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the original and its duplicate, each with its own sidecar
+	write("IMG_1234.jpg.json", `{"photoTakenTime": {"timestamp": "1689330605"}, "geoData": {"latitude": 35.0116, "longitude": 135.7681}}`)
+	write("IMG_1234.jpg(1).json", `{"photoTakenTime": {"timestamp": "1689330665"}}`)
+	write("broken.jpg.json", `{"photoTakenTime": `)
+	write("zero.jpg.json", `{"photoTakenTime": {"timestamp": "0"}}`)
+
+	tests := []struct {
+		image string
+		unix  int64 // 0 for no sidecar
+	}{
+		{"IMG_1234.jpg", 1689330605},
+		{"IMG_1234(1).jpg", 1689330665},
+		{"IMG_1234-edited.jpg", 1689330605},
+		{"IMG_1234(2).jpg", 0},
+		{"broken.jpg", 0},
+		{"zero.jpg", 0},
+		{"other.jpg", 0},
+	}
+	for _, tt := range tests {
+		s, got, ok := readTakeout(filepath.Join(dir, tt.image))
+		switch {
+		case tt.unix == 0 && ok:
+			t.Errorf("%s: sidecar time %v, want none", tt.image, got)
+		case tt.unix != 0 && (!ok || got.Unix() != tt.unix):
+			t.Errorf("%s: sidecar time %v, %v; want %d", tt.image, got.Unix(), ok, tt.unix)
+		}
+		if tt.image == "IMG_1234.jpg" {
+			if lat, lon, ok := s.latLong(); !ok || lat != 35.0116 || lon != 135.7681 {
+				t.Errorf("%s: position %v, %v, %v", tt.image, lat, lon, ok)
+			}
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package stamp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// stampLayout is the stamp text sized and positioned for one canvas, so the
+// same layout can be drawn onto several images (e.g. every GIF frame).
+type stampLayout struct {
+	face       font.Face
+	fonts      []*opentype.Font // chain and size face was acquired for; nil for the bitmap font
+	size       float64
+	lines      []string
+	dots       []image.Point // baseline origin of each line
+	lineHeight int
+	rotate     int             // degrees counter-clockwise; dots are then in an unrotated canvas
+	placed     image.Rectangle // where the rotated stamp lands on the real canvas
+}
+
+// layoutStamp chooses the font face, wraps text and computes the position of
+// every line for a canvas with the given bounds.
+func layoutStamp(bounds image.Rectangle, text string, opts Options) *stampLayout {
+	canvas := bounds
+	if opts.Rotate == 90 || opts.Rotate == 270 {
+		// size and wrap the text along the edge it runs up or down
+		bounds = image.Rect(0, 0, bounds.Dy(), bounds.Dx())
+	}
+	// determine font face: if a parsed TTF font is provided, choose size so that text width <= widthPercent% of image width
+	var face font.Face
+	imgWidth := bounds.Dx()
+	imgHeight := bounds.Dy()
+
+	// determine which side length to use for margin/width calculations
+	sideLower := strings.ToLower(opts.Side)
+	var sideLen int
+	switch sideLower {
+	case "l", "long":
+		sideLen = max(imgWidth, imgHeight)
+	case "s", "short":
+		sideLen = min(imgWidth, imgHeight)
+	default:
+		// default and "width" -> use image width
+		sideLen = imgWidth
+	}
+
+	widthPercent := opts.WidthPercent
+	if opts.WidthPercentPortrait > 0 && canvas.Dy() > canvas.Dx() {
+		widthPercent = opts.WidthPercentPortrait
+	}
+	availableWidth := max(sideLen*widthPercent/100, 10)
+	// convert marginPercent to pixel margin using the chosen side length
+	pixelMargin := max(sideLen*opts.MarginPercent/100, 1)
+	if opts.MarginPx >= 0 {
+		pixelMargin = opts.MarginPx
+	}
+
+	if opts.FontSize > 0 || opts.HeightPercent > 0 {
+		// fixed size: --widthpercent no longer applies, wrap only what would leave the image
+		availableWidth = max(imgWidth-2*pixelMargin, 10)
+	}
+
+	var size float64
+	switch {
+	case opts.Style == "lcd":
+		face = newLCDFace(text, opts, availableWidth, imgHeight)
+	case len(opts.Fonts) == 0:
+	case opts.FontSize > 0:
+		if f, err := acquireFace(opts.Fonts, opts.FontSize); err == nil {
+			face, size = f, opts.FontSize
+		}
+	case opts.HeightPercent > 0:
+		// line height scales linearly with the size, so measure once and scale
+		const refSize = 100.0
+		if ref, err := acquireFace(opts.Fonts, refSize); err == nil {
+			m := ref.Metrics()
+			releaseFace(opts.Fonts, refSize, ref)
+			if lh := (m.Ascent + m.Descent).Ceil(); lh > 0 {
+				target := float64(imgHeight*opts.HeightPercent) / 100
+				s := max(refSize*target/float64(lh), 1)
+				if f, err := acquireFace(opts.Fonts, s); err == nil {
+					face, size = f, s
+				}
+			}
+		}
+	default:
+		// text width scales almost linearly with the size: measure once at a
+		// reference size, jump to the target, then correct for hinting at most twice
+		const refSize = 100.0
+		s := refSize
+		for i := 0; i < 4; i++ {
+			f, err := acquireFace(opts.Fonts, s)
+			if err != nil {
+				break
+			}
+			w := widestToken(f, text)
+			if w <= availableWidth && s > size {
+				if face != nil {
+					releaseFace(opts.Fonts, size, face)
+				}
+				face, size = f, s
+			} else {
+				releaseFace(opts.Fonts, s, f)
+			}
+			// within 2% of the target is close enough
+			if w == 0 || (i > 0 && w <= availableWidth && w*50 >= availableWidth*49) {
+				break
+			}
+			next := min(max(s*float64(availableWidth)/float64(w), 1), float64(imgWidth))
+			if w > availableWidth && i > 0 {
+				// still too wide after hinting: aim a little lower
+				next *= 0.99
+			}
+			if next == s {
+				break
+			}
+			s = next
+		}
+	}
+	if face == nil {
+		face = bitmapFace(text, opts, availableWidth, imgHeight)
+	}
+	drawer := &font.Drawer{Face: face}
+
+	lines := wrapText(drawer, text, availableWidth)
+
+	metrics := face.Metrics()
+	ascent := metrics.Ascent.Ceil()
+	descent := metrics.Descent.Ceil()
+	lineHeight := ascent + descent
+
+	// starting y for the first (top) line of the block
+	var startY int
+	switch {
+	case strings.HasPrefix(opts.Position, "top"):
+		// block top is pixelMargin below the top edge
+		startY = bounds.Min.Y + pixelMargin + ascent
+	case opts.Position == "center":
+		// block vertically centered, used for the --frame strip
+		startY = bounds.Min.Y + (bounds.Dy()-len(lines)*lineHeight)/2 + ascent
+	default:
+		// block bottom is pixelMargin above bottom
+		startY = max(bounds.Max.Y-pixelMargin-descent-(len(lines)-1)*lineHeight, bounds.Min.Y+ascent+pixelMargin)
+	}
+	// a margin larger than the image must not push the block out of it
+	startY = max(min(startY, bounds.Max.Y-descent-(len(lines)-1)*lineHeight), bounds.Min.Y+ascent)
+
+	// the block goes to the chosen corner, and its lines are aligned within it
+	widths := make([]int, len(lines))
+	blockWidth := 0
+	for i, line := range lines {
+		widths[i] = lineWidth(face, line)
+		blockWidth = max(blockWidth, widths[i])
+	}
+	var blockX int
+	switch opts.Position {
+	case "bottom-left", "top-left":
+		blockX = bounds.Min.X + pixelMargin
+	case "bottom-center", "center":
+		blockX = max(bounds.Min.X+(bounds.Dx()-blockWidth)/2, bounds.Min.X+pixelMargin)
+	default:
+		blockX = max(bounds.Max.X-blockWidth-pixelMargin, bounds.Min.X+pixelMargin)
+	}
+	align := opts.Align
+	if align == "" {
+		align = positionAlign(opts.Position)
+	}
+	dots := make([]image.Point, len(lines))
+	for i, w := range widths {
+		x := blockX
+		switch align {
+		case "center":
+			x += (blockWidth - w) / 2
+		case "right":
+			x += blockWidth - w
+		}
+		x = max(min(x, bounds.Max.X-w), bounds.Min.X)
+		dots[i] = image.Pt(x, startY+i*lineHeight)
+	}
+	l := &stampLayout{face: face, lines: lines, dots: dots, lineHeight: lineHeight}
+	if size > 0 {
+		l.fonts, l.size = opts.Fonts, size
+	}
+	if opts.Rotate != 0 {
+		l.rotate = opts.Rotate
+		l.placed = l.place(canvas, opts, pixelMargin)
+	}
+	return l
+}
+
+// lineWidth returns how far line reaches right of its dot: its advance,
+// or further where the ink of the last glyph overhangs it (italics, a
+// swash), so that right alignment keeps every drawn pixel inside the
+// margin. Kerning is applied as when drawing: font.Drawer and
+// font.BoundString both go through the face's Kern.
+func lineWidth(face font.Face, line string) int {
+	b, advance := font.BoundString(face, line)
+	return max(advance.Ceil(), b.Max.X.Ceil())
+}
+
+// positionAlign returns the alignment of the lines that follows position:
+// to the side of its corner, centered for the centered positions.
+func positionAlign(position string) string {
+	switch position {
+	case "bottom-left", "top-left":
+		return "left"
+	case "bottom-center", "center":
+		return "center"
+	}
+	return "right"
+}
+
+// place positions the rotated stamp in the chosen corner of canvas.
+func (l *stampLayout) place(canvas image.Rectangle, opts Options, margin int) image.Rectangle {
+	size := l.drawRect(opts).Size()
+	if l.rotate != 180 {
+		size.X, size.Y = size.Y, size.X
+	}
+	var p image.Point
+	switch opts.Position {
+	case "bottom-left", "top-left":
+		p.X = canvas.Min.X + margin
+	case "bottom-center", "center":
+		p.X = canvas.Min.X + (canvas.Dx()-size.X)/2
+	default:
+		p.X = canvas.Max.X - size.X - margin
+	}
+	switch {
+	case strings.HasPrefix(opts.Position, "top"):
+		p.Y = canvas.Min.Y + margin
+	case opts.Position == "center":
+		p.Y = canvas.Min.Y + (canvas.Dy()-size.Y)/2
+	default:
+		p.Y = canvas.Max.Y - size.Y - margin
+	}
+	p.X = max(min(p.X, canvas.Max.X-size.X), canvas.Min.X)
+	p.Y = max(min(p.Y, canvas.Max.Y-size.Y), canvas.Min.Y)
+	return image.Rectangle{Min: p, Max: p.Add(size)}
+}
+
+// widestToken measures the widest piece of text wrapText can't break, which
+// is what has to fit the available width.
+func widestToken(f font.Face, text string) int {
+	d := &font.Drawer{Face: f}
+	maxW := 0
+	for _, t := range wrapTokens(text) {
+		maxW = max(maxW, d.MeasureString(t.text).Ceil())
+	}
+	return maxW
+}
+
+// release hands the layout's face back to the face cache. The layout must
+// not be drawn afterwards.
+func (l *stampLayout) release() {
+	if l.fonts != nil {
+		releaseFace(l.fonts, l.size, l.face)
+		l.face = nil
+	}
+}
+
+// bitmapFace returns the built-in bitmap font enlarged by the integer factor
+// that comes closest to the size a vector font would get.
+func bitmapFace(text string, opts Options, availableWidth, imgHeight int) font.Face {
+	base := basicfont.Face7x13
+	lh := base.Metrics().Height.Ceil()
+	var scale int
+	switch {
+	case opts.FontSize > 0:
+		scale = int(math.Round(opts.FontSize / float64(lh)))
+	case opts.HeightPercent > 0:
+		scale = imgHeight * opts.HeightPercent / 100 / lh
+	default:
+		scale = availableWidth / max(widestToken(base, text), 1)
+	}
+	if scale <= 1 {
+		return base
+	}
+	return &scaledFace{Face: base, scale: scale}
+}
+
+// draw renders the laid-out stamp onto dst in the configured style. A
+// rotated stamp is drawn into its own buffer, which is then turned and
+// composited at its placed position.
+func (l *stampLayout) draw(dst draw.Image, opts Options) {
+	if opts.Opacity <= 0 {
+		return
+	}
+	if l.rotate == 0 {
+		l.drawText(dst, opts)
+		return
+	}
+	buf := image.NewRGBA(l.drawRect(opts))
+	l.drawText(buf, opts)
+	// orientImage undoes an EXIF orientation: 8 turns counter-clockwise, 6 clockwise
+	orientation := map[int]int{90: 8, 180: 3, 270: 6}[l.rotate]
+	rotated := orientImage(buf, orientation)
+	draw.Draw(dst, l.placed, rotated, image.Point{}, draw.Over)
+	recycle(rotated)
+}
+
+// outlinePx is the outline thickness, which scales with the font size.
+func (l *stampLayout) outlinePx() int {
+	return max(l.lineHeight/20, 1)
+}
+
+// shadowOffset is the shadow displacement, scaled with the font size unless
+// set explicitly.
+func (l *stampLayout) shadowOffset(opts Options) int {
+	if opts.ShadowOffset > 0 {
+		return opts.ShadowOffset
+	}
+	return max(l.lineHeight/15, 1)
+}
+
+// drawRect is the area drawText may touch, including outline and shadow.
+func (l *stampLayout) drawRect(opts Options) image.Rectangle {
+	r := l.textRect()
+	switch opts.Style {
+	case "shadow":
+		off := l.shadowOffset(opts)
+		return r.Union(r.Add(image.Pt(off, off)))
+	case "plain":
+		return r
+	case "lcd":
+		return r.Inset(-2 * l.outlinePx())
+	default:
+		return r.Inset(-l.outlinePx())
+	}
+}
+
+// drawText renders the unrotated stamp. The text is rasterized once into an
+// alpha mask; the outline is that mask dilated, the shadow is that mask
+// offset, and the fill is composited on top.
+func (l *stampLayout) drawText(dst draw.Image, opts Options) {
+	fill := withOpacity(opts.TextColor, opts.Opacity)
+	outline := withOpacity(opts.OutlineColor, opts.Opacity)
+	shadow := withOpacity(opts.ShadowColor, opts.Opacity)
+
+	outlinePx := l.outlinePx()
+	pad := 0
+	switch opts.Style {
+	case "outline", "":
+		pad = outlinePx
+	case "lcd":
+		pad = 2 * outlinePx
+	}
+	mask := l.mask(pad)
+	rect := mask.Bounds()
+
+	switch opts.Style {
+	case "shadow":
+		// a single copy offset down-right
+		off := l.shadowOffset(opts)
+		draw.DrawMask(dst, rect.Add(image.Pt(off, off)), image.NewUniform(shadow), image.Point{}, mask, rect.Min, draw.Over)
+	case "plain":
+	case "lcd":
+		// a faint two-step glow in the text color around the segments
+		inner := dilate(mask, outlinePx)
+		outer := dilate(inner, outlinePx)
+		draw.DrawMask(dst, rect, image.NewUniform(withOpacity(fill, 15)), image.Point{}, outer, rect.Min, draw.Over)
+		draw.DrawMask(dst, rect, image.NewUniform(withOpacity(fill, 25)), image.Point{}, inner, rect.Min, draw.Over)
+	default:
+		draw.DrawMask(dst, rect, image.NewUniform(outline), image.Point{}, dilate(mask, outlinePx), rect.Min, draw.Over)
+	}
+
+	// main fill
+	draw.DrawMask(dst, rect, image.NewUniform(fill), image.Point{}, mask, rect.Min, draw.Over)
+}
+
+// withOpacity scales the premultiplied color c by percent/100.
+func withOpacity(c color.RGBA, percent int) color.RGBA {
+	if percent >= 100 {
+		return c
+	}
+	scale := func(v uint8) uint8 { return uint8((int(v)*percent + 50) / 100) }
+	return color.RGBA{scale(c.R), scale(c.G), scale(c.B), scale(c.A)}
+}
+
+// rect returns the area of the canvas covered by the stamp text.
+func (l *stampLayout) rect() image.Rectangle {
+	if l.rotate != 0 {
+		return l.placed
+	}
+	return l.textRect()
+}
+
+// textRect returns the bounding box of the glyphs of all lines, unrotated.
+func (l *stampLayout) textRect() image.Rectangle {
+	var rect image.Rectangle
+	for i, line := range l.lines {
+		b, _ := font.BoundString(l.face, line)
+		r := image.Rect(b.Min.X.Floor(), b.Min.Y.Floor(), b.Max.X.Ceil(), b.Max.Y.Ceil()).Add(l.dots[i])
+		rect = rect.Union(r)
+	}
+	return rect
+}
+
+// mask rasterizes all lines into an alpha mask covering the text block,
+// padded by pad pixels on every side.
+func (l *stampLayout) mask(pad int) *image.Alpha {
+	m := image.NewAlpha(l.textRect().Inset(-pad))
+	drawer := &font.Drawer{Dst: m, Src: image.Opaque, Face: l.face}
+	for i, line := range l.lines {
+		drawer.Dot = fixed.P(l.dots[i].X, l.dots[i].Y)
+		drawer.DrawString(line)
+	}
+	return m
+}
+
+// dilate returns m grown by r pixels in every direction: a (2r+1)×(2r+1)
+// max filter computed as a horizontal and a vertical pass.
+func dilate(m *image.Alpha, r int) *image.Alpha {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tmp := image.NewAlpha(b)
+	for y := 0; y < h; y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+w]
+		out := tmp.Pix[y*tmp.Stride : y*tmp.Stride+w]
+		for x := range out {
+			var v uint8
+			for k := max(x-r, 0); k <= min(x+r, w-1); k++ {
+				v = max(v, row[k])
+			}
+			out[x] = v
+		}
+	}
+	out := image.NewAlpha(b)
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			var v uint8
+			for k := max(y-r, 0); k <= min(y+r, h-1); k++ {
+				v = max(v, tmp.Pix[k*tmp.Stride+x])
+			}
+			out.Pix[y*out.Stride+x] = v
+		}
+	}
+	return out
+}
+
+// autoColors picks the higher-contrast of light-text-on-dark-outline and
+// dark-text-on-light-outline for the region r of img, using the average
+// relative luminance of the region. It also returns that luminance (0-1).
+func autoColors(img image.Image, r image.Rectangle) (fill, outline color.RGBA, lum float64) {
+	white := color.RGBA{255, 255, 255, 255}
+	black := color.RGBA{0, 0, 0, 255}
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return black, white, 1
+	}
+	// sample on a grid of at most ~100x100 points
+	step := max(max(r.Dx(), r.Dy())/100, 1)
+	var sum float64
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y += step {
+		for x := r.Min.X; x < r.Max.X; x += step {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			sum += 0.2126*linearize(cr) + 0.7152*linearize(cg) + 0.0722*linearize(cb)
+			n++
+		}
+	}
+	lum = sum / float64(n)
+	// WCAG contrast ratio of white and black text against the background
+	whiteContrast := 1.05 / (lum + 0.05)
+	blackContrast := (lum + 0.05) / 0.05
+	if whiteContrast > blackContrast {
+		return white, black, lum
+	}
+	return black, white, lum
+}
+
+// linearize converts a 16-bit sRGB channel value to linear light (0-1).
+func linearize(v uint32) float64 {
+	c := float64(v) / 0xffff
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// pickAutoColors resolves --color auto for the area under the stamp.
+func pickAutoColors(inPath string, img image.Image, l *stampLayout, verbose bool) (fill, outline color.RGBA) {
+	fill, outline, lum := autoColors(img, l.rect())
+	if verbose {
+		tone := "dark text on light outline"
+		if fill.R == 255 {
+			tone = "light text on dark outline"
+		}
+		log.Printf("%s: auto color: background luminance %.2f, using %s", inPath, lum, tone)
+	}
+	return fill, outline
+}
@@ -0,0 +1,370 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+func TestWrapTextParagraphs(t *testing.T) {
+	d := &font.Drawer{Face: basicfont.Face7x13}
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"2023-07-14 10:30\nKyoto", []string{"2023-07-14 10:30", "Kyoto"}},
+		{"2023-07-14\n\nKyoto", []string{"2023-07-14", "", "Kyoto"}},
+		{"2023-07-14\n \t\n\nKyoto", []string{"2023-07-14", "", "", "Kyoto"}},
+		{"\n2023-07-14\n\n", []string{"2023-07-14"}},
+		{"2023-07-14   10:30", []string{"2023-07-14 10:30"}},
+		{"", []string{""}},
+	}
+	for _, tt := range tests {
+		if got := wrapText(d, tt.text, 1000); !slices.Equal(got, tt.want) {
+			t.Errorf("wrapText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLayoutParagraphs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FontSize = 26 // wide enough for each paragraph on one line
+	l := layoutStamp(image.Rect(0, 0, 640, 480), "2023-07-14 10:30\n\nKyoto", opts)
+	defer l.release()
+	if !slices.Equal(l.lines, []string{"2023-07-14 10:30", "", "Kyoto"}) {
+		t.Fatalf("lines %q", l.lines)
+	}
+	for i := 1; i < len(l.dots); i++ {
+		if dy := l.dots[i].Y - l.dots[i-1].Y; dy != l.lineHeight {
+			t.Errorf("line %d is %dpx below the one before, want the line height %d", i, dy, l.lineHeight)
+		}
+	}
+	// sized by the widest line, the block right-aligned in the bottom right corner
+	first, last := lineWidth(l.face, l.lines[0]), lineWidth(l.face, l.lines[2])
+	if l.dots[0].X+first != l.dots[2].X+last {
+		t.Errorf("lines end at %d and %d, want them right-aligned", l.dots[0].X+first, l.dots[2].X+last)
+	}
+	if r := l.textRect(); !r.In(image.Rect(0, 0, 640, 480)) {
+		t.Errorf("text block %v on a 640x480 canvas", r)
+	}
+}
+
+// kernFace is the bitmap font with every pair of glyphs kerned by kern.
+type kernFace struct {
+	font.Face
+	kern fixed.Int26_6
+}
+
+func (f kernFace) Kern(r0, r1 rune) fixed.Int26_6 { return f.kern }
+
+func TestKerning(t *testing.T) {
+	const text, margin = "JULY 7, 2023", 10
+	opts := DefaultOptions()
+	opts.Style = "plain"
+	plain := lineWidth(basicfont.Face7x13, text)
+	for _, kern := range []int{3, -2} {
+		face := kernFace{basicfont.Face7x13, fixed.I(kern)}
+		w := lineWidth(face, text)
+		if want := plain + (len(text)-1)*kern; w != want {
+			t.Errorf("kern %d: measured %dpx, want %d", kern, w, want)
+		}
+		// right-aligned at the margin, as layoutStamp places it
+		canvas := image.Rect(0, 0, 240, 30)
+		l := &stampLayout{face: face, lines: []string{text}, dots: []image.Point{{canvas.Max.X - margin - w, 20}}, lineHeight: 13}
+		dst := image.NewRGBA(canvas)
+		l.drawText(dst, opts)
+		right := -1
+		for x := canvas.Min.X; x < canvas.Max.X; x++ {
+			for y := canvas.Min.Y; y < canvas.Max.Y; y++ {
+				if dst.RGBAAt(x, y).A > 0 {
+					right = x
+				}
+			}
+		}
+		if limit := canvas.Max.X - margin; right >= limit || right < limit-7 {
+			t.Errorf("kern %d: rightmost pixel at x=%d, want it just inside %d", kern, right, limit)
+		}
+	}
+}
+
+func TestWidthPercentPortrait(t *testing.T) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	white := encodeJPEG(t, solid(640, 480, color.White))
+	rotated := withExif(white, buildTIFF([]tiffEntry{shortTag(0x0112, 6)}, nil, nil)) // portrait once upright
+	portrait := encodeJPEG(t, solid(480, 640, color.White))
+	tests := []struct {
+		name     string
+		data     []byte
+		portrait int // Options.WidthPercentPortrait
+		want     int // stamp width in pixels
+	}{
+		{"landscape", white, 25, 640 * 40 / 100},
+		{"portrait", portrait, 25, 480 * 25 / 100},
+		{"rotated to portrait", rotated, 25, 480 * 25 / 100},
+		{"portrait, same percent", portrait, 0, 480 * 40 / 100},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Fonts = []*opentype.Font{f}
+		opts.WidthPercent, opts.WidthPercentPortrait = 40, tt.portrait
+		var out bytes.Buffer
+		if _, err := Process(context.Background(), bytes.NewReader(tt.data), &out, opts); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		img, err := jpeg.Decode(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the outline adds a little to the text's width
+		if w := inkBounds(img).Dx(); w < tt.want*90/100 || w > tt.want*108/100 {
+			t.Errorf("%s: stamp %dpx wide, want about %d", tt.name, w, tt.want)
+		}
+	}
+}
+
+func TestWrapTextCJK(t *testing.T) {
+	// every glyph of the bitmap font, and its stand-in for CJK, is 7px wide
+	d := &font.Drawer{Face: basicfont.Face7x13}
+	tests := []struct {
+		text     string
+		maxWidth int
+		want     []string
+	}{
+		{"2023年1月2日 東京", 5 * 7, []string{"2023年", "1月2日", "東京"}},
+		{"2023年1月2日 東京", 100 * 7, []string{"2023年1月2日 東京"}},
+		{"東京 Station 2023", 8 * 7, []string{"東京", "Station", "2023"}},
+		{"Kyoto駅 2023", 6 * 7, []string{"Kyoto駅", "2023"}},
+		{"Photograph 東京", 5 * 7, []string{"Photo", "graph", "東京"}},
+		// not even one glyph fits: one per line
+		{"東京", 3, []string{"東", "京"}},
+		{"ab 東", 3, []string{"a", "b", "東"}},
+	}
+	for _, tt := range tests {
+		got := wrapText(d, tt.text, tt.maxWidth)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("wrapText(%q, %d) = %q, want %q", tt.text, tt.maxWidth, got, tt.want)
+		}
+		for _, line := range got {
+			if w := d.MeasureString(line).Ceil(); w > tt.maxWidth && len([]rune(line)) > 1 {
+				t.Errorf("wrapText(%q, %d): line %q is %dpx wide", tt.text, tt.maxWidth, line, w)
+			}
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden images in testdata/golden")
+
+// checkGolden compares img with testdata/golden/name.png pixel for pixel,
+// or with -update writes it there.
+func checkGolden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".png")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, encodePNG(t, img), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Bounds() != img.Bounds() {
+		t.Fatalf("%s: %v image, golden is %v", name, img.Bounds(), want.Bounds())
+	}
+	diff := 0
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			if color.RGBAModel.Convert(img.At(x, y)) != color.RGBAModel.Convert(want.At(x, y)) {
+				diff++
+			}
+		}
+	}
+	if diff > 0 {
+		t.Errorf("%s: %d pixels differ from %s", name, diff, path)
+	}
+}
+
+// goldenStamp draws text with opts onto a gray w x h canvas, in the
+// bitmap font at twice its size.
+func goldenStamp(w, h int, text string, opts Options) (image.Image, *stampLayout) {
+	opts.FontSize = 26
+	canvas := solid(w, h, color.RGBA{128, 128, 128, 255})
+	l := layoutStamp(canvas.Bounds(), text, opts)
+	l.draw(canvas, opts)
+	return canvas, l
+}
+
+func TestStyleGolden(t *testing.T) {
+	for _, style := range []string{"outline", "shadow", "plain"} {
+		opts := DefaultOptions()
+		opts.Style = style
+		img, l := goldenStamp(260, 90, "2023-07-14\n10:30", opts)
+		l.release()
+		checkGolden(t, "style-"+style, img)
+	}
+}
+
+func TestAlignGolden(t *testing.T) {
+	for _, align := range []string{"left", "center", "right"} {
+		opts := DefaultOptions()
+		opts.Align = align
+		img, l := goldenStamp(260, 90, "2023-07-14\n10:30", opts)
+		checkGolden(t, "align-"+align, img)
+
+		// the lines share the edge, or the center, of the block
+		w0, w1 := lineWidth(l.face, l.lines[0]), lineWidth(l.face, l.lines[1])
+		a, b := l.dots[0].X, l.dots[1].X
+		switch align {
+		case "center":
+			a, b = 2*a+w0, 2*b+w1
+		case "right":
+			a, b = a+w0, b+w1
+		}
+		if d := a - b; d < -1 || d > 1 {
+			t.Errorf("%s: lines at x=%d and x=%d (%dpx and %dpx wide)", align, l.dots[0].X, l.dots[1].X, w0, w1)
+		}
+		l.release()
+	}
+}
+
+func TestFixedSizeExtremes(t *testing.T) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const text = "2023-07-14 10:30:05"
+	wide, tall := image.Rect(0, 0, 3000, 100), image.Rect(0, 0, 100, 3000)
+	layout := func(bounds image.Rectangle, set func(*Options)) *stampLayout {
+		opts := DefaultOptions()
+		opts.Fonts = []*opentype.Font{f}
+		set(&opts)
+		return layoutStamp(bounds, text, opts)
+	}
+
+	// --height-percent follows the height of a panorama, on one line
+	l := layout(wide, func(o *Options) { o.HeightPercent = 20 })
+	if l.lineHeight < 19 || l.lineHeight > 21 || len(l.lines) != 1 {
+		t.Errorf("3000x100 at 20%% of the height: %d lines %dpx high, want one 20px high", len(l.lines), l.lineHeight)
+	}
+	if r := l.textRect(); !r.In(wide) {
+		t.Errorf("3000x100 at 20%% of the height: text at %v", r)
+	}
+	l.release()
+
+	// --font-size on a narrow strip wraps instead of running off the edge
+	l = layout(tall, func(o *Options) { o.FontSize = 20 })
+	if l.size != 20 || len(l.lines) < 2 {
+		t.Errorf("100x3000 at 20pt: size %v, %d lines; want 20 and wrapped", l.size, len(l.lines))
+	}
+	if r := l.textRect(); !r.In(tall) {
+		t.Errorf("100x3000 at 20pt: text at %v", r)
+	}
+	l.release()
+
+	// --font-size wins over --height-percent
+	l = layout(wide, func(o *Options) { o.FontSize, o.HeightPercent = 12, 50 })
+	if l.size != 12 {
+		t.Errorf("--font-size 12 with --height-percent 50: size %v", l.size)
+	}
+	l.release()
+
+	// sized by the width alone, the stamp on a narrow strip is tiny
+	l = layout(tall, func(*Options) {})
+	if r := l.textRect(); !r.In(tall) || l.lineHeight > 10 {
+		t.Errorf("100x3000 by width: %dpx lines at %v", l.lineHeight, r)
+	}
+	l.release()
+}
+
+func TestSizeWithinTwoPercent(t *testing.T) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Fonts = []*opentype.Font{f}
+	for _, w := range []int{120, 333, 640, 1001, 2500, 6000} {
+		l := layoutStamp(image.Rect(0, 0, w, w*3/4), "2023-07-14", opts)
+		target := max(w*opts.WidthPercent/100, 10)
+		got := widestToken(l.face, "2023-07-14")
+		// hinting rounds every advance to a whole pixel, so a small size
+		// can only come within a few pixels
+		tolerance := max(target/50, 8)
+		if got > target || got < target-tolerance {
+			t.Errorf("%dpx wide image: text %dpx wide at %.2fpt, want within %dpx below %d", w, got, l.size, tolerance, target)
+		}
+		l.release()
+	}
+}
+
+// BenchmarkOutline compares the outline drawn through a dilated mask with
+// the text drawn again at every offset around it, as it was before.
+func BenchmarkOutline(b *testing.B) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Fonts = []*opentype.Font{f}
+	canvas := image.NewRGBA(image.Rect(0, 0, 7000, 5000))
+	for _, size := range []float64{60, 120, 240} {
+		opts.FontSize = size
+		l := layoutStamp(canvas.Bounds(), "2023-07-14 10:30", opts)
+		r := l.outlinePx()
+		b.Run(fmt.Sprintf("dilate/%dpx", r), func(b *testing.B) {
+			for b.Loop() {
+				l.drawText(canvas, opts)
+			}
+		})
+		b.Run(fmt.Sprintf("redraw/%dpx", r), func(b *testing.B) {
+			d := &font.Drawer{Dst: canvas, Face: l.face}
+			for b.Loop() {
+				d.Src = image.NewUniform(opts.OutlineColor)
+				for dy := -r; dy <= r; dy++ {
+					for dx := -r; dx <= r; dx++ {
+						if dx == 0 && dy == 0 {
+							continue
+						}
+						for i, line := range l.lines {
+							d.Dot = fixed.P(l.dots[i].X+dx, l.dots[i].Y+dy)
+							d.DrawString(line)
+						}
+					}
+				}
+				d.Src = image.NewUniform(opts.TextColor)
+				for i, line := range l.lines {
+					d.Dot = fixed.P(l.dots[i].X, l.dots[i].Y)
+					d.DrawString(line)
+				}
+			}
+		})
+		l.release()
+	}
+}
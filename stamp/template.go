@@ -0,0 +1,245 @@
+package stamp
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// templateData holds the fields available to --template.
+// Every field is pre-formatted text; fields missing from the EXIF are empty.
+type templateData struct {
+	Date        string // capture date formatted with --format
+	Make        string // camera make, e.g. "SONY"
+	Model       string // camera model, e.g. "ILCE-7M3"
+	Lens        string // lens model
+	ISO         string // ISO speed, e.g. "100"
+	FNumber     string // aperture without the "f/" prefix, e.g. "1.8"
+	Exposure    string // exposure time without the unit, e.g. "1/250" or "2"
+	FocalLength string // focal length in mm without the unit, e.g. "24"
+	GPS         string // "lat, lon" formatted per --gps-format
+	Lat         string // latitude formatted per --gps-format
+	Lon         string // longitude formatted per --gps-format
+	Place       string // nearest city from --geodb, e.g. "Kyoto, JP"
+}
+
+// ParseTemplate parses a stamp text template for Options.Template, e.g.
+// "{{.Date}} · {{.Make}} {{.Model}}". An empty value returns a nil template.
+func ParseTemplate(s string) (*template.Template, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := template.New("stamp").Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// catch unknown fields now, not once per image
+	if err := t.Execute(io.Discard, templateData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// renameData holds the fields available to --rename-format: those of
+// --template, the input's name, and Date taking an optional layout.
+type renameData struct {
+	templateData
+	Name string // input file name without extension, e.g. "IMG_0042"
+
+	time   time.Time
+	timeOK bool
+}
+
+// Date returns the capture date formatted with layout, a Go time layout such
+// as "20060102_150405", or with --format when no layout is given.
+func (d renameData) Date(layout ...string) string {
+	if len(layout) == 0 || !d.timeOK {
+		return d.templateData.Date
+	}
+	return d.time.Format(layout[0])
+}
+
+// ParseRenameTemplate parses a file name template for
+// Options.RenameFormat, e.g. "{{.Date \"20060102_150405\"}}_{{.Model}}".
+// An empty value returns a nil template.
+func ParseRenameTemplate(s string) (*template.Template, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := template.New("rename").Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// a file name is needed for every input: catch unknown fields now, not per file
+	if err := t.Execute(io.Discard, renameData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newTemplateData collects the template fields from the EXIF of capture,
+// which may have none, and its position.
+func newTemplateData(capture captureDate, date string, opts Options) templateData {
+	d := templateData{Date: date}
+	if lat, lon, ok := capture.latLong(); ok {
+		d.Lat, d.Lon, d.GPS = opts.GPS.format(lat, lon)
+		d.Place = opts.Geo.place(lat, lon)
+	}
+	ex := capture.ex
+	if ex == nil {
+		return d
+	}
+	d.Make = exifString(ex, exif.Make)
+	d.Model = exifString(ex, exif.Model)
+	d.Lens = exifString(ex, exif.LensModel)
+	if tag, err := ex.Get(exif.ISOSpeedRatings); err == nil {
+		if v, err := tag.Int(0); err == nil {
+			d.ISO = strconv.Itoa(v)
+		}
+	}
+	if v, ok := exifRat(ex, exif.FNumber); ok {
+		d.FNumber = formatFNumber(v)
+	}
+	if num, den, ok := exifRat2(ex, exif.ExposureTime); ok {
+		d.Exposure = formatExposure(num, den)
+	}
+	if v, ok := exifRat(ex, exif.FocalLength); ok {
+		d.FocalLength = strconv.Itoa(int(math.Round(v)))
+	}
+	return d
+}
+
+// renderTemplate executes tmpl with data and collapses the runs of spaces left behind by empty fields.
+func renderTemplate(tmpl *template.Template, data templateData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	lines := strings.Split(b.String(), "\n")
+	for i, l := range lines {
+		lines[i] = strings.Join(strings.Fields(l), " ")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// exposureLine returns e.g. "24mm f/1.8 1/250s ISO 100" from the template
+// fields, leaving out whichever are missing.
+func exposureLine(d templateData) string {
+	var parts []string
+	if d.FocalLength != "" {
+		parts = append(parts, d.FocalLength+"mm")
+	}
+	if d.FNumber != "" {
+		parts = append(parts, "f/"+d.FNumber)
+	}
+	if d.Exposure != "" {
+		parts = append(parts, d.Exposure+"s")
+	}
+	if d.ISO != "" {
+		parts = append(parts, "ISO "+d.ISO)
+	}
+	return strings.Join(parts, " ")
+}
+
+// artistName returns the photographer from the Artist tag, or else from the
+// Copyright tag with any leading "©", "(c)" or "Copyright" removed.
+func artistName(ex *exif.Exif) string {
+	if ex == nil {
+		return ""
+	}
+	if a := exifString(ex, exif.Artist); a != "" {
+		return a
+	}
+	c := exifString(ex, exif.Copyright)
+	for {
+		trimmed := strings.TrimSpace(c)
+		for _, p := range []string{"©", "(c)", "(C)", "Copyright", "copyright"} {
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, p))
+		}
+		if trimmed == c {
+			return c
+		}
+		c = trimmed
+	}
+}
+
+// cameraName returns "Make Model", dropping the make when the model already
+// starts with it (Canon "Canon EOS R5", NIKON CORPORATION "NIKON D750").
+func cameraName(ex *exif.Exif) string {
+	if ex == nil {
+		return ""
+	}
+	maker, model := exifString(ex, exif.Make), exifString(ex, exif.Model)
+	brand := maker
+	if i := strings.IndexByte(brand, ' '); i > 0 {
+		brand = brand[:i]
+	}
+	if model != "" && brand != "" && strings.HasPrefix(strings.ToLower(model), strings.ToLower(brand)) {
+		return model
+	}
+	return strings.TrimSpace(maker + " " + model)
+}
+
+// exifString returns the trimmed string value of an ASCII tag, or "" when absent.
+func exifString(ex *exif.Exif, name exif.FieldName) string {
+	tag, err := ex.Get(name)
+	if err != nil || tag == nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// exifRat2 returns the first rational value of a tag as numerator and denominator.
+func exifRat2(ex *exif.Exif, name exif.FieldName) (num, den int64, ok bool) {
+	tag, err := ex.Get(name)
+	if err != nil || tag == nil {
+		return 0, 0, false
+	}
+	num, den, err = tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0, 0, false
+	}
+	return num, den, true
+}
+
+// exifRat returns the first rational value of a tag as a float.
+func exifRat(ex *exif.Exif, name exif.FieldName) (float64, bool) {
+	num, den, ok := exifRat2(ex, name)
+	if !ok {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+// formatFNumber keeps one decimal only when the aperture is not a whole number.
+func formatFNumber(v float64) string {
+	if math.Abs(v-math.Round(v)) < 0.05 {
+		return strconv.Itoa(int(math.Round(v)))
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+// formatExposure prints exposures of a second or longer as whole seconds ("2")
+// and shorter ones as the conventional reciprocal ("1/250").
+func formatExposure(num, den int64) string {
+	if num <= 0 || den <= 0 {
+		return ""
+	}
+	if num >= den {
+		v := float64(num) / float64(den)
+		if math.Abs(v-math.Round(v)) < 0.05 {
+			return strconv.Itoa(int(math.Round(v)))
+		}
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	return "1/" + strconv.Itoa(int(math.Round(float64(den)/float64(num))))
+}
@@ -0,0 +1,104 @@
+package stamp
+
+import (
+	"bytes"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// templateJPEG returns a JPEG with the EXIF tags behind every template
+// field: camera, lens, exposure and a position in Kyoto.
+func templateJPEG(t *testing.T) []byte {
+	ifd0 := []tiffEntry{asciiTag(0x010F, "SONY"), asciiTag(0x0110, "ILCE-7M3")}
+	exifIFD := []tiffEntry{
+		asciiTag(0x9003, "2023:07:14 10:30:05"),
+		ratTag(0x829A, 1, 250),  // ExposureTime
+		ratTag(0x829D, 18, 10),  // FNumber
+		shortTag(0x8827, 100),   // ISOSpeedRatings
+		ratTag(0x920A, 240, 10), // FocalLength
+		asciiTag(0xA434, "FE 24mm F1.4 GM"),
+	}
+	gpsIFD := []tiffEntry{
+		asciiTag(0x0001, "N"),
+		ratTag(0x0002, 35, 1, 0, 1, 4176, 100),
+		asciiTag(0x0003, "E"),
+		ratTag(0x0004, 135, 1, 46, 1, 1200, 100),
+	}
+	return withExif(encodeJPEG(t, solid(16, 16, color.White)), buildTIFF(ifd0, exifIFD, gpsIFD))
+}
+
+func TestTemplateFields(t *testing.T) {
+	geodb := filepath.Join(t.TempDir(), "cities.txt")
+	if err := os.WriteFile(geodb, []byte("1857910\tKyoto\tKyoto\t\t35.02107\t135.75385\tP\tPPLA\tJP\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := LoadGeoDB(geodb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Geo = geo
+	capture := readCaptureDate(bytes.NewReader(templateJPEG(t)), false, "", time.Time{}, opts)
+	tests := []struct {
+		field, want string
+	}{
+		{"Date", "2023-07-14 10:30:05"},
+		{"Make", "SONY"},
+		{"Model", "ILCE-7M3"},
+		{"Lens", "FE 24mm F1.4 GM"},
+		{"ISO", "100"},
+		{"FNumber", "1.8"},
+		{"Exposure", "1/250"},
+		{"FocalLength", "24"},
+		{"GPS", "35.01160, 135.77000"},
+		{"Lat", "35.01160"},
+		{"Lon", "135.77000"},
+		{"Place", "Kyoto, JP"},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseTemplate("{{." + tt.field + "}}")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.field, err)
+		}
+		opts.Template = tmpl
+		got, err := stampText(capture, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.field, err)
+		}
+		if got != tt.want {
+			t.Errorf("{{.%s}} = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateMissingFields(t *testing.T) {
+	// no EXIF: the empty fields and the spaces around them go
+	opts := DefaultOptions()
+	opts.Template, _ = ParseTemplate("{{.Make}}  {{.Model}} {{.Date}}  {{.Lens}}")
+	capture := readCaptureDate(bytes.NewReader(dated(t, 16, 16, "2023:07:14 10:30:05")), false, "", time.Time{}, opts)
+	got, err := stampText(capture, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "2023-07-14 10:30:05" {
+		t.Errorf("stamp %q, want only the date", got)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	if tmpl, err := ParseTemplate(""); tmpl != nil || err != nil {
+		t.Errorf(`ParseTemplate("") = %v, %v; want nil, nil`, tmpl, err)
+	}
+	for _, s := range []string{"{{.Date}} {{.Shutter}}", "{{.Date"} {
+		_, err := ParseTemplate(s)
+		if err == nil {
+			t.Errorf("ParseTemplate(%q) succeeded, want an error", s)
+		} else if s == "{{.Date}} {{.Shutter}}" && !strings.Contains(err.Error(), "Shutter") {
+			t.Errorf("ParseTemplate(%q) error %q doesn't name the unknown field", s, err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package stamp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// setFileTimes sets the creation, access and modification times of path to
+// t, so Explorer's "Date created" column matches the photo too.
+func setFileTimes(path string, t time.Time) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.CloseHandle(h)
+	ft := syscall.NsecToFiletime(t.UnixNano())
+	if err := syscall.SetFileTime(h, &ft, &ft, &ft); err != nil {
+		return &os.PathError{Op: "setfiletime", Path: path, Err: err}
+	}
+	return nil
+}
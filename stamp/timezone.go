@@ -0,0 +1,80 @@
+package stamp
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF 2.31 time zone offsets ("+09:00") of the date tags, which goexif
+// doesn't know about.
+const (
+	offsetTime          exif.FieldName = "OffsetTime"          // of DateTime
+	offsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"  // of DateTimeOriginal
+	offsetTimeDigitized exif.FieldName = "OffsetTimeDigitized" // of DateTimeDigitized
+)
+
+var offsetFields = map[uint16]exif.FieldName{
+	0x9010: offsetTime,
+	0x9011: offsetTimeOriginal,
+	0x9012: offsetTimeDigitized,
+}
+
+func init() {
+	exif.RegisterParsers(offsetParser{})
+}
+
+// offsetParser loads the offset tags from the Exif sub-IFD.
+type offsetParser struct{}
+
+func (offsetParser) Parse(x *exif.Exif) error {
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	off, err := tag.Int64(0)
+	if err != nil || off <= 0 || off >= int64(len(x.Raw)) {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(off, 0); err != nil {
+		return nil
+	}
+	// a broken sub-IFD only costs the offsets, never the rest of the EXIF
+	if dir, _, err := tiff.DecodeDir(r, x.Tiff.Order); err == nil {
+		x.LoadTags(dir, offsetFields, false)
+	}
+	return nil
+}
+
+// parseOffset parses an EXIF offset such as "+09:00" or "-05:30" into a
+// fixed zone.
+func parseOffset(s string) (*time.Location, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) != 6 || (s[0] != '+' && s[0] != '-') || s[3] != ':' {
+		return nil, false
+	}
+	h, err1 := strconv.Atoi(s[1:3])
+	m, err2 := strconv.Atoi(s[4:6])
+	if err1 != nil || err2 != nil || h > 14 || m > 59 {
+		return nil, false
+	}
+	secs := (h*60 + m) * 60
+	if s[0] == '-' {
+		secs = -secs
+	}
+	return time.FixedZone("UTC"+s, secs), true
+}
+
+// ParseTimeZone parses a zone for Options.TimeZone: "Local", "UTC", an
+// offset such as "+09:00", or an IANA name such as "Asia/Tokyo".
+func ParseTimeZone(s string) (*time.Location, error) {
+	if loc, ok := parseOffset(s); ok {
+		return loc, nil
+	}
+	return time.LoadLocation(s)
+}
@@ -0,0 +1,95 @@
+package stamp
+
+import (
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseOffset(t *testing.T) {
+	for s, want := range map[string]int{
+		"+09:00":   9 * 3600,
+		"-05:30":   -(5*3600 + 30*60),
+		" +00:00 ": 0,
+		"+14:00":   14 * 3600,
+	} {
+		loc, ok := parseOffset(s)
+		if !ok {
+			t.Errorf("parseOffset(%q) rejected", s)
+			continue
+		}
+		if _, off := time.Date(2023, 7, 14, 0, 0, 0, 0, loc).Zone(); off != want {
+			t.Errorf("parseOffset(%q) = %ds, want %ds", s, off, want)
+		}
+	}
+	for _, s := range []string{"", "+9:00", "09:00", "+15:00", "+09:60", "+09-00", "   :  "} {
+		if _, ok := parseOffset(s); ok {
+			t.Errorf("parseOffset(%q) accepted", s)
+		}
+	}
+}
+
+func TestOffsetRoundTrip(t *testing.T) {
+	// 10:30:05 in Tokyo, read with another default zone: the offset tag
+	// wins, and survives into the output's EXIF
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.jpg")
+	exifIFD := []tiffEntry{asciiTag(0x9003, "2023:07:14 10:30:05"), asciiTag(0x9011, "+09:00")}
+	if err := os.WriteFile(in, withExif(encodeJPEG(t, solid(40, 30, color.White)), buildTIFF(nil, exifIFD, nil)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.TimeZone = time.FixedZone("UTC-05:00", -5*3600)
+	want := "2023-07-14T10:30:05+09:00"
+
+	res, err := ProcessFile(context.Background(), in, filepath.Join(dir, "out.jpg"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Time.Format(time.RFC3339); got != want || res.Date != "2023-07-14 10:30:05" {
+		t.Errorf("time %s, date %q; want %s, 2023-07-14 10:30:05", got, res.Date, want)
+	}
+	fi, err := os.Stat(res.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(time.Date(2023, 7, 14, 1, 30, 5, 0, time.UTC)) {
+		t.Errorf("output mtime %v, want 01:30:05 UTC", fi.ModTime().UTC())
+	}
+
+	// the output again, as an input
+	opts.Restamp = true
+	again, err := ProcessFile(context.Background(), res.Out, filepath.Join(dir, "again.jpg"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := again.Time.Format(time.RFC3339); got != want {
+		t.Errorf("time read back from the output %s, want %s", got, want)
+	}
+
+	// --rename names the file by the photo's own time, not the zone's
+	opts.Rename = true
+	renamed, err := ProcessFile(context.Background(), in, filepath.Join(dir, "in.jpg"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := filepath.Base(renamed.Out); got != "2023-07-14_10-30-05.jpg" {
+		t.Errorf("renamed to %s, want 2023-07-14_10-30-05.jpg", got)
+	}
+}
+
+func TestLocalDisplay(t *testing.T) {
+	tokyo, _ := parseOffset("+09:00")
+	c := captureDate{time: time.Date(2023, 7, 14, 10, 30, 5, 0, tokyo)}
+	if got := c.displayTime(DefaultOptions()); got.Location() != tokyo {
+		t.Errorf("display zone %v, want the photo's own", got.Location())
+	}
+	opts := DefaultOptions()
+	opts.LocalDisplay = true
+	if got := c.displayTime(opts); got.Location() != time.Local || !got.Equal(c.time) {
+		t.Errorf("display time %v with LocalDisplay, want %v in the local zone", got, c.time)
+	}
+}
@@ -0,0 +1,137 @@
+package stamp
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Variant is an extra, downscaled copy ProcessFile writes from the same
+// decoded image, e.g. a web size and a thumbnail next to the full-size
+// output.
+type Variant struct {
+	Name         string // directory under Options.OutRoot
+	MaxDimension int    // long edge in pixels, as Options.MaxDimension
+}
+
+// VariantResult reports one Options.Variants output of ProcessFile or
+// PlanFile. Err wraps ErrSkipped for a variant left alone by
+// Options.SkipExisting.
+type VariantResult struct {
+	Name        string
+	Out         string // empty when Err is set
+	Overwritten bool
+	Size        int64
+	Err         error
+}
+
+// ParseVariant parses a "name=maxdim" variant, e.g. "thumb=800".
+func ParseVariant(s string) (Variant, error) {
+	name, dim, ok := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return Variant{}, fmt.Errorf("%q: want name=maxdim, e.g. thumb=800", s)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) || asciiFilename(name) != name {
+		return Variant{}, fmt.Errorf("%q: the name must be usable as a directory name", name)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(dim))
+	if err != nil || n <= 0 {
+		return Variant{}, fmt.Errorf("%q: want a positive number of pixels after =", s)
+	}
+	return Variant{Name: name, MaxDimension: n}, nil
+}
+
+// variantPath returns where variant name of the output out goes: out's
+// path below root, mirrored under root/name.
+func variantPath(root, name, out string) string {
+	rel, err := filepath.Rel(root, out)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// not below root: put it next to out instead
+		return filepath.Join(filepath.Dir(out), name, filepath.Base(out))
+	}
+	return filepath.Join(root, name, rel)
+}
+
+// drawVariants stamps every Options.Variants copy of src, leaving src
+// untouched. A variant that can't be stamped is logged and left nil, so
+// the others keep their index in opts.Variants.
+func drawVariants(src *decoded, text, inPath string, opts Options) []*stamped {
+	var imgs []*stamped
+	for _, v := range opts.Variants {
+		vopts := opts
+		// a thumbnail's stamp is small by design
+		vopts.Scale, vopts.MaxDimension, vopts.MinLineHeight = 0, v.MaxDimension, 0
+		img, err := src.stamp(text, inPath, vopts, true)
+		if err != nil {
+			log.Printf("warning: %s: skipping variant %s: %v", inPath, v.Name, err)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs
+}
+
+// writeVariants writes the images drawVariants stamped for the output
+// finalOut. A failed variant is reported in its result and doesn't keep
+// the others from being written.
+func writeVariants(imgs []*stamped, capture captureDate, inPath, finalOut string, in os.FileInfo, opts Options) []VariantResult {
+	var results []VariantResult
+	for i, img := range imgs {
+		if img == nil {
+			continue // not stamped, see drawVariants
+		}
+		v := opts.Variants[i]
+		res := VariantResult{Name: v.Name}
+		res.Out, res.Overwritten, res.Size, res.Err = writeVariant(img, capture, inPath, variantPath(opts.OutRoot, v.Name, finalOut), in, opts)
+		recycle(img.img)
+		results = append(results, res)
+	}
+	return results
+}
+
+// writeVariant writes one variant to out, with the existing-file rules of
+// the main output, and returns the path used.
+func writeVariant(img *stamped, capture captureDate, inPath, out string, in os.FileInfo, opts Options) (string, bool, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return "", false, 0, fmt.Errorf("mkdir dest: %w", err)
+	}
+	_, err := os.Stat(out)
+	existed := err == nil && (opts.Overwrite || opts.Incremental)
+	of, out, err := createOutput(inPath, out, opts)
+	if err != nil {
+		return "", false, 0, err
+	}
+	size, err := writeImage(of, img, opts)
+	if cerr := of.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return "", false, 0, err
+	}
+	setOutputTimes(out, capture, in, opts)
+	return out, existed, size, nil
+}
+
+// planVariants is the PlanFile counterpart of writeVariants.
+func planVariants(inPath, finalOut string, opts Options) []VariantResult {
+	var results []VariantResult
+	for _, v := range opts.Variants {
+		res := VariantResult{Name: v.Name, Out: variantPath(opts.OutRoot, v.Name, finalOut)}
+		if _, err := os.Stat(res.Out); err == nil {
+			switch {
+			case opts.SkipExisting:
+				res.Out, res.Err = "", fmt.Errorf("%w %s: %s already exists", ErrSkipped, inPath, res.Out)
+			case opts.Overwrite, opts.Incremental:
+				res.Overwritten = true
+			default:
+				res.Out, res.Err = freePath(res.Out)
+			}
+		}
+		results = append(results, res)
+	}
+	return results
+}
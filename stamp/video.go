@@ -0,0 +1,213 @@
+package stamp
+
+import (
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// videoExts are the extensions of the MP4 and QuickTime videos Options.Rename
+// copies or moves to names from their creation time, without drawing.
+var videoExts = map[string]bool{".mp4": true, ".m4v": true, ".mov": true}
+
+// IsVideo reports whether path has the extension of a video that is
+// renamed like the images, but never stamped.
+func IsVideo(path string) bool {
+	return videoExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// Where the creation time of a video came from.
+const (
+	dateSourceQuickTime = "quicktime" // Apple's creation date, local time with its offset
+	dateSourceMvhd      = "mvhd"      // creation_time of the movie header, in UTC
+)
+
+// box is an ISO BMFF (MP4, QuickTime) box: its type and where its payload lies.
+type box struct {
+	typ       string
+	off, size int64
+}
+
+// end returns the offset just past the payload of b.
+func (b box) end() int64 { return b.off + b.size }
+
+// maxBoxes bounds the boxes readBoxes lists at one level; a corrupt file
+// could otherwise make it count tiny boxes for a long time.
+const maxBoxes = 1024
+
+// readBoxes lists the boxes of r from off to end, stopping at the first
+// that doesn't fit.
+func readBoxes(r io.ReaderAt, off, end int64) []box {
+	var boxes []box
+	for off+8 <= end && len(boxes) < maxBoxes {
+		var h [16]byte
+		if _, err := r.ReadAt(h[:8], off); err != nil {
+			break
+		}
+		size, hdr := int64(binary.BigEndian.Uint32(h[:4])), int64(8)
+		switch size {
+		case 0: // to the end
+			size = end - off
+		case 1: // a 64-bit size follows the type
+			if _, err := r.ReadAt(h[8:], off+8); err != nil {
+				return boxes
+			}
+			size, hdr = int64(binary.BigEndian.Uint64(h[8:])), 16
+		}
+		if size < hdr || size > end-off {
+			break
+		}
+		boxes = append(boxes, box{string(h[4:8]), off + hdr, size - hdr})
+		off += size
+	}
+	return boxes
+}
+
+// findBox returns the first box of type typ in boxes.
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+// readPayload returns the payload of b, or nil when it is implausibly
+// large for the metadata it is read for.
+func readPayload(r io.ReaderAt, b box) []byte {
+	if b.size > 1<<16 {
+		return nil
+	}
+	p := make([]byte, b.size)
+	if _, err := r.ReadAt(p, b.off); err != nil {
+		return nil
+	}
+	return p
+}
+
+// videoDate returns the creation time of the MP4 or QuickTime video r of
+// size bytes. Apple's creation date, in the keys and ilst of moov/meta or
+// as ©day in moov/udta, is local time with its offset and wins over the
+// UTC creation_time of moov/mvhd, which is given in zone.
+func videoDate(r io.ReaderAt, size int64, zone *time.Location) (time.Time, string, bool) {
+	moov, ok := findBox(readBoxes(r, 0, size), "moov")
+	if !ok {
+		return time.Time{}, "", false
+	}
+	boxes := readBoxes(r, moov.off, moov.end())
+	if meta, ok := findBox(boxes, "meta"); ok {
+		if t, ok := appleCreationDate(r, meta); ok {
+			return t, dateSourceQuickTime, true
+		}
+	}
+	if udta, ok := findBox(boxes, "udta"); ok {
+		if day, ok := findBox(readBoxes(r, udta.off, udta.end()), "\xa9day"); ok {
+			if t, ok := parseVideoTime(itemString(r, day)); ok {
+				return t, dateSourceQuickTime, true
+			}
+		}
+	}
+	if mvhd, ok := findBox(boxes, "mvhd"); ok {
+		if t, ok := mvhdTime(readPayload(r, mvhd)); ok {
+			return t.In(zone), dateSourceMvhd, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// mp4Epoch is the time zero of the times of an ISO BMFF file, 1904-01-01,
+// in seconds before the Unix epoch.
+const mp4Epoch = 2082844800
+
+// mvhdTime returns the creation_time of the payload of an mvhd box: 32 or,
+// in version 1, 64 bits of seconds since mp4Epoch after the version and
+// flags. Zero, as many encoders leave it, is no time.
+func mvhdTime(p []byte) (time.Time, bool) {
+	var secs uint64
+	switch {
+	case len(p) >= 8 && p[0] == 0:
+		secs = uint64(binary.BigEndian.Uint32(p[4:8]))
+	case len(p) >= 12 && p[0] == 1:
+		secs = binary.BigEndian.Uint64(p[4:12])
+	}
+	if secs == 0 || secs > 1<<40 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(secs)-mp4Epoch, 0).UTC(), true
+}
+
+// appleCreationDate returns the com.apple.quicktime.creationdate item of the
+// meta box: its keys box names the items, which the ilst box holds by their
+// 1-based index.
+func appleCreationDate(r io.ReaderAt, meta box) (time.Time, bool) {
+	off := meta.off
+	if p := readPayload(r, box{off: off, size: min(8, meta.size)}); len(p) == 8 && string(p[4:8]) != "hdlr" {
+		off += 4 // the version and flags of a full box, as in MP4
+	}
+	boxes := readBoxes(r, off, meta.end())
+	keys, ok1 := findBox(boxes, "keys")
+	ilst, ok2 := findBox(boxes, "ilst")
+	if !ok1 || !ok2 {
+		return time.Time{}, false
+	}
+	p := readPayload(r, keys)
+	if len(p) < 8 {
+		return time.Time{}, false
+	}
+	index := 0
+	// after the version, flags and entry count: size, namespace and name of each key
+	for i, e := 1, 8; e+8 <= len(p); i++ {
+		n := int(binary.BigEndian.Uint32(p[e:]))
+		if n < 8 || e+n > len(p) {
+			break
+		}
+		if string(p[e+8:e+n]) == "com.apple.quicktime.creationdate" {
+			index = i
+			break
+		}
+		e += n
+	}
+	if index == 0 {
+		return time.Time{}, false
+	}
+	var want [4]byte
+	binary.BigEndian.PutUint32(want[:], uint32(index))
+	item, ok := findBox(readBoxes(r, ilst.off, ilst.end()), string(want[:]))
+	if !ok {
+		return time.Time{}, false
+	}
+	return parseVideoTime(itemString(r, item))
+}
+
+// itemString returns the text of a metadata item: the value of its data
+// box (after the type indicator and locale), else a QuickTime user data
+// text (after the length and language code).
+func itemString(r io.ReaderAt, item box) string {
+	if data, ok := findBox(readBoxes(r, item.off, item.end()), "data"); ok {
+		if p := readPayload(r, data); len(p) > 8 {
+			return string(p[8:])
+		}
+		return ""
+	}
+	p := readPayload(r, item)
+	if len(p) < 4 {
+		return ""
+	}
+	n := min(int(binary.BigEndian.Uint16(p)), len(p)-4)
+	return string(p[4 : 4+n])
+}
+
+// parseVideoTime parses a creation date like "2023-07-14T10:30:05+0200",
+// with or without a fraction of a second or a colon in the offset.
+func parseVideoTime(s string) (time.Time, bool) {
+	s = strings.TrimRight(strings.TrimSpace(s), "\x00")
+	for _, layout := range []string{"2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05Z07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,189 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mp4Box returns an ISO BMFF box of type typ around the concatenated payload.
+func mp4Box(typ string, payload ...[]byte) []byte {
+	p := bytes.Join(payload, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(p)))
+	return append(append(b, typ...), p...)
+}
+
+// mp4Box64 is mp4Box with the size in the 64-bit field.
+func mp4Box64(typ string, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 1)
+	b = append(b, typ...)
+	b = binary.BigEndian.AppendUint64(b, uint64(16+len(payload)))
+	return append(b, payload...)
+}
+
+// mvhd returns a movie header of version v created secs after mp4Epoch.
+func mvhd(v byte, secs uint64) []byte {
+	p := []byte{v, 0, 0, 0}
+	if v == 1 {
+		p = binary.BigEndian.AppendUint64(p, secs)
+		p = binary.BigEndian.AppendUint64(p, secs) // modification_time
+	} else {
+		p = binary.BigEndian.AppendUint32(p, uint32(secs))
+		p = binary.BigEndian.AppendUint32(p, uint32(secs))
+	}
+	return mp4Box("mvhd", p, make([]byte, 80))
+}
+
+// appleMeta returns a moov/meta box whose keys name the creation date as
+// its second key, and whose ilst holds it. fullBox puts the version and
+// flags of MP4 before the boxes, as QuickTime files don't.
+func appleMeta(date string, fullBox bool) []byte {
+	entry := func(name string) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(8+len(name)))
+		return append(append(b, "mdta"...), name...)
+	}
+	keys := mp4Box("keys", []byte{0, 0, 0, 0, 0, 0, 0, 2}, entry("com.apple.quicktime.make"), entry("com.apple.quicktime.creationdate"))
+	data := func(s string) []byte { return mp4Box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(s)) }
+	ilst := mp4Box("ilst", mp4Box("\x00\x00\x00\x01", data("Apple")), mp4Box("\x00\x00\x00\x02", data(date)))
+	hdlr := mp4Box("hdlr", make([]byte, 4), []byte("mdta"), make([]byte, 13))
+	var version []byte
+	if fullBox {
+		version = make([]byte, 4)
+	}
+	return mp4Box("meta", version, hdlr, keys, ilst)
+}
+
+// udtaDay returns a moov/udta box with a QuickTime ©day text.
+func udtaDay(date string) []byte {
+	p := binary.BigEndian.AppendUint16(nil, uint16(len(date)))
+	p = binary.BigEndian.AppendUint16(p, 0x55c4) // language
+	return mp4Box("udta", mp4Box("\xa9day", p, []byte(date)))
+}
+
+func TestReadBoxes(t *testing.T) {
+	free := mp4Box("free", make([]byte, 4))
+	tests := []struct {
+		name string
+		data []byte
+		want []box
+	}{
+		{"32-bit", append(mp4Box("ftyp", []byte("isom")), free...), []box{{"ftyp", 8, 4}, {"free", 20, 4}}},
+		{"64-bit", append(mp4Box64("mdat", make([]byte, 10)), free...), []box{{"mdat", 16, 10}, {"free", 34, 4}}},
+		{"size 0", append(append([]byte{}, free...), 0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3), []box{{"free", 8, 4}, {"mdat", 20, 3}}},
+		{"truncated", append(append([]byte{}, free...), mp4Box("moov", make([]byte, 100))[:50]...), []box{{"free", 8, 4}}},
+		{"size below header", append(append([]byte{}, free...), 0, 0, 0, 4, 'b', 'a', 'd', '!'), []box{{"free", 8, 4}}},
+		{"short", []byte{0, 0, 0}, nil},
+	}
+	for _, tt := range tests {
+		got := readBoxes(bytes.NewReader(tt.data), 0, int64(len(tt.data)))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: box %d is %v, want %v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestMvhdTime(t *testing.T) {
+	const secs = mp4Epoch + 1689330605 // 2023-07-14T10:30:05Z
+	for _, v := range []byte{0, 1} {
+		p := mvhd(v, secs)[8:]
+		got, ok := mvhdTime(p)
+		if !ok || !got.Equal(time.Unix(1689330605, 0)) {
+			t.Errorf("version %d: %v, %v; want 2023-07-14T10:30:05Z", v, got, ok)
+		}
+	}
+	for _, p := range [][]byte{mvhd(0, 0)[8:], {0, 0, 0}, mvhd(2, secs)[8:]} {
+		if got, ok := mvhdTime(p); ok {
+			t.Errorf("mvhdTime(% x...) = %v, want no time", p[:4], got)
+		}
+	}
+}
+
+func TestVideoDate(t *testing.T) {
+	const secs = mp4Epoch + 1689330605 // 2023-07-14T10:30:05Z
+	tokyo := time.FixedZone("JST", 9*3600)
+	ftyp := mp4Box("ftyp", []byte("qt  "))
+	tests := []struct {
+		name   string
+		moov   []byte
+		want   string
+		source string
+	}{
+		{"quicktime meta", mp4Box("moov", mvhd(0, secs), appleMeta("2023-07-14T12:30:05+0200", false)), "2023-07-14T12:30:05+02:00", dateSourceQuickTime},
+		{"mp4 meta", mp4Box("moov", mvhd(0, secs), appleMeta("2023-07-14T12:30:05+02:00", true)), "2023-07-14T12:30:05+02:00", dateSourceQuickTime},
+		{"udta", mp4Box("moov", mvhd(0, secs), udtaDay("2023-07-14T11:30:05+0100")), "2023-07-14T11:30:05+01:00", dateSourceQuickTime},
+		{"bad meta, mvhd", mp4Box("moov", appleMeta("yesterday", false), mvhd(1, secs)), "2023-07-14T19:30:05+09:00", dateSourceMvhd},
+		{"mvhd", mp4Box("moov", mvhd(0, secs)), "2023-07-14T19:30:05+09:00", dateSourceMvhd},
+		{"no moov", mp4Box("mdat", make([]byte, 16)), "", ""},
+		{"empty mvhd", mp4Box("moov", mvhd(0, 0)), "", ""},
+	}
+	for _, tt := range tests {
+		data := append(append([]byte{}, ftyp...), tt.moov...)
+		got, source, ok := videoDate(bytes.NewReader(data), int64(len(data)), tokyo)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("%s: %v from %s, want no date", tt.name, got, source)
+			}
+			continue
+		}
+		if !ok || got.Format(time.RFC3339) != tt.want || source != tt.source {
+			t.Errorf("%s: %v from %q, want %s from %q", tt.name, got.Format(time.RFC3339), source, tt.want, tt.source)
+		}
+	}
+}
+
+func TestParseVideoTime(t *testing.T) {
+	for s, want := range map[string]string{
+		"2023-07-14T10:30:05+0200":      "2023-07-14T10:30:05+02:00",
+		"2023-07-14T10:30:05+02:00":     "2023-07-14T10:30:05+02:00",
+		"2023-07-14T10:30:05Z":          "2023-07-14T10:30:05Z",
+		"2023-07-14T10:30:05.250+0200":  "2023-07-14T10:30:05.25+02:00",
+		" 2023-07-14T10:30:05+0200\x00": "2023-07-14T10:30:05+02:00",
+		"2023-07-14 10:30:05":           "",
+		"":                              "",
+	} {
+		got, ok := parseVideoTime(s)
+		if want == "" {
+			if ok {
+				t.Errorf("parseVideoTime(%q) = %v, want it rejected", s, got)
+			}
+		} else if !ok || got.Format(time.RFC3339Nano) != want {
+			t.Errorf("parseVideoTime(%q) = %v, %v; want %s", s, got, ok, want)
+		}
+	}
+}
+
+func TestProcessFileVideo(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "IMG_0001.MOV")
+	data := append(mp4Box("ftyp", []byte("qt  ")), mp4Box("moov", mvhd(0, mp4Epoch+1689330605), appleMeta("2023-07-14T12:30:05+0200", false))...)
+	data = append(data, mp4Box("mdat", make([]byte, 64))...)
+	if err := os.WriteFile(in, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProcessFile(context.Background(), in, in, DefaultOptions()); !errors.Is(err, ErrSkipped) {
+		t.Errorf("video without Rename: error %v, want ErrSkipped", err)
+	}
+	opts := DefaultOptions()
+	opts.Rename = true
+	res, err := ProcessFile(context.Background(), in, in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "2023-07-14_12-30-05.MOV"); res.Out != want || res.DateSource != dateSourceQuickTime {
+		t.Errorf("wrote %s from %q, want %s from %q", res.Out, res.DateSource, want, dateSourceQuickTime)
+	}
+	if out, err := os.ReadFile(res.Out); err != nil || !bytes.Equal(out, data) {
+		t.Errorf("renamed copy differs from the video: %v", err)
+	}
+}
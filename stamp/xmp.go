@@ -0,0 +1,126 @@
+package stamp
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// XMP namespaces of the date properties read from sidecars.
+const (
+	nsXMPExif      = "http://ns.adobe.com/exif/1.0/"
+	nsXMPBasic     = "http://ns.adobe.com/xap/1.0/"
+	nsXMPPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+)
+
+// xmpDateProps are the XMP properties holding the capture date, best first.
+var xmpDateProps = []xml.Name{
+	{Space: nsXMPExif, Local: "DateTimeOriginal"},
+	{Space: nsXMPPhotoshop, Local: "DateCreated"},
+	{Space: nsXMPBasic, Local: "CreateDate"},
+}
+
+// xmpLayouts are the date forms of XMP (ISO 8601 cut short anywhere after
+// the day), plus the EXIF form some tools write.
+var xmpLayouts = []struct {
+	layout string
+	zoned  bool
+}{
+	{"2006-01-02T15:04:05Z07:00", true},
+	{"2006-01-02T15:04Z07:00", true},
+	{"2006-01-02T15:04:05", false},
+	{"2006-01-02T15:04", false},
+	{"2006-01-02", false},
+	{"2006:01:02 15:04:05", false},
+}
+
+// xmpPaths returns where a sidecar of the image at path may be: next to it
+// with the extension replaced (Lightroom, Capture One) or appended
+// (darktable), in either case.
+func xmpPaths(path string) []string {
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	var paths []string
+	for _, p := range []string{stem + ".xmp", stem + ".XMP", path + ".xmp", path + ".XMP"} {
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// readXMP returns the capture date in the XMP sidecar of the image at path.
+// Dates without an offset are in zone.
+func readXMP(path string, zone *time.Location) (time.Time, bool) {
+	for _, p := range xmpPaths(path) {
+		f, err := os.Open(p)
+		if err != nil {
+			continue
+		}
+		vals := xmpDates(f)
+		f.Close()
+		for _, name := range xmpDateProps {
+			if t, ok := parseXMPDate(vals[name], zone); ok {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// xmpDates collects the values of xmpDateProps in the XMP packet r, written
+// either as attributes of rdf:Description or as elements. A malformed
+// packet yields what was read up to the error.
+func xmpDates(r io.Reader) map[xml.Name]string {
+	vals := map[xml.Name]string{}
+	d := xml.NewDecoder(r)
+	var cur xml.Name
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return vals
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			for _, a := range tok.Attr {
+				if slices.Contains(xmpDateProps, a.Name) && vals[a.Name] == "" {
+					vals[a.Name] = a.Value
+				}
+			}
+			cur = tok.Name
+			text.Reset()
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			if tok.Name == cur && slices.Contains(xmpDateProps, cur) && vals[cur] == "" {
+				vals[cur] = strings.TrimSpace(text.String())
+			}
+			cur = xml.Name{}
+		}
+	}
+}
+
+// parseXMPDate parses an XMP date in its own offset, else in zone.
+func parseXMPDate(s string, zone *time.Location) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, l := range xmpLayouts {
+		var t time.Time
+		var err error
+		if l.zoned {
+			t, err = time.Parse(l.layout, s)
+		} else {
+			t, err = time.ParseInLocation(l.layout, s, zone)
+		}
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
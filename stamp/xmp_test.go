@@ -0,0 +1,129 @@
+package stamp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const xmpAttrs = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmp:CreateDate="2021-01-01T00:00:00"
+    exif:DateTimeOriginal="2023-07-14T10:30:05.12+09:00"/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+const xmpElements = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/">
+   <photoshop:DateCreated>
+     2023-07-14T10:30
+   </photoshop:DateCreated>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+func TestXMPDates(t *testing.T) {
+	vals := xmpDates(strings.NewReader(xmpAttrs))
+	if got := vals[xmpDateProps[0]]; got != "2023-07-14T10:30:05.12+09:00" {
+		t.Errorf("exif:DateTimeOriginal attribute = %q", got)
+	}
+	if got := vals[xmpDateProps[2]]; got != "2021-01-01T00:00:00" {
+		t.Errorf("xmp:CreateDate attribute = %q", got)
+	}
+	vals = xmpDates(strings.NewReader(xmpElements))
+	if got := vals[xmpDateProps[1]]; got != "2023-07-14T10:30" {
+		t.Errorf("photoshop:DateCreated element = %q", got)
+	}
+	// a packet cut short keeps what came before the error
+	cut := xmpAttrs[:strings.Index(xmpAttrs, "</rdf:RDF>")]
+	if got := xmpDates(strings.NewReader(cut))[xmpDateProps[0]]; got == "" {
+		t.Errorf("truncated packet lost its date")
+	}
+}
+
+func TestParseXMPDate(t *testing.T) {
+	zone := time.FixedZone("UTC-05:00", -5*3600)
+	tests := []struct {
+		s    string
+		want string // RFC 3339; "" when rejected
+	}{
+		{"2023-07-14T10:30:05+09:00", "2023-07-14T10:30:05+09:00"},
+		{"2023-07-14T10:30:05.12+09:00", "2023-07-14T10:30:05+09:00"},
+		{"2023-07-14T10:30:05Z", "2023-07-14T10:30:05Z"},
+		{"2023-07-14T10:30+09:00", "2023-07-14T10:30:00+09:00"},
+		{"2023-07-14T10:30:05", "2023-07-14T10:30:05-05:00"},
+		{"2023-07-14T10:30", "2023-07-14T10:30:00-05:00"},
+		{"2023-07-14", "2023-07-14T00:00:00-05:00"},
+		{"2023:07:14 10:30:05", "2023-07-14T10:30:05-05:00"},
+		{"", ""},
+		{"yesterday", ""},
+		{"2023-13-14", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseXMPDate(tt.s, zone)
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("parseXMPDate(%q) = %v, want it rejected", tt.s, got)
+		case tt.want != "" && (!ok || got.Format(time.RFC3339) != tt.want):
+			t.Errorf("parseXMPDate(%q) = %s, %v; want %s", tt.s, got.Format(time.RFC3339), ok, tt.want)
+		}
+	}
+}
+
+func TestReadXMP(t *testing.T) {
+	dir := t.TempDir()
+	// Lightroom replaces the extension, darktable appends to it
+	for sidecar, image := range map[string]string{"a.xmp": "a.cr2", "b.CR2.xmp": "b.CR2", "c.XMP": "c.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, sidecar), []byte(xmpAttrs), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := readXMP(filepath.Join(dir, image), time.UTC)
+		if !ok || got.Format(time.RFC3339) != "2023-07-14T10:30:05+09:00" {
+			t.Errorf("%s with %s: %v, %v", image, sidecar, got, ok)
+		}
+	}
+	if _, ok := readXMP(filepath.Join(dir, "none.jpg"), time.UTC); ok {
+		t.Errorf("date without a sidecar")
+	}
+}
+
+func TestXMPPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "IMG_20200101_000000.jpg")
+	if err := os.WriteFile(in, dated(t, 40, 30, "2022:02:02 02:02:02"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "IMG_20200101_000000.xmp"), []byte(xmpElements), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sources []string
+		source  string
+		date    string
+	}{
+		{nil, dateSourceOriginal, "2022-02-02 02:02:02"},
+		{[]string{DateSourceXMP, DateSourceEXIF}, dateSourceXMP, "2023-07-14 10:30:00"},
+		{[]string{DateSourceFilename, DateSourceXMP}, dateSourceFilename, "2020-01-01 00:00:00"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.TimeZone = time.UTC
+		opts.DateSources = tt.sources
+		res, err := PlanFile(context.Background(), in, filepath.Join(dir, "out.jpg"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.DateSource != tt.source || res.Date != tt.date {
+			t.Errorf("sources %q: %s from %s, want %s from %s", tt.sources, res.Date, res.DateSource, tt.date, tt.source)
+		}
+	}
+}
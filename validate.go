@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	flag "github.com/spf13/pflag"
+)
+
+// flagRange is the range of an integer flag; want says it for the message.
+type flagRange struct {
+	name     string
+	min, max int64
+	want     string
+}
+
+// flagRanges are the ranges checkFlags holds the integer flags to.
+var flagRanges = []flagRange{
+	{"widthpercent", 1, 100, "1-100"},
+	{"widthpercent-portrait", 0, 100, "1-100, or 0 for --widthpercent"},
+	{"height-percent", 0, 100, "1-100, or 0 to size by --widthpercent"},
+	{"concurrency", 1, math.MaxInt, "1 or more"},
+	{"decode-workers", 0, math.MaxInt, "0 (--concurrency) or more"},
+	{"encode-workers", 0, math.MaxInt, "0 (--concurrency) or more"},
+	{"min-width", 0, math.MaxInt, "0 or more pixels"},
+	{"min-height", 0, math.MaxInt, "0 or more pixels"},
+	{"max-pixels", 0, math.MaxInt64, "0 (no limit) or more"},
+	{"scale", 0, 100, "a percentage from 1 to 100"},
+	{"max-dimension", 0, math.MaxInt, "0 (no limit) or more"},
+	{"retries", 0, math.MaxInt, "0 or more"},
+	{"sample", 0, math.MaxInt, "0 or more images"},
+	{"sample-random", 0, math.MaxInt, "0 or more images"},
+	{"frame-size", 1, 100, "1-100"},
+	{"gps-precision", 0, 8, "0-8"},
+	{"opacity", 0, 100, "0-100"},
+}
+
+// maxMarginPercent is the largest --margin percentage: more would put
+// the stamp past the middle of the side.
+const maxMarginPercent = 45
+
+// checkFlags checks the values of the flags, the combinations of them that
+// can't be used together, and that --out can take the outputs of inputs,
+// returning every problem found, each naming its flags.
+func checkFlags(flags *flag.FlagSet, inputs []string) []string {
+	var problems []string
+	bad := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, r := range flagRanges {
+		v := flags.Lookup(r.name).Value.String()
+		if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < r.min || n > r.max {
+			bad("invalid --%s %s: want %s", r.name, v, r.want)
+		}
+	}
+	if v := flags.Lookup("font-size").Value.String(); v[0] == '-' {
+		bad("invalid --font-size %s: want a positive size in points", v)
+	}
+	switch v := flags.Lookup("rotate").Value.String(); v {
+	case "0", "90", "180", "270":
+	default:
+		bad("invalid --rotate %s: want 0|90|180|270", v)
+	}
+	margin := flags.Lookup("margin").Value.String()
+	if percent, _, err := parseMargin(margin); err != nil {
+		bad("invalid --margin %q: %v", margin, err)
+	} else if percent > maxMarginPercent {
+		bad("invalid --margin %q: want 0-%d percent, or pixels like 24px", margin, maxMarginPercent)
+	}
+	if v := flags.Lookup("min-font-px").Value.String(); v != "" {
+		if _, _, err := parseMinFontPx(v); err != nil {
+			bad("invalid --min-font-px %q: %v", v, err)
+		}
+	}
+
+	// several inputs or a directory make a batch run into an --out directory
+	out := flags.Lookup("out").Value.String()
+	if fi, err := os.Stat(out); err == nil && fi.Mode().IsRegular() {
+		batch := len(inputs) > 1 || flags.Lookup("files-from").Value.String() != ""
+		for _, in := range inputs {
+			if fi, err := os.Stat(in); err == nil && fi.IsDir() {
+				batch = true
+			}
+		}
+		if batch {
+			bad("invalid --out %s: it is a file, but the inputs need an output directory", out)
+		}
+	}
+	return append(problems, flagConflicts(flags)...)
+}
+
+// flagConflicts returns a problem for every pair of flags that can't be
+// used together, and every flag missing the one it needs.
+func flagConflicts(flags *flag.FlagSet) []string {
+	var problems []string
+	bad := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	// on reports whether a flag is set to something other than its zero value
+	on := func(name string) bool {
+		switch flags.Lookup(name).Value.String() {
+		case "", "false", "0", "[]":
+			return false
+		}
+		return true
+	}
+	rename := on("rename") || on("rename-format") // a --rename-format implies --rename
+	inPlace, noStamp, watch := on("in-place"), on("no-stamp"), on("watch")
+	sampling := on("sample") || on("sample-random")
+
+	if on("quiet") && on("verbose") {
+		bad("--quiet and --verbose cannot be combined")
+	}
+	if on("text") && on("template") {
+		bad("--text and --template can't be used together")
+	}
+	if inPlace && (flags.Changed("out") || rename || on("output-format")) {
+		bad("--in-place can't be combined with --out, --rename or --output-format")
+	}
+	if !inPlace && on("backup-dir") {
+		bad("--backup-dir only applies to --in-place")
+	}
+	if on("overwrite") && on("skip-existing") {
+		bad("--overwrite and --skip-existing can't be used together")
+	}
+	if on("incremental") {
+		switch {
+		case on("overwrite") || on("skip-existing"):
+			bad("--incremental can't be combined with --overwrite or --skip-existing")
+		case inPlace:
+			bad("--incremental can't be combined with --in-place (the output is the input)")
+		case rename:
+			bad("--incremental can't be combined with --rename: outputs named by date can't be matched to their inputs (use --manifest)")
+		}
+	}
+	after, before := flags.Lookup("after").Value.String(), flags.Lookup("before").Value.String()
+	afterTime, err := parseDateBound(after, false)
+	if err != nil {
+		bad("invalid --after: %v", err)
+	}
+	beforeTime, err := parseDateBound(before, true)
+	if err != nil {
+		bad("invalid --before: %v", err)
+	}
+	if !afterTime.IsZero() && !beforeTime.IsZero() && afterTime.After(beforeTime) {
+		bad("--after %s is later than --before %s", after, before)
+	}
+	if on("require-exif") && on("fallback-date") {
+		bad("--require-exif and --fallback-date can't be used together")
+	}
+	if watch && (inPlace || on("dry-run")) {
+		bad("--watch can't be combined with --in-place or --dry-run")
+	}
+	if noStamp && (inPlace || on("output-format")) {
+		bad("--no-stamp can't be combined with --in-place or --output-format")
+	}
+	if noStamp && (on("scale") || on("max-dimension") || on("variant")) {
+		bad("--no-stamp copies the original bytes and can't be combined with --scale, --max-dimension or --variant")
+	}
+	if on("variant") && inPlace {
+		bad("--variant can't be combined with --in-place")
+	}
+	if on("sample") && on("sample-random") {
+		bad("--sample and --sample-random can't be combined")
+	}
+	if flags.Changed("seed") && !on("sample-random") {
+		bad("--seed needs --sample-random")
+	}
+	if watch && sampling {
+		bad("--watch can't be combined with --sample or --sample-random")
+	}
+	if (on("copy-others") || on("link-others")) && inPlace {
+		bad("--copy-others and --link-others can't be combined with --in-place")
+	}
+	if on("move") && !noStamp {
+		bad("--move needs --no-stamp")
+	}
+	if on("include-videos") && !rename {
+		bad("--include-videos needs --rename (or snapstamp rename): videos are only renamed, never stamped")
+	}
+	if on("move") && on("manifest") {
+		bad("--move can't be combined with --manifest (moved inputs can't be recognized later)")
+	}
+	if on("rehash") && !on("manifest") {
+		bad("--rehash needs --manifest")
+	}
+	if on("text-append") && !on("text") {
+		bad("--text-append needs --text")
+	}
+	if on("show-place") && !on("geodb") {
+		bad("--show-place needs a cities database, see --geodb")
+	}
+	if (on("null") || on("base")) && !on("files-from") {
+		bad("--null and --base only apply to --files-from")
+	}
+	return problems
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+// checkedFlags returns a flag set with the flags checkFlags reads, at
+// valid values.
+func checkedFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("snapstamp", flag.ContinueOnError)
+	for _, r := range flagRanges {
+		fs.Int64(r.name, r.min, "")
+	}
+	fs.String("font-size", "0", "")
+	fs.String("rotate", "0", "")
+	fs.String("margin", "5", "")
+	fs.String("min-font-px", "", "")
+	fs.String("out", "", "")
+	fs.String("files-from", "", "")
+	for _, name := range []string{"text", "template", "rename-format", "output-format", "backup-dir", "after", "before",
+		"fallback-date", "manifest", "geodb", "base"} {
+		fs.String(name, "", "")
+	}
+	for _, name := range []string{"quiet", "verbose", "rename", "in-place", "overwrite", "skip-existing", "incremental",
+		"require-exif", "watch", "dry-run", "no-stamp", "copy-others", "link-others", "move", "include-videos", "rehash",
+		"text-append", "show-place", "null"} {
+		fs.Bool(name, false, "")
+	}
+	fs.StringArray("variant", nil, "")
+	fs.Uint64("seed", 0, "")
+	return fs
+}
+
+func TestCheckFlags(t *testing.T) {
+	if problems := checkFlags(checkedFlags(), nil); len(problems) != 0 {
+		t.Fatalf("valid flags: %q", problems)
+	}
+
+	fs := checkedFlags()
+	for name, v := range map[string]string{
+		"widthpercent":   "0",
+		"opacity":        "101",
+		"concurrency":    "0",
+		"gps-precision":  "9",
+		"font-size":      "-3",
+		"rotate":         "45",
+		"margin":         "50",
+		"min-font-px":    "tiny",
+		"decode-workers": "-1",
+	} {
+		if err := fs.Set(name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems := checkFlags(fs, nil)
+	// every bad flag is reported, not only the first
+	for _, name := range []string{"widthpercent", "opacity", "concurrency", "gps-precision", "font-size", "rotate", "margin", "min-font-px", "decode-workers"} {
+		n := 0
+		for _, p := range problems {
+			if strings.HasPrefix(p, "invalid --"+name+" ") {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("--%s reported %d times in %q, want once", name, n, problems)
+		}
+	}
+	if len(problems) != 9 {
+		t.Errorf("%d problems, want 9: %q", len(problems), problems)
+	}
+}
+
+func TestCheckFlagsOutFile(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.jpg")
+	if err := os.WriteFile(out, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := checkedFlags()
+	fs.Set("out", out)
+	if problems := checkFlags(fs, []string{filepath.Join(dir, "a.jpg")}); len(problems) != 0 {
+		t.Errorf("a single input into an --out file: %q", problems)
+	}
+	fs.Set("widthpercent", "200")
+	problems := checkFlags(fs, []string{dir})
+	if len(problems) != 2 || !strings.Contains(problems[1], "--out") {
+		t.Errorf("a directory into an --out file with a bad --widthpercent: %q, want both reported", problems)
+	}
+}
+
+func TestFlagConflicts(t *testing.T) {
+	fs := checkedFlags()
+	for name, v := range map[string]string{
+		"quiet":         "true",
+		"verbose":       "true",
+		"rename-format": "{{.Name}}", // implies --rename
+		"in-place":      "true",
+		"incremental":   "true",
+		"after":         "2024-01-01",
+		"before":        "2023-01-01",
+		"move":          "true",
+		"null":          "true",
+		"widthpercent":  "0",
+	} {
+		if err := fs.Set(name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems := checkFlags(fs, nil)
+	// every conflict is reported along with the bad values, not only the first
+	for _, want := range []string{
+		"invalid --widthpercent ",
+		"--quiet and --verbose",
+		"--in-place can't be combined with --out, --rename",
+		"--incremental can't be combined with --in-place",
+		"--after 2024-01-01 is later than --before 2023-01-01",
+		"--move needs --no-stamp",
+		"--null and --base only apply to --files-from",
+	} {
+		if !slices.ContainsFunc(problems, func(p string) bool { return strings.HasPrefix(p, want) }) {
+			t.Errorf("%q not reported in %q", want, problems)
+		}
+	}
+	if len(problems) != 7 {
+		t.Errorf("%d problems, want 7: %q", len(problems), problems)
+	}
+
+	fs = checkedFlags()
+	fs.Set("after", "someday")
+	fs.Set("seed", "1")
+	if problems := checkFlags(fs, nil); len(problems) != 2 {
+		t.Errorf("a bad --after and --seed without --sample-random: %q, want both", problems)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"snapstamp/stamp"
+)
+
+// inputFile is one file of a batch run. Its output goes to the same path
+// relative to root under the output directory. err is reported as the
+// file's result instead of processing it.
+type inputFile struct {
+	path  string
+	root  string
+	err   error
+	seq   int  // position in the run, see orderResults
+	other bool // not an image: copied as is for --copy-others
+}
+
+// imageExts are the extensions picked up when walking a directory.
+var imageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".heif": true,
+	".cr2": true, ".nef": true, ".arw": true, ".dng": true, // camera raw, see stamp.rawPreview
+}
+
+// expandInputs expands glob patterns the shell left alone (e.g. on Windows,
+// or quoted). Arguments that name an existing path are kept as they are.
+func expandInputs(args []string) []string {
+	var out []string
+	for _, a := range args {
+		if _, err := os.Lstat(a); err == nil || !strings.ContainsAny(a, "*?[") {
+			out = append(out, a)
+			continue
+		}
+		matches, err := filepath.Glob(a)
+		if err != nil || len(matches) == 0 {
+			// keep it so it is reported as missing
+			out = append(out, a)
+			continue
+		}
+		out = append(out, matches...)
+	}
+	return out
+}
+
+// inputSet collects input files, dropping repeats of the same path.
+type inputSet struct {
+	files   []inputFile
+	seen    map[string]bool
+	resolve bool // compare paths with symlinks resolved, keeping the first
+}
+
+func (s *inputSet) add(path, root string, err error) {
+	s.put(inputFile{path: path, root: root, err: err})
+}
+
+func (s *inputSet) put(f inputFile) {
+	path := f.path
+	key := path
+	if abs, aerr := filepath.Abs(path); aerr == nil {
+		key = abs
+	}
+	if s.resolve {
+		if real, rerr := filepath.EvalSymlinks(path); rerr == nil {
+			key = real
+		}
+	}
+	if s.seen[key] {
+		return
+	}
+	if s.seen == nil {
+		s.seen = map[string]bool{}
+	}
+	s.seen[key] = true
+	s.files = append(s.files, f)
+}
+
+// walkOptions controls which files collectInputs picks up.
+type walkOptions struct {
+	recursive   bool
+	outDir      string   // output directory, "" for in-place runs
+	skipOutputs bool     // leave earlier outputs out when outDir is inside an input
+	include     []string // when set, only files matching one of these are picked up
+	exclude     []string // files and directories to leave out; wins over include
+	followLinks bool     // descend into symlinked directories, see walk
+	others      bool     // also pick up non-image files, see wantOther
+	videos      bool     // pick up videos like images, see stamp.IsVideo
+	verbose     bool     // log the directories walk leaves out
+}
+
+// walk calls fn for root and the entries below it like filepath.WalkDir.
+// Symlinked directories are left out unless wo.followLinks: then they are
+// walked like real ones, their entries reported under the link's path. A
+// directory reached a second time (through a link cycle, or a link to a
+// directory already walked) is skipped, so each is walked once, under the
+// first path the walk reaches it by.
+func (wo walkOptions) walk(root string, fn fs.WalkDirFunc) error {
+	visited := map[string]bool{}
+	var walkDir func(dir, as string) error
+	walkDir = func(dir, as string) error {
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if as != dir {
+				rel, _ := filepath.Rel(dir, path)
+				path = filepath.Join(as, rel)
+			}
+			if err != nil {
+				return fn(path, d, err)
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				if fi, serr := os.Stat(path); serr == nil && fi.IsDir() {
+					if !wo.followLinks {
+						if wo.verbose {
+							log.Printf("skipping symlinked directory %s (use --follow-symlinks)", path)
+						}
+						return nil
+					}
+					real, err := filepath.EvalSymlinks(path)
+					if err != nil {
+						return fn(path, d, err)
+					}
+					return walkDir(real, path)
+				}
+			}
+			if d.IsDir() && wo.followLinks {
+				if real, err := filepath.EvalSymlinks(path); err == nil {
+					if visited[real] {
+						if wo.verbose {
+							log.Printf("skipping %s: already walked as %s", path, real)
+						}
+						return filepath.SkipDir
+					}
+					visited[real] = true
+				}
+			}
+			return fn(path, d, nil)
+		})
+	}
+	return walkDir(root, root)
+}
+
+// skipDir reports whether the walk of root leaves out the directory path.
+// absOut is the absolute output directory, skipped when outInside.
+func (wo walkOptions) skipDir(root, path, absOut string, outInside bool) bool {
+	if outInside {
+		if abs, err := filepath.Abs(path); err == nil && abs == absOut {
+			return true
+		}
+	}
+	return !wo.recursive || matchAny(wo.exclude, relPath(root, path), true)
+}
+
+// wantFile reports whether the walk of root picks up the file path.
+func (wo walkOptions) wantFile(root, path string, outInside bool) bool {
+	name := filepath.Base(path)
+	if outInside && isStampedOutput(name) {
+		return false
+	}
+	if !isInput(name, wo.videos) {
+		return false
+	}
+	rel := relPath(root, path)
+	return !matchAny(wo.exclude, rel, false) && (len(wo.include) == 0 || matchAny(wo.include, rel, false))
+}
+
+// wantOther reports whether the walk of root picks up path as a file that
+// isn't an image, for --copy-others. Only --exclude applies: --include
+// names the images to stamp.
+func (wo walkOptions) wantOther(root, path string) bool {
+	return wo.others && !isInput(path, wo.videos) && !matchAny(wo.exclude, relPath(root, path), false)
+}
+
+// isInput reports whether the file name is an image, or with videos a
+// video, to process.
+func isInput(name string, videos bool) bool {
+	return imageExts[strings.ToLower(filepath.Ext(name))] || videos && stamp.IsVideo(name)
+}
+
+// collectInputs lists the images of a batch run: files named directly, and
+// the images in named directories, sorted by path. A file reachable
+// through several inputs is listed once; with wo.followLinks, so is a file
+// reachable through symlinks, by the first path the walk finds it at.
+func collectInputs(ctx context.Context, inputs []string, wo walkOptions) []inputFile {
+	set := inputSet{resolve: wo.followLinks}
+	absOut := ""
+	if wo.outDir != "" {
+		absOut, _ = filepath.Abs(wo.outDir)
+	}
+	warned := false
+	for _, in := range inputs {
+		if ctx.Err() != nil {
+			break
+		}
+		fi, err := os.Stat(in)
+		if err != nil {
+			set.add(in, filepath.Dir(in), fmt.Errorf("stat input: %w", err))
+			continue
+		}
+		if !fi.IsDir() {
+			set.add(in, filepath.Dir(in), nil)
+			continue
+		}
+		// when the output lands inside the input tree, keep earlier outputs
+		// (and the output directory itself) out of the walk so they aren't stamped again
+		outInside := wo.skipOutputs && absOut != "" && isWithin(in, wo.outDir)
+		if outInside && !warned {
+			log.Printf("output directory is inside the input directory: skipping *_timestamped files (use --force to stamp them)")
+			warned = true
+		}
+		// WalkDir: record errors encountered during traversal but continue where possible
+		err = wo.walk(in, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("walk error %s: %v", path, err)
+				return nil
+			}
+			// stop walking if context cancelled
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != in && wo.skipDir(in, path, absOut, outInside) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if wo.wantFile(in, path, outInside) {
+				set.add(path, in, nil)
+			} else if d.Type()&^fs.ModeSymlink == 0 && wo.wantOther(in, path) {
+				// regular files (or links to them), never pipes or devices
+				set.put(inputFile{path: path, root: in, other: true})
+			}
+			return nil
+		})
+		if err == context.Canceled {
+			log.Printf("walk cancelled")
+			// proceed with whatever files were collected
+			break
+		} else if err != nil {
+			log.Fatalf("walkdir failed: %v", err)
+		}
+	}
+	slices.SortStableFunc(set.files, func(a, b inputFile) int { return strings.Compare(a.path, b.path) })
+	return set.files
+}
+
+// sampleInputs returns n of the images in files for --sample: the first n,
+// or with rng a uniform random pick, kept in their order, and how many
+// images there were. --copy-others files are left out of a sample.
+func sampleInputs(files []inputFile, n int, rng *rand.Rand) (sample []inputFile, images int) {
+	var all []inputFile
+	for _, f := range files {
+		if !f.other {
+			all = append(all, f)
+		}
+	}
+	if n >= len(all) {
+		return all, len(all)
+	}
+	if rng == nil {
+		return all[:n], len(all)
+	}
+	picked := rng.Perm(len(all))[:n]
+	slices.Sort(picked)
+	for _, p := range picked {
+		sample = append(sample, all[p])
+	}
+	return sample, len(all)
+}
+
+// readFileList reads the paths of --files-from: one per line, or
+// NUL-separated with null. Empty entries are ignored.
+func readFileList(r io.Reader, null bool) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if null {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, p := range strings.Split(string(data), sep) {
+		if !null {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// listedInputs turns a --files-from list into input files whose outputs are
+// placed relative to base, or to the deepest directory shared by all paths
+// when base is empty. Missing, directory and non-image entries, videos
+// unless videos, become per-file errors.
+func listedInputs(paths []string, base string, videos bool) []inputFile {
+	if base == "" {
+		base = commonDir(paths)
+	}
+	var set inputSet
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		switch {
+		case err != nil:
+			set.add(p, base, fmt.Errorf("stat input: %w", err))
+		case fi.IsDir():
+			set.add(p, base, fmt.Errorf("%s is a directory", p))
+		case !isInput(p, videos):
+			set.add(p, base, fmt.Errorf("%s is not a supported image (jpg/png/gif/webp/heic/raw)", p))
+		default:
+			set.add(p, base, nil)
+		}
+	}
+	return set.files
+}
+
+// commonDir returns the deepest directory containing all paths, comparing
+// absolute paths. It is "" when they share none (e.g. different drives).
+func commonDir(paths []string) string {
+	common := ""
+	for i, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return ""
+		}
+		dir := filepath.Dir(abs)
+		if i == 0 {
+			common = dir
+			continue
+		}
+		for !isWithin(common, dir) {
+			parent := filepath.Dir(common)
+			if parent == common {
+				return ""
+			}
+			common = parent
+		}
+	}
+	return common
+}
+
+// relPath returns p relative to root, falling back to its base name. A
+// relative p is made absolute first when root is absolute, and vice versa.
+func relPath(root, p string) string {
+	if filepath.IsAbs(root) != filepath.IsAbs(p) {
+		absRoot, err1 := filepath.Abs(root)
+		absP, err2 := filepath.Abs(p)
+		if err1 == nil && err2 == nil {
+			root, p = absRoot, absP
+		}
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Base(p)
+	}
+	return rel
+}
+
+// matchAny reports whether the relative path rel matches one of patterns.
+func matchAny(patterns []string, rel string, isDir bool) bool {
+	for _, p := range patterns {
+		if matchPattern(p, rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches rel, a path relative to the input root, against a
+// --include/--exclude glob. "**" stands for any number of directories; a
+// pattern without a slash matches the name at any depth; a trailing slash
+// only matches directories. Matching ignores case on Windows.
+func matchPattern(pattern, rel string, isDir bool) bool {
+	return matchGlob(pattern, rel, isDir, runtime.GOOS == "windows")
+}
+
+// matchGlob is matchPattern, ignoring case when fold is set.
+func matchGlob(pattern, rel string, isDir, fold bool) bool {
+	pattern, dirOnly := strings.CutSuffix(pattern, "/")
+	if dirOnly && !isDir {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if fold {
+		pattern, rel = strings.ToLower(pattern), strings.ToLower(rel)
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(pattern[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segs[0])
+	return ok && matchSegments(pattern[1:], segs[1:])
+}
+
+// validPattern reports whether every segment of a --include/--exclude glob is well-formed.
+func validPattern(pattern string) bool {
+	for _, seg := range strings.Split(strings.TrimSuffix(pattern, "/"), "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
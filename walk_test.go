@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// inputPaths returns the paths of files relative to root.
+func inputPaths(files []inputFile, root string) []string {
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, filepath.ToSlash(relPath(root, f.path)))
+	}
+	return paths
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	// photos/
+	//   2023/a.png
+	//   2023/back -> ..          a cycle
+	//   years/2023 -> ../2023    the same directory again
+	//   years/2019 -> ../../ext  a directory outside the tree
+	//   b.png -> 2023/a.png      the same file again
+	// ext/c.png
+	dir := t.TempDir()
+	root := filepath.Join(dir, "photos")
+	for _, d := range []string{"photos/2023", "photos/years", "ext"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePNGs(t, filepath.Join(root, "2023"), 1, 8, 8)
+	if err := os.Rename(filepath.Join(root, "2023", "img0.png"), filepath.Join(root, "2023", "a.png")); err != nil {
+		t.Fatal(err)
+	}
+	writePNGs(t, filepath.Join(dir, "ext"), 1, 8, 8)
+	if err := os.Rename(filepath.Join(dir, "ext", "img0.png"), filepath.Join(dir, "ext", "c.png")); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"photos/2023/back":  "..",
+		"photos/years/2023": "../2023",
+		"photos/years/2019": "../../ext",
+		"photos/b.png":      "2023/a.png",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Skipf("no symlinks: %v", err)
+		}
+	}
+
+	tests := []struct {
+		follow bool
+		want   []string
+	}{
+		// as before --follow-symlinks: linked directories are left out,
+		// linked files taken as they are
+		{false, []string{"2023/a.png", "b.png"}},
+		// each directory and file once, under the first path it is found by
+		{true, []string{"2023/a.png", "years/2019/c.png"}},
+	}
+	for _, tt := range tests {
+		files := collectInputs(context.Background(), []string{root}, walkOptions{recursive: true, followLinks: tt.follow})
+		if got := inputPaths(files, root); !slices.Equal(got, tt.want) {
+			t.Errorf("follow %v: %q, want %q", tt.follow, got, tt.want)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, rel string
+		isDir        bool
+		want, fold   bool // the match on other systems, and on Windows
+	}{
+		{"IMG_*.jpg", "IMG_1234.jpg", false, true, true},
+		{"IMG_*.jpg", "2023/07/IMG_1234.jpg", false, true, true},
+		{"IMG_*.jpg", "img_1234.JPG", false, false, true},
+		{"thumbnails/", "thumbnails", true, true, true},
+		{"thumbnails/", "thumbnails", false, false, false},
+		{"**/thumbnails/", "a/b/thumbnails", true, true, true},
+		{"**/thumbnails/", "a/b/Thumbnails", true, false, true},
+		{"*/thumbnails/**", "a/thumbnails/x/y.jpg", false, true, true},
+		{"*/thumbnails/**", "a/b/thumbnails/y.jpg", false, false, false},
+		{"2023/**/*.png", "2023/a.png", false, true, true},
+		{"2023/**/*.png", "2023/07/14/a.png", false, true, true},
+		{"2023/**/*.png", "2024/a.png", false, false, false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.rel, tt.isDir, false); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.rel, got, tt.want)
+		}
+		if got := matchGlob(tt.pattern, tt.rel, tt.isDir, true); got != tt.fold {
+			t.Errorf("matchGlob(%q, %q) ignoring case = %v, want %v", tt.pattern, tt.rel, got, tt.fold)
+		}
+	}
+}
+
+func TestWalkIncludeExclude(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"a/thumbnails/deep", "a/b/thumbnails", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{
+		"IMG_1.jpg", "other.jpg", "a/IMG_2.jpg", "a/thumbnails/IMG_3.jpg", "a/thumbnails/deep/IMG_4.jpg",
+		"a/b/IMG_5.jpg", "a/b/thumbnails/IMG_6.jpg", "c/IMG_7.jpg",
+	} {
+		if err := os.WriteFile(filepath.Join(root, p), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{nil, []string{"**/thumbnails/"}, []string{"IMG_1.jpg", "a/IMG_2.jpg", "a/b/IMG_5.jpg", "c/IMG_7.jpg", "other.jpg"}},
+		{[]string{"IMG_*.jpg"}, []string{"thumbnails/", "c/"}, []string{"IMG_1.jpg", "a/IMG_2.jpg", "a/b/IMG_5.jpg"}},
+		// excludes win over includes
+		{[]string{"a/**"}, []string{"a/b/"}, []string{"a/IMG_2.jpg", "a/thumbnails/IMG_3.jpg", "a/thumbnails/deep/IMG_4.jpg"}},
+	}
+	for _, tt := range tests {
+		wo := walkOptions{recursive: true, include: tt.include, exclude: tt.exclude}
+		got := inputPaths(collectInputs(context.Background(), []string{root}, wo), root)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("include %q, exclude %q: %q, want %q", tt.include, tt.exclude, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long a new file must keep the same size before it is
+// stamped: cameras and network copies write slowly.
+const watchSettle = time.Second
+
+// watchPoll is how often files still being written are checked.
+const watchPoll = 250 * time.Millisecond
+
+// pendingFile is a new file waiting to stop growing.
+type pendingFile struct {
+	root    string
+	size    int64
+	changed time.Time // when size was last seen to change, or an event arrived
+}
+
+// fileStamp identifies a version of a file that was already dispatched.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// watcher follows the input directories of --watch and hands over images
+// created in them once they are completely written.
+type watcher struct {
+	fs        *fsnotify.Watcher
+	wo        walkOptions
+	absOut    string
+	roots     map[string]string // watched directory -> input directory it belongs to
+	outInside map[string]bool   // input directory -> output directory inside it
+	pending   map[string]*pendingFile
+	done      map[string]fileStamp
+}
+
+// newWatcher starts watching the directories among inputs (and their
+// subdirectories with --recursive). It is set up before the initial walk so
+// files arriving meanwhile aren't missed.
+func newWatcher(inputs []string, wo walkOptions) (*watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{fs: fw, wo: wo, roots: map[string]string{}, outInside: map[string]bool{}, pending: map[string]*pendingFile{}, done: map[string]fileStamp{}}
+	if wo.outDir != "" {
+		w.absOut, _ = filepath.Abs(wo.outDir)
+	}
+	for _, in := range inputs {
+		if fi, err := os.Stat(in); err != nil || !fi.IsDir() {
+			continue
+		}
+		w.outInside[in] = wo.skipOutputs && w.absOut != "" && isWithin(in, wo.outDir)
+		w.addTree(in, in)
+	}
+	if len(w.roots) == 0 {
+		fw.Close()
+		return nil, errors.New("no input directory to watch")
+	}
+	return w, nil
+}
+
+// addTree watches dir and, with --recursive, the directories below it that
+// the walk would enter. It returns the images already inside them.
+func (w *watcher) addTree(root, dir string) []inputFile {
+	var found []inputFile
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if w.wo.wantFile(root, path, w.outInside[root]) {
+				found = append(found, inputFile{path: path, root: root})
+			}
+			return nil
+		}
+		if path != root && w.wo.skipDir(root, path, w.absOut, w.outInside[root]) {
+			return filepath.SkipDir
+		}
+		if err := w.fs.Add(path); err != nil {
+			log.Printf("watch %s: %v", path, err)
+			return filepath.SkipDir
+		}
+		w.roots[path] = root
+		return nil
+	})
+	return found
+}
+
+// seen marks files as dispatched, so later events for the same unchanged
+// file don't stamp it again.
+func (w *watcher) seen(files []inputFile) {
+	for _, f := range files {
+		if fi, err := os.Stat(f.path); err == nil {
+			w.done[f.path] = fileStamp{fi.Size(), fi.ModTime()}
+		}
+	}
+}
+
+// run sends new images to jobs until ctx is cancelled and returns how many
+// it sent, numbering them from seq on. Watch errors are logged and don't
+// stop it.
+func (w *watcher) run(ctx context.Context, jobs chan<- inputFile, seq int) int {
+	defer w.fs.Close()
+	tick := time.NewTicker(watchPoll)
+	defer tick.Stop()
+	sent := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return sent
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return sent
+			}
+			log.Printf("watch error: %v", err)
+		case ev, ok := <-w.fs.Events:
+			if !ok {
+				return sent
+			}
+			w.event(ev)
+		case now := <-tick.C:
+			for _, f := range w.settled(now) {
+				f.seq = seq + sent
+				select {
+				case <-ctx.Done():
+					return sent
+				case jobs <- f:
+					sent++
+				}
+			}
+		}
+	}
+}
+
+// event records a created or written file as pending; a new directory is
+// watched too, and its images become pending.
+func (w *watcher) event(ev fsnotify.Event) {
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return
+	}
+	root, ok := w.roots[filepath.Dir(ev.Name)]
+	if !ok {
+		return
+	}
+	fi, err := os.Stat(ev.Name)
+	if err != nil {
+		return // already gone
+	}
+	if fi.IsDir() {
+		if ev.Has(fsnotify.Create) && !w.wo.skipDir(root, ev.Name, w.absOut, w.outInside[root]) {
+			for _, f := range w.addTree(root, ev.Name) {
+				w.touch(f.path, root, -1)
+			}
+		}
+		return
+	}
+	if w.wo.wantFile(root, ev.Name, w.outInside[root]) {
+		w.touch(ev.Name, root, fi.Size())
+	}
+}
+
+// touch (re)starts the settle time of a pending file.
+func (w *watcher) touch(path, root string, size int64) {
+	if p, ok := w.pending[path]; ok {
+		p.changed = time.Now()
+		return
+	}
+	w.pending[path] = &pendingFile{root: root, size: size, changed: time.Now()}
+}
+
+// settled returns the pending files whose size hasn't changed for
+// watchSettle and that weren't already dispatched as they are.
+func (w *watcher) settled(now time.Time) []inputFile {
+	var ready []inputFile
+	for path, p := range w.pending {
+		fi, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if fi.Size() != p.size {
+			p.size, p.changed = fi.Size(), now
+			continue
+		}
+		if now.Sub(p.changed) < watchSettle {
+			continue
+		}
+		delete(w.pending, path)
+		if d, ok := w.done[path]; ok && d.size == fi.Size() && d.modTime.Equal(fi.ModTime()) {
+			continue
+		}
+		w.done[path] = fileStamp{fi.Size(), fi.ModTime()}
+		ready = append(ready, inputFile{path: path, root: p.root})
+	}
+	return ready
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"snapstamp/stamp"
+)
+
+// zipEncrypted is the general purpose flag of an encrypted ZIP entry,
+// which archive/zip can't read.
+const zipEncrypted = 0x1
+
+// isZip reports whether the input p is a ZIP archive to stamp the images of.
+func isZip(p string) bool {
+	if !strings.EqualFold(filepath.Ext(p), ".zip") {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// zipRun stamps the images of a ZIP archive without extracting it: each
+// entry is read into memory and stamped by stamp.ProcessReader, and the
+// output goes to the entry's path under outDir, or into a new archive.
+type zipRun struct {
+	opts    stamp.Options
+	wo      walkOptions // only include and exclude apply
+	workers int
+	touch   bool // times of the outputs: when written, not the capture time
+
+	outDir string // when zw is nil
+	zw     *zip.Writer
+	names  map[string]bool // taken in zw
+}
+
+// zipOutput is a stamped entry on its way to its output.
+type zipOutput struct {
+	fileResult
+	name string       // of the output, relative to the output root
+	data bytes.Buffer // the stamped image
+	date time.Time    // capture time, else the entry's own
+}
+
+// entries opens the archive at zipPath and lists the entries to stamp, in
+// archive order.
+func (z *zipRun) entries(zipPath string) (*zip.ReadCloser, []*zip.File, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []*zip.File
+	for _, f := range zr.File {
+		if z.wants(f) {
+			entries = append(entries, f)
+		}
+	}
+	return zr, entries, nil
+}
+
+// run stamps the entries of the archive at zipPath and reports them to rep.
+func (z *zipRun) run(ctx context.Context, zipPath string, entries []*zip.File, rep *reporter) {
+	jobs := make(chan *zip.File)
+	outs := make(chan *zipOutput)
+	var wg sync.WaitGroup
+	for range max(z.workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				outs <- z.stamp(ctx, zipPath, f)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, f := range entries {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- f:
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(outs)
+	}()
+	// one writer, as entries of a zip.Writer are written one at a time
+	for o := range outs {
+		if o.err == nil {
+			o.Out, o.Overwritten, o.err = z.write(o)
+		}
+		rep.file(o.fileResult)
+	}
+}
+
+// wants reports whether the entry f is an image --include and --exclude
+// let through.
+func (z *zipRun) wants(f *zip.File) bool {
+	if f.FileInfo().IsDir() || !imageExts[strings.ToLower(path.Ext(f.Name))] {
+		return false
+	}
+	return !matchAny(z.wo.exclude, f.Name, false) && (len(z.wo.include) == 0 || matchAny(z.wo.include, f.Name, false))
+}
+
+// stamp reads and stamps the entry f. Its date comes from its EXIF or its
+// name, there being no sidecars next to it on disk, else from the time
+// the archive records for it.
+func (z *zipRun) stamp(ctx context.Context, zipPath string, f *zip.File) *zipOutput {
+	start := time.Now()
+	// not joined, which would clean away a "../" leading out of the archive
+	o := &zipOutput{fileResult: fileResult{in: zipPath + "/" + f.Name}, date: f.Modified}
+	ext := stamp.OutputExt(f.Name, z.opts.OutputFormat)
+	o.name = strings.TrimSuffix(f.Name, path.Ext(f.Name)) + "_timestamped" + ext
+	switch {
+	case !filepath.IsLocal(filepath.FromSlash(f.Name)):
+		o.err = fmt.Errorf("%w %s: the entry's path leads out of the output directory", stamp.ErrSkipped, o.in)
+		return o
+	case f.Flags&zipEncrypted != 0:
+		o.err = fmt.Errorf("%w %s: encrypted", stamp.ErrSkipped, o.in)
+		return o
+	}
+	rc, err := f.Open()
+	if err != nil {
+		o.err = fmt.Errorf("open entry: %w", err)
+		return o
+	}
+	defer rc.Close()
+	o.Result, o.err = stamp.ProcessReader(ctx, rc, f.Name, f.Modified, &o.data, z.opts)
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", o.Date, time.Local); err == nil {
+		o.date = t
+	}
+	if z.touch {
+		o.date = time.Now()
+	}
+	o.elapsed = time.Since(start)
+	return o
+}
+
+// write writes the stamped entry o to its output and returns where it
+// went, in the archive or on disk, and whether it replaced a file.
+func (z *zipRun) write(o *zipOutput) (string, bool, error) {
+	if z.zw != nil {
+		name := o.name
+		for i := 1; z.names[name]; i++ {
+			name = path.Join(path.Dir(o.name), fmt.Sprintf("%s_%d%s", stamp.FileBase(o.name), i, path.Ext(o.name)))
+		}
+		z.names[name] = true
+		// images are compressed already
+		w, err := z.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: o.date})
+		if err != nil {
+			return "", false, fmt.Errorf("write output: %w", err)
+		}
+		if _, err := o.data.WriteTo(w); err != nil {
+			return "", false, fmt.Errorf("write output: %w", err)
+		}
+		return name, false, nil
+	}
+
+	p := filepath.Join(z.outDir, filepath.FromSlash(o.name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", false, fmt.Errorf("create out dir: %w", err)
+	}
+	existed := false
+	if _, err := os.Stat(p); err == nil {
+		switch {
+		case z.opts.SkipExisting:
+			return "", false, fmt.Errorf("%w %s: %s already exists", stamp.ErrSkipped, o.in, p)
+		case z.opts.Overwrite:
+			existed = true
+		}
+	}
+	var f *os.File
+	var err error
+	if existed {
+		f, err = os.Create(p)
+	} else {
+		f, p, err = stamp.CreateUnique(p)
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("create output: %w", err)
+	}
+	_, err = o.data.WriteTo(f)
+	if err == nil && z.opts.Fsync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(p)
+		return "", false, fmt.Errorf("write output: %w", err)
+	}
+	if !z.touch {
+		os.Chtimes(p, o.date, o.date)
+	}
+	return p, existed, nil
+}
+
+// stampZip stamps entries of the archive at zipPath into outDir, or into
+// a new archive at zipOut when that isn't empty. An existing zipOut is
+// only replaced with opts.Overwrite.
+func stampZip(ctx context.Context, zipPath string, entries []*zip.File, outDir, zipOut string, z *zipRun, rep *reporter) error {
+	if zipOut == "" {
+		z.outDir = outDir
+		z.run(ctx, zipPath, entries, rep)
+		return nil
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if z.opts.Overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(zipOut, flags, 0666)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("--zip-out %s already exists (use --overwrite to replace it)", zipOut)
+	} else if err != nil {
+		return err
+	}
+	z.zw, z.names = zip.NewWriter(f), map[string]bool{}
+	z.run(ctx, zipPath, entries, rep)
+	err = z.zw.Close()
+	if err == nil && z.opts.Fsync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(zipOut)
+	}
+	return err
+}
+
+// zipDateSources are the date sources an archive entry can have: those
+// of opts without the sidecars, which would be looked for on disk.
+func zipDateSources(sources []string) []string {
+	if sources == nil {
+		sources = stamp.DefaultDateSources
+	}
+	return slices.DeleteFunc(slices.Clone(sources), func(s string) bool {
+		return s == stamp.DateSourceXMP || s == stamp.DateSourceTakeout
+	})
+}